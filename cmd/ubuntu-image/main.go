@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
@@ -17,14 +21,127 @@ var Version string = ""
 
 // helper variables for unit testing
 var osExit = os.Exit
+var signalNotify = signal.Notify
 var captureStd = helper.CaptureStd
 var stateMachineInterface statemachine.SmInterface
 var imageType string = ""
+var statemachineShowState = statemachine.ShowState
+var statemachineCleanup = statemachine.Cleanup
+var statemachineShell = statemachine.Shell
+var statemachineValidateImageDefinition = statemachine.ValidateImageDefinition
+var statemachineImageDefinitionSchema = statemachine.ImageDefinitionSchema
 
 var stateMachineLongDesc = `Options for controlling the internal state machine.
 Other than -w, these options are mutually exclusive. When -u or -t is given,
 the state machine can be resumed later with -r, but -w must be given in that
-case since the state is saved in a ubuntu-image.gob file in the working directory.`
+case since the state is saved in a ubuntu-image.json file in the working directory.`
+
+// showState prints the progress of the partial build in the working directory
+func showState(stateMachineOpts *commands.StateMachineOpts) {
+	if stateMachineOpts.WorkDir == "" {
+		fmt.Println("Error: must specify workdir when using the state command")
+		osExit(1)
+		return
+	}
+	if err := statemachineShowState(stateMachineOpts.WorkDir); err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+}
+
+// cleanup tears down the mounts and loop devices left in the working directory by a crashed build
+func cleanup(stateMachineOpts *commands.StateMachineOpts) {
+	if stateMachineOpts.WorkDir == "" {
+		fmt.Println("Error: must specify workdir when using the cleanup command")
+		osExit(1)
+		return
+	}
+	if err := statemachineCleanup(stateMachineOpts.WorkDir); err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+}
+
+// shell opens an interactive shell in the chroot or rootfs of the partial build in the working directory
+func shell(stateMachineOpts *commands.StateMachineOpts) {
+	if stateMachineOpts.WorkDir == "" {
+		fmt.Println("Error: must specify workdir when using the shell command")
+		osExit(1)
+		return
+	}
+	if err := statemachineShell(stateMachineOpts.WorkDir); err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+}
+
+// validationReport is printed by the validate command with --format=json
+type validationReport struct {
+	File   string                         `json:"file"`
+	Valid  bool                           `json:"valid"`
+	Errors []statemachine.ValidationError `json:"errors"`
+}
+
+// validate checks an image definition and reports every problem found in it
+func validate(ubuntuImageCommand *commands.UbuntuImageCommand) {
+	imageDefinition := ubuntuImageCommand.Validate.ValidateArgsPassed.ImageDefinition
+	if imageDefinition == "" {
+		fmt.Println("Error: must specify an image definition when using the validate command")
+		osExit(1)
+		return
+	}
+	validationErrors, err := statemachineValidateImageDefinition(imageDefinition,
+		ubuntuImageCommand.Validate.ValidateOptsPassed.AllowUnknownKeys,
+		ubuntuImageCommand.Validate.ValidateOptsPassed.Set)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+
+	if ubuntuImageCommand.Validate.ValidateOptsPassed.Format == "json" {
+		report := validationReport{
+			File:   imageDefinition,
+			Valid:  len(validationErrors) == 0,
+			Errors: validationErrors,
+		}
+		if report.Errors == nil {
+			report.Errors = []statemachine.ValidationError{}
+		}
+		reportBytes, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			osExit(1)
+			return
+		}
+		fmt.Println(string(reportBytes))
+	} else {
+		for _, validationError := range validationErrors {
+			fmt.Println(validationError.String())
+		}
+		if len(validationErrors) == 0 {
+			fmt.Printf("%s is valid\n", imageDefinition)
+		}
+	}
+	if len(validationErrors) > 0 {
+		osExit(1)
+		return
+	}
+}
+
+// schema prints the JSON schema of image definitions
+func schema() {
+	schemaBytes, err := statemachineImageDefinitionSchema()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+	fmt.Println(string(schemaBytes))
+}
 
 func executeStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *commands.StateMachineOpts, ubuntuImageCommand *commands.UbuntuImageCommand) {
 	// Set up the state machine
@@ -42,27 +159,67 @@ func executeStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *comm
 		stateMachineInterface = stateMachine
 	}
 
-	// set up, run, and tear down the state machine
-	if err := stateMachineInterface.Setup(); err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
+	// set up, run, and tear down the state machine, cancelling it on SIGINT and SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopHandlingSignals := handleSignals(cancel, stateMachineOpts)
+	defer stopHandlingSignals()
+	// with --progress-format=json, stdout only receives the events of the build
+	errorOutput := io.Writer(os.Stdout)
+	if commonOpts.ProgressFormat == "json" {
+		errorOutput = os.Stderr
+	}
+	if err := stateMachineInterface.Setup(ctx); err != nil {
+		fmt.Fprintf(errorOutput, "Error: %s\n", err.Error())
 		osExit(1)
 		return
 	}
 
-	if err := stateMachineInterface.Run(); err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
+	if err := stateMachineInterface.Run(ctx); err != nil {
+		fmt.Fprintf(errorOutput, "Error: %s\n", err.Error())
 		osExit(1)
 		return
 	}
 
-	if err := stateMachineInterface.Teardown(); err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
+	if err := stateMachineInterface.Teardown(ctx); err != nil {
+		fmt.Fprintf(errorOutput, "Error: %s\n", err.Error())
 		osExit(1)
 		return
 	}
 
 }
 
+// handleSignals cancels the build when SIGINT or SIGTERM is received. This kills
+// the running commands, after which the state machine tears down the mounts and
+// cleans up the workdir as it does for any failure. If a second signal is received,
+// ubuntu-image exits immediately. The returned function stops handling signals
+func handleSignals(cancel context.CancelFunc, stateMachineOpts *commands.StateMachineOpts) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signalNotify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "Received %s, cancelling the build\n", sig.String())
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "Received %s again, exiting without cleaning up. Run "+
+				"\"ubuntu-image cleanup --workdir %s\" to tear down the mounts left behind\n",
+				sig.String(), stateMachineOpts.WorkDir)
+			osExit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
 func main() {
 	// instantiate structs for
 	commonOpts := new(commands.CommonOpts)
@@ -153,6 +310,31 @@ func main() {
 		imageType = parser.Command.Active.Name
 	}
 
+	if imageType == "state" {
+		showState(stateMachineOpts)
+		return
+	}
+
+	if imageType == "validate" {
+		validate(ubuntuImageCommand)
+		return
+	}
+
+	if imageType == "schema" {
+		schema()
+		return
+	}
+
+	if imageType == "shell" {
+		shell(stateMachineOpts)
+		return
+	}
+
+	if imageType == "cleanup" {
+		cleanup(stateMachineOpts)
+		return
+	}
+
 	// let the state machine handle the image build
 	executeStateMachine(commonOpts, stateMachineOpts, ubuntuImageCommand)
 }
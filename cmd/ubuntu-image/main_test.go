@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"io"
 	"os"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
@@ -16,21 +19,21 @@ type MockedStateMachine struct {
 	whenToFail string
 }
 
-func (mockSM *MockedStateMachine) Setup() error {
+func (mockSM *MockedStateMachine) Setup(ctx context.Context) error {
 	if mockSM.whenToFail == "Setup" {
 		return errors.New("Testing Error")
 	}
 	return nil
 }
 
-func (mockSM *MockedStateMachine) Run() error {
+func (mockSM *MockedStateMachine) Run(ctx context.Context) error {
 	if mockSM.whenToFail == "Run" {
 		return errors.New("Testing Error")
 	}
 	return nil
 }
 
-func (mockSM *MockedStateMachine) Teardown() error {
+func (mockSM *MockedStateMachine) Teardown(ctx context.Context) error {
 	if mockSM.whenToFail == "Teardown" {
 		return errors.New("Testing Error")
 	}
@@ -139,6 +142,15 @@ func TestExitCode(t *testing.T) {
 		{"bad_state_machine_args_snap", []string{"snap", "model_assertion.yaml", "-u", "5", "-t", "6"}, 1},
 		{"no_command_given", []string{}, 1},
 		{"resume_without_workdir", []string{"--resume"}, 1},
+		{"state_without_workdir", []string{"state", "show"}, 1},
+		{"state_without_metadata", []string{"state", "show", "-w", "/tmp/ubuntu-image-0615c8dd-d3af-4074-bfcb-c3d3c8392b06"}, 1},
+		{"cleanup_without_workdir", []string{"cleanup"}, 1},
+		{"shell_without_workdir", []string{"shell"}, 1},
+		{"validate_without_image_definition", []string{"validate"}, 1},
+		{"validate_valid_image_definition", []string{"validate", "../../internal/statemachine/testdata/image_definitions/test_amd64.yaml"}, 0},
+		{"validate_invalid_image_definition", []string{"validate", "--format", "json", "../../internal/statemachine/testdata/image_definitions/test_bad_class.yaml"}, 1},
+		{"schema", []string{"schema"}, 0},
+		{"shell_without_chroot", []string{"shell", "-w", "/tmp/ubuntu-image-0615c8dd-d3af-4074-bfcb-c3d3c8392b06"}, 1},
 		{"invalid_sector_size", []string{"--sector-size", "128", "--help"}, 1}, // Cheap trick with the --help to make the test work
 	}
 	for _, tc := range testCases {
@@ -324,3 +336,91 @@ func TestFailedStateMachine(t *testing.T) {
 		})
 	}
 }
+
+// TestFailedStateMachineJSON ensures that the error of a failed build is not
+// printed to stdout with --progress-format=json, which only receives the events
+func TestFailedStateMachineJSON(t *testing.T) {
+	t.Run("test_failed_state_machine_json", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		oldOsExit := osExit
+		defer func() {
+			osExit = oldOsExit
+		}()
+		var got int
+		osExit = func(code int) {
+			got = code
+		}
+
+		flag.CommandLine = flag.NewFlagSet("failed_state_machine_json", flag.ExitOnError)
+		os.Args = []string{"failed_state_machine_json", "snap", "--progress-format=json", "model_assertion"}
+		imageType = "test"
+		mockedStateMachine.whenToFail = "Run"
+		stateMachineInterface = &mockedStateMachine
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+		stderr, restoreStderr, err := helper.CaptureStd(&os.Stderr)
+		asserter.AssertErrNil(err, true)
+		main()
+		restoreStdout()
+		restoreStderr()
+		readStdout, err := io.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+		readStderr, err := io.ReadAll(stderr)
+		asserter.AssertErrNil(err, true)
+
+		if got != 1 {
+			t.Errorf("Expected error code on exit, got: %d", got)
+		}
+		if len(readStdout) != 0 {
+			t.Errorf("Expected nothing on stdout but got \"%s\"", string(readStdout))
+		}
+		if string(readStderr) != "Error: Testing Error\n" {
+			t.Errorf("Expected the error on stderr but got \"%s\"", string(readStderr))
+		}
+	})
+}
+
+// TestHandleSignals ensures the build is cancelled on the first signal and that
+// ubuntu-image exits on the second one
+func TestHandleSignals(t *testing.T) {
+	t.Run("test_handle_signals", func(t *testing.T) {
+		oldOsExit := osExit
+		oldSignalNotify := signalNotify
+		defer func() {
+			osExit = oldOsExit
+			signalNotify = oldSignalNotify
+		}()
+
+		exitCodes := make(chan int, 1)
+		osExit = func(code int) {
+			exitCodes <- code
+		}
+		var signals chan<- os.Signal
+		signalNotify = func(c chan<- os.Signal, sig ...os.Signal) {
+			signals = c
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stop := handleSignals(cancel, &commands.StateMachineOpts{WorkDir: "/tmp/ubuntu-image-test"})
+		defer stop()
+
+		signals <- syscall.SIGTERM
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the build to be cancelled on SIGTERM")
+		}
+
+		signals <- os.Interrupt
+		select {
+		case code := <-exitCodes:
+			if code != 1 {
+				t.Errorf("Expected exit code 1, got %d", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Expected ubuntu-image to exit on the second signal")
+		}
+	})
+}
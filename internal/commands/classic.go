@@ -7,7 +7,11 @@ type ClassicArgs struct {
 
 // ClassicOpts holds all flags that are specific to the classic command
 type ClassicOpts struct {
-	AptParams []string `long:"apt-params" description:"Any additional APT specific configuration needed for the image build."` // TODO: is this used?
+	AptParams        []string `long:"apt-params" description:"Any additional APT specific configuration needed for the image build."` // TODO: is this used?
+	Plan             bool     `long:"plan" description:"Parse and validate the image definition, then print the states that would run and why they are needed, without building the image."`
+	DryRun           bool     `long:"dry-run" description:"Like --plan, but also print the external commands every state would run."`
+	Set              []string `long:"set" description:"Set a key of the image definition, overriding its value in the file. The key path is written as in the YAML file, with the index of list items in brackets, for example --set rootfs.mirror=http://ports.ubuntu.com/ubuntu/ or --set customization.extra-snaps[0].channel=edge. Can be given multiple times" value-name:"KEY=VALUE"`
+	AllowUnknownKeys bool     `long:"allow-unknown-keys" description:"Only warn about the keys of the image definition that are not part of its format, such as the keys added by a newer version of ubuntu-image, instead of failing."`
 }
 
 type classicCommand struct {
@@ -2,18 +2,27 @@
 // parse command line input
 package commands
 
+import "time"
+
 // CommonOpts stores the options that are common to all image types
 type CommonOpts struct {
-	Debug      bool   `long:"debug" description:"Enable debugging output"`
-	Verbose    bool   `short:"v" long:"verbose" description:"Enable verbose output"`
-	Quiet      bool   `short:"q" long:"quiet" description:"Turn off all output"`
-	Size       string `short:"i" long:"image-size" description:"The suggested size of the generated disk image file. If this size is smaller than the minimum calculated size of the image a warning will be issued and --image-size will be ignored. The value is the size in bytes, with allowable suffixes \"M\" for MiB and \"G\" for GiB. Use an extended syntax to define the suggested size for the disk images generated by a multi-volume gadget.yaml spec" value-name:"SIZE"`
-	DiskInfo   string `long:"disk-info" description:"File to be used as .disk/info on the image's rootfs. This file can contain useful information about the target image, like image identification data, system name, build timestamp etc." value-name:"DISK-INFO-CONTENTS"`
-	OutputDir  string `short:"O" long:"output-dir" description:"The directory in which to put generated disk image files. For snap builds, the disk image files themselves will be named <volume>.img inside this directory, where <volume> is the volume name taken from the gadget.yaml file. For classic builds, the disk image files themselves will be named based on the image definition inside this directory. The output dir will default to the value of --workdir if --workdir is specified and --output-dir is not. If neither --output-dir or --workdir is used, the images will be placed in the current working directory." value-name:"DIRECTORY"`
-	Version    bool   `long:"version" description:"Print the version number of ubuntu-image and exit"`
-	Channel    string `short:"c" long:"channel" description:"The default snap channel to use" value-name:"CHANNEL"`
-	SectorSize string `long:"sector-size" description:"Sector size to use when creating the disk image. Only 512 and 4k sector sizes are supported." choice:"512" choice:"4096" value-name:"SECTOR-SIZE" default:"512"`
-	Validation string `long:"validation" description:"Control whether validations should be ignored or enforced" choice:"ignore" choice:"enforce"`
+	Debug               bool                     `long:"debug" description:"Enable debugging output"`
+	Verbose             bool                     `short:"v" long:"verbose" description:"Enable verbose output"`
+	Quiet               bool                     `short:"q" long:"quiet" description:"Turn off all output"`
+	Size                string                   `short:"i" long:"image-size" description:"The suggested size of the generated disk image file. If this size is smaller than the minimum calculated size of the image a warning will be issued and --image-size will be ignored. The value is the size in bytes, with allowable suffixes \"M\" for MiB and \"G\" for GiB. Use an extended syntax to define the suggested size for the disk images generated by a multi-volume gadget.yaml spec" value-name:"SIZE"`
+	DiskInfo            string                   `long:"disk-info" description:"File to be used as .disk/info on the image's rootfs. This file can contain useful information about the target image, like image identification data, system name, build timestamp etc." value-name:"DISK-INFO-CONTENTS"`
+	OutputDir           string                   `short:"O" long:"output-dir" description:"The directory in which to put generated disk image files. For snap builds, the disk image files themselves will be named <volume>.img inside this directory, where <volume> is the volume name taken from the gadget.yaml file. For classic builds, the disk image files themselves will be named based on the image definition inside this directory. The output dir will default to the value of --workdir if --workdir is specified and --output-dir is not. If neither --output-dir or --workdir is used, the images will be placed in the current working directory." value-name:"DIRECTORY"`
+	Version             bool                     `long:"version" description:"Print the version number of ubuntu-image and exit"`
+	Channel             string                   `short:"c" long:"channel" description:"The default snap channel to use" value-name:"CHANNEL"`
+	SectorSize          string                   `long:"sector-size" description:"Sector size to use when creating the disk image. Only 512 and 4k sector sizes are supported." choice:"512" choice:"4096" value-name:"SECTOR-SIZE" default:"512"`
+	Validation          string                   `long:"validation" description:"Control whether validations should be ignored or enforced" choice:"ignore" choice:"enforce"`
+	HooksDirectories    []string                 `long:"hooks-directory" description:"Path or comma-separated list of paths of directories in which scripts for build-time hooks will be located. A hook is either an executable named after the hook, or a directory named <hook>.d containing executables that are run in lexical order. Can be given multiple times" value-name:"DIRECTORY"`
+	Timeout             time.Duration            `long:"timeout" description:"The maximum time the build may take, for example 90m or 2h. When it is exceeded, the running commands are killed and the build fails" value-name:"DURATION"`
+	StateTimeouts       map[string]time.Duration `long:"state-timeout" description:"The maximum time the given step may take, including its hooks, for example germinate:30m. Can be given multiple times" value-name:"STEP:DURATION"`
+	Jobs                int                      `long:"jobs" description:"The maximum number of independent steps that may run at the same time, such as the steps generating the qcow2 image, manifest, filelist and rootfs tarball of a classic image. Their output is printed in order once they all finished" value-name:"N" default:"1"`
+	DebugShellOnFailure bool                     `long:"debug-shell-on-failure" description:"When a step fails, open an interactive shell in the chroot or rootfs of the image, with /dev, /proc, /sys and /run mounted, before cleaning up. The build carries on failing once the shell exits"`
+	SkipPreflight       bool                     `long:"skip-preflight" description:"Do not check that the host tools, privileges and free space needed by the build are available before running it"`
+	ProgressFormat      string                   `long:"progress-format" description:"The format in which to report the progress of the build. \"json\" prints one JSON object per line for every state started, finished or failed, command spawned and artifact written" choice:"text" choice:"json" value-name:"FORMAT" default:"text"`
 }
 
 // StateMachineOpts stores the options that are related to the state machine
@@ -22,6 +31,8 @@ type StateMachineOpts struct {
 	Until   string `short:"u" long:"until" description:"Run the state machine until the given STEP, non-inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
 	Thru    string `short:"t" long:"thru" description:"Run the state machine through the given STEP, inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
 	Resume  bool   `short:"r" long:"resume" description:"Continue the state machine from the previously saved state. It is an error if there is no previous state."`
+	Only    string `long:"only" description:"Load the previously saved state and run only the given STEP again. STEP must have run already or be the next step of the partial build. Can't be used with --resume, --until or --thru." value-name:"STEP" default:""`
+	From    string `long:"from" description:"Load the previously saved state and run the state machine again from the given STEP onward. STEP must have run already or be the next step of the partial build. Can be combined with --until or --thru, but not with --resume." value-name:"STEP" default:""`
 }
 
 // UbuntuImageCommand is needed for the parser to store positional arguments and flags
@@ -34,6 +45,16 @@ type UbuntuImageCommand struct {
 		ClassicArgsPassed ClassicArgs `positional-args:"true" required:"false"`
 		ClassicOptsPassed ClassicOpts
 	} `command:"classic"`
+	State struct {
+		Show struct{} `command:"show" description:"Print the completed and remaining steps, sizes and volume names of the partial build in the working directory given with -w."`
+	} `command:"state" description:"Inspect the state of a partial build"`
+	Validate struct {
+		ValidateArgsPassed ValidateArgs `positional-args:"true" required:"false"`
+		ValidateOptsPassed ValidateOpts
+	} `command:"validate" description:"Check a classic image definition without building the image. Every problem found is reported with its line, column and key path in the file."`
+	Schema  struct{} `command:"schema" description:"Print the JSON schema of classic image definitions, with the description, default value and allowed values of every key. Editors can use it to complete and check image definitions, for example with yaml-language-server."`
+	Shell   struct{} `command:"shell" description:"Open an interactive shell in the chroot or rootfs of the partial build in the working directory given with -w, with /dev, /proc, /sys and /run mounted and the resolv.conf of the host. Everything is unmounted when the shell exits."`
+	Cleanup struct{} `command:"cleanup" description:"Unmount the directories and detach the loop devices left behind in the working directory given with -w by a build that crashed or was killed."`
 }
 
 type commonOptions struct {
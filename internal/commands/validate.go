@@ -0,0 +1,13 @@
+package commands
+
+// ValidateArgs holds the image definition to validate. positional arguments need their own struct
+type ValidateArgs struct {
+	ImageDefinition string `positional-arg-name:"image_definition" description:"Classic image definition file to validate."`
+}
+
+// ValidateOpts holds all flags that are specific to the validate command
+type ValidateOpts struct {
+	AllowUnknownKeys bool     `long:"allow-unknown-keys" description:"Do not report the keys that are not part of the image definition format, such as the keys added by a newer version of ubuntu-image"`
+	Set              []string `long:"set" description:"Set a key of the image definition before validating it, as with the classic command" value-name:"KEY=VALUE"`
+	Format           string   `long:"format" description:"The format in which to report the problems found. \"json\" prints a single JSON object with the list of problems, for editors and CI systems" choice:"text" choice:"json" value-name:"FORMAT" default:"text"`
+}
@@ -2,6 +2,7 @@ package helper
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -9,7 +10,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/invopop/jsonschema"
@@ -49,18 +52,53 @@ func InitCommonOpts() (*commands.CommonOpts, *commands.StateMachineOpts) {
 	return commonOpts, new(commands.StateMachineOpts)
 }
 
-// RunScript runs scripts from disk. Currently only used for hooks
-func RunScript(hookScript string) error {
+// RunScript runs scripts from disk with the given variables added to
+// the environment. Currently only used for hooks. The output of the script
+// is written to the given logs as well as to output and stderr
+func RunScript(ctx context.Context, hookScript string, env []string, output io.Writer, logs ...io.Writer) error {
 	hookScriptCmd := exec.Command(hookScript)
-	hookScriptCmd.Env = os.Environ()
-	hookScriptCmd.Stdout = os.Stdout
-	hookScriptCmd.Stderr = os.Stderr
-	if err := hookScriptCmd.Run(); err != nil {
+	hookScriptCmd.Env = append(os.Environ(), env...)
+	hookScriptCmd.Stdout = io.MultiWriter(append([]io.Writer{output}, logs...)...)
+	hookScriptCmd.Stderr = io.MultiWriter(append([]io.Writer{os.Stderr}, logs...)...)
+	if err := RunCmdContext(ctx, hookScriptCmd); err != nil {
 		return fmt.Errorf("Error running hook script %s: %s", hookScript, err.Error())
 	}
 	return nil
 }
 
+// RunCmdContext runs a command and waits for it to finish. If the context is done
+// first, the command and all of its children are killed. To be able to do that,
+// the command is run in its own process group
+func RunCmdContext(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// a negative pid signals the whole process group
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-finished:
+		}
+	}()
+
+	err := cmd.Wait()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 // SaveCWD gets the current working directory and returns a function to go back to it
 func SaveCWD() func() {
 	wd, _ := os.Getwd()
@@ -83,12 +121,13 @@ func Du(path string) (quantity.Size, error) {
 	return size, err
 }
 
-// CopyBlob runs `dd` to copy a blob to an image file
-func CopyBlob(ddArgs []string) error {
+// CopyBlob runs `dd` to copy a blob to an image file. dd is killed if the
+// context is done first
+func CopyBlob(ctx context.Context, ddArgs []string) error {
 	ddCommand := *exec.Command("dd")
 	ddCommand.Args = append(ddCommand.Args, ddArgs...)
 
-	if err := ddCommand.Run(); err != nil {
+	if err := RunCmdContext(ctx, &ddCommand); err != nil {
 		return fmt.Errorf("Command \"%s\" returned with %s", ddCommand.String(), err.Error())
 	}
 	return nil
@@ -118,6 +157,14 @@ func SetDefaults(needsDefaults interface{}) error {
 			// otherwise if it's just a pointer, look for default types
 			if field.Elem().Kind() == reflect.Struct {
 				SetDefaults(field.Interface())
+			} else if field.IsNil() && field.Type().Elem().Kind() == reflect.Bool {
+				// a pointer to a bool tells an explicit false from a missing value,
+				// which is the only one that gets the default
+				defaultValue, hasDefault := elem.Type().Field(i).Tag.Lookup("default")
+				if hasDefault && field.CanSet() {
+					boolean := defaultValue == "true"
+					field.Set(reflect.ValueOf(&boolean))
+				}
 			}
 		} else {
 			tags := elem.Type().Field(i).Tag
@@ -158,6 +205,12 @@ func SetDefaults(needsDefaults interface{}) error {
 // https://github.com/xeipuuv/gojsonschema/pull/352
 // if it gets merged this can be deleted
 func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema *jsonschema.Schema) error {
+	return checkEmptyFields(Interface, result, schema, gojsonschema.NewJsonContext("(root)", nil))
+}
+
+// checkEmptyFields does the work of CheckEmptyFields. The errors are added with
+// the context of the struct that is missing a field, so they can be located
+func checkEmptyFields(Interface interface{}, result *gojsonschema.Result, schema *jsonschema.Schema, context *gojsonschema.JsonContext) error {
 	value := reflect.ValueOf(Interface)
 	if value.Kind() != reflect.Ptr {
 		return fmt.Errorf("The argument to CheckEmptyFields must be a pointer")
@@ -165,14 +218,16 @@ func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema
 	elem := value.Elem()
 	for i := 0; i < elem.NumField(); i++ {
 		field := elem.Field(i)
-		// if we're dealing with a slice, iterate through
-		// it and search for missing required fields in each
-		// element of the slice
-		if field.Type().Kind() == reflect.Slice {
+		// if we're dealing with a slice of pointers, iterate
+		// through it and search for missing required fields
+		// in each element of the slice
+		fieldContext := gojsonschema.NewJsonContext(jsonFieldName(elem.Type().Field(i)), context)
+		if field.Type().Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Ptr {
 			for i := 0; i < field.Cap(); i++ {
 				sliceElem := field.Index(i)
 				if sliceElem.Kind() == reflect.Ptr && sliceElem.Elem().Kind() == reflect.Struct {
-					err := CheckEmptyFields(sliceElem.Interface(), result, schema)
+					err := checkEmptyFields(sliceElem.Interface(), result, schema,
+						gojsonschema.NewJsonContext(strconv.Itoa(i), fieldContext))
 					if err != nil {
 						return err
 					}
@@ -182,7 +237,7 @@ func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema
 			// otherwise if it's just a pointer to a nested struct
 			// search it for empty required fields
 			if field.Elem().Kind() == reflect.Struct {
-				err := CheckEmptyFields(field.Interface(), result, schema)
+				err := checkEmptyFields(field.Interface(), result, schema, fieldContext)
 				if err != nil {
 					return err
 				}
@@ -207,14 +262,13 @@ func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema
 			if required {
 				// this is a required field, check for zero values
 				if reflect.Indirect(field).IsZero() {
-					jsonContext := gojsonschema.NewJsonContext("image_definition", nil)
 					errDetail := gojsonschema.ErrorDetails{
 						"property": tags.Get("yaml"),
 						"parent":   elem.Type().Name(),
 					}
 					result.AddError(
 						newMissingFieldError(
-							gojsonschema.NewJsonContext("missing_field", jsonContext),
+							context,
 							52,
 							errDetail,
 						),
@@ -227,6 +281,15 @@ func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema
 	return nil
 }
 
+// jsonFieldName returns the name of a struct field in the JSON schema
+func jsonFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
 func newMissingFieldError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *MissingFieldError {
 	err := MissingFieldError{}
 	err.SetContext(context)
@@ -256,17 +319,18 @@ func SliceHasElement(haystack []string, needle string) bool {
 }
 
 // SetCommandOutput sets the output of a command to either use a multiwriter
-// or behave as a normal command and store the output in a buffer
-func SetCommandOutput(cmd *exec.Cmd, liveOutput bool) (cmdOutput *bytes.Buffer) {
+// or behave as a normal command and store the output in a buffer. The output
+// is written to the given logs as well, and live to liveOutput unless it is nil
+func SetCommandOutput(cmd *exec.Cmd, liveOutput io.Writer, logs ...io.Writer) (cmdOutput *bytes.Buffer) {
 	var cmdOutputBuffer bytes.Buffer
 	cmdOutput = &cmdOutputBuffer
-	cmd.Stdout = cmdOutput
-	cmd.Stderr = cmdOutput
-	if liveOutput {
-		mwriter := io.MultiWriter(os.Stdout, cmdOutput)
-		cmd.Stdout = mwriter
-		cmd.Stderr = mwriter
+	writers := append([]io.Writer{cmdOutput}, logs...)
+	if liveOutput != nil {
+		writers = append(writers, liveOutput)
 	}
+	mwriter := io.MultiWriter(writers...)
+	cmd.Stdout = mwriter
+	cmd.Stderr = mwriter
 	return cmdOutput
 }
 
@@ -280,8 +344,9 @@ func SafeQuantitySubtraction(orig, subtract quantity.Size) quantity.Size {
 
 // CreateTarArchive places all of the files from a source directory into a tar.
 // Currently supported are uncompressed tar archives and the following
-// compression types: zip, gzip, xz bzip2, zstd
-func CreateTarArchive(src, dest, compression string, verbose, debug bool) error {
+// compression types: zip, gzip, xz bzip2, zstd. The output of tar is written
+// to the given logs, and tar is killed if the context is done first
+func CreateTarArchive(ctx context.Context, src, dest, compression string, verbose, debug bool, logs ...io.Writer) error {
 	tarCommand := *exec.Command(
 		"tar",
 		"--directory",
@@ -316,8 +381,8 @@ func CreateTarArchive(src, dest, compression string, verbose, debug bool) error
 		return fmt.Errorf("Unknown compression type: \"%s\"", compression)
 	}
 
-	tarOutput := SetCommandOutput(&tarCommand, debug)
-	if err := tarCommand.Run(); err != nil {
+	tarOutput := SetCommandOutput(&tarCommand, nil, logs...)
+	if err := RunCmdContext(ctx, &tarCommand); err != nil {
 		return fmt.Errorf("Error running \"tar\" command \"%s\". "+
 			"Error is \"%s\". Full output below:\n%s",
 			tarCommand.String(), err.Error(), tarOutput.String())
@@ -327,8 +392,9 @@ func CreateTarArchive(src, dest, compression string, verbose, debug bool) error
 
 // ExtractTarArchive extracts all the files from a tar. Currently supported are
 // uncompressed tar archives and the following compression types: zip, gzip, xz
-// bzip2, zstd
-func ExtractTarArchive(src, dest string, verbose, debug bool) error {
+// bzip2, zstd. The output of tar is written to the given logs, and tar is killed
+// if the context is done first
+func ExtractTarArchive(ctx context.Context, src, dest string, verbose, debug bool, logs ...io.Writer) error {
 	tarCommand := *exec.Command(
 		"tar",
 		"--xattrs",
@@ -342,8 +408,8 @@ func ExtractTarArchive(src, dest string, verbose, debug bool) error {
 	if debug {
 		tarCommand.Args = append(tarCommand.Args, "--verbose")
 	}
-	tarOutput := SetCommandOutput(&tarCommand, debug)
-	if err := tarCommand.Run(); err != nil {
+	tarOutput := SetCommandOutput(&tarCommand, nil, logs...)
+	if err := RunCmdContext(ctx, &tarCommand); err != nil {
 		return fmt.Errorf("Error running \"tar\" command \"%s\". "+
 			"Error is \"%s\". Full output below:\n%s",
 			tarCommand.String(), err.Error(), tarOutput.String())
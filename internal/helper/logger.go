@@ -0,0 +1,194 @@
+package helper
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a message of the build log
+type LogLevel int
+
+// The levels of the messages of the build log, from the least to the most severe
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarning:
+		return "WARNING"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL%d", int(level))
+}
+
+// logTimeFormat is the format of the timestamp starting every line of the build log
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// RedactedSecret replaces the secrets of a build, such as the credentials of
+// private PPAs, in the messages of the build log, see BuildLog.AddSecret
+const RedactedSecret = "<redacted>"
+
+// BuildLog writes the messages of a build to a file, whatever their level. Every
+// line starts with a timestamp, the level of the message and the state that logged
+// it. The messages logged before the file is opened are kept in memory and written
+// to the file once it is opened. All the methods can be called on a nil *BuildLog,
+// which discards the messages
+type BuildLog struct {
+	mutex   sync.Mutex
+	file    *os.File
+	pending bytes.Buffer
+	secrets []string
+}
+
+// NewBuildLog returns a build log keeping the messages in memory until it is opened
+func NewBuildLog() *BuildLog {
+	return &BuildLog{}
+}
+
+// Open appends the messages logged so far and all the messages that follow to
+// the file at path. It does nothing if the build log is already open
+func (buildLog *BuildLog) Open(path string) error {
+	if buildLog == nil {
+		return nil
+	}
+	buildLog.mutex.Lock()
+	defer buildLog.mutex.Unlock()
+	if buildLog.file != nil {
+		return nil
+	}
+	logFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening build log: %s", err.Error())
+	}
+	if _, err := buildLog.pending.WriteTo(logFile); err != nil {
+		logFile.Close()
+		return fmt.Errorf("Error writing build log: %s", err.Error())
+	}
+	buildLog.file = logFile
+	return nil
+}
+
+// Close closes the file of the build log. The messages logged afterwards are kept
+// in memory until it is opened again
+func (buildLog *BuildLog) Close() error {
+	if buildLog == nil {
+		return nil
+	}
+	buildLog.mutex.Lock()
+	defer buildLog.mutex.Unlock()
+	if buildLog.file == nil {
+		return nil
+	}
+	err := buildLog.file.Close()
+	buildLog.file = nil
+	return err
+}
+
+// AddSecret makes the build log replace a secret with RedactedSecret in all the
+// messages logged from now on. The messages logged before are not modified, so
+// secrets must be added as soon as they are known
+func (buildLog *BuildLog) AddSecret(secret string) {
+	if buildLog == nil || secret == "" {
+		return
+	}
+	buildLog.mutex.Lock()
+	defer buildLog.mutex.Unlock()
+	for _, known := range buildLog.secrets {
+		if known == secret {
+			return
+		}
+	}
+	buildLog.secrets = append(buildLog.secrets, secret)
+}
+
+// Redact replaces the secrets added with AddSecret in a message
+func (buildLog *BuildLog) Redact(message string) string {
+	if buildLog == nil {
+		return message
+	}
+	buildLog.mutex.Lock()
+	defer buildLog.mutex.Unlock()
+	for _, secret := range buildLog.secrets {
+		message = strings.ReplaceAll(message, secret, RedactedSecret)
+	}
+	return message
+}
+
+// Log formats a message and writes every line of it to the build log
+func (buildLog *BuildLog) Log(level LogLevel, state string, format string, v ...interface{}) {
+	message := strings.TrimRight(fmt.Sprintf(format, v...), "\n")
+	for _, line := range strings.Split(message, "\n") {
+		buildLog.writeLine(level, state, line)
+	}
+}
+
+// writeLine writes a single line of the build log. Errors are ignored, the build
+// log must not make the build fail
+func (buildLog *BuildLog) writeLine(level LogLevel, state string, line string) {
+	if buildLog == nil {
+		return
+	}
+	line = buildLog.Redact(line)
+	prefix := fmt.Sprintf("%s %s", time.Now().Format(logTimeFormat), level.String())
+	if state != "" {
+		prefix = fmt.Sprintf("%s [%s]", prefix, state)
+	}
+	buildLog.mutex.Lock()
+	defer buildLog.mutex.Unlock()
+	var output io.Writer = &buildLog.pending
+	if buildLog.file != nil {
+		output = buildLog.file
+	}
+	fmt.Fprintf(output, "%s %s\n", prefix, line)
+}
+
+// Writer returns a writer that logs every line written to it with the given level
+// and state, such as the output of a command. Flush must be called once everything
+// is written, to log the last line if it does not end with a newline
+func (buildLog *BuildLog) Writer(level LogLevel, state string) *LogWriter {
+	return &LogWriter{buildLog: buildLog, level: level, state: state}
+}
+
+// LogWriter writes to the build log line by line, see BuildLog.Writer
+type LogWriter struct {
+	buildLog *BuildLog
+	level    LogLevel
+	state    string
+	partial  []byte
+}
+
+// Write logs the complete lines written so far and keeps the incomplete last line
+func (logWriter *LogWriter) Write(p []byte) (int, error) {
+	logWriter.partial = append(logWriter.partial, p...)
+	for {
+		newline := bytes.IndexByte(logWriter.partial, '\n')
+		if newline < 0 {
+			break
+		}
+		logWriter.buildLog.writeLine(logWriter.level, logWriter.state, string(logWriter.partial[:newline]))
+		logWriter.partial = logWriter.partial[newline+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs the last line written if it does not end with a newline
+func (logWriter *LogWriter) Flush() {
+	if len(logWriter.partial) > 0 {
+		logWriter.buildLog.writeLine(logWriter.level, logWriter.state, string(logWriter.partial))
+		logWriter.partial = nil
+	}
+}
@@ -0,0 +1,84 @@
+package imagedefinition
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+)
+
+// Architectures is the architecture of the image. It is written as a string, or as
+// a list of strings to build the image for each of the architectures. A single
+// architecture is encoded back as a string, as it is usually written
+type Architectures []string
+
+// UnmarshalYAML decodes a single architecture or a list of architectures
+func (architectures *Architectures) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var architecture string
+	if err := unmarshal(&architecture); err == nil {
+		*architectures = Architectures{architecture}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*architectures = list
+	return nil
+}
+
+// MarshalYAML encodes a single architecture as a string
+func (architectures Architectures) MarshalYAML() (interface{}, error) {
+	if len(architectures) == 1 {
+		return architectures[0], nil
+	}
+	return []string(architectures), nil
+}
+
+// MarshalJSON encodes a single architecture as a string. No architecture is encoded
+// as an empty string, so it is reported as missing rather than of the wrong type
+func (architectures Architectures) MarshalJSON() ([]byte, error) {
+	if len(architectures) <= 1 {
+		return json.Marshal(architectures.String())
+	}
+	return json.Marshal([]string(architectures))
+}
+
+// UnmarshalJSON decodes a single architecture or a list of architectures
+func (architectures *Architectures) UnmarshalJSON(data []byte) error {
+	var architecture string
+	if err := json.Unmarshal(data, &architecture); err == nil {
+		*architectures = nil
+		if architecture != "" {
+			*architectures = Architectures{architecture}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*architectures = list
+	return nil
+}
+
+// JSONSchema describes the architectures in the JSON schema of the image definition
+func (Architectures) JSONSchema() *jsonschema.Schema {
+	return &jsonschema.Schema{
+		OneOf: []*jsonschema.Schema{
+			{Type: "string"},
+			{
+				Type:        "array",
+				Items:       &jsonschema.Schema{Type: "string"},
+				MinItems:    1,
+				UniqueItems: true,
+			},
+		},
+	}
+}
+
+// String returns the architectures separated by commas, which is the architecture
+// of an image definition built for a single architecture
+func (architectures Architectures) String() string {
+	return strings.Join(architectures, ",")
+}
@@ -0,0 +1,136 @@
+package imagedefinition
+
+// Descriptions documents the structs of the image definition and their fields,
+// keyed by "Struct" and "Struct.Field". They are used as the descriptions of the
+// exported JSON schema, so editors can show them while writing an image definition
+var Descriptions = map[string]string{
+	"ImageDefinition":                "An image definition specifies how to build a classic image.",
+	"ImageDefinition.ImageName":      "The name of the image.",
+	"ImageDefinition.DisplayName":    "The human readable name to use in the image.",
+	"ImageDefinition.Revision":       "An integer used to track changes to the image definition file.",
+	"ImageDefinition.Architecture":   "The architecture of the image to create, for example amd64, armhf, arm64, s390x, ppc64el or riscv64. A list of architectures builds the image for each of them.",
+	"ImageDefinition.Series":         "The Ubuntu codename to use as apt sources, for example jammy.",
+	"ImageDefinition.Kernel":         "An additional kernel package to install in the image.",
+	"ImageDefinition.Gadget":         "Where the gadget tree defining the boot assets of the image is sourced from. Required to create img, iso or qcow2 artifacts.",
+	"ImageDefinition.ModelAssertion": "A path to a model assertion to use when preseeding snaps in the image. Must be a local file URI beginning with file://, relative to the directory of the image definition file.",
+	"ImageDefinition.Rootfs":         "How the rootfs of the image is built. Exactly one of seed, archive-tasks or tarball must be specified.",
+	"ImageDefinition.Customization":  "The customizations to make to the rootfs of the image.",
+	"ImageDefinition.Artifacts":      "The files to create from the image.",
+	"ImageDefinition.Class":          "The classification of the image.",
+	"ImageDefinition.Extends":        "An image definition file this one extends. Its keys are merged with the ones of this file, which take precedence. A relative path is relative to the directory of this file.",
+	"ImageDefinition.Include":        "Image definition fragments merged in order after the file this one extends and before the keys of this file. A relative path is relative to the directory of this file.",
+
+	"Gadget.Ref":          "A git reference to use when building a gadget tree from git.",
+	"Gadget.GadgetTarget": "The target to build when running make. No target is given to make if it is not specified. Has no effect on prebuilt gadgets.",
+	"Gadget.GadgetBranch": "The branch to use when building a gadget tree from git.",
+	"Gadget.GadgetType":   "The type of gadget tree source. A git URL is cloned and make is run in it, make is run in a directory, and a prebuilt gadget tree is copied as is.",
+	"Gadget.GadgetURL":    "A URI pointing to the gadget tree, beginning with http://, https:// or file://. Local paths are relative to the directory of the image definition file. Required unless the gadget is prebuilt.",
+
+	"Rootfs.Components":   "The components of the archive to use as apt sources, such as main, universe and restricted.",
+	"Rootfs.Archive":      "The archive to use as an apt source.",
+	"Rootfs.Flavor":       "The flavor of Ubuntu to build, for example kubuntu or xubuntu.",
+	"Rootfs.Mirror":       "The mirror for apt sources.",
+	"Rootfs.Pocket":       "The pocket to use as an apt source. The security pocket includes the release pocket, updates includes security, and proposed includes all pockets.",
+	"Rootfs.Seed":         "The seed to germinate from to create the list of packages to install in the image.",
+	"Rootfs.Tarball":      "A prebuilt rootfs to use rather than germinating from a seed or using archive tasks.",
+	"Rootfs.ArchiveTasks": "A list of archive tasks to build the image from rather than seeds.",
+
+	"Seed.SeedBranch": "An alternative branch to use when retrieving seeds from a git or bzr source.",
+	"Seed.SeedURLs":   "A list of git, bzr or http locations from which to retrieve the seeds.",
+	"Seed.Names":      "The names of the seeds to use from the germinate output, for example server, minimal or cloud-image.",
+	"Seed.Vcs":        "Whether to use the --vcs flag when running germinate.",
+
+	"Tarball.TarballURL": "The path of the tarball, beginning with file://, relative to the directory of the image definition file. It may be uncompressed or compressed with bzip2, gzip, xz or zstd.",
+	"Tarball.GPG":        "A URL to the GPG signature to verify the tarball against.",
+	"Tarball.SHA256sum":  "The SHA256 sum of the tarball, used to verify it has not been altered.",
+
+	"Customization.Installer":         "Customizations of installer images.",
+	"Customization.CloudInit":         "A custom cloud-init configuration.",
+	"Customization.ExtraPPAs":         "Extra PPAs to use as sources while building the rootfs. Both public and private PPAs are supported.",
+	"Customization.ExtraRepositories": "Extra third-party APT repositories to use as sources, signed with a key given as a file. Neither Launchpad nor a keyserver is needed to add them.",
+	"Customization.ExtraPackages":     "Extra packages to install in the rootfs beyond what is included in the germinate output.",
+	"Customization.ExtraSnaps":        "Extra snaps to preseed in the rootfs.",
+	"Customization.Fstab":             "The entries of the fstab of the image.",
+	"Customization.Manual":            "Manual customizations made to the rootfs after it has been created and before the artifacts are generated.",
+
+	"Installer.Preseeds": "The preseeds of the installer.",
+	"Installer.Layers":   "The layers of subiquity based layered images.",
+
+	"CloudInit.MetaData":      "The cloud-init meta-data, as a YAML string.",
+	"CloudInit.UserData":      "The cloud-init user-data, as a YAML string.",
+	"CloudInit.NetworkConfig": "The cloud-init network-config, as a YAML string.",
+
+	"PPA.PPAName":     "The name of the PPA in the format \"user/ppa-name\".",
+	"PPA.Auth":        "The authentication of a private PPA in the format \"user:password\". It is kept for compatibility, auth-file or auth-env keep the credentials out of the image definition. The fingerprint is required when it is given.",
+	"PPA.AuthFile":    "The path of a file containing the authentication of a private PPA in the format \"user:password\", relative to the directory of the image definition file. The fingerprint is required when it is given.",
+	"PPA.AuthEnv":     "The name of an environment variable containing the authentication of a private PPA in the format \"user:password\". The fingerprint is required when it is given.",
+	"PPA.Fingerprint": "The fingerprint of the GPG signing key of the PPA. It is retrieved from Launchpad for public PPAs and required for private PPAs.",
+	"PPA.KeepEnabled": "Whether to leave the PPA configured in the image. If false, it is only used as a source while building the rootfs, and its sources.list.d file and signing key are removed once the packages and snaps are installed.",
+
+	"Repository.Name":          "The name of the repository, used to name its sources file in /etc/apt/sources.list.d and its keyring in /etc/apt/keyrings.",
+	"Repository.URI":           "The URI of the repository.",
+	"Repository.Suites":        "The suites of the repository. Defaults to the series of the image. A suite ending with \"/\" is the path of a flat repository.",
+	"Repository.Components":    "The components of the repository. They are not given for a flat repository.",
+	"Repository.Architectures": "The architectures to use from the repository. All the architectures of apt are used if they are not given.",
+	"Repository.SignedBy":      "The path of the keyring signing the repository, relative to the directory of the image definition file. An ASCII armored key must have the .asc extension.",
+
+	"Package.PackageName": "The name of the package.",
+
+	"Snap.SnapName":     "The name of the snap.",
+	"Snap.SnapRevision": "The revision of the snap to preseed. If a channel is also given, updates come from that channel.",
+	"Snap.Store":        "The store to retrieve the snap from.",
+	"Snap.Channel":      "The channel from which to preseed the snap.",
+
+	"Manual.CopyFile":  "Files to copy from the host to the rootfs.",
+	"Manual.Execute":   "Executables to run in the rootfs, after the files have been copied.",
+	"Manual.TouchFile": "Empty files to create in the rootfs.",
+	"Manual.AddGroup":  "Groups to create in the rootfs.",
+	"Manual.AddUser":   "Users to create in the rootfs.",
+
+	"Fstab.Label":        "The value of LABEL= for the fstab entry.",
+	"Fstab.Mountpoint":   "Where to mount the partition.",
+	"Fstab.FSType":       "The filesystem type.",
+	"Fstab.MountOptions": "The options for mounting the filesystem.",
+	"Fstab.Dump":         "Whether to dump the filesystem.",
+	"Fstab.FsckOrder":    "The order in which to fsck the filesystem.",
+
+	"CopyFile.Dest":   "The absolute path in the rootfs to copy the file to.",
+	"CopyFile.Source": "The path of the file to copy, relative to the directory of the image definition file.",
+
+	"Execute.ExecutePath": "The absolute path in the rootfs of the executable to run.",
+
+	"TouchFile.TouchPath": "The absolute path in the rootfs of the file to create.",
+
+	"AddGroup.GroupName": "The name of the group.",
+	"AddGroup.GroupID":   "The GID of the group.",
+
+	"AddUser.UserName": "The name of the user.",
+	"AddUser.UserID":   "The UID of the user.",
+
+	"Artifact.Img":       "The .img files to create. Requires a gadget.",
+	"Artifact.Iso":       "The .iso files to create. Requires a gadget.",
+	"Artifact.Qcow2":     "The .qcow2 files to create. Requires a gadget.",
+	"Artifact.Manifest":  "The list of the packages in the rootfs and their versions.",
+	"Artifact.Filelist":  "The list of the files in the rootfs.",
+	"Artifact.Changelog": "The changelog of the packages in the rootfs.",
+	"Artifact.RootfsTar": "A tarball of the rootfs.",
+
+	"Img.ImgName":   "The name of the .img file.",
+	"Img.ImgVolume": "The volume of the gadget to create the image from. Required for multi-volume gadgets.",
+
+	"Iso.IsoName":   "The name of the .iso file.",
+	"Iso.IsoVolume": "The volume of the gadget to create the image from. Required for multi-volume gadgets.",
+	"Iso.Command":   "The xorriso command to create the image with.",
+
+	"Qcow2.Qcow2Name":   "The name of the .qcow2 file.",
+	"Qcow2.Qcow2Volume": "The volume of the gadget to create the image from. Required for multi-volume gadgets.",
+
+	"Manifest.ManifestName": "The name of the manifest file.",
+
+	"Filelist.FilelistName": "The name of the filelist file.",
+
+	"Changelog.ChangelogName": "The name of the changelog file.",
+
+	"RootfsTar.RootfsTarName": "The name of the tarball.",
+	"RootfsTar.Compression":   "The compression to use on the tarball.",
+}
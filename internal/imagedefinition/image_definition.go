@@ -17,7 +17,7 @@ type ImageDefinition struct {
 	ImageName      string         `yaml:"name"            json:"ImageName"`
 	DisplayName    string         `yaml:"display-name"    json:"DisplayName"`
 	Revision       int            `yaml:"revision"        json:"Revision,omitempty"`
-	Architecture   string         `yaml:"architecture"    json:"Architecture"`
+	Architecture   Architectures  `yaml:"architecture"    json:"Architecture"`
 	Series         string         `yaml:"series"          json:"Series"`
 	Kernel         string         `yaml:"kernel"          json:"Kernel,omitempty"`
 	Gadget         *Gadget        `yaml:"gadget"          json:"Gadget,omitempty"`
@@ -26,6 +26,8 @@ type ImageDefinition struct {
 	Customization  *Customization `yaml:"customization"   json:"Customization,omitempty"`
 	Artifacts      *Artifact      `yaml:"artifacts"       json:"Artifacts"`
 	Class          string         `yaml:"class"           json:"Class"                    jsonschema:"enum=preinstalled,enum=cloud,enum=installer"`
+	Extends        string         `yaml:"extends"         json:"Extends,omitempty"`
+	Include        []string       `yaml:"include"         json:"Include,omitempty"`
 }
 
 // Gadget defines the gadget section of the image definition file
@@ -70,13 +72,14 @@ type Tarball struct {
 // The extra_step_prebuilt_rootfs struct tag denotes that an extra state will
 // need to be added for image builds with prebuilt root filesystems.
 type Customization struct {
-	Installer     *Installer `yaml:"installer"      json:"Installer,omitempty"`
-	CloudInit     *CloudInit `yaml:"cloud-init"     json:"CloudInit,omitempty"`
-	ExtraPPAs     []*PPA     `yaml:"extra-ppas"     json:"ExtraPPAs,omitempty"     extra_step_prebuilt_rootfs:"add_extra_ppas"`
-	ExtraPackages []*Package `yaml:"extra-packages" json:"ExtraPackages,omitempty" extra_step_prebuilt_rootfs:"install_extra_packages"`
-	ExtraSnaps    []*Snap    `yaml:"extra-snaps"    json:"ExtraSnaps,omitempty"    extra_step_prebuilt_rootfs:"install_extra_snaps"`
-	Fstab         []*Fstab   `yaml:"fstab"          json:"Fstab,omitempty"`
-	Manual        *Manual    `yaml:"manual"         json:"Manual,omitempty"`
+	Installer         *Installer    `yaml:"installer"          json:"Installer,omitempty"`
+	CloudInit         *CloudInit    `yaml:"cloud-init"         json:"CloudInit,omitempty"`
+	ExtraPPAs         []*PPA        `yaml:"extra-ppas"         json:"ExtraPPAs,omitempty"         extra_step_prebuilt_rootfs:"add_extra_ppas"`
+	ExtraRepositories []*Repository `yaml:"extra-repositories" json:"ExtraRepositories,omitempty" extra_step_prebuilt_rootfs:"add_extra_repositories"`
+	ExtraPackages     []*Package    `yaml:"extra-packages"     json:"ExtraPackages,omitempty"     extra_step_prebuilt_rootfs:"install_extra_packages"`
+	ExtraSnaps        []*Snap       `yaml:"extra-snaps"        json:"ExtraSnaps,omitempty"        extra_step_prebuilt_rootfs:"install_extra_snaps"`
+	Fstab             []*Fstab      `yaml:"fstab"              json:"Fstab,omitempty"`
+	Manual            *Manual       `yaml:"manual"             json:"Manual,omitempty"`
 }
 
 // Installer provides customization options specific to installer images
@@ -96,8 +99,21 @@ type CloudInit struct {
 type PPA struct {
 	PPAName     string `yaml:"name"         json:"PPAName"               jsonschema:"pattern=^[a-zA-Z0-9_.+-]+/[a-zA-Z0-9_.+-]+$"`
 	Auth        string `yaml:"auth"         json:"Auth,omitempty"        jsonschema:"pattern=^[a-zA-Z0-9_.+-]+:[a-zA-Z0-9]+$"`
+	AuthFile    string `yaml:"auth-file"    json:"AuthFile,omitempty"`
+	AuthEnv     string `yaml:"auth-env"     json:"AuthEnv,omitempty"     jsonschema:"pattern=^[a-zA-Z_][a-zA-Z0-9_]*$"`
 	Fingerprint string `yaml:"fingerprint"  json:"Fingerprint,omitempty"`
-	KeepEnabled bool   `yaml:"keep-enabled" json:"KeepEnabled"           default:"true"`
+	KeepEnabled *bool  `yaml:"keep-enabled" json:"KeepEnabled"           default:"true"`
+}
+
+// Repository contains information about a third-party APT repository,
+// signed with a key given as a file
+type Repository struct {
+	Name          string   `yaml:"name"          json:"Name"                    jsonschema:"pattern=^[a-zA-Z0-9_.+-]+$"`
+	URI           string   `yaml:"uri"           json:"URI"                     jsonschema:"type=string,format=uri"`
+	Suites        []string `yaml:"suites"        json:"Suites,omitempty"`
+	Components    []string `yaml:"components"    json:"Components,omitempty"`
+	Architectures []string `yaml:"architectures" json:"Architectures,omitempty"`
+	SignedBy      string   `yaml:"signed-by"     json:"SignedBy"`
 }
 
 // Package contains information about packages
@@ -260,6 +276,25 @@ type InvalidPPAError struct {
 	gojsonschema.ResultErrorFields
 }
 
+// NewConflictingPPAAuthError fails the image definition parsing when the
+// credentials of a private PPA are given with several keys
+func NewConflictingPPAAuthError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *ConflictingPPAAuthError {
+	err := ConflictingPPAAuthError{}
+	err.SetContext(context)
+	err.SetType("private_ppa_conflicting_auth")
+	err.SetDescriptionFormat("Only one of auth, auth-file and auth-env can be given for a private PPA ({{.keys}})")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// ConflictingPPAAuthError implements gojsonschema.ErrorType. It is used for custom
+// errors when the credentials of a private PPA are given with several keys
+type ConflictingPPAAuthError struct {
+	gojsonschema.ResultErrorFields
+}
+
 // NewPathNotAbsoluteError fails the image definition parsing when a relative path is given
 func NewPathNotAbsoluteError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *PathNotAbsoluteError {
 	err := PathNotAbsoluteError{}
@@ -299,7 +334,7 @@ type DependentKeyError struct {
 }
 
 func (imageDef ImageDefinition) securityMirror() string {
-	if imageDef.Architecture == "amd64" || imageDef.Architecture == "i386" {
+	if imageDef.Architecture.String() == "amd64" || imageDef.Architecture.String() == "i386" {
 		return "http://security.ubuntu.com/ubuntu/"
 	}
 	return imageDef.Rootfs.Mirror
@@ -1,10 +1,13 @@
 package imagedefinition
 
 import (
+	"encoding/json"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
 )
 
 func TestGeneratePocketList(t *testing.T) {
@@ -28,7 +31,7 @@ func TestGeneratePocketList(t *testing.T) {
 		{
 			"security",
 			ImageDefinition{
-				Architecture: "amd64",
+				Architecture: Architectures{"amd64"},
 				Series:       "jammy",
 				Rootfs: &Rootfs{
 					Pocket:     "security",
@@ -41,7 +44,7 @@ func TestGeneratePocketList(t *testing.T) {
 		{
 			"updates",
 			ImageDefinition{
-				Architecture: "arm64",
+				Architecture: Architectures{"arm64"},
 				Series:       "jammy",
 				Rootfs: &Rootfs{
 					Pocket:     "updates",
@@ -57,7 +60,7 @@ func TestGeneratePocketList(t *testing.T) {
 		{
 			"proposed",
 			ImageDefinition{
-				Architecture: "amd64",
+				Architecture: Architectures{"amd64"},
 				Series:       "jammy",
 				Rootfs: &Rootfs{
 					Pocket:     "proposed",
@@ -146,3 +149,52 @@ func TestCustomErrors(t *testing.T) {
 		}
 	})
 }
+
+// TestArchitectures ensures that the architecture of an image definition can be
+// written as a string or as a list of strings
+func TestArchitectures(t *testing.T) {
+	testCases := []struct {
+		name     string
+		yaml     string
+		expected Architectures
+		json     string
+	}{
+		{"string", "architecture: amd64\n", Architectures{"amd64"}, `"amd64"`},
+		{"list", "architecture: [amd64, arm64]\n", Architectures{"amd64", "arm64"}, `["amd64","arm64"]`},
+		{"single_item_list", "architecture:\n  - riscv64\n", Architectures{"riscv64"}, `"riscv64"`},
+		{"missing", "series: jammy\n", nil, `""`},
+	}
+	for _, tc := range testCases {
+		t.Run("test_architectures_"+tc.name, func(t *testing.T) {
+			var imageDef ImageDefinition
+			if err := yaml.Unmarshal([]byte(tc.yaml), &imageDef); err != nil {
+				t.Fatalf("Did not expect an error decoding the architecture, got %s", err.Error())
+			}
+			if !reflect.DeepEqual(imageDef.Architecture, tc.expected) {
+				t.Errorf("Expected architecture %q but got %q", tc.expected, imageDef.Architecture)
+			}
+
+			// the image definition is validated and written to the metadata as JSON
+			jsonBytes, err := json.Marshal(imageDef.Architecture)
+			if err != nil {
+				t.Fatalf("Did not expect an error encoding the architecture, got %s", err.Error())
+			}
+			if string(jsonBytes) != tc.json {
+				t.Errorf("Expected the architecture to be encoded as %s but got %s", tc.json, jsonBytes)
+			}
+			var architectures Architectures
+			if err := json.Unmarshal(jsonBytes, &architectures); err != nil {
+				t.Fatalf("Did not expect an error decoding the architecture, got %s", err.Error())
+			}
+			if !reflect.DeepEqual(architectures, tc.expected) {
+				t.Errorf("Expected architecture %q to be decoded back but got %q", tc.expected, architectures)
+			}
+		})
+	}
+	t.Run("test_architectures_invalid", func(t *testing.T) {
+		var imageDef ImageDefinition
+		if err := yaml.Unmarshal([]byte("architecture:\n  amd64: true\n"), &imageDef); err == nil {
+			t.Errorf("Expected an error decoding a mapping as the architecture")
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+)
+
+// buildContext returns the context of the state that is currently running. It
+// is done when the build is cancelled, or when --timeout or the --state-timeout
+// of the state expires. The external commands run by the states are killed then
+func (stateMachine *StateMachine) buildContext() context.Context {
+	if stateMachine.ctx == nil {
+		return context.Background()
+	}
+	return stateMachine.ctx
+}
+
+// runStateContext runs a state, making ctx and the timeout given for the state
+// with --state-timeout available to it through buildContext
+func (stateMachine *StateMachine) runStateContext(ctx context.Context, state stateFunc) error {
+	if err := ctx.Err(); err != nil {
+		return &cancelledError{
+			message: fmt.Sprintf("Error running state %s: %s", state.name, cancellationReason(ctx)),
+			cause:   err,
+		}
+	}
+
+	stateCtx := ctx
+	timeout, hasTimeout := stateMachine.commonFlags.StateTimeouts[state.name]
+	if hasTimeout {
+		var cancel context.CancelFunc
+		stateCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	stateMachine.ctx = stateCtx
+	defer func() {
+		stateMachine.ctx = nil
+	}()
+
+	err := stateMachine.runState(state)
+	if err == nil || stateCtx.Err() == nil {
+		return err
+	}
+	if ctx.Err() == nil {
+		return &cancelledError{
+			message: fmt.Sprintf("State %s exceeded the timeout of %s given with --state-timeout: %s",
+				state.name, timeout.String(), err.Error()),
+			cause: stateCtx.Err(),
+		}
+	}
+	return &cancelledError{
+		message: fmt.Sprintf("%s: %s", cancellationReason(ctx), err.Error()),
+		cause:   ctx.Err(),
+	}
+}
+
+// cancelledError is returned when a state was stopped because the build was
+// cancelled or timed out. It wraps context.Canceled or context.DeadlineExceeded
+// so callers can tell it apart from other failures with errors.Is
+type cancelledError struct {
+	message string
+	cause   error
+}
+
+func (err *cancelledError) Error() string {
+	return err.message
+}
+
+func (err *cancelledError) Unwrap() error {
+	return err.cause
+}
+
+// cancellationReason explains why the build was stopped
+func cancellationReason(ctx context.Context) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return "the build timed out"
+	}
+	return "the build was cancelled"
+}
+
+// validateStateTimeouts makes sure that the states given with --state-timeout exist
+func (stateMachine *StateMachine) validateStateTimeouts() error {
+	for stateName, timeout := range stateMachine.commonFlags.StateTimeouts {
+		stateFound := false
+		for _, state := range stateMachine.states {
+			if state.name == stateName {
+				stateFound = true
+				break
+			}
+		}
+		if !stateFound {
+			return fmt.Errorf("Invalid state name %s given with --state-timeout", stateName)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("Invalid timeout %s given with --state-timeout for state %s",
+				timeout.String(), stateName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// This test file tests cancelling builds and the timeouts of builds and states
+package statemachine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// cancelTestStates mounts a directory and then runs a command that takes a long time
+var cancelTestStates = []stateFunc{
+	{"mount_directory", func(stateMachine *StateMachine) error {
+		mountCmd, _ := mountFromHost(stateMachine.stateMachineFlags.WorkDir, "/dev")
+		return stateMachine.mount(mountCmd,
+			filepath.Join(stateMachine.stateMachineFlags.WorkDir, "dev"))
+	}},
+	{"run_long_command", func(stateMachine *StateMachine) error {
+		_, err := stateMachine.runCmd(execCommand("sleep", "30"))
+		return err
+	}},
+	{"finish", (*StateMachine).finish},
+}
+
+// TestCancelBuild ensures the running command is killed and the mounts are torn
+// down when the build is cancelled, times out or a state times out
+func TestCancelBuild(t *testing.T) {
+	testCases := []struct {
+		name          string
+		timeout       time.Duration
+		stateTimeouts map[string]time.Duration
+		cancel        bool
+		expectedError string
+		expectedCause error
+	}{
+		{"timeout", 500 * time.Millisecond, nil, false, "the build timed out", context.DeadlineExceeded},
+		{"state_timeout", 0, map[string]time.Duration{"run_long_command": 500 * time.Millisecond},
+			false, "State run_long_command exceeded the timeout of 500ms given with --state-timeout",
+			context.DeadlineExceeded},
+		{"cancel", 0, nil, true, "the build was cancelled", context.Canceled},
+	}
+	for _, tc := range testCases {
+		t.Run("test_cancel_build_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Timeout = tc.timeout
+			stateMachine.commonFlags.StateTimeouts = tc.stateTimeouts
+			stateMachine.commonFlags.Quiet = true
+			workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(workDir)
+			stateMachine.stateMachineFlags.WorkDir = workDir
+			stateMachine.states = cancelTestStates
+
+			err = stateMachine.validateStateTimeouts()
+			asserter.AssertErrNil(err, true)
+
+			testCaseName = "TestCancelBuild"
+			execCommand = fakeExecCommand
+			defer func() {
+				execCommand = exec.Command
+			}()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				go func() {
+					time.Sleep(500 * time.Millisecond)
+					cancel()
+				}()
+			}
+
+			start := time.Now()
+			err = stateMachine.Run(ctx)
+			asserter.AssertErrContains(err, tc.expectedError)
+			if !errors.Is(err, tc.expectedCause) {
+				t.Errorf("Expected error \"%s\" to wrap \"%s\"", err.Error(), tc.expectedCause.Error())
+			}
+			if time.Since(start) > 20*time.Second {
+				t.Errorf("Expected the long running command to be killed")
+			}
+			if stateMachine.CurrentStep != "run_long_command" {
+				t.Errorf("Expected the build to stop in run_long_command, but it stopped in %s",
+					stateMachine.CurrentStep)
+			}
+			if len(stateMachine.mounts.Entries) != 0 {
+				t.Errorf("Expected all mounts to be torn down, but got %v", stateMachine.mounts.Entries)
+			}
+		})
+	}
+}
+
+// TestCancelledContext ensures no state is run if the context is already done
+func TestCancelledContext(t *testing.T) {
+	t.Run("test_cancelled_context", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.states = cancelTestStates
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := stateMachine.Run(ctx)
+		asserter.AssertErrContains(err, "Error running state mount_directory: the build was cancelled")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected error \"%s\" to wrap context.Canceled", err.Error())
+		}
+		if stateMachine.StepsTaken != 0 {
+			t.Errorf("Expected no state to run, but %d ran", stateMachine.StepsTaken)
+		}
+	})
+}
+
+// TestCancelledHelperCommands ensures the tar and dd commands run by the helpers
+// are not started once the context is done
+func TestCancelledHelperCommands(t *testing.T) {
+	t.Run("test_cancelled_helper_commands", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		testDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(testDir)
+		tarPath := filepath.Join(testDir, "test.tar")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		errs := []error{
+			helper.CreateTarArchive(ctx, testDir, tarPath, "uncompressed", false, false),
+			helper.ExtractTarArchive(ctx, tarPath, testDir, false, false),
+			helper.CopyBlob(ctx, []string{"if=/dev/zero", "of=" + filepath.Join(testDir, "blob"), "count=1"}),
+		}
+		for _, err := range errs {
+			asserter.AssertErrContains(err, context.Canceled.Error())
+		}
+		if _, err := os.Stat(filepath.Join(testDir, "blob")); !os.IsNotExist(err) {
+			t.Errorf("Expected dd not to run once the build was cancelled")
+		}
+	})
+}
+
+// TestFailedValidateStateTimeouts tests invalid values of --state-timeout
+func TestFailedValidateStateTimeouts(t *testing.T) {
+	testCases := []struct {
+		name          string
+		stateTimeouts map[string]time.Duration
+		expectedError string
+	}{
+		{"invalid_state", map[string]time.Duration{"fake_state": time.Minute},
+			"Invalid state name fake_state given with --state-timeout"},
+		{"invalid_timeout", map[string]time.Duration{"finish": -time.Minute},
+			"Invalid timeout -1m0s given with --state-timeout for state finish"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_validate_state_timeouts_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine testStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.StateTimeouts = tc.stateTimeouts
+			stateMachine.states = allTestStates
+
+			err := stateMachine.validateStateTimeouts()
+			asserter.AssertErrContains(err, tc.expectedError)
+		})
+	}
+}
@@ -1,6 +1,11 @@
 package statemachine
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/imagedefinition"
 )
@@ -32,10 +37,27 @@ type ClassicStateMachine struct {
 	Args     commands.ClassicArgs
 	Packages []string
 	Snaps    []string
+
+	// the checksums of the image definition file and of the --set overrides,
+	// used to detect changes to them when resuming a partial build
+	imageDefinitionSHA256 string
+	setOverridesSHA256    string
+
+	// the reason every calculated state was added, printed by --plan
+	stateReasons map[string]string
+
+	// the builds for every architecture, when the image definition lists
+	// several of them. The state machine then only runs these builds
+	architectureBuilds []*architectureBuild
+
+	// the architecture added to the names of the artifacts, and the directory
+	// in which the builds for several architectures share their downloads
+	artifactArchitecture string
+	sharedDir            string
 }
 
 // Setup assigns variables and calls other functions that must be executed before Run()
-func (classicStateMachine *ClassicStateMachine) Setup() error {
+func (classicStateMachine *ClassicStateMachine) Setup(ctx context.Context) error {
 	// set the parent pointer of the embedded struct
 	classicStateMachine.parent = classicStateMachine
 
@@ -47,6 +69,31 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 		return err
 	}
 
+	if classicStateMachine.Opts.Plan || classicStateMachine.Opts.DryRun {
+		if classicStateMachine.stateMachineFlags.Resume ||
+			classicStateMachine.stateMachineFlags.Until != "" ||
+			classicStateMachine.stateMachineFlags.Thru != "" {
+			return fmt.Errorf("--plan and --dry-run cannot be used with --resume, --until or --thru")
+		}
+		if classicStateMachine.loadsMetadata() {
+			return fmt.Errorf("--plan and --dry-run cannot be used with --only or --from")
+		}
+	}
+
+	// an image definition listing several architectures is built once for
+	// every architecture, each build resuming from its own workdir. The image
+	// definition may be omitted when resuming, then the partial build knows it
+	if classicStateMachine.Args.ImageDefinition != "" {
+		architectures, err := imageDefinitionArchitectures(classicStateMachine.Args.ImageDefinition,
+			classicStateMachine.Opts.Set)
+		if err != nil {
+			return fmt.Errorf("Error reading image definition file: %s", err.Error())
+		}
+		if len(architectures) > 1 {
+			return classicStateMachine.setupArchitectureBuilds(ctx, architectures)
+		}
+	}
+
 	// if --resume was passed, figure out where to start
 	if err := classicStateMachine.readMetadata(); err != nil {
 		return err
@@ -54,3 +101,115 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 
 	return nil
 }
+
+// Run iterates through the states. If --plan or --dry-run was passed, the states
+// that would run are printed instead
+func (classicStateMachine *ClassicStateMachine) Run(ctx context.Context) error {
+	if len(classicStateMachine.architectureBuilds) > 0 {
+		return classicStateMachine.runArchitectureBuilds(ctx)
+	}
+	if classicStateMachine.Opts.Plan || classicStateMachine.Opts.DryRun {
+		return classicStateMachine.printPlan()
+	}
+	return classicStateMachine.StateMachine.Run(ctx)
+}
+
+// Teardown handles anything else that needs to happen after the states have finished
+// running. Nothing was written to disk if only the plan was printed. The builds
+// for every architecture were torn down as they finished, only the temporary
+// workdir containing them is left to remove
+func (classicStateMachine *ClassicStateMachine) Teardown(ctx context.Context) error {
+	if len(classicStateMachine.architectureBuilds) > 0 {
+		if classicStateMachine.cleanWorkDir {
+			if err := osRemoveAll(classicStateMachine.stateMachineFlags.WorkDir); err != nil {
+				return fmt.Errorf("Error cleaning up workDir: %s", err.Error())
+			}
+		}
+		return nil
+	}
+	if classicStateMachine.Opts.Plan || classicStateMachine.Opts.DryRun {
+		return nil
+	}
+	return classicStateMachine.StateMachine.Teardown(ctx)
+}
+
+// imageDefinitionChecksum calculates the hex encoded sha256 of the image definition file
+// and of the files it extends and includes
+func (classicStateMachine *ClassicStateMachine) imageDefinitionChecksum() (string, error) {
+	files, err := readImageDefinitionFiles(classicStateMachine.Args.ImageDefinition)
+	if err != nil {
+		return "", fmt.Errorf("Error reading image definition file: %s", err.Error())
+	}
+	checksum := sha256.New()
+	for _, file := range files {
+		checksum.Write(file.bytes)
+	}
+	return hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// setOverridesChecksum calculates the hex encoded sha256 of the --set overrides, or
+// returns an empty string if there are none. Only the checksum is kept in the metadata,
+// since the overrides can set the credentials of private PPAs
+func (classicStateMachine *ClassicStateMachine) setOverridesChecksum() string {
+	if len(classicStateMachine.Opts.Set) == 0 {
+		return ""
+	}
+	checksum := sha256.New()
+	for _, override := range classicStateMachine.Opts.Set {
+		checksum.Write([]byte(override))
+		checksum.Write([]byte{0})
+	}
+	return hex.EncodeToString(checksum.Sum(nil))
+}
+
+// restoreClassicMetadata restores the classic specific information of a partial
+// build and recalculates the states if they were calculated before
+func (classicStateMachine *ClassicStateMachine) restoreClassicMetadata(metadata *stateMachineMetadata) error {
+	if metadata.Classic == nil {
+		return fmt.Errorf("metadata file does not contain the information needed " +
+			"to resume a classic build. The partial build may have been started by " +
+			"an older version of ubuntu-image and has to be restarted")
+	}
+	classicStateMachine.Packages = metadata.Classic.Packages
+	classicStateMachine.Snaps = metadata.Classic.Snaps
+	if classicStateMachine.Args.ImageDefinition == "" {
+		classicStateMachine.Args.ImageDefinition = metadata.Classic.ImageDefinitionPath
+	}
+
+	// nothing else to restore if the image definition was not parsed yet
+	if metadata.Classic.ImageDefinitionSHA256 == "" {
+		return nil
+	}
+	checksum, err := classicStateMachine.imageDefinitionChecksum()
+	if err != nil {
+		return err
+	}
+	if checksum != metadata.Classic.ImageDefinitionSHA256 {
+		return fmt.Errorf("the image definition %s has changed since the partial build "+
+			"was started. Restart the build without --resume to use the modified image definition",
+			classicStateMachine.Args.ImageDefinition)
+	}
+	setChecksum := classicStateMachine.setOverridesChecksum()
+	if setChecksum != metadata.Classic.SetOverridesSHA256 {
+		return fmt.Errorf("the --set overrides differ from the ones the partial build " +
+			"was started with. Resume the build with the same --set overrides, or restart " +
+			"it without --resume to use the new ones")
+	}
+	classicStateMachine.ImageDef = metadata.Classic.ImageDef
+	classicStateMachine.imageDefinitionSHA256 = checksum
+	classicStateMachine.setOverridesSHA256 = setChecksum
+
+	// the credentials written in the image definition are not kept in the metadata
+	if err := classicStateMachine.restoreRedactedCredentials(); err != nil {
+		return err
+	}
+
+	// calculate_states adds the states that depend on the image definition, so
+	// they have to be calculated again before the build can be resumed
+	for i, state := range startingClassicStates {
+		if state.name == "calculate_states" && classicStateMachine.StepsTaken > i {
+			return classicStateMachine.calculateStates()
+		}
+	}
+	return nil
+}
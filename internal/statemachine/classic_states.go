@@ -2,10 +2,8 @@ package statemachine
 
 import (
 	"bufio"
-	"context"
 	"fmt"
 	"io"
-	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -16,16 +14,12 @@ import (
 
 	"github.com/canonical/ubuntu-image/internal/helper"
 	"github.com/canonical/ubuntu-image/internal/imagedefinition"
-	"github.com/invopop/jsonschema"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/image"
 	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/snap"
 	"github.com/snapcore/snapd/store"
-	"github.com/xeipuuv/gojsonschema"
-
-	"gopkg.in/yaml.v2"
 )
 
 // parseImageDefinition parses the provided yaml file and ensures it is valid
@@ -33,168 +27,88 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 	var classicStateMachine *ClassicStateMachine
 	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
 
-	// Open and decode the yaml file
-	var imageDefinition imagedefinition.ImageDefinition
-	imageFile, err := os.Open(classicStateMachine.Args.ImageDefinition)
+	// Read the yaml file and the files it extends and includes, then decode
+	// the result of merging them
+	files, err := readImageDefinitionFiles(classicStateMachine.Args.ImageDefinition)
 	if err != nil {
-		return fmt.Errorf("Error opening image definition file: %s", err.Error())
+		return err
 	}
-	defer imageFile.Close()
-	if err := yaml.NewDecoder(imageFile).Decode(&imageDefinition); err != nil {
+	merged := mergeImageDefinitionFiles(files)
+	var imageDefinition imagedefinition.ImageDefinition
+	if err := merged.decode(&imageDefinition); err != nil {
 		return err
 	}
 
-	// populate the default values for imageDefinition if they were not provided in
-	// the image definition YAML file
-	if err := helperSetDefaults(&imageDefinition); err != nil {
+	// the decoder ignores the keys that are not part of the struct, so typos
+	// in the keys would go unnoticed
+	if err := classicStateMachine.checkUnknownKeys(files); err != nil {
 		return err
 	}
 
-	// The official standard for YAML schemas states that they are an extension of
-	// JSON schema draft 4. We therefore validate the decoded YAML against a JSON
-	// schema. The workflow is as follows:
-	// 1. Use the jsonschema library to generate a schema from the struct definition
-	// 2. Load the created schema and parsed yaml into types defined by gojsonschema
-	// 3. Use the gojsonschema library to validate the parsed YAML against the schema
-
-	var jsonReflector jsonschema.Reflector
+	// apply the keys given with --set, then substitute the variables, so the
+	// values given on the command line can use them too
+	if err := setOverrides(&imageDefinition, classicStateMachine.Opts.Set); err != nil {
+		return err
+	}
+	if err := keyErrorsToError("Error substituting variables in the image definition",
+		substituteVariables(&imageDefinition)); err != nil {
+		return err
+	}
 
-	// 1. parse the ImageDefinition struct into a schema using the jsonschema tags
-	schema := jsonReflector.Reflect(&imagedefinition.ImageDefinition{})
+	// the artifacts of the builds for several architectures are written
+	// to the same output directory
+	if classicStateMachine.artifactArchitecture != "" {
+		nameArtifactsForArchitecture(imageDefinition.Artifacts, classicStateMachine.artifactArchitecture)
+	}
 
-	// 2. load the schema and parsed YAML data into types understood by gojsonschema
-	schemaLoader := gojsonschema.NewGoLoader(schema)
-	imageDefinitionLoader := gojsonschema.NewGoLoader(imageDefinition)
+	// populate the default values for imageDefinition if they were not provided in
+	// the image definition YAML file
+	if err := helperSetDefaults(&imageDefinition); err != nil {
+		return err
+	}
 
-	// 3. validate the parsed data against the schema
-	result, err := gojsonschemaValidate(schemaLoader, imageDefinitionLoader)
+	result, err := validateImageDefinition(&imageDefinition)
 	if err != nil {
-		return fmt.Errorf("Schema validation returned an error: %s", err.Error())
+		return err
 	}
 
-	// do custom validation for gadgetURL being required if gadget is not pre-built
-	if imageDefinition.Gadget != nil {
-		if imageDefinition.Gadget.GadgetType != "prebuilt" && imageDefinition.Gadget.GadgetURL == "" {
-			jsonContext := gojsonschema.NewJsonContext("gadget_validation", nil)
-			errDetail := gojsonschema.ErrorDetails{
-				"key":   "gadget:type",
-				"value": imageDefinition.Gadget.GadgetType,
-			}
-			result.AddError(
-				imagedefinition.NewMissingURLError(
-					gojsonschema.NewJsonContext("missingURL", jsonContext),
-					52,
-					errDetail,
-				),
-				errDetail,
-			)
+	if !result.Valid() {
+		// the fields of the merged image definition don't tell which file
+		// they come from, so the problems are located in the files
+		if len(files) > 1 {
+			return imageDefinitionFilesError("Schema validation failed",
+				merged.validationErrors(resultKeyErrors(result)))
 		}
+		return fmt.Errorf("Schema validation failed: %s", result.Errors())
 	}
 
-	// don't allow any images to be created without a gadget
-	if imageDefinition.Gadget == nil {
-		diskUsed, err := helperCheckTags(imageDefinition.Artifacts, "is_disk")
-		if err != nil {
-			return fmt.Errorf("Error checking struct tags for Artifacts: \"%s\"", err.Error())
-		}
-		if diskUsed != "" {
-			jsonContext := gojsonschema.NewJsonContext("image_without_gadget", nil)
-			errDetail := gojsonschema.ErrorDetails{
-				"key1": diskUsed,
-				"key2": "gadget:",
-			}
-			result.AddError(
-				imagedefinition.NewDependentKeyError(
-					gojsonschema.NewJsonContext("dependentKey", jsonContext),
-					52,
-					errDetail,
-				),
-				errDetail,
-			)
-		}
+	// the paths on the host are relative to the directory of the image definition
+	// rather than to the current directory, and must exist before anything is built
+	if err := keyErrorsToError("Error resolving the paths of the image definition",
+		resolveLocalPaths(&imageDefinition, func(keyPath []string) string {
+			return merged.fileOf(keyPath, classicStateMachine.Opts.Set)
+		})); err != nil {
+		return err
 	}
 
-	if imageDefinition.Customization != nil {
-		// do custom validation for private PPAs requiring fingerprint
-		for _, ppa := range imageDefinition.Customization.ExtraPPAs {
-			if ppa.Auth != "" && ppa.Fingerprint == "" {
-				jsonContext := gojsonschema.NewJsonContext("ppa_validation", nil)
-				errDetail := gojsonschema.ErrorDetails{
-					"ppaName": ppa.PPAName,
-				}
-				result.AddError(
-					imagedefinition.NewInvalidPPAError(
-						gojsonschema.NewJsonContext("missingPrivatePPAFingerprint",
-							jsonContext),
-						52,
-						errDetail,
-					),
-					errDetail,
-				)
-			}
-		}
-		// do custom validation for manual customization paths
-		if imageDefinition.Customization.Manual != nil {
-			jsonContext := gojsonschema.NewJsonContext("manual_path_validation", nil)
-			if imageDefinition.Customization.Manual.CopyFile != nil {
-				for _, copy := range imageDefinition.Customization.Manual.CopyFile {
-					// XXX: filepath.IsAbs() does returns true for paths like /../../something
-					// and those are NOT absolute paths.
-					if !filepath.IsAbs(copy.Dest) || strings.Contains(copy.Dest, "/../") {
-						errDetail := gojsonschema.ErrorDetails{
-							"key":   "customization:manual:copy-file:destination",
-							"value": copy.Dest,
-						}
-						result.AddError(
-							imagedefinition.NewPathNotAbsoluteError(
-								gojsonschema.NewJsonContext("nonAbsoluteManualPath",
-									jsonContext),
-								52,
-								errDetail,
-							),
-							errDetail,
-						)
-					}
-				}
-			}
-			if imageDefinition.Customization.Manual.TouchFile != nil {
-				for _, touch := range imageDefinition.Customization.Manual.TouchFile {
-					// XXX: filepath.IsAbs() does returns true for paths like /../../something
-					// and those are NOT absolute paths.
-					if !filepath.IsAbs(touch.TouchPath) || strings.Contains(touch.TouchPath, "/../") {
-						errDetail := gojsonschema.ErrorDetails{
-							"key":   "customization:manual:touch-file:path",
-							"value": touch.TouchPath,
-						}
-						result.AddError(
-							imagedefinition.NewPathNotAbsoluteError(
-								gojsonschema.NewJsonContext("nonAbsoluteManualPath",
-									jsonContext),
-								52,
-								errDetail,
-							),
-							errDetail,
-						)
-					}
-				}
-			}
-		}
+	// the credentials of the private PPAs are only read when they are needed,
+	// but they must be available and redacted from the output from now on
+	if err := keyErrorsToError("Error reading the credentials of the image definition",
+		stateMachine.checkPPACredentials(&imageDefinition)); err != nil {
+		return err
 	}
 
-	// TODO: I've created a PR upstream in xeipuuv/gojsonschema
-	// https://github.com/xeipuuv/gojsonschema/pull/352
-	// if it gets merged this can be removed
-	err = helperCheckEmptyFields(&imageDefinition, result, schema)
+	// remember the checksums of the image definition and of the --set overrides
+	// so a resumed build can detect that they were modified in the meantime
+	checksum, err := classicStateMachine.imageDefinitionChecksum()
 	if err != nil {
 		return err
 	}
 
-	if !result.Valid() {
-		return fmt.Errorf("Schema validation failed: %s", result.Errors())
-	}
-
 	// Validation succeeded, so set the value in the parent struct
 	classicStateMachine.ImageDef = imageDefinition
+	classicStateMachine.imageDefinitionSHA256 = checksum
+	classicStateMachine.setOverridesSHA256 = classicStateMachine.setOverridesChecksum()
 
 	return nil
 }
@@ -210,23 +124,35 @@ func (stateMachine *StateMachine) calculateStates() error {
 
 	var rootfsCreationStates []stateFunc
 
+	// keep track of the image definition key that caused each state
+	// to be added, so it can be explained when printing the plan
+	classicStateMachine.stateReasons = make(map[string]string)
+	addStates := func(reason string, states ...stateFunc) {
+		for _, state := range states {
+			rootfsCreationStates = append(rootfsCreationStates, state)
+			classicStateMachine.stateReasons[state.name] = reason
+		}
+	}
+
 	if classicStateMachine.ImageDef.Gadget != nil {
+		gadgetTypeReason := fmt.Sprintf("gadget:type is \"%s\"",
+			classicStateMachine.ImageDef.Gadget.GadgetType)
 		// determine the states needed for preparing the gadget
 		switch classicStateMachine.ImageDef.Gadget.GadgetType {
 		case "git":
 			fallthrough
 		case "directory":
-			rootfsCreationStates = append(rootfsCreationStates,
+			addStates(gadgetTypeReason,
 				stateFunc{"build_gadget_tree", (*StateMachine).buildGadgetTree})
 			fallthrough
 		case "prebuilt":
-			rootfsCreationStates = append(rootfsCreationStates,
+			addStates(gadgetTypeReason,
 				stateFunc{"prepare_gadget_tree", (*StateMachine).prepareGadgetTree})
 			break
 		}
 
 		// Load the gadget yaml after the gadget is built
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates("gadget is set",
 			stateFunc{"load_gadget_yaml", (*StateMachine).loadGadgetYaml})
 	}
 
@@ -236,7 +162,7 @@ func (stateMachine *StateMachine) calculateStates() error {
 		return fmt.Errorf("Error checking struct tags for Artifacts: \"%s\"", err.Error())
 	}
 	if diskUsed != "" {
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates(fmt.Sprintf("artifacts:%s is set", diskUsed),
 			stateFunc{"verify_artifact_names", (*StateMachine).verifyArtifactNames})
 	}
 
@@ -246,7 +172,7 @@ func (stateMachine *StateMachine) calculateStates() error {
 	// options are mutually exclusive and have been validated
 	// by the schema already
 	if classicStateMachine.ImageDef.Rootfs.Tarball != nil {
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates("rootfs:tarball is set",
 			stateFunc{"extract_rootfs_tar", (*StateMachine).extractRootfsTar})
 		// if there are extra snaps or packages to install, these will have
 		// to be done as separate steps. To add one of these extra steps, add the
@@ -256,17 +182,22 @@ func (stateMachine *StateMachine) calculateStates() error {
 			extraStates := checkCustomizationSteps(classicStateMachine.ImageDef.Customization,
 				"extra_step_prebuilt_rootfs",
 			)
-			rootfsCreationStates = append(rootfsCreationStates, extraStates...)
+			addStates("customization adds extra PPAs, repositories, packages or snaps to the rootfs:tarball",
+				extraStates...)
 		}
 	} else if classicStateMachine.ImageDef.Rootfs.Seed != nil {
-		rootfsCreationStates = append(rootfsCreationStates, rootfsSeedStates...)
+		addStates("rootfs:seed is set", rootfsSeedStates...)
 		if classicStateMachine.ImageDef.Customization != nil {
 			if len(classicStateMachine.ImageDef.Customization.ExtraPPAs) > 0 {
-				rootfsCreationStates = append(rootfsCreationStates,
+				addStates("customization:extra-ppas is set",
 					stateFunc{"add_extra_ppas", (*StateMachine).addExtraPPAs})
 			}
+			if len(classicStateMachine.ImageDef.Customization.ExtraRepositories) > 0 {
+				addStates("customization:extra-repositories is set",
+					stateFunc{"add_extra_repositories", (*StateMachine).addExtraRepositories})
+			}
 		}
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates("rootfs:seed is set",
 			[]stateFunc{
 				{"install_packages", (*StateMachine).installPackages},
 				{"prepare_image", (*StateMachine).prepareClassicImage},
@@ -274,7 +205,7 @@ func (stateMachine *StateMachine) calculateStates() error {
 			}...,
 		)
 	} else {
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates("rootfs:archive-tasks is set",
 			stateFunc{"build_rootfs_from_tasks", (*StateMachine).buildRootfsFromTasks})
 	}
 
@@ -282,38 +213,65 @@ func (stateMachine *StateMachine) calculateStates() error {
 	//TODO: installer image customization... eventually.
 	if classicStateMachine.ImageDef.Customization != nil {
 		if classicStateMachine.ImageDef.Customization.CloudInit != nil {
-			rootfsCreationStates = append(rootfsCreationStates,
+			addStates("customization:cloud-init is set",
 				stateFunc{"customize_cloud_init", (*StateMachine).customizeCloudInit})
 		}
 		if len(classicStateMachine.ImageDef.Customization.Fstab) > 0 {
-			rootfsCreationStates = append(rootfsCreationStates,
+			addStates("customization:fstab is set",
 				stateFunc{"customize_fstab", (*StateMachine).customizeFstab})
 		}
 		if classicStateMachine.ImageDef.Customization.Manual != nil {
-			rootfsCreationStates = append(rootfsCreationStates,
+			addStates("customization:manual is set",
 				stateFunc{"perform_manual_customization", (*StateMachine).manualCustomization})
 		}
 	}
 
+	// the extra PPAs are only added by add_extra_ppas, which is not run when the
+	// rootfs is built from archive-tasks, so there is nothing to clean up then
+	addedPPAs := false
+	for _, state := range rootfsCreationStates {
+		addedPPAs = addedPPAs || state.name == "add_extra_ppas"
+	}
+	if addedPPAs {
+		// the PPAs that are not kept enabled are only used to install packages and
+		// snaps, and they need the credentials of the private PPAs to be removed
+		for _, ppa := range classicStateMachine.ImageDef.Customization.ExtraPPAs {
+			if !ppaKeepEnabled(ppa) {
+				addStates("customization:extra-ppas has PPAs with keep-enabled: false",
+					stateFunc{"disable_extra_ppas", (*StateMachine).disableExtraPPAs})
+				break
+			}
+		}
+
+		// the credentials of the private PPAs must not end up in the image
+		for _, ppa := range classicStateMachine.ImageDef.Customization.ExtraPPAs {
+			if isPrivatePPA(ppa) {
+				addStates("customization:extra-ppas has private PPAs",
+					stateFunc{"remove_ppa_credentials", (*StateMachine).removePPACredentials})
+				break
+			}
+		}
+	}
+
 	// The rootfs is laid out in a staging area, now populate it in the correct location
-	rootfsCreationStates = append(rootfsCreationStates,
+	addStates("always run",
 		stateFunc{"populate_rootfs_contents", (*StateMachine).populateClassicRootfsContents})
 
 	// if the --disk-info flag was used on the command line place it in the correct
 	// location in the rootfs
 	if stateMachine.commonFlags.DiskInfo != "" {
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates("--disk-info was passed",
 			stateFunc{"generate_disk_info", (*StateMachine).generateDiskInfo})
 	}
 
 	if classicStateMachine.ImageDef.Gadget != nil {
 		// Add the "always there" states that populate partitions, build the disk, etc.
 		// This includes the no-op "finish" state to signify successful setup
-		rootfsCreationStates = append(rootfsCreationStates, imageCreationStates...)
+		addStates("gadget is set", imageCreationStates...)
 
 		// only run makeDisk if there is an artifact to make
 		if classicStateMachine.ImageDef.Artifacts.Img != nil {
-			rootfsCreationStates = append(rootfsCreationStates,
+			addStates("artifacts:img is set",
 				stateFunc{"make_disk", (*StateMachine).makeDisk},
 				stateFunc{"update_bootloader", (*StateMachine).updateBootloader},
 			)
@@ -330,53 +288,54 @@ func (stateMachine *StateMachine) calculateStates() error {
 			}
 		}
 		if !found {
-			rootfsCreationStates = append(rootfsCreationStates,
+			addStates("artifacts:qcow2 is set",
 				stateFunc{"make_disk", (*StateMachine).makeDisk},
 				stateFunc{"update_bootloader", (*StateMachine).updateBootloader},
 			)
 		}
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates("artifacts:qcow2 is set",
 			stateFunc{"make_qcow2_image", (*StateMachine).makeQcow2Img})
 	}
 
 	// only run generatePackageManifest if there is a manifest in the image definition
 	if classicStateMachine.ImageDef.Artifacts.Manifest != nil {
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates("artifacts:manifest is set",
 			stateFunc{"generate_manifest", (*StateMachine).generatePackageManifest})
 	}
 
 	// only run generateFilelist if there is a filelist in the image definition
 	if classicStateMachine.ImageDef.Artifacts.Filelist != nil {
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates("artifacts:filelist is set",
 			stateFunc{"generate_filelist", (*StateMachine).generateFilelist})
 	}
 
 	// only run generateRootfsTarball if there is a rootfs-tarball in the image definition
 	if classicStateMachine.ImageDef.Artifacts.RootfsTar != nil {
-		rootfsCreationStates = append(rootfsCreationStates,
+		addStates("artifacts:rootfs-tarball is set",
 			stateFunc{"generate_rootfs_tarball", (*StateMachine).generateRootfsTarball})
 	}
 
 	// add the no-op "finish" state
-	rootfsCreationStates = append(rootfsCreationStates,
-		stateFunc{"finish", (*StateMachine).finish})
+	addStates("always run", stateFunc{"finish", (*StateMachine).finish})
 
 	// Append the newly calculated states to the slice of funcs in the parent struct
 	stateMachine.states = append(stateMachine.states, rootfsCreationStates...)
 
-	// if the --debug option was passed, print the calculated states
-	if stateMachine.commonFlags.Debug {
-		fmt.Println("\nThe calculated states are as follows:")
-		for i, state := range stateMachine.states {
-			fmt.Printf("[%d] %s\n", i, state.name)
-		}
-		fmt.Println("\n\nContinuing")
+	// the calculated states are printed if the --debug option was passed
+	stateMachine.debugf("\nThe calculated states are as follows:\n")
+	for i, state := range stateMachine.states {
+		stateMachine.debugf("[%d] %s\n", i, state.name)
 	}
+	stateMachine.debugf("\n\nContinuing\n")
 
 	if err := stateMachine.validateUntilThru(); err != nil {
 		return err
 	}
 
+	if err := stateMachine.validateStateTimeouts(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -396,24 +355,50 @@ func (stateMachine *StateMachine) buildGadgetTree() error {
 	var sourceDir string
 	switch classicStateMachine.ImageDef.Gadget.GadgetType {
 	case "git":
-		err := cloneGitRepo(classicStateMachine.ImageDef, gadgetDir)
+		if classicStateMachine.sharedDir == "" {
+			err := cloneGitRepo(classicStateMachine.ImageDef, gadgetDir)
+			if err != nil {
+				return fmt.Errorf("Error cloning gadget repository: \"%s\"", err.Error())
+			}
+			sourceDir = gadgetDir
+			break
+		}
+		// the builds for several architectures clone the repository once,
+		// and build the gadget tree in a copy of it
+		sharedSource := classicStateMachine.sharedGadgetSource()
+		if _, err := os.Stat(sharedSource); err != nil {
+			if err := osMkdirAll(classicStateMachine.sharedDir, 0755); err != nil {
+				return fmt.Errorf("Error creating the shared directory: %s", err.Error())
+			}
+			err := cloneGitRepo(classicStateMachine.ImageDef, sharedSource)
+			if err != nil {
+				osRemoveAll(sharedSource)
+				return fmt.Errorf("Error cloning gadget repository: \"%s\"", err.Error())
+			}
+		}
+		files, err := osReadDir(sharedSource)
 		if err != nil {
-			return fmt.Errorf("Error cloning gadget repository: \"%s\"", err.Error())
+			return fmt.Errorf("Error reading gadget tree: %s", err.Error())
+		}
+		for _, gadgetFile := range files {
+			srcFile := filepath.Join(sharedSource, gadgetFile.Name())
+			if err := osutilCopySpecialFile(srcFile, gadgetDir); err != nil {
+				return fmt.Errorf("Error copying gadget source: %s", err.Error())
+			}
 		}
 		sourceDir = gadgetDir
 		break
 	case "directory":
-		// no need to check error here as the validity of the URL
-		// has been confirmed by the schema validation
-		sourceURL, _ := url.Parse(classicStateMachine.ImageDef.Gadget.GadgetURL)
+		// the URL was made absolute when parsing the image definition
+		sourcePath := strings.TrimPrefix(classicStateMachine.ImageDef.Gadget.GadgetURL, fileURIPrefix)
 
 		// copy the source tree to the workdir
-		files, err := osReadDir(sourceURL.Path)
+		files, err := osReadDir(sourcePath)
 		if err != nil {
 			return fmt.Errorf("Error reading gadget tree: %s", err.Error())
 		}
 		for _, gadgetFile := range files {
-			srcFile := filepath.Join(sourceURL.Path, gadgetFile.Name())
+			srcFile := filepath.Join(sourcePath, gadgetFile.Name())
 			if err := osutilCopySpecialFile(srcFile, gadgetDir); err != nil {
 				return fmt.Errorf("Error copying gadget source: %s", err.Error())
 			}
@@ -440,9 +425,8 @@ func (stateMachine *StateMachine) buildGadgetTree() error {
 	makeCmd.Env = append(makeCmd.Env, os.Environ()...)
 	makeCmd.Dir = sourceDir
 
-	makeOutput := helper.SetCommandOutput(makeCmd, classicStateMachine.commonFlags.Debug)
-
-	if err := makeCmd.Run(); err != nil {
+	makeOutput, err := stateMachine.runCmd(makeCmd)
+	if err != nil {
 		return fmt.Errorf("Error running \"make\" in gadget source. "+
 			"Error is \"%s\". Full output below:\n%s",
 			err.Error(), makeOutput.String())
@@ -463,10 +447,8 @@ func (stateMachine *StateMachine) prepareGadgetTree() error {
 	// recursively copy the gadget tree to unpack/gadget
 	var gadgetTree string
 	if classicStateMachine.ImageDef.Gadget.GadgetType == "prebuilt" {
-		gadgetTree = strings.TrimPrefix(classicStateMachine.ImageDef.Gadget.GadgetURL, "file://")
-		if !filepath.IsAbs(gadgetTree) {
-			gadgetTree, _ = filepath.Abs(gadgetTree)
-		}
+		// the URL was made absolute when parsing the image definition
+		gadgetTree = strings.TrimPrefix(classicStateMachine.ImageDef.Gadget.GadgetURL, fileURIPrefix)
 	} else {
 		gadgetTree = filepath.Join(classicStateMachine.tempDirs.scratch, "gadget")
 	}
@@ -501,9 +483,8 @@ func (stateMachine *StateMachine) createChroot() error {
 		classicStateMachine.Packages,
 	)
 
-	debootstrapOutput := helper.SetCommandOutput(debootstrapCmd, classicStateMachine.commonFlags.Debug)
-
-	if err := debootstrapCmd.Run(); err != nil {
+	debootstrapOutput, err := stateMachine.runCmd(debootstrapCmd)
+	if err != nil {
 		return fmt.Errorf("Error running debootstrap command \"%s\". Error is \"%s\". Output is: \n%s",
 			debootstrapCmd.String(), err.Error(), debootstrapOutput.String())
 	}
@@ -550,6 +531,12 @@ func (stateMachine *StateMachine) addExtraPPAs() error {
 		ppaIO.Write([]byte(ppaFileContents))
 		ppaIO.Close()
 
+		if isPrivatePPA(ppa) {
+			if err := stateMachine.writePPACredentials(ppa, classicStateMachine.ImageDef.Series); err != nil {
+				return err
+			}
+		}
+
 		// Import keys either from the specified fingerprint or via the Launchpad API
 		/* TODO: this is the logic for deb822 sources. When other projects
 		(software-properties, ubuntu-release-upgrader) are ready, update
@@ -559,7 +546,7 @@ func (stateMachine *StateMachine) addExtraPPAs() error {
 		keyFileName := strings.Replace(ppaFileName, ".list", ".gpg", 1)
 		keyFilePath := filepath.Join(classicStateMachine.tempDirs.chroot,
 			"etc", "apt", "trusted.gpg.d", keyFileName)
-		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, stateMachine.commonFlags.Debug)
+		err = stateMachine.importPPAKeys(ppa, tmpGPGDir, keyFilePath)
 		if err != nil {
 			return fmt.Errorf("Error retrieving signing key for ppa \"%s\": %s",
 				ppa.PPAName, err.Error())
@@ -572,6 +559,143 @@ func (stateMachine *StateMachine) addExtraPPAs() error {
 	return nil
 }
 
+// addExtraRepositories adds the extra repositories to the apt sources of the chroot
+// as deb822 .sources files. Each of them is signed by its own keyring, copied from
+// the host to /etc/apt/keyrings, so neither Launchpad nor a keyserver is needed
+func (stateMachine *StateMachine) addExtraRepositories() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	sourcesListD := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d")
+	keyringsDir := filepath.Join(stateMachine.tempDirs.chroot, repositoryKeyringsDir)
+	for _, dir := range []string{sourcesListD, keyringsDir} {
+		if err := osMkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Failed to create %s: %s", dir, err.Error())
+		}
+	}
+
+	for _, repository := range classicStateMachine.ImageDef.Customization.ExtraRepositories {
+		sourcesFileName, keyringPath, sourcesFileContents := createRepositoryInfo(repository,
+			classicStateMachine.ImageDef.Series)
+
+		keyring, err := osReadFile(repository.SignedBy)
+		if err != nil {
+			return fmt.Errorf("Error reading the keyring of repository \"%s\": %s",
+				repository.Name, err.Error())
+		}
+		keyringFile := filepath.Join(stateMachine.tempDirs.chroot, keyringPath)
+		if err := osWriteFile(keyringFile, keyring, 0644); err != nil {
+			return fmt.Errorf("Error writing the keyring of repository \"%s\": %s",
+				repository.Name, err.Error())
+		}
+
+		sourcesFile := filepath.Join(sourcesListD, sourcesFileName)
+		if err := osWriteFile(sourcesFile, []byte(sourcesFileContents), 0644); err != nil {
+			return fmt.Errorf("Error creating %s: %s", sourcesFile, err.Error())
+		}
+	}
+	return nil
+}
+
+// writePPACredentials writes the credentials of a private PPA to /etc/apt/auth.conf.d
+// in the chroot, where apt finds them, rather than to the URL of the PPA. They are
+// removed before the rootfs is populated, see removePPACredentials
+func (stateMachine *StateMachine) writePPACredentials(ppa *imagedefinition.PPA, series string) error {
+	login, password, err := ppaCredentials(ppa)
+	if err != nil {
+		return err
+	}
+	stateMachine.buildLogger().AddSecret(password)
+
+	authConfD := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "auth.conf.d")
+	if err := osMkdirAll(authConfD, 0755); err != nil {
+		return fmt.Errorf("Failed to create apt auth.conf.d: %s", err.Error())
+	}
+	authFileName, authFileContents := createPPAAuthInfo(ppa, series, login, password)
+	authFile := filepath.Join(authConfD, authFileName)
+	if err := osWriteFile(authFile, []byte(authFileContents), 0600); err != nil {
+		return fmt.Errorf("Error writing the credentials of ppa \"%s\": %s", ppa.PPAName, err.Error())
+	}
+	return nil
+}
+
+// removePPACredentials removes the credentials of the private PPAs from the chroot
+// once the rootfs is customized, so they are not part of the image nor of any of
+// the artifacts generated from the rootfs
+func (stateMachine *StateMachine) removePPACredentials() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	authConfD := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "auth.conf.d")
+	for _, ppa := range classicStateMachine.ImageDef.Customization.ExtraPPAs {
+		if !isPrivatePPA(ppa) {
+			continue
+		}
+		authFileName, _ := createPPAAuthInfo(ppa, classicStateMachine.ImageDef.Series, "", "")
+		authFile := filepath.Join(authConfD, authFileName)
+		if err := osRemove(authFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing the credentials of ppa \"%s\": %s", ppa.PPAName, err.Error())
+		}
+	}
+	return nil
+}
+
+// disableExtraPPAs removes the sources.list.d files and the signing keys of the
+// PPAs with keep-enabled set to false once the packages and snaps are installed,
+// so they are only used to build the rootfs. apt is then updated in the chroot,
+// which also drops the package lists of these PPAs, to make sure the remaining
+// sources still work in the image
+func (stateMachine *StateMachine) disableExtraPPAs() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	aptDir := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt")
+	for _, ppa := range classicStateMachine.ImageDef.Customization.ExtraPPAs {
+		if ppaKeepEnabled(ppa) {
+			continue
+		}
+		ppaFileName, _ := createPPAInfo(ppa, classicStateMachine.ImageDef.Series)
+		keyFileName := strings.Replace(ppaFileName, ".list", ".gpg", 1)
+		for _, ppaFile := range []string{
+			filepath.Join(aptDir, "sources.list.d", ppaFileName),
+			filepath.Join(aptDir, "trusted.gpg.d", keyFileName),
+		} {
+			if err := osRemove(ppaFile); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Error removing %s of ppa \"%s\": %s", ppaFile, ppa.PPAName, err.Error())
+			}
+		}
+	}
+
+	// copy /etc/resolv.conf from the host system into the chroot
+	err := helperBackupAndCopyResolvConf(stateMachine.tempDirs.chroot)
+	if err != nil {
+		return fmt.Errorf("Error setting up /etc/resolv.conf in the chroot: \"%s\"", err.Error())
+	}
+
+	mountTargets, err := stateMachine.mountChroot(stateMachine.tempDirs.chroot)
+	if err != nil {
+		return err
+	}
+
+	updateCmd := generateAptUpdateCmd(stateMachine.tempDirs.chroot)
+	cmdOutput, err := stateMachine.runCmd(updateCmd)
+	if err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			updateCmd.String(), err.Error(), cmdOutput.String())
+	}
+
+	if err := stateMachine.unmountAll(mountTargets); err != nil {
+		return err
+	}
+
+	// apt doesn't need to reach the archive anymore, restore the resolv.conf of the chroot
+	err = helperRestoreResolvConf(stateMachine.tempDirs.chroot)
+	if err != nil {
+		return fmt.Errorf("Error restoring /etc/resolv.conf in the chroot: \"%s\"", err.Error())
+	}
+	return nil
+}
+
 // Install packages in the chroot environment. This is accomplished by
 // running commands to do the following:
 // 1. Mount /proc /sys /dev and /run in the chroot
@@ -602,73 +726,25 @@ func (stateMachine *StateMachine) installPackages() error {
 			classicStateMachine.ImageDef.Kernel)
 	}
 
-	// Slice used to store all the commands that need to be run
-	// to install the packages
-	var installPackagesCmds []*exec.Cmd
-
 	// mount some necessary partitions from the host in the chroot
-	type mountPoint struct {
-		dest     string
-		fromHost bool
-	}
-	mountPoints := []mountPoint{
-		{
-			dest:     "/dev",
-			fromHost: true,
-		},
-		{
-			dest:     "/proc",
-			fromHost: true,
-		},
-		{
-			dest:     "/sys",
-			fromHost: true,
-		},
-		{
-			dest:     "/run",
-			fromHost: false,
-		},
-	}
-
-	var umounts []*exec.Cmd
-	for _, mount := range mountPoints {
-		var mountCmd, umountCmd *exec.Cmd
-		if mount.fromHost {
-			mountCmd, umountCmd = mountFromHost(stateMachine.tempDirs.chroot, mount.dest)
-		} else {
-			var err error
-			mountCmd, umountCmd, err = mountTempFS(stateMachine.tempDirs.chroot,
-				stateMachine.tempDirs.scratch,
-				mount.dest,
-			)
-			if err != nil {
-				return fmt.Errorf("Error mounting temporary directory for mountpoint \"%s\": \"%s\"",
-					mount.dest,
-					err.Error(),
-				)
-
-			}
-		}
-		defer umountCmd.Run()
-		installPackagesCmds = append(installPackagesCmds, mountCmd)
-		umounts = append(umounts, umountCmd)
+	mountTargets, err := stateMachine.mountChroot(stateMachine.tempDirs.chroot)
+	if err != nil {
+		return err
 	}
 
-	// generate the apt update/install commands and append them to the slice of commands
+	// generate the apt update/install commands and run them
 	aptCmds := generateAptCmds(stateMachine.tempDirs.chroot, classicStateMachine.Packages)
-	installPackagesCmds = append(installPackagesCmds, aptCmds...)
-	installPackagesCmds = append(installPackagesCmds, umounts...) // don't forget to unmount!
-
-	for _, cmd := range installPackagesCmds {
-		cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
-		err := cmd.Run()
+	for _, cmd := range aptCmds {
+		cmdOutput, err := stateMachine.runCmd(cmd)
 		if err != nil {
 			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
 				cmd.String(), err.Error(), cmdOutput.String())
 		}
 	}
 
-	return nil
+	// don't forget to unmount! If anything failed above, the
+	// state machine tears down the mounts instead
+	return stateMachine.unmountAll(mountTargets)
 }
 
 // Verify artifact names have volumes listed for multi-volume gadgets and set
@@ -778,13 +854,9 @@ func (stateMachine *StateMachine) extractRootfsTar() error {
 		return fmt.Errorf("Failed to create chroot directory: %s", err.Error())
 	}
 
-	// convert the URL to a file path
-	// no need to check error here as the validity of the URL
-	// has been confirmed by the schema validation
-	tarPath := strings.TrimPrefix(classicStateMachine.ImageDef.Rootfs.Tarball.TarballURL, "file://")
-	if !filepath.IsAbs(tarPath) {
-		tarPath, _ = filepath.Abs(tarPath)
-	}
+	// convert the URL to a file path. It was made absolute
+	// when parsing the image definition
+	tarPath := strings.TrimPrefix(classicStateMachine.ImageDef.Rootfs.Tarball.TarballURL, fileURIPrefix)
 
 	// if the sha256 sum of the tarball is provided, make sure it matches
 	if classicStateMachine.ImageDef.Rootfs.Tarball.SHA256sum != "" {
@@ -800,8 +872,13 @@ func (stateMachine *StateMachine) extractRootfsTar() error {
 	}
 
 	// now extract the archive
-	return helper.ExtractTarArchive(tarPath, stateMachine.tempDirs.chroot,
-		stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug)
+	return stateMachine.timeCommand([]string{"tar", "--extract", "--file", tarPath},
+		func() error {
+			commandLog := stateMachine.commandLog()
+			defer commandLog.Flush()
+			return helper.ExtractTarArchive(stateMachine.buildContext(), tarPath, stateMachine.tempDirs.chroot,
+				stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug, stateMachine.commandLogs(commandLog)...)
+		})
 }
 
 // germinate runs the germinate binary and parses the output to create
@@ -820,9 +897,8 @@ func (stateMachine *StateMachine) germinate() error {
 	germinateCmd := generateGerminateCmd(classicStateMachine.ImageDef)
 	germinateCmd.Dir = germinateDir
 
-	germinateOutput := helper.SetCommandOutput(germinateCmd, classicStateMachine.commonFlags.Debug)
-
-	if err := germinateCmd.Run(); err != nil {
+	germinateOutput, err := stateMachine.runCmd(germinateCmd)
+	if err != nil {
 		return fmt.Errorf("Error running germinate command \"%s\". Error is \"%s\". Output is: \n%s",
 			germinateCmd.String(), err.Error(), germinateOutput.String())
 	}
@@ -967,33 +1043,33 @@ func (stateMachine *StateMachine) manualCustomization() error {
 
 	type customizationHandler struct {
 		inputData   interface{}
-		handlerFunc func(interface{}, string, bool) error
+		handlerFunc func(interface{}, string) error
 	}
 	customizationHandlers := []customizationHandler{
 		{
 			inputData:   classicStateMachine.ImageDef.Customization.Manual.CopyFile,
-			handlerFunc: manualCopyFile,
+			handlerFunc: stateMachine.manualCopyFile,
 		},
 		{
 			inputData:   classicStateMachine.ImageDef.Customization.Manual.Execute,
-			handlerFunc: manualExecute,
+			handlerFunc: stateMachine.manualExecute,
 		},
 		{
 			inputData:   classicStateMachine.ImageDef.Customization.Manual.TouchFile,
-			handlerFunc: manualTouchFile,
+			handlerFunc: stateMachine.manualTouchFile,
 		},
 		{
 			inputData:   classicStateMachine.ImageDef.Customization.Manual.AddGroup,
-			handlerFunc: manualAddGroup,
+			handlerFunc: stateMachine.manualAddGroup,
 		},
 		{
 			inputData:   classicStateMachine.ImageDef.Customization.Manual.AddUser,
-			handlerFunc: manualAddUser,
+			handlerFunc: stateMachine.manualAddUser,
 		},
 	}
 
 	for _, customization := range customizationHandlers {
-		err := customization.handlerFunc(customization.inputData, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
+		err := customization.handlerFunc(customization.inputData, stateMachine.tempDirs.chroot)
 		if err != nil {
 			return err
 		}
@@ -1062,8 +1138,7 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 	for _, seededSnap := range imageOpts.Snaps {
 		snapStore := store.New(nil, nil)
 		snapSpec := store.SnapSpec{Name: seededSnap}
-		snapContext := context.TODO() //context can be empty, just not nil
-		snapInfo, err := snapStore.SnapInfo(snapContext, snapSpec, nil)
+		snapInfo, err := snapStore.SnapInfo(stateMachine.buildContext(), snapSpec, nil)
 		if err != nil {
 			return fmt.Errorf("Error getting info for snap %s: \"%s\"",
 				seededSnap, err.Error())
@@ -1085,7 +1160,7 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 				imageOpts.SnapChannels[extraSnap.SnapName] = extraSnap.Channel
 			}
 			if extraSnap.SnapRevision != 0 {
-				fmt.Printf("WARNING: revision %d for snap %s may not be the latest available version!\n",
+				stateMachine.warningf("revision %d for snap %s may not be the latest available version!\n",
 					extraSnap.SnapRevision,
 					extraSnap.SnapName,
 				)
@@ -1095,8 +1170,8 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 	}
 
 	imageOpts.Classic = true
-	imageOpts.ModelFile = strings.TrimPrefix(classicStateMachine.ImageDef.ModelAssertion, "file://")
-	imageOpts.Architecture = classicStateMachine.ImageDef.Architecture
+	imageOpts.ModelFile = strings.TrimPrefix(classicStateMachine.ImageDef.ModelAssertion, fileURIPrefix)
+	imageOpts.Architecture = classicStateMachine.ImageDef.Architecture.String()
 	imageOpts.PrepareDir = classicStateMachine.tempDirs.chroot
 	imageOpts.Customizations = *new(image.Customizations)
 	imageOpts.Customizations.Validation = stateMachine.commonFlags.Validation
@@ -1120,9 +1195,6 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 
 // preseedClassicImage preseeds the snaps that have already been staged in the chroot
 func (stateMachine *StateMachine) preseedClassicImage() error {
-	var classicStateMachine *ClassicStateMachine
-	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
-
 	// create some directories in the chroot that we will bind mount from the
 	// host system. This is required or else the call to snap-preseed will fail
 	mkdirs := []string{
@@ -1136,36 +1208,26 @@ func (stateMachine *StateMachine) preseedClassicImage() error {
 		}
 	}
 
-	// slice to hold all of the commands to do the preseeding
-	var preseedCmds []*exec.Cmd
-
-	// set up the mount commands
+	// set up the mounts
 	mountPoints := []string{"/dev", "/proc", "/sys/kernel/security", "/sys/fs/cgroup"}
-	var mountCmds []*exec.Cmd
-	var umountCmds []*exec.Cmd
+	var mountTargets []string
 	for _, mountPoint := range mountPoints {
-		var mountCmd, umountCmd *exec.Cmd
-		mountCmd, umountCmd = mountFromHost(stateMachine.tempDirs.chroot, mountPoint)
-		defer umountCmd.Run()
-		mountCmds = append(mountCmds, mountCmd)
-		umountCmds = append(umountCmds, umountCmd)
+		mountCmd, _ := mountFromHost(stateMachine.tempDirs.chroot, mountPoint)
+		target := filepath.Join(stateMachine.tempDirs.chroot, mountPoint)
+		if err := stateMachine.mount(mountCmd, target); err != nil {
+			return err
+		}
+		mountTargets = append(mountTargets, target)
 	}
 
-	// assemble the commands in the correct order: mount, preseed, unmount
-	preseedCmds = append(preseedCmds, mountCmds...)
-	preseedCmds = append(preseedCmds,
-		exec.Command("/usr/lib/snapd/snap-preseed", stateMachine.tempDirs.chroot),
-	)
-	preseedCmds = append(preseedCmds, umountCmds...)
-	for _, cmd := range preseedCmds {
-		cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
-		err := cmd.Run()
-		if err != nil {
-			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
-				cmd.String(), err.Error(), cmdOutput.String())
-		}
+	preseedCmd := exec.Command("/usr/lib/snapd/snap-preseed", stateMachine.tempDirs.chroot)
+	cmdOutput, err := stateMachine.runCmd(preseedCmd)
+	if err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			preseedCmd.String(), err.Error(), cmdOutput.String())
 	}
-	return nil
+
+	return stateMachine.unmountAll(mountTargets)
 }
 
 // populateClassicRootfsContents copies over the staged rootfs
@@ -1223,9 +1285,8 @@ func (stateMachine *StateMachine) generatePackageManifest() error {
 	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir,
 		classicStateMachine.ImageDef.Artifacts.Manifest.ManifestName)
 	cmd := execCommand("chroot", stateMachine.tempDirs.rootfs, "dpkg-query", "-W", "--showformat=${Package} ${Version}\n")
-	cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
-
-	if err := cmd.Run(); err != nil {
+	cmdOutput, err := stateMachine.runCmd(cmd)
+	if err != nil {
 		return fmt.Errorf("Error generating package manifest with command \"%s\". "+
 			"Error is \"%s\". Full output below:\n%s",
 			cmd.String(), err.Error(), cmdOutput.String())
@@ -1238,6 +1299,7 @@ func (stateMachine *StateMachine) generatePackageManifest() error {
 	}
 	defer manifest.Close()
 	manifest.Write(cmdOutput.Bytes())
+	stateMachine.artifactWritten(ArtifactManifest, outputPath)
 	return nil
 }
 
@@ -1250,9 +1312,8 @@ func (stateMachine *StateMachine) generateFilelist() error {
 	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir,
 		classicStateMachine.ImageDef.Artifacts.Filelist.FilelistName)
 	cmd := execCommand("chroot", stateMachine.tempDirs.rootfs, "find", "-xdev")
-	cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
-
-	if err := cmd.Run(); err != nil {
+	cmdOutput, err := stateMachine.runCmd(cmd)
+	if err != nil {
 		return fmt.Errorf("Error generating file list with command \"%s\". "+
 			"Error is \"%s\". Full output below:\n%s",
 			cmd.String(), err.Error(), cmdOutput.String())
@@ -1265,6 +1326,7 @@ func (stateMachine *StateMachine) generateFilelist() error {
 	}
 	defer filelist.Close()
 	filelist.Write(cmdOutput.Bytes())
+	stateMachine.artifactWritten(ArtifactFilelist, outputPath)
 	return nil
 }
 
@@ -1277,9 +1339,19 @@ func (stateMachine *StateMachine) generateRootfsTarball() error {
 	rootfsSrc := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
 	rootfsDst := filepath.Join(stateMachine.commonFlags.OutputDir,
 		classicStateMachine.ImageDef.Artifacts.RootfsTar.RootfsTarName)
-	return helper.CreateTarArchive(rootfsSrc, rootfsDst,
-		classicStateMachine.ImageDef.Artifacts.RootfsTar.Compression,
-		stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug)
+	err := stateMachine.timeCommand([]string{"tar", "--create", "--file", rootfsDst},
+		func() error {
+			commandLog := stateMachine.commandLog()
+			defer commandLog.Flush()
+			return helper.CreateTarArchive(stateMachine.buildContext(), rootfsSrc, rootfsDst,
+				classicStateMachine.ImageDef.Artifacts.RootfsTar.Compression,
+				stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug, stateMachine.commandLogs(commandLog)...)
+		})
+	if err != nil {
+		return err
+	}
+	stateMachine.artifactWritten(ArtifactRootfsTarball, rootfsDst)
+	return nil
 }
 
 // makeQcow2Img converts raw .img artifacts into qcow2 artifacts
@@ -1290,22 +1362,14 @@ func (stateMachine *StateMachine) makeQcow2Img() error {
 	for _, qcow2 := range *classicStateMachine.ImageDef.Artifacts.Qcow2 {
 		backingFile := filepath.Join(stateMachine.commonFlags.OutputDir, stateMachine.VolumeNames[qcow2.Qcow2Volume])
 		resultingFile := filepath.Join(stateMachine.commonFlags.OutputDir, qcow2.Qcow2Name)
-		qemuImgCommand := execCommand("qemu-img",
-			"convert",
-			"-c",
-			"-O",
-			"qcow2",
-			"-o",
-			"compat=0.10",
-			backingFile,
-			resultingFile,
-		)
-		qemuOutput := helper.SetCommandOutput(qemuImgCommand, classicStateMachine.commonFlags.Debug)
-		if err := qemuImgCommand.Run(); err != nil {
+		qemuImgCommand := generateQemuImgCmd(backingFile, resultingFile)
+		qemuOutput, err := stateMachine.runCmd(qemuImgCommand)
+		if err != nil {
 			return fmt.Errorf("Error creating qcow2 artifact with command \"%s\". "+
 				"Error is \"%s\". Full output below:\n%s",
 				qemuImgCommand.String(), err.Error(), qemuOutput.String())
 		}
+		stateMachine.artifactWritten(ArtifactQcow2, resultingFile)
 	}
 	return nil
 }
@@ -1328,7 +1392,7 @@ func (stateMachine *StateMachine) updateBootloader() error {
 						return err
 					}
 				default:
-					fmt.Printf("WARNING: updating bootloader %s not yet supported\n",
+					stateMachine.warningf("updating bootloader %s not yet supported\n",
 						volume.Bootloader,
 					)
 				}
@@ -3,6 +3,7 @@
 package statemachine
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -45,7 +46,7 @@ func TestClassicSetup(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 
-		err := stateMachine.Setup()
+		err := stateMachine.Setup(context.Background())
 		asserter.AssertErrNil(err, true)
 	})
 }
@@ -71,6 +72,7 @@ func TestYAMLSchemaParsing(t *testing.T) {
 		{"not_valid_yaml", "test_invalid_yaml.yaml", false, "yaml: unmarshal errors"},
 		{"missing_yaml_fields", "test_missing_name.yaml", false, "Key \"name\" is required in struct \"ImageDefinition\", but is not in the YAML file!"},
 		{"private_ppa_without_fingerprint", "test_private_ppa_without_fingerprint.yaml", false, "Fingerprint is required for private PPAs"},
+		{"conflicting_ppa_auth", "test_conflicting_ppa_auth.yaml", false, "Only one of auth, auth-file and auth-env can be given for a private PPA"},
 		{"invalid_paths_in_manual_copy", "test_invalid_paths_in_manual_copy.yaml", false, "needs to be an absolute path (../../malicious)"},
 		{"invalid_paths_in_manual_copy_bug", "test_invalid_paths_in_manual_copy.yaml", false, "needs to be an absolute path (/../../malicious)"},
 		{"invalid_paths_in_manual_touch_file", "test_invalid_paths_in_manual_touch_file.yaml", false, "needs to be an absolute path (../../malicious)"},
@@ -99,6 +101,34 @@ func TestYAMLSchemaParsing(t *testing.T) {
 	}
 }
 
+// TestParseImageDefinitionUnknownKeys ensures that unknown keys in the image definition
+// fail the build, unless --allow-unknown-keys is used in which case they are warned about
+func TestParseImageDefinitionUnknownKeys(t *testing.T) {
+	t.Run("test_parse_image_definition_unknown_keys", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		logger := &testLogger{}
+		stateMachine.SetLogger(logger)
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"test_unknown_keys.yaml")
+		err := stateMachine.parseImageDefinition()
+		asserter.AssertErrContains(err, "unknown key \"extra-package\", did you mean \"extra-packages\"?")
+		asserter.AssertErrContains(err, "use --allow-unknown-keys to ignore them")
+
+		stateMachine.Opts.AllowUnknownKeys = true
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+		if !strings.Contains(strings.Join(logger.messages, ""), "ignoring unknown keys") {
+			t.Errorf("Expected a warning about the unknown keys but got %q", logger.messages)
+		}
+	})
+}
+
 // TestFailedParseImageDefinition mocks function calls to test
 // failure cases in the parseImageDefinition state
 func TestFailedParseImageDefinition(t *testing.T) {
@@ -171,6 +201,9 @@ func TestCalculateStates(t *testing.T) {
 		{"build_rootfs_from_tasks", "test_rootfs_tasks.yaml", []string{"build_rootfs_from_tasks"}},
 		{"customization_states", "test_customization.yaml", []string{"customize_cloud_init", "perform_manual_customization"}},
 		{"qcow2", "test_qcow2.yaml", []string{"make_disk", "make_qcow2_image"}},
+		{"private_ppa", "test_amd64.yaml", []string{"add_extra_ppas", "remove_ppa_credentials"}},
+		{"disable_extra_ppas", "test_disable_extra_ppas.yaml", []string{"add_extra_ppas", "install_extra_packages", "disable_extra_ppas"}},
+		{"extra_repositories", "test_extra_repositories.yaml", []string{"add_extra_repositories", "install_extra_packages"}},
 	}
 	for _, tc := range testCases {
 		t.Run("test_calcluate_states_"+tc.name, func(t *testing.T) {
@@ -246,6 +279,42 @@ func TestFailedCalculateStates(t *testing.T) {
 	})
 }
 
+// TestCalculateStatesArchiveTasksExtraPPAs ensures that the extra PPAs are not
+// disabled nor their credentials removed when add_extra_ppas does not run
+func TestCalculateStatesArchiveTasksExtraPPAs(t *testing.T) {
+	t.Run("test_calculate_states_archive_tasks_extra_ppas", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		keepEnabled := false
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Rootfs: &imagedefinition.Rootfs{
+				ArchiveTasks: []string{"test"},
+			},
+			Customization: &imagedefinition.Customization{
+				ExtraPPAs: []*imagedefinition.PPA{
+					{
+						PPAName:     "canonical-foundations/ubuntu-image-private-test",
+						Auth:        "testuser:testpass",
+						KeepEnabled: &keepEnabled,
+					},
+				},
+			},
+			Artifacts: &imagedefinition.Artifact{},
+		}
+
+		err := stateMachine.calculateStates()
+		asserter.AssertErrNil(err, true)
+		for _, state := range stateMachine.states {
+			switch state.name {
+			case "add_extra_ppas", "disable_extra_ppas", "remove_ppa_credentials":
+				t.Errorf("Expected state %s not to be scheduled without add_extra_ppas", state.name)
+			}
+		}
+	})
+}
+
 // TestPrintStates ensures the states are printed to stdout when the --debug flag is set
 func TestPrintStates(t *testing.T) {
 	t.Run("test_print_states", func(t *testing.T) {
@@ -317,7 +386,7 @@ func TestFailedValidateInputClassic(t *testing.T) {
 		stateMachine.stateMachineFlags.Until = "until-test"
 		stateMachine.stateMachineFlags.Thru = "thru-test"
 
-		err := stateMachine.Setup()
+		err := stateMachine.Setup(context.Background())
 		asserter.AssertErrContains(err, "cannot specify both --until and --thru")
 		os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 	})
@@ -336,12 +405,141 @@ func TestFailedReadMetadataClassic(t *testing.T) {
 		stateMachine.stateMachineFlags.Resume = true
 		stateMachine.stateMachineFlags.WorkDir = testDir
 
-		err := stateMachine.Setup()
+		err := stateMachine.Setup(context.Background())
 		asserter.AssertErrContains(err, "error reading metadata file")
 		os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 	})
 }
 
+// TestClassicResume runs a partial classic state machine and ensures that a resumed
+// state machine restores the image definition and the calculated states
+func TestClassicResume(t *testing.T) {
+	t.Run("test_classic_resume", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var partialStateMachine ClassicStateMachine
+		partialStateMachine.commonFlags, partialStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		partialStateMachine.stateMachineFlags.WorkDir = workDir
+		partialStateMachine.stateMachineFlags.Until = "build_gadget_tree"
+		partialStateMachine.Args.ImageDefinition = filepath.Join("testdata",
+			"image_definitions", "test_prebuilt_gadget.yaml")
+
+		err = partialStateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		err = partialStateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		err = partialStateMachine.Teardown(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		// resume without giving the image definition again
+		var resumeStateMachine ClassicStateMachine
+		resumeStateMachine.commonFlags, resumeStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		resumeStateMachine.stateMachineFlags.WorkDir = workDir
+		resumeStateMachine.stateMachineFlags.Resume = true
+
+		err = resumeStateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		if resumeStateMachine.StepsTaken != partialStateMachine.StepsTaken {
+			t.Errorf("Expected %d steps taken, but got %d",
+				partialStateMachine.StepsTaken, resumeStateMachine.StepsTaken)
+		}
+		if !reflect.DeepEqual(resumeStateMachine.stateNames(), partialStateMachine.stateNames()) {
+			t.Errorf("Expected states %v, but got %v",
+				partialStateMachine.stateNames(), resumeStateMachine.stateNames())
+		}
+		if !reflect.DeepEqual(resumeStateMachine.ImageDef, partialStateMachine.ImageDef) {
+			t.Errorf("Expected image definition %+v, but got %+v",
+				partialStateMachine.ImageDef, resumeStateMachine.ImageDef)
+		}
+		if resumeStateMachine.tempDirs.chroot != filepath.Join(workDir, "chroot") {
+			t.Errorf("Expected chroot dir %s, but got %s",
+				filepath.Join(workDir, "chroot"), resumeStateMachine.tempDirs.chroot)
+		}
+		if resumeStateMachine.commonFlags.OutputDir != workDir {
+			t.Errorf("Expected output dir %s, but got %s",
+				workDir, resumeStateMachine.commonFlags.OutputDir)
+		}
+	})
+}
+
+// TestFailedClassicResume tests failures when resuming a partial classic state machine
+func TestFailedClassicResume(t *testing.T) {
+	t.Run("test_failed_classic_resume", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		// work on a copy of the image definition so it can be modified
+		imageDefBytes, err := os.ReadFile(filepath.Join("testdata",
+			"image_definitions", "test_prebuilt_gadget.yaml"))
+		asserter.AssertErrNil(err, true)
+		// the gadget tree is relative to the original image definition
+		gadgetTree, err := filepath.Abs(filepath.Join("testdata", "gadget_tree"))
+		asserter.AssertErrNil(err, true)
+		imageDefBytes = bytes.ReplaceAll(imageDefBytes, []byte("../gadget_tree"), []byte(gadgetTree))
+		imageDefPath := filepath.Join(workDir, "image_definition.yaml")
+		err = os.WriteFile(imageDefPath, imageDefBytes, 0644)
+		asserter.AssertErrNil(err, true)
+
+		var partialStateMachine ClassicStateMachine
+		partialStateMachine.commonFlags, partialStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		partialStateMachine.stateMachineFlags.WorkDir = workDir
+		partialStateMachine.stateMachineFlags.Thru = "calculate_states"
+		partialStateMachine.Args.ImageDefinition = imageDefPath
+
+		err = partialStateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		err = partialStateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		err = partialStateMachine.Teardown(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		// resuming with other --set overrides is refused
+		var overriddenStateMachine ClassicStateMachine
+		overriddenStateMachine.commonFlags, overriddenStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		overriddenStateMachine.stateMachineFlags.WorkDir = workDir
+		overriddenStateMachine.stateMachineFlags.Resume = true
+		overriddenStateMachine.Opts.Set = []string{"revision=3"}
+
+		err = overriddenStateMachine.Setup(context.Background())
+		asserter.AssertErrContains(err, "the --set overrides differ from the ones the partial build was started with")
+
+		// modify the image definition and make sure resuming is refused
+		err = os.WriteFile(imageDefPath, append(imageDefBytes, []byte("\n# modified\n")...), 0644)
+		asserter.AssertErrNil(err, true)
+
+		var resumeStateMachine ClassicStateMachine
+		resumeStateMachine.commonFlags, resumeStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		resumeStateMachine.stateMachineFlags.WorkDir = workDir
+		resumeStateMachine.stateMachineFlags.Resume = true
+
+		err = resumeStateMachine.Setup(context.Background())
+		asserter.AssertErrContains(err, "has changed since the partial build was started")
+
+		// now remove the image definition entirely
+		err = os.Remove(imageDefPath)
+		asserter.AssertErrNil(err, true)
+
+		err = resumeStateMachine.Setup(context.Background())
+		asserter.AssertErrContains(err, "Error reading image definition file")
+	})
+}
+
 // TestPrepareGadgetTree runs prepareGadgetTree() and ensures the gadget_tree files
 // are placed in the correct locations
 func TestPrepareGadgetTree(t *testing.T) {
@@ -354,7 +552,7 @@ func TestPrepareGadgetTree(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget:       &imagedefinition.Gadget{},
 		}
@@ -394,7 +592,7 @@ func TestPrepareGadgetTreePrebuilt(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget: &imagedefinition.Gadget{
 				GadgetType: "prebuilt",
@@ -428,7 +626,7 @@ func TestFailedPrepareGadgetTree(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget:       &imagedefinition.Gadget{},
 		}
@@ -798,7 +996,7 @@ func TestVerifyArtifactNames(t *testing.T) {
 
 			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadgetYAML)
 			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture: getHostArch(),
+				Architecture: imagedefinition.Architectures{getHostArch()},
 				Series:       getHostSuite(),
 				Rootfs: &imagedefinition.Rootfs{
 					Archive: "ubuntu",
@@ -926,7 +1124,7 @@ func TestExtractRootfsTar(t *testing.T) {
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.parent = &stateMachine
 			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture: getHostArch(),
+				Architecture: imagedefinition.Architectures{getHostArch()},
 				Series:       getHostSuite(),
 				Rootfs: &imagedefinition.Rootfs{
 					Tarball: &imagedefinition.Tarball{
@@ -966,7 +1164,7 @@ func TestFailedExtractRootfsTar(t *testing.T) {
 		absTarPath, err := filepath.Abs(filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar"))
 		asserter.AssertErrNil(err, true)
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Tarball: &imagedefinition.Tarball{
@@ -1238,7 +1436,7 @@ func TestManualCustomization(t *testing.T) {
 		stateMachine.parent = &stateMachine
 
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Archive: "ubuntu",
@@ -1380,7 +1578,7 @@ func TestPrepareClassicImage(t *testing.T) {
 		stateMachine.Snaps = []string{"lxd"}
 		stateMachine.commonFlags.Channel = "stable"
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Customization: &imagedefinition.Customization{
 				ExtraSnaps: []*imagedefinition.Snap{
 					{
@@ -1446,7 +1644,7 @@ func TestClassicSnapRevisions(t *testing.T) {
 		stateMachine.Snaps = []string{"lxd"}
 		stateMachine.commonFlags.Channel = "stable"
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Customization: &imagedefinition.Customization{
 				ExtraSnaps: []*imagedefinition.Snap{
 					{
@@ -1513,7 +1711,7 @@ func TestFailedPrepareClassicImage(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Customization: &imagedefinition.Customization{
 				ExtraSnaps: []*imagedefinition.Snap{},
 			},
@@ -1586,7 +1784,7 @@ func TestPopulateClassicRootfsContents(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Archive: "ubuntu",
@@ -1630,7 +1828,7 @@ func TestFailedPopulateClassicRootfsContents(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Archive: "ubuntu",
@@ -1711,7 +1909,7 @@ func TestGeneratePackageManifest(t *testing.T) {
 		stateMachine.parent = &stateMachine
 		stateMachine.commonFlags.OutputDir = outputDir
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Archive: "ubuntu",
@@ -1752,7 +1950,7 @@ func TestFailedGeneratePackageManifest(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Archive: "ubuntu",
@@ -1820,7 +2018,7 @@ func TestGenerateFilelist(t *testing.T) {
 		stateMachine.parent = &stateMachine
 		stateMachine.commonFlags.OutputDir = outputDir
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Archive: "ubuntu",
@@ -1867,7 +2065,7 @@ func TestFailedGenerateFilelist(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Archive: "ubuntu",
@@ -1937,10 +2135,10 @@ func TestSuccessfulClassicRun(t *testing.T) {
 		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
 			"test_amd64.yaml")
 
-		err = stateMachine.Setup()
+		err = stateMachine.Setup(context.Background())
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Run()
+		err = stateMachine.Run(context.Background())
 		asserter.AssertErrNil(err, true)
 
 		// make sure packages were successfully installed from public and private ppas
@@ -2094,7 +2292,7 @@ func TestSuccessfulClassicRun(t *testing.T) {
 			}
 		}
 
-		err = stateMachine.Teardown()
+		err = stateMachine.Teardown(context.Background())
 		asserter.AssertErrNil(err, true)
 
 		os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
@@ -2206,7 +2404,7 @@ func TestGerminate(t *testing.T) {
 			hostArch := getHostArch()
 			hostSuite := getHostSuite()
 			imageDef := imagedefinition.ImageDefinition{
-				Architecture: hostArch,
+				Architecture: imagedefinition.Architectures{hostArch},
 				Series:       hostSuite,
 				Rootfs: &imagedefinition.Rootfs{
 					Flavor: tc.flavor,
@@ -2278,7 +2476,7 @@ func TestFailedGerminate(t *testing.T) {
 		hostArch := getHostArch()
 		hostSuite := getHostSuite()
 		imageDef := imagedefinition.ImageDefinition{
-			Architecture: hostArch,
+			Architecture: imagedefinition.Architectures{hostArch},
 			Series:       hostSuite,
 			Rootfs: &imagedefinition.Rootfs{
 				Flavor: "ubuntu",
@@ -2345,7 +2543,7 @@ func TestBuildGadgetTreeGit(t *testing.T) {
 		sourcePath := filepath.Join(wd, "testdata", "gadget_source")
 		sourcePath = "file://" + sourcePath
 		imageDef := imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget: &imagedefinition.Gadget{
 				GadgetURL:  sourcePath,
@@ -2360,7 +2558,7 @@ func TestBuildGadgetTreeGit(t *testing.T) {
 
 		// test the git method
 		imageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget: &imagedefinition.Gadget{
 				GadgetURL:    "https://github.com/snapcore/pc-amd64-gadget",
@@ -2398,7 +2596,7 @@ func TestBuildGadgetTreeDirectory(t *testing.T) {
 		sourcePath := filepath.Join(wd, "testdata", "gadget_source")
 		sourcePath = "file://" + sourcePath
 		imageDef := imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget: &imagedefinition.Gadget{
 				GadgetURL:  sourcePath,
@@ -2428,7 +2626,7 @@ func TestBuildGadgetTreeDirectory(t *testing.T) {
 
 		// now set up the image definition to build from this directory
 		imageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget: &imagedefinition.Gadget{
 				GadgetURL:  fmt.Sprintf("file://%s", gadgetDir),
@@ -2489,7 +2687,7 @@ func TestGadgetGadgetTargets(t *testing.T) {
 			wd, _ := os.Getwd()
 			gadgetSrc := filepath.Join(wd, "testdata", "gadget_source")
 			imageDef := imagedefinition.ImageDefinition{
-				Architecture: getHostArch(),
+				Architecture: imagedefinition.Architectures{getHostArch()},
 				Series:       getHostSuite(),
 				Gadget: &imagedefinition.Gadget{
 					GadgetURL:    fmt.Sprintf("file://%s", gadgetSrc),
@@ -2548,7 +2746,7 @@ func TestFailedBuildGadgetTree(t *testing.T) {
 
 		// try to clone a repo that doesn't exist
 		imageDef := imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget: &imagedefinition.Gadget{
 				GadgetURL:  "http://fakerepo.git",
@@ -2562,7 +2760,7 @@ func TestFailedBuildGadgetTree(t *testing.T) {
 
 		// try to copy a file that doesn't exist
 		imageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget: &imagedefinition.Gadget{
 				GadgetURL:  "file:///fake/file/that/does/not/exist",
@@ -2576,7 +2774,7 @@ func TestFailedBuildGadgetTree(t *testing.T) {
 
 		// mock osutil.CopySpecialFile and run with /tmp as the gadget source
 		imageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget: &imagedefinition.Gadget{
 				GadgetURL:  "file:///tmp",
@@ -2604,7 +2802,7 @@ func TestFailedBuildGadgetTree(t *testing.T) {
 		sourcePath := filepath.Join(wd, "testdata", "gadget_source")
 		sourcePath = "file://" + sourcePath
 		imageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget: &imagedefinition.Gadget{
 				GadgetURL:  sourcePath,
@@ -2632,7 +2830,7 @@ func TestCreateChroot(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Pocket: "proposed",
@@ -2693,7 +2891,7 @@ func TestFailedCreateChroot(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs:       &imagedefinition.Rootfs{},
 		}
@@ -2736,7 +2934,7 @@ func TestFailedInstallPackages(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs:       &imagedefinition.Rootfs{},
 			Customization: &imagedefinition.Customization{
@@ -2794,6 +2992,228 @@ func TestFailedInstallPackages(t *testing.T) {
 	})
 }
 
+// TestKeepEnabledDefault ensures that keep-enabled defaults to true for the
+// PPAs that don't set it, and that setting it to false is not overridden
+func TestKeepEnabledDefault(t *testing.T) {
+	t.Run("test_keep_enabled_default", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"test_disable_extra_ppas.yaml")
+		err := stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+
+		for i, expected := range []bool{false, true} {
+			ppa := stateMachine.ImageDef.Customization.ExtraPPAs[i]
+			if ppa.KeepEnabled == nil || *ppa.KeepEnabled != expected {
+				t.Errorf("Expected keep-enabled to be %t for ppa \"%s\" but got %v",
+					expected, ppa.PPAName, ppa.KeepEnabled)
+			}
+		}
+	})
+}
+
+// TestDisableExtraPPAs ensures that the sources.list.d files and the keys of the
+// PPAs that are not kept enabled are removed from the chroot, and tests the
+// failure cases of the apt update that follows
+func TestDisableExtraPPAs(t *testing.T) {
+	t.Run("test_disable_extra_ppas", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		keepEnabled := false
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Architecture: imagedefinition.Architectures{getHostArch()},
+			Series:       "jammy",
+			Rootfs:       &imagedefinition.Rootfs{},
+			Customization: &imagedefinition.Customization{
+				ExtraPPAs: []*imagedefinition.PPA{
+					{PPAName: "build/only", KeepEnabled: &keepEnabled},
+					{PPAName: "kept/ppa"},
+				},
+			},
+		}
+
+		// need workdir set up for this
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		aptDir := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt")
+		var removedFiles, keptFiles []string
+		for _, name := range []string{"build-ubuntu-only-jammy", "kept-ubuntu-ppa-jammy"} {
+			ppaFiles := []string{
+				filepath.Join(aptDir, "sources.list.d", name+".list"),
+				filepath.Join(aptDir, "trusted.gpg.d", name+".gpg"),
+			}
+			for _, ppaFile := range ppaFiles {
+				err = os.MkdirAll(filepath.Dir(ppaFile), 0755)
+				asserter.AssertErrNil(err, true)
+				err = os.WriteFile(ppaFile, []byte("test"), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+			if removedFiles == nil {
+				removedFiles = ppaFiles
+			} else {
+				keptFiles = ppaFiles
+			}
+		}
+		_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf"))
+		asserter.AssertErrNil(err, true)
+
+		// mock os.MkdirTemp to cause a failure in mountTempFS, once the files
+		// are removed
+		osMkdirTemp = mockMkdirTemp
+		defer func() {
+			osMkdirTemp = os.MkdirTemp
+		}()
+		err = stateMachine.disableExtraPPAs()
+		asserter.AssertErrContains(err, "Error mounting temporary directory for mountpoint")
+		osMkdirTemp = os.MkdirTemp
+		err = stateMachine.teardownMounts()
+		asserter.AssertErrNil(err, true)
+		for _, removedFile := range removedFiles {
+			if _, err := os.Stat(removedFile); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be removed from the chroot", removedFile)
+			}
+		}
+		for _, keptFile := range keptFiles {
+			if _, err := os.Stat(keptFile); err != nil {
+				t.Errorf("Expected %s to be kept in the chroot but got %s", keptFile, err.Error())
+			}
+		}
+
+		// Setup the exec.Command mock
+		testCaseName = "TestFailedDisableExtraPPAs"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		err = stateMachine.disableExtraPPAs()
+		asserter.AssertErrContains(err, "Error running command")
+		execCommand = exec.Command
+
+		// delete the backed up resolv.conf to trigger another backup
+		err = os.Remove(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf.tmp"))
+		asserter.AssertErrNil(err, true)
+		// mock helper.BackupAndCopyResolvConf
+		helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConf
+		defer func() {
+			helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+		}()
+		err = stateMachine.disableExtraPPAs()
+		asserter.AssertErrContains(err, "Error setting up /etc/resolv.conf")
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+
+		// the resolv.conf of the chroot is restored once apt is updated
+		testCaseName = "TestDisableExtraPPAs"
+		execCommand = fakeExecCommand
+		err = stateMachine.disableExtraPPAs()
+		asserter.AssertErrNil(err, true)
+		backupResolvConf := filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf.tmp")
+		if _, err := os.Stat(backupResolvConf); !os.IsNotExist(err) {
+			t.Errorf("Expected the resolv.conf of the chroot to be restored")
+		}
+
+		// mock helper.RestoreResolvConf
+		helperRestoreResolvConf = mockRestoreResolvConf
+		defer func() {
+			helperRestoreResolvConf = helper.RestoreResolvConf
+		}()
+		err = stateMachine.disableExtraPPAs()
+		asserter.AssertErrContains(err, "Error restoring /etc/resolv.conf")
+		helperRestoreResolvConf = helper.RestoreResolvConf
+		execCommand = exec.Command
+
+		// mock os.Remove
+		osRemove = mockRemove
+		defer func() {
+			osRemove = os.Remove
+		}()
+		err = stateMachine.disableExtraPPAs()
+		asserter.AssertErrContains(err, "Error removing")
+		osRemove = os.Remove
+	})
+}
+
+// TestAddExtraRepositories ensures that the extra repositories are written as
+// deb822 sources files in the chroot, with their keyrings, and tests the failure
+// cases of addExtraRepositories
+func TestAddExtraRepositories(t *testing.T) {
+	t.Run("test_add_extra_repositories", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"test_extra_repositories.yaml")
+		err := stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+
+		// need workdir set up for this
+		err = stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		err = stateMachine.addExtraRepositories()
+		asserter.AssertErrNil(err, true)
+
+		sourcesBytes, err := os.ReadFile(filepath.Join(stateMachine.tempDirs.chroot,
+			"etc", "apt", "sources.list.d", "internal.sources"))
+		asserter.AssertErrNil(err, true)
+		expectedSources := "Types: deb\nURIs: http://apt.example.com/internal\nSuites: stable\n" +
+			"Components: main\nArchitectures: amd64\nSigned-By: /etc/apt/keyrings/internal.gpg\n"
+		if string(sourcesBytes) != expectedSources {
+			t.Errorf("Expected the sources of the repository \"%s\" but got \"%s\"", expectedSources, sourcesBytes)
+		}
+		keyringBytes, err := os.ReadFile(filepath.Join(stateMachine.tempDirs.chroot,
+			"etc", "apt", "keyrings", "internal.gpg"))
+		asserter.AssertErrNil(err, true)
+		if string(keyringBytes) != "test keyring\n" {
+			t.Errorf("Expected the keyring of the repository to be copied to the chroot but got \"%s\"", keyringBytes)
+		}
+
+		// mock os.MkdirAll
+		osMkdirAll = mockMkdirAll
+		defer func() {
+			osMkdirAll = os.MkdirAll
+		}()
+		err = stateMachine.addExtraRepositories()
+		asserter.AssertErrContains(err, "Failed to create")
+		osMkdirAll = os.MkdirAll
+
+		// mock os.ReadFile
+		osReadFile = mockReadFile
+		defer func() {
+			osReadFile = os.ReadFile
+		}()
+		err = stateMachine.addExtraRepositories()
+		asserter.AssertErrContains(err, "Error reading the keyring of repository")
+		osReadFile = os.ReadFile
+
+		// mock os.WriteFile
+		osWriteFile = mockWriteFile
+		defer func() {
+			osWriteFile = os.WriteFile
+		}()
+		err = stateMachine.addExtraRepositories()
+		asserter.AssertErrContains(err, "Error writing the keyring of repository")
+		osWriteFile = os.WriteFile
+	})
+}
+
 // TestFailedAddExtraPPAs tests failure cases in addExtraPPAs
 func TestFailedAddExtraPPAs(t *testing.T) {
 	t.Run("test_failed_add_extra_ppas", func(t *testing.T) {
@@ -2812,7 +3232,7 @@ func TestFailedAddExtraPPAs(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs:       &imagedefinition.Rootfs{},
 			Customization: &imagedefinition.Customization{
@@ -2943,7 +3363,7 @@ LABEL=system-boot	/boot/firmware	vfat	defaults	0	1`,
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.parent = &stateMachine
 			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture: getHostArch(),
+				Architecture: imagedefinition.Architectures{getHostArch()},
 				Series:       getHostSuite(),
 				Rootfs:       &imagedefinition.Rootfs{},
 				Customization: &imagedefinition.Customization{
@@ -2991,7 +3411,7 @@ func TestFailedCustomizeFstab(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs:       &imagedefinition.Rootfs{},
 			Customization: &imagedefinition.Customization{
@@ -3063,7 +3483,7 @@ func TestGenerateRootfsTarball(t *testing.T) {
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.parent = &stateMachine
 			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture: getHostArch(),
+				Architecture: imagedefinition.Architectures{getHostArch()},
 				Series:       getHostSuite(),
 				Rootfs:       &imagedefinition.Rootfs{},
 				Artifacts: &imagedefinition.Artifact{
@@ -3129,10 +3549,10 @@ func TestTarXattrs(t *testing.T) {
 
 		// now run the helper tar creation and extraction functions
 		tarPath := filepath.Join(testDir, "test-xattrs.tar")
-		err = helper.CreateTarArchive(testDir, tarPath, "uncompressed", false, false)
+		err = helper.CreateTarArchive(context.Background(), testDir, tarPath, "uncompressed", false, false)
 		asserter.AssertErrNil(err, true)
 
-		err = helper.ExtractTarArchive(tarPath, extractDir, false, false)
+		err = helper.ExtractTarArchive(context.Background(), tarPath, extractDir, false, false)
 		asserter.AssertErrNil(err, true)
 
 		// now read the extracted file's extended attributes
@@ -3162,7 +3582,7 @@ func TestPingXattrs(t *testing.T) {
 		//defer os.RemoveAll(testDir)
 		testFile := filepath.Join("testdata", "rootfs_tarballs", "ping.tar")
 
-		err = helper.ExtractTarArchive(testFile, testDir, true, true)
+		err = helper.ExtractTarArchive(context.Background(), testFile, testDir, true, true)
 		asserter.AssertErrNil(err, true)
 
 		binPing := filepath.Join(testDir, "bin", "ping")
@@ -3185,7 +3605,7 @@ func TestFailedMakeQcow2Img(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Artifacts: &imagedefinition.Artifact{
 				Qcow2: &[]imagedefinition.Qcow2{
@@ -3222,7 +3642,7 @@ func TestPreseedResetChroot(t *testing.T) {
 		stateMachine.Snaps = []string{"lxd"}
 		stateMachine.commonFlags.Channel = "stable"
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Archive: "ubuntu",
@@ -3271,7 +3691,7 @@ func TestPreseedResetChroot(t *testing.T) {
 
 		// set up a new set of snaps to be installed
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Customization: &imagedefinition.Customization{
 				ExtraSnaps: []*imagedefinition.Snap{
 					{
@@ -3309,7 +3729,7 @@ func TestFailedUpdateBootloader(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget:       &imagedefinition.Gadget{},
 		}
@@ -3367,7 +3787,7 @@ func TestUnsupportedBootloader(t *testing.T) {
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Gadget:       &imagedefinition.Gadget{},
 		}
@@ -3428,7 +3848,7 @@ func TestPreseedClassicImage(t *testing.T) {
 		stateMachine.Snaps = []string{"lxd"}
 		stateMachine.commonFlags.Channel = "stable"
 		stateMachine.ImageDef = imagedefinition.ImageDefinition{
-			Architecture: getHostArch(),
+			Architecture: imagedefinition.Architectures{getHostArch()},
 			Series:       getHostSuite(),
 			Rootfs: &imagedefinition.Rootfs{
 				Archive: "ubuntu",
@@ -3521,3 +3941,101 @@ func TestFailedPreseedClassicImage(t *testing.T) {
 		os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 	})
 }
+
+// TestClassicPlan ensures --plan and --dry-run print the calculated states with the
+// reason they were added, and the commands they would run, without building anything
+func TestClassicPlan(t *testing.T) {
+	testCases := []struct {
+		name            string
+		dryRun          bool
+		expectedOutput  []string
+		forbiddenOutput []string
+	}{
+		{
+			"plan",
+			false,
+			[]string{
+				"[0] parse_image_definition (always run)\n",
+				"build_gadget_tree (gadget:type is \"git\")\n",
+				"germinate (rootfs:seed is set)\n",
+				"customize_fstab (customization:fstab is set)\n",
+				"make_disk (artifacts:img is set)\n",
+				"generate_manifest (artifacts:manifest is set)\n",
+			},
+			[]string{"debootstrap"},
+		},
+		{
+			"dry_run",
+			true,
+			[]string{
+				"germinate (rootfs:seed is set)\n    germinate ",
+				"\n    debootstrap ",
+				"\n    chroot " + filepath.Join("<workdir>", "chroot") + " apt install",
+				"pi-bluetooth ubuntu-raspi-settings linux-image-raspi\n",
+				"\n    dd if=" + filepath.Join("<workdir>", "volumes", "<volume>", "part<N>.img"),
+				"raspi.img",
+			},
+			[]string{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run("test_classic_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			saveCWD := helper.SaveCWD()
+			defer saveCWD()
+
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.OutputDir = "/tmp"
+			stateMachine.Opts.Plan = !tc.dryRun
+			stateMachine.Opts.DryRun = tc.dryRun
+			stateMachine.Args.ImageDefinition = filepath.Join("testdata",
+				"image_definitions", "test_raspi.yaml")
+
+			err := stateMachine.Setup(context.Background())
+			asserter.AssertErrNil(err, true)
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.Run(context.Background())
+			restoreStdout()
+			asserter.AssertErrNil(err, true)
+			readStdout, err := io.ReadAll(stdout)
+			asserter.AssertErrNil(err, true)
+
+			for _, expected := range tc.expectedOutput {
+				if !strings.Contains(string(readStdout), expected) {
+					t.Errorf("Expected \"%s\" in output \"%s\"", expected, string(readStdout))
+				}
+			}
+			for _, forbidden := range tc.forbiddenOutput {
+				if strings.Contains(string(readStdout), forbidden) {
+					t.Errorf("Did not expect \"%s\" in output \"%s\"", forbidden, string(readStdout))
+				}
+			}
+
+			err = stateMachine.Teardown(context.Background())
+			asserter.AssertErrNil(err, true)
+			if _, err := os.Stat(stateMachine.tempDirs.chroot); !os.IsNotExist(err) {
+				t.Errorf("Expected nothing to be created in plan mode")
+			}
+		})
+	}
+}
+
+// TestFailedClassicPlan ensures --plan can't be combined with partial builds
+func TestFailedClassicPlan(t *testing.T) {
+	t.Run("test_failed_classic_plan", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.Until = "germinate"
+		stateMachine.Opts.Plan = true
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata",
+			"image_definitions", "test_raspi.yaml")
+
+		err := stateMachine.Setup(context.Background())
+		asserter.AssertErrContains(err, "cannot be used with --resume, --until or --thru")
+	})
+}
@@ -32,6 +32,14 @@ func (stateMachine *StateMachine) makeTemporaryDirectories() error {
 		}
 	}
 
+	// make sure no other build uses the same workdir
+	if err := stateMachine.lock(); err != nil {
+		return err
+	}
+	if err := stateMachine.openBuildLog(); err != nil {
+		return err
+	}
+
 	stateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
 	stateMachine.tempDirs.unpack = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "unpack")
 	stateMachine.tempDirs.volumes = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "volumes")
@@ -64,6 +72,9 @@ func (stateMachine *StateMachine) determineOutputDirectory() error {
 			return fmt.Errorf("Error creating OutputDir: %s", err.Error())
 		}
 	}
+	if classicStateMachine, isClassic := stateMachine.parent.(*ClassicStateMachine); isClassic {
+		return classicStateMachine.writeResolvedImageDefinition()
+	}
 	return nil
 }
 
@@ -394,6 +405,7 @@ func (stateMachine *StateMachine) makeDisk() error {
 			if err := writeOffsetValues(volume, imgName, uint64(stateMachine.SectorSize), uint64(imgSize)); err != nil {
 				return err
 			}
+			stateMachine.artifactWritten(ArtifactImg, imgName)
 		}
 	}
 	return nil
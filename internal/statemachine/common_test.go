@@ -112,6 +112,7 @@ func TestDetermineOutputDirectory(t *testing.T) {
 			// need workdir set up for this
 			err := stateMachine.makeTemporaryDirectories()
 			asserter.AssertErrNil(err, true)
+			defer stateMachine.unlock()
 
 			err = stateMachine.determineOutputDirectory()
 			asserter.AssertErrNil(err, true)
@@ -0,0 +1,175 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// stateDependencies lists the states that only read the finished rootfs or disk
+// images to produce an artifact, along with the states whose results they need.
+// Consecutive states listed here are run concurrently when --jobs is greater
+// than 1, as long as the states they depend on have already run
+var stateDependencies = map[string][]string{
+	"make_qcow2_image":        {"make_disk", "update_bootloader"},
+	"generate_manifest":       {"populate_rootfs_contents", "generate_disk_info"},
+	"generate_filelist":       {"populate_rootfs_contents", "generate_disk_info"},
+	"generate_rootfs_tarball": {"populate_rootfs_contents", "generate_disk_info"},
+}
+
+// jobs returns the maximum number of states that may run at the same time
+func (stateMachine *StateMachine) jobs() int {
+	if stateMachine.commonFlags.Jobs < 1 {
+		return 1
+	}
+	return stateMachine.commonFlags.Jobs
+}
+
+// validateJobs makes sure the value given with --jobs makes sense
+func (stateMachine *StateMachine) validateJobs() error {
+	if stateMachine.commonFlags.Jobs < 0 {
+		return fmt.Errorf("Invalid value %d given with --jobs, it cannot be negative",
+			stateMachine.commonFlags.Jobs)
+	}
+	return nil
+}
+
+// nextStates returns the states that run next. This is usually a single state,
+// but consecutive independent states are returned together so they can be run
+// concurrently when --jobs is greater than 1. The batch never extends past --until,
+// --thru or --only, so those keep their meaning. No states are returned once the --until
+// state is reached
+func (stateMachine *StateMachine) nextStates() []stateFunc {
+	start := stateMachine.StepsTaken
+	var batch []stateFunc
+	for i := start; i < len(stateMachine.states); i++ {
+		state := stateMachine.states[i]
+		if state.name == stateMachine.stateMachineFlags.Until {
+			break
+		}
+		independent := stateMachine.jobs() > 1 && stateMachine.isIndependent(state, start)
+		if len(batch) > 0 && !independent {
+			break
+		}
+		batch = append(batch, state)
+		if stateMachine.isLastState(state.name) || !independent {
+			break
+		}
+	}
+	return batch
+}
+
+// isIndependent returns whether a state can run concurrently with others, because all
+// the states it depends on are before the given index in the list of states
+func (stateMachine *StateMachine) isIndependent(state stateFunc, start int) bool {
+	dependencies, found := stateDependencies[state.name]
+	if !found {
+		return false
+	}
+	for _, dependency := range dependencies {
+		for i := start; i < len(stateMachine.states); i++ {
+			if stateMachine.states[i].name == dependency {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// deferredOutput holds the messages and events of a state that runs concurrently with
+// others, so they can be replayed in the order of the states once they all finished
+type deferredOutput struct {
+	entries []deferredEntry
+}
+
+// deferredEntry is either a message, a log message or an event
+type deferredEntry struct {
+	message string
+	event   *Event
+
+	// set for the log messages, see LeveledLogger
+	leveled bool
+	level   LogLevel
+	state   string
+}
+
+// Printf records a message of the state
+func (output *deferredOutput) Printf(format string, v ...interface{}) {
+	output.entries = append(output.entries, deferredEntry{message: fmt.Sprintf(format, v...)})
+}
+
+// Logf records a log message of the state. Whether it is printed is decided
+// when it is replayed
+func (output *deferredOutput) Logf(level LogLevel, state string, format string, v ...interface{}) {
+	output.entries = append(output.entries, deferredEntry{
+		message: fmt.Sprintf(format, v...),
+		leveled: true,
+		level:   level,
+		state:   state,
+	})
+}
+
+// addEvent records an event of the state
+func (output *deferredOutput) addEvent(event Event) {
+	output.entries = append(output.entries, deferredEntry{event: &event})
+}
+
+// replay sends the recorded messages and events to the outputs of the state machine
+func (output *deferredOutput) replay(stateMachine *StateMachine) {
+	for _, entry := range output.entries {
+		if entry.event != nil {
+			stateMachine.sendEvent(*entry.event)
+		} else if entry.leveled {
+			stateMachine.printLog(entry.level, entry.state, entry.message)
+		} else {
+			stateMachine.logger().Printf("%s", entry.message)
+		}
+	}
+}
+
+// runConcurrently runs independent states at the same time. Each state runs in a
+// copy of the state machine that records its output, which is replayed in the
+// order of the states once they all finished, so the output does not depend on
+// which state finished first. If several states fail, the error of the first
+// one in the list is returned
+func (stateMachine *StateMachine) runConcurrently(ctx context.Context, batch []stateFunc) error {
+	// make sure the copies share the mount registry
+	stateMachine.registry()
+
+	workers := make([]*StateMachine, len(batch))
+	errs := make([]error, len(batch))
+	semaphore := make(chan struct{}, stateMachine.jobs())
+	var waitGroup sync.WaitGroup
+	for i, state := range batch {
+		worker := *stateMachine
+		worker.StepsTaken = stateMachine.StepsTaken + i
+		worker.profile = buildProfile{Start: stateMachine.profile.Start}
+		worker.deferred = &deferredOutput{}
+		workers[i] = &worker
+
+		waitGroup.Add(1)
+		go func(i int, worker *StateMachine, state stateFunc) {
+			defer waitGroup.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			errs[i] = worker.runStep(ctx, state)
+		}(i, &worker, state)
+	}
+	waitGroup.Wait()
+
+	for _, worker := range workers {
+		worker.deferred.replay(stateMachine)
+		stateMachine.profile.States = append(stateMachine.profile.States, worker.profile.States...)
+		stateMachine.profile.Commands = append(stateMachine.profile.Commands, worker.profile.Commands...)
+	}
+	for i, err := range errs {
+		stateMachine.CurrentStep = batch[i].name
+		if err != nil {
+			// report the failure of the first state that failed, even if
+			// later states of the batch finished successfully
+			return err
+		}
+		stateMachine.StepsTaken++
+	}
+	return nil
+}
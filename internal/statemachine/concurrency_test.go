@@ -0,0 +1,178 @@
+// This test file tests running independent states concurrently
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// noopState returns a state with the given name that does nothing
+func noopState(name string) stateFunc {
+	return stateFunc{name, func(*StateMachine) error { return nil }}
+}
+
+// TestNextStates ensures that only consecutive independent states are
+// batched, and that batches stop at --until and --thru
+func TestNextStates(t *testing.T) {
+	states := []stateFunc{
+		noopState("populate_rootfs_contents"),
+		noopState("make_disk"),
+		noopState("update_bootloader"),
+		noopState("make_qcow2_image"),
+		noopState("generate_manifest"),
+		noopState("generate_filelist"),
+		noopState("finish"),
+	}
+	testCases := []struct {
+		name       string
+		stepsTaken int
+		jobs       int
+		until      string
+		thru       string
+		expected   []string
+	}{
+		{"single_state", 0, 4, "", "", []string{"populate_rootfs_contents"}},
+		{"batch", 3, 4, "", "", []string{"make_qcow2_image", "generate_manifest", "generate_filelist"}},
+		{"one_job", 3, 1, "", "", []string{"make_qcow2_image"}},
+		{"default_jobs", 3, 0, "", "", []string{"make_qcow2_image"}},
+		{"until", 3, 4, "generate_filelist", "", []string{"make_qcow2_image", "generate_manifest"}},
+		{"until_first", 3, 4, "make_qcow2_image", "", nil},
+		{"thru", 3, 4, "", "generate_manifest", []string{"make_qcow2_image", "generate_manifest"}},
+		{"dependency_not_run", 2, 4, "", "", []string{"update_bootloader"}},
+		{"last_state", 6, 4, "", "", []string{"finish"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_next_states_"+tc.name, func(t *testing.T) {
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Jobs = tc.jobs
+			stateMachine.stateMachineFlags.Until = tc.until
+			stateMachine.stateMachineFlags.Thru = tc.thru
+			stateMachine.states = states
+			stateMachine.StepsTaken = tc.stepsTaken
+
+			var names []string
+			for _, state := range stateMachine.nextStates() {
+				names = append(names, state.name)
+			}
+			if !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("Expected the states %v but got %v", tc.expected, names)
+			}
+		})
+	}
+}
+
+// TestRunConcurrently ensures that independent states run at the same time and that
+// their output is printed in the order of the states, whichever finished first
+func TestRunConcurrently(t *testing.T) {
+	t.Run("test_run_concurrently", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Jobs = 3
+		logger := &testLogger{}
+		stateMachine.SetLogger(logger)
+		var events []string
+		stateMachine.SetEventHandler(func(event Event) {
+			events = append(events, event.Type+" "+event.State)
+		})
+
+		slowState := func(name string) stateFunc {
+			return stateFunc{name, func(stateMachine *StateMachine) error {
+				time.Sleep(500 * time.Millisecond)
+				stateMachine.logger().Printf("done %s\n", name)
+				return nil
+			}}
+		}
+		stateMachine.states = []stateFunc{
+			noopState("populate_rootfs_contents"),
+			slowState("generate_manifest"),
+			slowState("generate_filelist"),
+			{"generate_rootfs_tarball", func(stateMachine *StateMachine) error {
+				stateMachine.logger().Printf("done generate_rootfs_tarball\n")
+				stateMachine.artifactWritten(ArtifactRootfsTarball, "rootfs.tar")
+				return nil
+			}},
+		}
+
+		start := time.Now()
+		err := stateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+		if time.Since(start) > 900*time.Millisecond {
+			t.Errorf("Expected the slow states to run concurrently, but the build took %s", time.Since(start))
+		}
+		if stateMachine.StepsTaken != 4 {
+			t.Errorf("Expected 4 steps to be taken but got %d", stateMachine.StepsTaken)
+		}
+
+		expectedOutput := "[0] populate_rootfs_contents\n" +
+			"[1] generate_manifest\ndone generate_manifest\n" +
+			"[2] generate_filelist\ndone generate_filelist\n" +
+			"[3] generate_rootfs_tarball\ndone generate_rootfs_tarball\n"
+		if output := strings.Join(logger.messages, ""); output != expectedOutput {
+			t.Errorf("Expected output:\n%s\nbut got:\n%s", expectedOutput, output)
+		}
+
+		expectedEvents := []string{
+			"state_started populate_rootfs_contents", "state_finished populate_rootfs_contents",
+			"state_started generate_manifest", "state_finished generate_manifest",
+			"state_started generate_filelist", "state_finished generate_filelist",
+			"state_started generate_rootfs_tarball", "artifact_written generate_rootfs_tarball",
+			"state_finished generate_rootfs_tarball",
+		}
+		if !reflect.DeepEqual(events, expectedEvents) {
+			t.Errorf("Expected events %v but got %v", expectedEvents, events)
+		}
+		if len(stateMachine.profile.States) != 4 {
+			t.Errorf("Expected the timings of 4 states but got %+v", stateMachine.profile.States)
+		}
+	})
+}
+
+// TestFailedRunConcurrently ensures that the error of the first failed state is
+// returned when several states that run concurrently fail
+func TestFailedRunConcurrently(t *testing.T) {
+	t.Run("test_failed_run_concurrently", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Jobs = 2
+		stateMachine.SetLogger(&testLogger{})
+		stateMachine.states = []stateFunc{
+			noopState("generate_manifest"),
+			{"generate_filelist", func(*StateMachine) error {
+				time.Sleep(200 * time.Millisecond)
+				return fmt.Errorf("Test Error filelist")
+			}},
+			{"generate_rootfs_tarball", func(*StateMachine) error {
+				return fmt.Errorf("Test Error tarball")
+			}},
+			noopState("finish"),
+		}
+
+		err := stateMachine.Run(context.Background())
+		asserter.AssertErrContains(err, "Test Error filelist")
+		if stateMachine.CurrentStep != "generate_filelist" || stateMachine.StepsTaken != 1 {
+			t.Errorf("Expected the build to stop in generate_filelist after 1 step, but it "+
+				"stopped in %s after %d steps", stateMachine.CurrentStep, stateMachine.StepsTaken)
+		}
+	})
+}
+
+// TestFailedValidateJobs tests a negative value of --jobs
+func TestFailedValidateJobs(t *testing.T) {
+	t.Run("test_failed_validate_jobs", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Jobs = -1
+		err := stateMachine.validateInput()
+		asserter.AssertErrContains(err, "Invalid value -1 given with --jobs")
+	})
+}
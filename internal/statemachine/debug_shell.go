@@ -0,0 +1,136 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+)
+
+// define some functions that can be mocked by test cases
+var osStdin = os.Stdin
+var stdinIsTerminal = func() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// debugShells are the shells that are looked for in the chroot or rootfs, in order
+var debugShells = []string{"/bin/bash", "/bin/sh"}
+
+// debugShellDir returns the directory to open a debug shell in and the shell to
+// run: the chroot of classic images if it was created, the rootfs otherwise
+func (stateMachine *StateMachine) debugShellDir() (string, string, error) {
+	for _, dir := range []string{stateMachine.tempDirs.chroot, stateMachine.tempDirs.rootfs} {
+		if dir == "" {
+			continue
+		}
+		for _, shell := range debugShells {
+			if _, err := os.Stat(filepath.Join(dir, shell)); err == nil {
+				return dir, shell, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("Error opening debug shell: no shell was found in %s or %s",
+		stateMachine.tempDirs.chroot, stateMachine.tempDirs.rootfs)
+}
+
+// debugShell opens an interactive shell in the chroot or rootfs, with the same
+// mounts and /etc/resolv.conf that install_packages uses, so the failure of a
+// state can be investigated. Everything is torn down when the shell exits
+func (stateMachine *StateMachine) debugShell() error {
+	shellDir, shell, err := stateMachine.debugShellDir()
+	if err != nil {
+		return err
+	}
+
+	// the resolv.conf of the host may already be in place, if the state that
+	// failed set it up. It is only restored if it was copied for the shell
+	_, err = os.Stat(filepath.Join(shellDir, "etc", "resolv.conf.tmp"))
+	restoreResolvConf := os.IsNotExist(err)
+	if err := helperBackupAndCopyResolvConf(shellDir); err != nil {
+		return fmt.Errorf("Error setting up /etc/resolv.conf in the chroot: \"%s\"", err.Error())
+	}
+
+	mountTargets, err := stateMachine.mountChroot(shellDir)
+	if err == nil {
+		stateMachine.logger().Printf("Opening a shell in %s, exit the shell to continue\n", shellDir)
+		shellCmd := execCommand("chroot", shellDir, shell)
+		// the Ubuntu bashrc shows debian_chroot in the prompt
+		shellCmd.Env = append(os.Environ(), "debian_chroot=ubuntu-image")
+		shellCmd.Stdin = osStdin
+		shellCmd.Stdout = os.Stdout
+		shellCmd.Stderr = os.Stderr
+		// the exit status of the shell is the one of the last command run in it,
+		// which is of no interest
+		if runErr := shellCmd.Run(); runErr != nil {
+			stateMachine.debugf("The debug shell exited with: %s\n", runErr.Error())
+		}
+	}
+
+	if unmountErr := stateMachine.unmountAll(mountTargets); unmountErr != nil && err == nil {
+		err = unmountErr
+	}
+	if restoreResolvConf {
+		if restoreErr := helperRestoreResolvConf(shellDir); restoreErr != nil && err == nil {
+			err = fmt.Errorf("Error restoring /etc/resolv.conf in the chroot: \"%s\"", restoreErr.Error())
+		}
+	}
+	return err
+}
+
+// debugShellOnFailure opens a debug shell after a state failed, if it was
+// requested with --debug-shell-on-failure. The mounts left behind by the state
+// are torn down first, the shell sets up its own
+func (stateMachine *StateMachine) debugShellOnFailure() {
+	if !stateMachine.commonFlags.DebugShellOnFailure {
+		return
+	}
+	if !stdinIsTerminal() {
+		stateMachine.warningf("not opening a debug shell, standard input is not a terminal\n")
+		return
+	}
+	if err := stateMachine.teardownMounts(); err != nil {
+		stateMachine.warningf("not opening a debug shell: %s\n", err.Error())
+		return
+	}
+	stateMachine.infof("%s failed, opening a debug shell to investigate it\n", stateMachine.CurrentStep)
+	if err := stateMachine.debugShell(); err != nil {
+		stateMachine.warningf("%s\n", err.Error())
+	}
+}
+
+// Shell opens an interactive shell in the chroot or rootfs of the partial build in
+// the given workdir, with /dev, /proc, /sys and /run mounted and the resolv.conf
+// of the host, to investigate a build that stopped or failed
+func Shell(workDir string) error {
+	absWorkDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return fmt.Errorf("Error resolving the workdir: %s", err.Error())
+	}
+	if _, err := os.Stat(absWorkDir); err != nil {
+		return fmt.Errorf("Error opening debug shell: %s", err.Error())
+	}
+	var stateMachine StateMachine
+	stateMachine.commonFlags = new(commands.CommonOpts)
+	stateMachine.stateMachineFlags = new(commands.StateMachineOpts)
+	stateMachine.stateMachineFlags.WorkDir = absWorkDir
+	stateMachine.tempDirs.rootfs = filepath.Join(absWorkDir, "root")
+	stateMachine.tempDirs.chroot = filepath.Join(absWorkDir, "chroot")
+	stateMachine.tempDirs.scratch = filepath.Join(absWorkDir, "scratch")
+
+	if err := stateMachine.lock(); err != nil {
+		return err
+	}
+	defer stateMachine.unlock()
+
+	// the registry of a crashed build would be overwritten by the one of the shell
+	if _, err := os.Stat(stateMachine.registry().path); err == nil {
+		return fmt.Errorf("Error opening debug shell: mounts were left behind in %s. "+
+			"Run \"ubuntu-image cleanup --workdir %s\" first", absWorkDir, workDir)
+	}
+	if err := osMkdirAll(stateMachine.tempDirs.scratch, 0755); err != nil {
+		return fmt.Errorf("Error creating scratch dir: %s", err.Error())
+	}
+	return stateMachine.debugShell()
+}
@@ -0,0 +1,163 @@
+// This test file tests the debug shell opened in the chroot or rootfs
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// mockDebugShell mocks the commands and the resolv.conf handling of the debug shell
+// and records the commands that are run and the resolv.conf setups
+func mockDebugShell(commands *[]string, resolvConf *[]string) (restore func()) {
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		if command != "umount" {
+			*commands = append(*commands, strings.Join(append([]string{command}, args...), " "))
+		}
+		return fakeExecCommand(command, args...)
+	}
+	helperBackupAndCopyResolvConf = func(chroot string) error {
+		*resolvConf = append(*resolvConf, "backup "+chroot)
+		return nil
+	}
+	helperRestoreResolvConf = func(chroot string) error {
+		*resolvConf = append(*resolvConf, "restore "+chroot)
+		return nil
+	}
+	oldStdinIsTerminal := stdinIsTerminal
+	stdinIsTerminal = func() bool { return true }
+	testCaseName = "TestDebugShell"
+	return func() {
+		execCommand = exec.Command
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+		helperRestoreResolvConf = helper.RestoreResolvConf
+		stdinIsTerminal = oldStdinIsTerminal
+	}
+}
+
+// makeShellDir creates a directory that looks like it contains a shell
+func makeShellDir(t *testing.T, dir string) {
+	asserter := helper.Asserter{T: t}
+	err := os.MkdirAll(filepath.Join(dir, "bin"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(dir, "bin", "sh"), []byte{}, 0755)
+	asserter.AssertErrNil(err, true)
+}
+
+// TestShell ensures that `ubuntu-image shell` opens a shell in the chroot with the
+// same mounts as install_packages, and tears them down when the shell exits
+func TestShell(t *testing.T) {
+	t.Run("test_shell", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var commands, resolvConf []string
+		restore := mockDebugShell(&commands, &resolvConf)
+		defer restore()
+
+		// there is nothing to open a shell in yet
+		err = Shell(workDir)
+		asserter.AssertErrContains(err, "no shell was found")
+
+		chroot := filepath.Join(workDir, "chroot")
+		makeShellDir(t, filepath.Join(workDir, "root"))
+		makeShellDir(t, chroot)
+		err = Shell(workDir)
+		asserter.AssertErrNil(err, true)
+
+		if len(commands) != 5 {
+			t.Fatalf("Expected 4 mounts and the shell to run but got %q", commands)
+		}
+		for i, mountPoint := range []string{"/dev", "/proc", "/sys"} {
+			expected := fmt.Sprintf("mount --bind %s %s", mountPoint, filepath.Join(chroot, mountPoint))
+			if commands[i] != expected {
+				t.Errorf("Expected command \"%s\" but got \"%s\"", expected, commands[i])
+			}
+		}
+		if !strings.HasSuffix(commands[3], filepath.Join(chroot, "run")) {
+			t.Errorf("Expected /run to be mounted but got \"%s\"", commands[3])
+		}
+		if expected := "chroot " + chroot + " /bin/sh"; commands[4] != expected {
+			t.Errorf("Expected command \"%s\" but got \"%s\"", expected, commands[4])
+		}
+		expected := []string{"backup " + chroot, "restore " + chroot}
+		if strings.Join(resolvConf, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected resolv.conf calls %q but got %q", expected, resolvConf)
+		}
+		if _, err := os.Stat(filepath.Join(workDir, mountRegistryFileName)); !os.IsNotExist(err) {
+			t.Errorf("Expected everything to be unmounted when the shell exits")
+		}
+		if _, err := os.Stat(filepath.Join(workDir, lockFileName)); !os.IsNotExist(err) {
+			t.Errorf("Expected the workdir to be unlocked when the shell exits")
+		}
+
+		// the mounts left behind by a crashed build must be cleaned up first
+		err = os.WriteFile(filepath.Join(workDir, mountRegistryFileName), []byte("{}"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = Shell(workDir)
+		asserter.AssertErrContains(err, "Run \"ubuntu-image cleanup --workdir "+workDir+"\" first")
+
+		err = Shell(filepath.Join(workDir, "does-not-exist"))
+		asserter.AssertErrContains(err, "Error opening debug shell")
+	})
+}
+
+// TestDebugShellOnFailure ensures that a shell is opened in the rootfs when a state
+// fails with --debug-shell-on-failure, before the workdir is cleaned up
+func TestDebugShellOnFailure(t *testing.T) {
+	t.Run("test_debug_shell_on_failure", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var commands, resolvConf []string
+		restore := mockDebugShell(&commands, &resolvConf)
+		defer restore()
+
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.commonFlags.DebugShellOnFailure = true
+		logger := &testLogger{}
+		stateMachine.SetLogger(logger)
+		stateMachine.tempDirs.rootfs = filepath.Join(workDir, "root")
+		stateMachine.tempDirs.chroot = filepath.Join(workDir, "chroot")
+		stateMachine.tempDirs.scratch = filepath.Join(workDir, "scratch")
+		makeShellDir(t, stateMachine.tempDirs.rootfs)
+		err = os.Mkdir(stateMachine.tempDirs.scratch, 0755)
+		asserter.AssertErrNil(err, true)
+		stateMachine.states = []stateFunc{
+			{"perform_manual_customization", func(stateMachine *StateMachine) error {
+				return fmt.Errorf("customization failed")
+			}},
+		}
+
+		err = stateMachine.Run(context.Background())
+		asserter.AssertErrContains(err, "customization failed")
+		expected := "chroot " + stateMachine.tempDirs.rootfs + " /bin/sh"
+		if len(commands) == 0 || commands[len(commands)-1] != expected {
+			t.Errorf("Expected a shell to be opened in the rootfs but got %q", commands)
+		}
+
+		// no shell can be used without a terminal
+		commands = nil
+		stdinIsTerminal = func() bool { return false }
+		err = stateMachine.Run(context.Background())
+		asserter.AssertErrContains(err, "customization failed")
+		if len(commands) != 0 {
+			t.Errorf("Expected no shell to be opened but got %q", commands)
+		}
+		if !strings.Contains(strings.Join(logger.messages, ""), "standard input is not a terminal") {
+			t.Errorf("Expected a warning about the terminal but got %q", logger.messages)
+		}
+	})
+}
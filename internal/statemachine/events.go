@@ -0,0 +1,78 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// The types of events that can be emitted by the state machine
+const (
+	EventStateStarted    = "state_started"
+	EventStateFinished   = "state_finished"
+	EventStateFailed     = "state_failed"
+	EventCommandSpawned  = "command_spawned"
+	EventArtifactWritten = "artifact_written"
+)
+
+// The types of the artifacts reported by artifact_written events
+const (
+	ArtifactImg           = "img"
+	ArtifactQcow2         = "qcow2"
+	ArtifactManifest      = "manifest"
+	ArtifactFilelist      = "filelist"
+	ArtifactRootfsTarball = "rootfs-tarball"
+	ArtifactSeedManifest  = "seed-manifest"
+	ArtifactSnapsManifest = "snaps-manifest"
+)
+
+// Event describes a single step of progress of the state machine. When
+// --progress-format=json is used, every event is printed to stdout as
+// one JSON object per line. Events are also passed to the function set
+// with SetEventHandler
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	State    string    `json:"state,omitempty"`
+	Step     int       `json:"step"`
+	Duration float64   `json:"duration,omitempty"` // in seconds, only set for finished or failed states
+	Error    string    `json:"error,omitempty"`
+	Command  []string  `json:"command,omitempty"`
+	Artifact string    `json:"artifact,omitempty"`
+	// the type of the artifact, one of the Artifact* constants
+	ArtifactType string `json:"artifact_type,omitempty"`
+}
+
+// emitEvent fills in the common fields of an event and sends
+// it to the configured outputs
+func (stateMachine *StateMachine) emitEvent(event Event) {
+	if stateMachine.commonFlags.ProgressFormat != "json" && stateMachine.eventHandler == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.State = stateMachine.CurrentStep
+	event.Step = stateMachine.StepsTaken
+
+	// the events of states that run concurrently are held back, see runConcurrently
+	if stateMachine.deferred != nil {
+		stateMachine.deferred.addEvent(event)
+		return
+	}
+	stateMachine.sendEvent(event)
+}
+
+// sendEvent passes an event to the event handler and prints it with --progress-format=json
+func (stateMachine *StateMachine) sendEvent(event Event) {
+	if stateMachine.eventHandler != nil {
+		stateMachine.eventHandler(event)
+	}
+	if stateMachine.commonFlags.ProgressFormat == "json" {
+		// no need to check errors, there is nothing sensible to do if stdout is gone
+		json.NewEncoder(os.Stdout).Encode(event)
+	}
+}
+
+// artifactWritten notifies listeners that an artifact of the given type was written to disk
+func (stateMachine *StateMachine) artifactWritten(artifactType string, path string) {
+	stateMachine.emitEvent(Event{Type: EventArtifactWritten, Artifact: path, ArtifactType: artifactType})
+}
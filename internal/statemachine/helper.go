@@ -2,8 +2,10 @@ package statemachine
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"os/exec"
@@ -36,6 +38,21 @@ func (stateMachine *StateMachine) validateInput() error {
 	if stateMachine.stateMachineFlags.WorkDir == "" && stateMachine.stateMachineFlags.Resume {
 		return fmt.Errorf("must specify workdir when using --resume flag")
 	}
+	if stateMachine.stateMachineFlags.Only != "" && stateMachine.stateMachineFlags.From != "" {
+		return fmt.Errorf("cannot specify both --only and --from")
+	}
+	if stateMachine.stateMachineFlags.Only != "" &&
+		(stateMachine.stateMachineFlags.Until != "" || stateMachine.stateMachineFlags.Thru != "") {
+		return fmt.Errorf("cannot specify --only with --until or --thru")
+	}
+	if stateMachine.stateMachineFlags.Only != "" || stateMachine.stateMachineFlags.From != "" {
+		if stateMachine.stateMachineFlags.Resume {
+			return fmt.Errorf("cannot specify --only or --from with --resume")
+		}
+		if stateMachine.stateMachineFlags.WorkDir == "" {
+			return fmt.Errorf("must specify workdir when using --only or --from")
+		}
+	}
 
 	logLevelFlags := []bool{stateMachine.commonFlags.Debug,
 		stateMachine.commonFlags.Verbose,
@@ -53,23 +70,33 @@ func (stateMachine *StateMachine) validateInput() error {
 		return fmt.Errorf("--quiet, --verbose, and --debug flags are mutually exclusive")
 	}
 
+	if err := stateMachine.validateHooksDirectories(); err != nil {
+		return err
+	}
+
+	if err := stateMachine.validateJobs(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// validateUntilThru validates that the the state passed as --until
-// or --thru exists in the state machine's list of states
+// validateUntilThru validates that the the states passed as --until, --thru,
+// --only or --from exist in the state machine's list of states
 func (stateMachine *StateMachine) validateUntilThru() error {
 	// if --until or --thru was given, make sure the specified state exists
-	var searchState string
-	var stateFound bool = false
-	if stateMachine.stateMachineFlags.Until != "" {
-		searchState = stateMachine.stateMachineFlags.Until
-	}
-	if stateMachine.stateMachineFlags.Thru != "" {
-		searchState = stateMachine.stateMachineFlags.Thru
+	searchStates := []string{
+		stateMachine.stateMachineFlags.Until,
+		stateMachine.stateMachineFlags.Thru,
+		stateMachine.stateMachineFlags.Only,
+		stateMachine.stateMachineFlags.From,
 	}
 
-	if searchState != "" {
+	for _, searchState := range searchStates {
+		if searchState == "" {
+			continue
+		}
+		stateFound := false
 		for _, state := range stateMachine.states {
 			if state.name == searchState {
 				stateFound = true
@@ -84,9 +111,59 @@ func (stateMachine *StateMachine) validateUntilThru() error {
 	return nil
 }
 
-// cleanup cleans the workdir. For now this is just deleting the temporary directory if necessary
-// but will have more functionality added to it later
+// loadsMetadata returns whether the state of a partial build is loaded from the workdir,
+// which is the case for --resume, --only and --from
+func (stateMachine *StateMachine) loadsMetadata() bool {
+	return stateMachine.stateMachineFlags.Resume ||
+		stateMachine.stateMachineFlags.Only != "" ||
+		stateMachine.stateMachineFlags.From != ""
+}
+
+// isLastState returns whether the state machine stops after the given
+// state, because it was passed to --thru or --only
+func (stateMachine *StateMachine) isLastState(stateName string) bool {
+	return stateName == stateMachine.stateMachineFlags.Thru ||
+		stateName == stateMachine.stateMachineFlags.Only
+}
+
+// rewind moves a loaded partial build back to the state given with --only or
+// --from, so it runs again against the contents of the workdir. The state must
+// have run already or be the next one to run, since every state needs the
+// results of the states before it. The states after it are considered not
+// to have run anymore, as their results may be outdated
+func (stateMachine *StateMachine) rewind() error {
+	stateName := stateMachine.stateMachineFlags.Only
+	if stateName == "" {
+		stateName = stateMachine.stateMachineFlags.From
+	}
+	if stateName == "" {
+		return nil
+	}
+	for i, state := range stateMachine.states {
+		if state.name != stateName {
+			continue
+		}
+		if i > stateMachine.StepsTaken {
+			return fmt.Errorf("state %s cannot run yet, the next state of the partial build is %s. "+
+				"Use --resume to continue the build", stateName, stateMachine.states[stateMachine.StepsTaken].name)
+		}
+		stateMachine.StepsTaken = i
+		return nil
+	}
+	return fmt.Errorf("state %s is not a valid state name", stateName)
+}
+
+// cleanup tears down the mounts and loop devices that are still set up, then
+// deletes the temporary workdir if necessary, closes the build log and releases
+// the lock on the workdir
 func (stateMachine *StateMachine) cleanup() error {
+	defer stateMachine.unlock()
+	defer stateMachine.buildLogger().Close()
+	// never remove the workdir while something is still mounted in it,
+	// as that would remove the contents of the mounted directories too
+	if err := stateMachine.teardownMounts(); err != nil {
+		return err
+	}
 	if stateMachine.cleanWorkDir {
 		if err := osRemoveAll(stateMachine.stateMachineFlags.WorkDir); err != nil {
 			return fmt.Errorf("Error cleaning up workDir: %s", err.Error())
@@ -152,7 +229,7 @@ func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
 		ddArgs := []string{"if=/dev/zero", "of=" + partImg, "count=0",
 			"bs=" + strconv.FormatUint(uint64(structure.Size), 10),
 			"seek=1"}
-		if err := helperCopyBlob(ddArgs); err != nil {
+		if err := stateMachine.copyBlob(ddArgs); err != nil {
 			return fmt.Errorf("Error zeroing partition: %s",
 				err.Error())
 		}
@@ -167,7 +244,7 @@ func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
 			ddArgs = []string{"if=" + inFile, "of=" + partImg, "bs=" + mockableBlockSize,
 				"seek=" + strconv.FormatUint(uint64(runningOffset), 10),
 				"conv=sparse,notrunc"}
-			if err := helperCopyBlob(ddArgs); err != nil {
+			if err := stateMachine.copyBlob(ddArgs); err != nil {
 				return fmt.Errorf("Error copying image blob: %s",
 					err.Error())
 			}
@@ -179,12 +256,10 @@ func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
 			// system-data and system-seed structures are not required to have
 			// an explicit size set in the yaml file
 			if structure.Size < stateMachine.RootfsSize {
-				if !stateMachine.commonFlags.Quiet {
-					fmt.Printf("WARNING: rootfs structure size %s smaller "+
-						"than actual rootfs contents %s\n",
-						structure.Size.IECString(),
-						stateMachine.RootfsSize.IECString())
-				}
+				stateMachine.warningf("rootfs structure size %s smaller "+
+					"than actual rootfs contents %s\n",
+					structure.Size.IECString(),
+					stateMachine.RootfsSize.IECString())
 				blockSize = stateMachine.RootfsSize
 				structure.Size = stateMachine.RootfsSize
 				volume.Structure[structureNumber] = structure
@@ -201,7 +276,7 @@ func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
 			// zero out the .img file
 			ddArgs := []string{"if=/dev/zero", "of=" + partImg, "count=0",
 				"bs=" + strconv.FormatUint(uint64(blockSize), 10), "seek=1"}
-			if err := helperCopyBlob(ddArgs); err != nil {
+			if err := stateMachine.copyBlob(ddArgs); err != nil {
 				return fmt.Errorf("Error zeroing image file %s: %s",
 					partImg, err.Error())
 			}
@@ -459,7 +534,7 @@ func (stateMachine *StateMachine) copyDataToImage(volumeName string, volume *gad
 			"conv=notrunc",
 			"conv=sparse",
 		}
-		if err := helperCopyBlob(ddArgs); err != nil {
+		if err := stateMachine.copyBlob(ddArgs); err != nil {
 			return fmt.Errorf("Error writing disk image: %s",
 				err.Error())
 		}
@@ -567,7 +642,7 @@ func generateGerminateCmd(imageDefinition imagedefinition.ImageDefinition) *exec
 
 	germinateCmd := execCommand("germinate",
 		"--mirror", imageDefinition.Rootfs.Mirror,
-		"--arch", imageDefinition.Architecture,
+		"--arch", imageDefinition.Architecture.String(),
 		"--dist", imageDefinition.Series,
 		"--seed-source", seedSource,
 		"--seed-dist", seedDist,
@@ -608,7 +683,7 @@ func cloneGitRepo(imageDefinition imagedefinition.ImageDefinition, workDir strin
 // environment that will eventually become the rootfs of the resulting image
 func generateDebootstrapCmd(imageDefinition imagedefinition.ImageDefinition, targetDir string, includeList []string) *exec.Cmd {
 	debootstrapCmd := execCommand("debootstrap",
-		"--arch", imageDefinition.Architecture,
+		"--arch", imageDefinition.Architecture.String(),
 		"--variant=minbase",
 	)
 
@@ -635,7 +710,7 @@ func generateDebootstrapCmd(imageDefinition imagedefinition.ImageDefinition, tar
 // generateAptCmd generates the apt command used to create a chroot
 // environment that will eventually become the rootfs of the resulting image
 func generateAptCmds(targetDir string, packageList []string) []*exec.Cmd {
-	updateCmd := execCommand("chroot", targetDir, "apt", "update")
+	updateCmd := generateAptUpdateCmd(targetDir)
 
 	installCmd := execCommand("chroot", targetDir, "apt", "install",
 		"--assume-yes",
@@ -658,6 +733,40 @@ func generateAptCmds(targetDir string, packageList []string) []*exec.Cmd {
 	return []*exec.Cmd{updateCmd, installCmd}
 }
 
+// generateAptUpdateCmd generates the command updating the package lists of apt
+// in a chroot
+func generateAptUpdateCmd(targetDir string) *exec.Cmd {
+	return execCommand("chroot", targetDir, "apt", "update")
+}
+
+// generateLosetupCmd generates the losetup command used to attach
+// a disk image to the first unused loop device
+func generateLosetupCmd(sectorSize, imgPath string) *exec.Cmd {
+	return execCommand("losetup",
+		"--find",
+		"--show",
+		"--partscan",
+		"--sector-size",
+		sectorSize,
+		imgPath,
+	)
+}
+
+// generateQemuImgCmd generates the qemu-img command used to
+// convert a raw disk image to a qcow2 image
+func generateQemuImgCmd(backingFile, resultingFile string) *exec.Cmd {
+	return execCommand("qemu-img",
+		"convert",
+		"-c",
+		"-O",
+		"qcow2",
+		"-o",
+		"compat=0.10",
+		backingFile,
+		resultingFile,
+	)
+}
+
 // createPPAInfo generates the name for a PPA sources.list file
 // in the convention of add-apt-repository, and the contents
 // that define the sources.list in the DEB822 format
@@ -673,11 +782,10 @@ func createPPAInfo(ppa *imagedefinition.PPA, series string) (fileName string, fi
 	*/
 	fileName = fmt.Sprintf("%s-ubuntu-%s-%s.list", user, ppaName, series)
 
-	var domain string
-	if ppa.Auth == "" {
-		domain = "https://ppa.launchpadcontent.net"
-	} else {
-		domain = fmt.Sprintf("https://%s@private-ppa.launchpadcontent.net", ppa.Auth)
+	// the credentials of private PPAs are not part of the URL, see createPPAAuthInfo
+	domain := "https://ppa.launchpadcontent.net"
+	if isPrivatePPA(ppa) {
+		domain = "https://" + privatePPAHost
 	}
 
 	fullDomain := fmt.Sprintf("%s/%s/%s/ubuntu", domain, user, ppaName)
@@ -692,11 +800,66 @@ func createPPAInfo(ppa *imagedefinition.PPA, series string) (fileName string, fi
 	return fileName, fileContents
 }
 
+// repositoryKeyringsDir is the directory of the rootfs holding the keyrings
+// of the extra repositories, which are only trusted for their repository
+const repositoryKeyringsDir = "/etc/apt/keyrings"
+
+// createRepositoryInfo generates the name of the deb822 .sources file of an extra
+// repository, the path of its keyring in the rootfs, and the contents of the
+// .sources file. The suites default to the series of the image
+func createRepositoryInfo(repository *imagedefinition.Repository, series string) (fileName string, keyringPath string, fileContents string) {
+	fileName = repository.Name + ".sources"
+
+	// apt reads ASCII armored keys only if they have the .asc extension
+	keyringExt := ".gpg"
+	if filepath.Ext(repository.SignedBy) == ".asc" {
+		keyringExt = ".asc"
+	}
+	keyringPath = filepath.Join(repositoryKeyringsDir, repository.Name+keyringExt)
+
+	suites := repository.Suites
+	if len(suites) == 0 {
+		suites = []string{series}
+	}
+	fileContents = fmt.Sprintf("Types: deb\nURIs: %s\nSuites: %s\n",
+		repository.URI, strings.Join(suites, " "))
+	if len(repository.Components) > 0 {
+		fileContents += fmt.Sprintf("Components: %s\n", strings.Join(repository.Components, " "))
+	}
+	if len(repository.Architectures) > 0 {
+		fileContents += fmt.Sprintf("Architectures: %s\n", strings.Join(repository.Architectures, " "))
+	}
+	fileContents += fmt.Sprintf("Signed-By: %s\n", keyringPath)
+
+	return fileName, keyringPath, fileContents
+}
+
+// ppaKeepEnabled returns whether a PPA is left configured in the image, which
+// is the default when keep-enabled is not set
+func ppaKeepEnabled(ppa *imagedefinition.PPA) bool {
+	return ppa.KeepEnabled == nil || *ppa.KeepEnabled
+}
+
+// privatePPAHost is the host serving the private PPAs
+const privatePPAHost = "private-ppa.launchpadcontent.net"
+
+// createPPAAuthInfo generates the name of the file of /etc/apt/auth.conf.d holding
+// the credentials of a private PPA, named after its sources.list file, and its
+// contents in the netrc-like format of apt_auth.conf(5). Keeping the credentials
+// out of the sources.list file lets the build remove them from the image
+func createPPAAuthInfo(ppa *imagedefinition.PPA, series string, login string, password string) (fileName string, fileContents string) {
+	ppaFileName, _ := createPPAInfo(ppa, series)
+	fileName = strings.TrimSuffix(ppaFileName, filepath.Ext(ppaFileName)) + ".conf"
+	fileContents = fmt.Sprintf("machine %s/%s/ubuntu login %s password %s\n",
+		privatePPAHost, ppa.PPAName, login, password)
+	return fileName, fileContents
+}
+
 // importPPAKeys imports keys for ppas with specified fingerprints.
 // The schema parsing has already validated that either Fingerprint is
 // specified or the PPA is public. If no fingerprint is provided, this
 // function reaches out to the Launchpad API to get the signing key
-func importPPAKeys(ppa *imagedefinition.PPA, tmpGPGDir, keyFilePath string, debug bool) error {
+func (stateMachine *StateMachine) importPPAKeys(ppa *imagedefinition.PPA, tmpGPGDir, keyFilePath string) error {
 	if ppa.Fingerprint == "" {
 		// The YAML schema has already validated that if no fingerprint is
 		// provided, then this is a public PPA. We will get the fingerprint
@@ -753,8 +916,7 @@ func importPPAKeys(ppa *imagedefinition.PPA, tmpGPGDir, keyFilePath string, debu
 	}
 
 	for _, gpgCmd := range gpgCmds {
-		gpgOutput := helper.SetCommandOutput(gpgCmd, debug)
-		err := gpgCmd.Run()
+		gpgOutput, err := stateMachine.runCmd(gpgCmd)
 		if err != nil {
 			return fmt.Errorf("Error running gpg command \"%s\". Error is \"%s\". Full output below:\n%s",
 				gpgCmd.String(), err.Error(), gpgOutput.String())
@@ -764,6 +926,50 @@ func importPPAKeys(ppa *imagedefinition.PPA, tmpGPGDir, keyFilePath string, debu
 	return nil
 }
 
+// liveOutput returns where the output of the commands is shown live, which is
+// only done when --debug is used
+func (stateMachine *StateMachine) liveOutput() io.Writer {
+	if !stateMachine.commonFlags.Debug {
+		return nil
+	}
+	return stateMachine.consoleOutput()
+}
+
+// commandLogs returns the writers receiving the output of a command run by a
+// helper: the given command log and, when --debug is used, the console
+func (stateMachine *StateMachine) commandLogs(commandLog io.Writer) []io.Writer {
+	if liveOutput := stateMachine.liveOutput(); liveOutput != nil {
+		return []io.Writer{commandLog, liveOutput}
+	}
+	return []io.Writer{commandLog}
+}
+
+// runCmd runs a command and returns its output. The output is also shown live
+// when --debug is used. The command is timed and listeners are notified that
+// it was spawned. If the build is cancelled or times out, the command and its
+// children are killed
+func (stateMachine *StateMachine) runCmd(cmd *exec.Cmd) (*bytes.Buffer, error) {
+	return stateMachine.runCmdContext(stateMachine.buildContext(), cmd)
+}
+
+// runCmdContext is like runCmd, but the command is only killed when the given context is done
+func (stateMachine *StateMachine) runCmdContext(ctx context.Context, cmd *exec.Cmd) (*bytes.Buffer, error) {
+	commandLog := stateMachine.commandLog()
+	defer commandLog.Flush()
+	cmdOutput := helper.SetCommandOutput(cmd, stateMachine.liveOutput(), commandLog)
+	return cmdOutput, stateMachine.timeCommand(cmd.Args, func() error {
+		return helperRunCmdContext(ctx, cmd)
+	})
+}
+
+// copyBlob wraps helper.CopyBlob so that the dd call is timed
+// and listeners are notified about it
+func (stateMachine *StateMachine) copyBlob(ddArgs []string) error {
+	return stateMachine.timeCommand(append([]string{"dd"}, ddArgs...), func() error {
+		return helperCopyBlob(stateMachine.buildContext(), ddArgs)
+	})
+}
+
 // mountFromHost mounts mountpoints from the host system in the chroot
 // for certain operations that require this
 func mountFromHost(targetDir, mountpoint string) (mountCmd, umountCmd *exec.Cmd) {
@@ -784,16 +990,14 @@ func mountTempFS(targetDir, scratchDir, mountpoint string) (mountCmd, umountCmd
 }
 
 // manualCopyFile copies a file into the chroot
-func manualCopyFile(copyFileInterfaces interface{}, targetDir string, debug bool) error {
+func (stateMachine *StateMachine) manualCopyFile(copyFileInterfaces interface{}, targetDir string) error {
 	copyFileSlice := reflect.ValueOf(copyFileInterfaces)
 	for i := 0; i < copyFileSlice.Len(); i++ {
 		copyFile := copyFileSlice.Index(i).Interface().(*imagedefinition.CopyFile)
 
 		// Copy the file into the specified location in the chroot
 		dest := filepath.Join(targetDir, copyFile.Dest)
-		if debug {
-			fmt.Printf("Copying file \"%s\" to \"%s\"\n", copyFile.Source, dest)
-		}
+		stateMachine.debugf("Copying file \"%s\" to \"%s\"\n", copyFile.Source, dest)
 		if err := osutilCopySpecialFile(copyFile.Source, dest); err != nil {
 			return fmt.Errorf("Error copying file \"%s\" into chroot: %s",
 				copyFile.Source, err.Error())
@@ -803,16 +1007,13 @@ func manualCopyFile(copyFileInterfaces interface{}, targetDir string, debug bool
 }
 
 // manualExecute executes an executable file in the chroot
-func manualExecute(executeInterfaces interface{}, targetDir string, debug bool) error {
+func (stateMachine *StateMachine) manualExecute(executeInterfaces interface{}, targetDir string) error {
 	executeSlice := reflect.ValueOf(executeInterfaces)
 	for i := 0; i < executeSlice.Len(); i++ {
 		execute := executeSlice.Index(i).Interface().(*imagedefinition.Execute)
 		executeCmd := execCommand("chroot", targetDir, execute.ExecutePath)
-		if debug {
-			fmt.Printf("Executing command \"%s\"\n", executeCmd.String())
-		}
-		executeOutput := helper.SetCommandOutput(executeCmd, debug)
-		err := executeCmd.Run()
+		stateMachine.debugf("Executing command \"%s\"\n", executeCmd.String())
+		executeOutput, err := stateMachine.runCmd(executeCmd)
 		if err != nil {
 			return fmt.Errorf("Error running script \"%s\". Error is %s. Full output below:\n%s",
 				executeCmd.String(), err.Error(), executeOutput.String())
@@ -822,14 +1023,12 @@ func manualExecute(executeInterfaces interface{}, targetDir string, debug bool)
 }
 
 // manualTouchFile touches a file in the chroot
-func manualTouchFile(touchFileInterfaces interface{}, targetDir string, debug bool) error {
+func (stateMachine *StateMachine) manualTouchFile(touchFileInterfaces interface{}, targetDir string) error {
 	touchFileSlice := reflect.ValueOf(touchFileInterfaces)
 	for i := 0; i < touchFileSlice.Len(); i++ {
 		touchFile := touchFileSlice.Index(i).Interface().(*imagedefinition.TouchFile)
 		fullPath := filepath.Join(targetDir, touchFile.TouchPath)
-		if debug {
-			fmt.Printf("Creating empty file \"%s\"\n", fullPath)
-		}
+		stateMachine.debugf("Creating empty file \"%s\"\n", fullPath)
 		_, err := osCreate(fullPath)
 		if err != nil {
 			return fmt.Errorf("Error creating file in chroot: %s", err.Error())
@@ -839,7 +1038,7 @@ func manualTouchFile(touchFileInterfaces interface{}, targetDir string, debug bo
 }
 
 // manualAddGroup adds a group in the chroot
-func manualAddGroup(addGroupInterfaces interface{}, targetDir string, debug bool) error {
+func (stateMachine *StateMachine) manualAddGroup(addGroupInterfaces interface{}, targetDir string) error {
 	addGroupSlice := reflect.ValueOf(addGroupInterfaces)
 	for i := 0; i < addGroupSlice.Len(); i++ {
 		addGroup := addGroupSlice.Index(i).Interface().(*imagedefinition.AddGroup)
@@ -849,11 +1048,8 @@ func manualAddGroup(addGroupInterfaces interface{}, targetDir string, debug bool
 			addGroupCmd.Args = append(addGroupCmd.Args, []string{"--gid", addGroup.GroupID}...)
 			debugStatement = fmt.Sprintf("%s with GID %s\n", strings.TrimSpace(debugStatement), addGroup.GroupID)
 		}
-		if debug {
-			fmt.Printf(debugStatement)
-		}
-		addGroupOutput := helper.SetCommandOutput(addGroupCmd, debug)
-		err := addGroupCmd.Run()
+		stateMachine.debugf("%s", debugStatement)
+		addGroupOutput, err := stateMachine.runCmd(addGroupCmd)
 		if err != nil {
 			return fmt.Errorf("Error adding group. Command used is \"%s\". Error is %s. Full output below:\n%s",
 				addGroupCmd.String(), err.Error(), addGroupOutput.String())
@@ -863,7 +1059,7 @@ func manualAddGroup(addGroupInterfaces interface{}, targetDir string, debug bool
 }
 
 // manualAddUser adds a group in the chroot
-func manualAddUser(addUserInterfaces interface{}, targetDir string, debug bool) error {
+func (stateMachine *StateMachine) manualAddUser(addUserInterfaces interface{}, targetDir string) error {
 	addUserSlice := reflect.ValueOf(addUserInterfaces)
 	for i := 0; i < addUserSlice.Len(); i++ {
 		addUser := addUserSlice.Index(i).Interface().(*imagedefinition.AddUser)
@@ -873,11 +1069,8 @@ func manualAddUser(addUserInterfaces interface{}, targetDir string, debug bool)
 			addUserCmd.Args = append(addUserCmd.Args, []string{"--uid", addUser.UserID}...)
 			debugStatement = fmt.Sprintf("%s with UID %s\n", strings.TrimSpace(debugStatement), addUser.UserID)
 		}
-		if debug {
-			fmt.Printf(debugStatement)
-		}
-		addUserOutput := helper.SetCommandOutput(addUserCmd, debug)
-		err := addUserCmd.Run()
+		stateMachine.debugf("%s", debugStatement)
+		addUserOutput, err := stateMachine.runCmd(addUserCmd)
 		if err != nil {
 			return fmt.Errorf("Error adding user. Command used is \"%s\". Error is %s. Full output below:\n%s",
 				addUserCmd.String(), err.Error(), addUserOutput.String())
@@ -895,6 +1088,9 @@ func checkCustomizationSteps(searchStruct interface{}, tag string) (extraStates
 		"add_extra_ppas": []stateFunc{
 			stateFunc{"add_extra_ppas", (*StateMachine).addExtraPPAs},
 		},
+		"add_extra_repositories": []stateFunc{
+			stateFunc{"add_extra_repositories", (*StateMachine).addExtraRepositories},
+		},
 		"install_extra_packages": []stateFunc{
 			stateFunc{"install_extra_packages", (*StateMachine).installPackages},
 		},
@@ -957,78 +1153,47 @@ func (stateMachine *StateMachine) updateGrub(rootfsVolName string, rootfsPartNum
 		return fmt.Errorf("Error creating scratch/loopback directory: %s", err.Error())
 	}
 
-	// Slice used to store all the commands that need to be run
-	// to properly update grub.cfg in the chroot
-	var updateGrubCmds []*exec.Cmd
-
 	imgPath := filepath.Join(stateMachine.commonFlags.OutputDir, stateMachine.VolumeNames[rootfsVolName])
 
-	// run the losetup command and read the output to determine which loopback was used
-	losetupCmd := execCommand("losetup",
-		"--find",
-		"--show",
-		"--partscan",
-		"--sector-size",
-		stateMachine.commonFlags.SectorSize,
-		imgPath,
-	)
-	losetupOutput, err := losetupCmd.Output()
+	// attach the image to a loop device and find out which one was used
+	loopUsed, err := stateMachine.attachLoop(imgPath)
 	if err != nil {
-		return fmt.Errorf("Error running losetup command \"%s\". Error is %s",
-			losetupCmd.String(),
-			err.Error(),
-		)
-	}
-	loopUsed := strings.TrimSpace(string(losetupOutput))
-
-	var umounts []*exec.Cmd
-	updateGrubCmds = append(updateGrubCmds,
-		// mount the rootfs partition in which to run update-grub
-		exec.Command("mount",
-			fmt.Sprintf("%sp%d", loopUsed, rootfsPartNum),
-			mountDir,
-		),
+		return err
+	}
+	mountTargets := []string{loopUsed}
+
+	// mount the rootfs partition in which to run update-grub
+	err = stateMachine.mount(
+		exec.Command("mount", fmt.Sprintf("%sp%d", loopUsed, rootfsPartNum), mountDir),
+		mountDir,
 	)
+	if err != nil {
+		return err
+	}
+	mountTargets = append(mountTargets, mountDir)
 
 	// set up the mountpoints
 	mountPoints := []string{"/dev", "/proc", "/sys"}
 	for _, mountPoint := range mountPoints {
-		mountCmd, umountCmd := mountFromHost(mountDir, mountPoint)
-		updateGrubCmds = append(updateGrubCmds, mountCmd)
-		umounts = append(umounts, umountCmd)
-		defer umountCmd.Run()
+		mountCmd, _ := mountFromHost(mountDir, mountPoint)
+		target := filepath.Join(mountDir, mountPoint)
+		if err := stateMachine.mount(mountCmd, target); err != nil {
+			return err
+		}
+		mountTargets = append(mountTargets, target)
 	}
-	// make sure to unmount the disk too
-	umounts = append(umounts, exec.Command("umount", mountDir))
 
 	// actually run update-grub
-	updateGrubCmds = append(updateGrubCmds,
-		exec.Command("chroot",
-			mountDir,
-			"update-grub",
-		),
-	)
-
-	// unmount /dev /proc and /sys
-	updateGrubCmds = append(updateGrubCmds, umounts...)
-
-	// tear down the loopback
-	teardownCmd := exec.Command("losetup",
-		"--detach",
-		loopUsed,
+	updateGrubCmd := exec.Command("chroot",
+		mountDir,
+		"update-grub",
 	)
-	defer teardownCmd.Run()
-	updateGrubCmds = append(updateGrubCmds, teardownCmd)
-
-	// now run all the commands
-	for _, cmd := range updateGrubCmds {
-		cmdOutput := helper.SetCommandOutput(cmd, stateMachine.commonFlags.Debug)
-		err := cmd.Run()
-		if err != nil {
-			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
-				cmd.String(), err.Error(), cmdOutput.String())
-		}
+	cmdOutput, err := stateMachine.runCmd(updateGrubCmd)
+	if err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			updateGrubCmd.String(), err.Error(), cmdOutput.String())
 	}
 
-	return nil
+	// unmount /dev /proc /sys and the disk, then tear down the loopback
+	return stateMachine.unmountAll(mountTargets)
 }
@@ -0,0 +1,114 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// preStateHooks are the hooks that are run before a state, keyed by state name
+var preStateHooks = map[string]string{
+	"make_disk": "pre-make-disk",
+}
+
+// postStateHooks are the hooks that are run after a state, keyed by state name
+var postStateHooks = map[string]string{
+	"populate_rootfs_contents": "post-populate-rootfs",
+	"make_disk":                "post-make-disk",
+}
+
+// runState runs the hooks that must run before the given state, the state
+// itself and then the hooks that must run after it
+func (stateMachine *StateMachine) runState(state stateFunc) error {
+	if err := stateMachine.runHooks(preStateHooks[state.name]); err != nil {
+		return err
+	}
+	if err := state.function(stateMachine); err != nil {
+		return err
+	}
+	return stateMachine.runHooks(postStateHooks[state.name])
+}
+
+// hooksDirectories returns the directories passed with --hooks-directory,
+// which may each be a comma-separated list of directories
+func (stateMachine *StateMachine) hooksDirectories() []string {
+	var hooksDirs []string
+	for _, hooksDirFlag := range stateMachine.commonFlags.HooksDirectories {
+		for _, hooksDir := range strings.Split(hooksDirFlag, ",") {
+			if hooksDir != "" {
+				hooksDirs = append(hooksDirs, hooksDir)
+			}
+		}
+	}
+	return hooksDirs
+}
+
+// validateHooksDirectories makes sure all the hooks directories exist
+func (stateMachine *StateMachine) validateHooksDirectories() error {
+	for _, hooksDir := range stateMachine.hooksDirectories() {
+		hooksDirInfo, err := os.Stat(hooksDir)
+		if err != nil {
+			return fmt.Errorf("Error reading hooks directory: %s", err.Error())
+		}
+		if !hooksDirInfo.IsDir() {
+			return fmt.Errorf("hooks directory %s is not a directory", hooksDir)
+		}
+	}
+	return nil
+}
+
+// hookEnvironment returns the variables that are set in the environment
+// of the hooks to let them find the contents of the image
+func (stateMachine *StateMachine) hookEnvironment(hookName string) []string {
+	return []string{
+		"UBUNTU_IMAGE_HOOK_NAME=" + hookName,
+		"UBUNTU_IMAGE_HOOK_ROOTFS=" + stateMachine.tempDirs.rootfs,
+		"UBUNTU_IMAGE_HOOK_UNPACK=" + stateMachine.tempDirs.unpack,
+		"UBUNTU_IMAGE_HOOK_VOLUMES=" + stateMachine.tempDirs.volumes,
+		"UBUNTU_IMAGE_HOOK_OUTPUT_DIR=" + stateMachine.commonFlags.OutputDir,
+		"UBUNTU_IMAGE_HOOK_WORKDIR=" + stateMachine.stateMachineFlags.WorkDir,
+	}
+}
+
+// runHooks runs the hook with the given name from every hooks directory, in the
+// order the directories were given. In each directory, the executables in
+// <hookName>.d are run in lexical order, followed by the executable <hookName>.
+// It is not an error for a hook to be missing from a hooks directory
+func (stateMachine *StateMachine) runHooks(hookName string) error {
+	if hookName == "" {
+		return nil
+	}
+	env := stateMachine.hookEnvironment(hookName)
+	for _, hooksDir := range stateMachine.hooksDirectories() {
+		var hookScripts []string
+		hooksDirD := filepath.Join(hooksDir, hookName+".d")
+		hookFiles, err := osReadDir(hooksDirD)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error reading hooks directory %s: %s", hooksDirD, err.Error())
+		}
+		// os.ReadDir sorts the entries by file name
+		for _, hookFile := range hookFiles {
+			if !hookFile.IsDir() {
+				hookScripts = append(hookScripts, filepath.Join(hooksDirD, hookFile.Name()))
+			}
+		}
+		hookScript := filepath.Join(hooksDir, hookName)
+		if _, err := os.Stat(hookScript); err == nil {
+			hookScripts = append(hookScripts, hookScript)
+		}
+
+		for _, hookScript := range hookScripts {
+			err := stateMachine.timeCommand([]string{hookScript}, func() error {
+				commandLog := stateMachine.commandLog()
+				defer commandLog.Flush()
+				return helperRunScript(stateMachine.buildContext(), hookScript, env,
+					stateMachine.consoleOutput(), commandLog)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// This test file tests running hooks from the hooks directories
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestRunHooks runs the post-populate-rootfs hook from the hooks directories in the test data
+func TestRunHooks(t *testing.T) {
+	testCases := []struct {
+		name          string
+		hooksDirs     []string
+		expectedFiles []string
+	}{
+		{"hook_script", []string{filepath.Join("testdata", "good_hookscript")},
+			[]string{"post-populate-rootfs-hookfile"}},
+		{"hooks_d", []string{filepath.Join("testdata", "good_hooksd")},
+			[]string{"post-populate-rootfs-hookfile.d1", "post-populate-rootfs-hookfile.d2"}},
+		{"comma_separated", []string{filepath.Join("testdata", "good_hookscript") + "," +
+			filepath.Join("testdata", "good_hooksd")},
+			[]string{"post-populate-rootfs-hookfile", "post-populate-rootfs-hookfile.d1"}},
+		{"multiple_flags", []string{filepath.Join("testdata", "good_hookscript"),
+			filepath.Join("testdata", "good_hooksd")},
+			[]string{"post-populate-rootfs-hookfile", "post-populate-rootfs-hookfile.d2"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_run_hooks_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.HooksDirectories = tc.hooksDirs
+
+			rootfs, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(rootfs)
+			stateMachine.tempDirs.rootfs = rootfs
+
+			err = stateMachine.validateInput()
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.runState(stateFunc{"populate_rootfs_contents",
+				func(*StateMachine) error { return nil }})
+			asserter.AssertErrNil(err, true)
+
+			for _, expectedFile := range tc.expectedFiles {
+				if _, err := os.Stat(filepath.Join(rootfs, expectedFile)); err != nil {
+					t.Errorf("Expected hook to create %s, but got %s", expectedFile, err.Error())
+				}
+			}
+
+			// hooks are only run at the boundaries of the states they belong to
+			err = os.RemoveAll(filepath.Join(rootfs, tc.expectedFiles[0]))
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.runState(stateFunc{"generate_disk_info",
+				func(*StateMachine) error { return nil }})
+			asserter.AssertErrNil(err, true)
+			if _, err := os.Stat(filepath.Join(rootfs, tc.expectedFiles[0])); !os.IsNotExist(err) {
+				t.Errorf("Did not expect hooks to run after generate_disk_info")
+			}
+		})
+	}
+}
+
+// TestFailedRunHooks tests failures in hooks and invalid hooks directories
+func TestFailedRunHooks(t *testing.T) {
+	testCases := []struct {
+		name          string
+		hooksDir      string
+		expectedError string
+	}{
+		{"not_executable", filepath.Join("testdata", "hooks_not_executable"), "Error running hook script"},
+		{"return_error", filepath.Join("testdata", "hooks_return_error"), "Error running hook script"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_run_hooks_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.HooksDirectories = []string{tc.hooksDir}
+
+			err := stateMachine.runHooks("post-populate-rootfs")
+			asserter.AssertErrContains(err, tc.expectedError)
+		})
+	}
+
+	t.Run("test_failed_validate_hooks_directories", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		stateMachine.commonFlags.HooksDirectories = []string{filepath.Join("testdata", "nonexistent")}
+		err := stateMachine.validateInput()
+		asserter.AssertErrContains(err, "Error reading hooks directory")
+
+		stateMachine.commonFlags.HooksDirectories = []string{
+			filepath.Join("testdata", "good_hookscript", "post-populate-rootfs")}
+		err = stateMachine.validateInput()
+		asserter.AssertErrContains(err, "is not a directory")
+	})
+}
@@ -0,0 +1,287 @@
+package statemachine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// replaceTag marks a list or a mapping of an image definition that replaces the
+// one of the files it extends or includes, rather than being merged with it
+const replaceTag = "!replace"
+
+// imageDefinitionFile is one of the files an image definition is made of: the file
+// given on the command line, or one of the files it extends or includes
+type imageDefinitionFile struct {
+	path     string
+	bytes    []byte
+	document *yamlv3.Node
+}
+
+// imageDefinitionFileError is a problem found while reading one of the files an
+// image definition is made of, located in that file
+type imageDefinitionFileError struct {
+	err              error
+	validationErrors []ValidationError
+}
+
+func (fileError *imageDefinitionFileError) Error() string {
+	return fileError.err.Error()
+}
+
+// mergedImageDefinition is an image definition merged with the files it extends
+// and includes. The nodes of the merged document are the ones of the files, so
+// the values can be located in the file that introduced them
+type mergedImageDefinition struct {
+	files     []imageDefinitionFile
+	document  *yamlv3.Node
+	nodeFiles map[*yamlv3.Node]string
+}
+
+// readImageDefinitionFiles reads the image definition at the given path and the files
+// it extends and includes, recursively. The files are returned in the order they are
+// merged in: the file it extends, the files it includes, then the file itself, so
+// that its values take precedence. Relative paths are relative to the directory of
+// the file that extends or includes them. A file reached several times, like the
+// common base of two included files, is only merged the first time
+func readImageDefinitionFiles(imageDefinitionPath string) ([]imageDefinitionFile, error) {
+	return readIncludedImageDefinitionFiles(imageDefinitionPath, nil, make(map[string]bool))
+}
+
+// absImageDefinitionPath identifies an image definition file by its absolute path,
+// so that the different relative paths of a file are recognized
+func absImageDefinitionPath(imageDefinitionPath string) string {
+	absPath, err := filepath.Abs(imageDefinitionPath)
+	if err != nil {
+		return filepath.Clean(imageDefinitionPath)
+	}
+	return absPath
+}
+
+// readIncludedImageDefinitionFiles reads an image definition file extended or included
+// by the files of includedBy, and the files it extends and includes. The files already
+// read are skipped, see readImageDefinitionFiles
+func readIncludedImageDefinitionFiles(imageDefinitionPath string, includedBy []string,
+	read map[string]bool) ([]imageDefinitionFile, error) {
+	absPath := absImageDefinitionPath(imageDefinitionPath)
+	for _, includer := range includedBy {
+		if includer == absPath {
+			return nil, fmt.Errorf("%s extends or includes itself", imageDefinitionPath)
+		}
+	}
+	if read[absPath] {
+		return nil, nil
+	}
+	imageDefinitionBytes, err := osReadFile(imageDefinitionPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening image definition file: %s", err.Error())
+	}
+
+	// the nodes of the document know where they are in the file
+	var document yamlv3.Node
+	if err := yamlv3.Unmarshal(imageDefinitionBytes, &document); err != nil {
+		return nil, &imageDefinitionFileError{
+			err:              fmt.Errorf("Error decoding %s: %s", imageDefinitionPath, err.Error()),
+			validationErrors: yamlErrors(imageDefinitionPath, nil, err),
+		}
+	}
+
+	// every file is decoded on its own, so the type errors are located in it
+	var imageDefinition imagedefinition.ImageDefinition
+	if err := yaml.NewDecoder(bytes.NewReader(imageDefinitionBytes)).Decode(&imageDefinition); err != nil {
+		return nil, &imageDefinitionFileError{
+			err:              fmt.Errorf("Error decoding %s: %s", imageDefinitionPath, err.Error()),
+			validationErrors: yamlErrors(imageDefinitionPath, &document, err),
+		}
+	}
+
+	type inclusion struct {
+		path    string
+		keyPath []string
+	}
+	var inclusions []inclusion
+	if imageDefinition.Extends != "" {
+		inclusions = append(inclusions, inclusion{imageDefinition.Extends, []string{"extends"}})
+	}
+	for i, include := range imageDefinition.Include {
+		inclusions = append(inclusions, inclusion{include, []string{"include", strconv.Itoa(i)}})
+	}
+
+	var files []imageDefinitionFile
+	for _, included := range inclusions {
+		includedPath := included.path
+		if !filepath.IsAbs(includedPath) {
+			includedPath = filepath.Join(filepath.Dir(imageDefinitionPath), includedPath)
+		}
+		includedFiles, err := readIncludedImageDefinitionFiles(includedPath,
+			append(append([]string{}, includedBy...), absPath), read)
+		if err != nil {
+			var fileError *imageDefinitionFileError
+			if errors.As(err, &fileError) {
+				return nil, err
+			}
+			line, column := locateKeyPath(&document, included.keyPath)
+			validationError := ValidationError{
+				File:    imageDefinitionPath,
+				Line:    line,
+				Column:  column,
+				Path:    formatKeyPath(included.keyPath),
+				Message: err.Error(),
+			}
+			return nil, &imageDefinitionFileError{
+				err:              fmt.Errorf("%s", validationError.String()),
+				validationErrors: []ValidationError{validationError},
+			}
+		}
+		files = append(files, includedFiles...)
+	}
+	read[absPath] = true
+	return append(files, imageDefinitionFile{
+		path:     imageDefinitionPath,
+		bytes:    imageDefinitionBytes,
+		document: &document,
+	}), nil
+}
+
+// mergeImageDefinitionFiles merges the documents of the files of an image definition,
+// in order. Mappings are merged key by key, lists are appended to the ones of the
+// previous files and scalars replace them. A list or a mapping tagged with !replace
+// replaces the one of the previous files instead
+func mergeImageDefinitionFiles(files []imageDefinitionFile) *mergedImageDefinition {
+	merged := &mergedImageDefinition{
+		files:     files,
+		nodeFiles: make(map[*yamlv3.Node]string),
+	}
+	document := &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+	for _, file := range files {
+		node := file.document
+		if node.Kind == yamlv3.DocumentNode && len(node.Content) > 0 {
+			node = node.Content[0]
+		}
+		if node.Kind != yamlv3.MappingNode {
+			continue
+		}
+		merged.addNodeFile(node, file.path)
+		document = merged.mergeNodes(document, node)
+	}
+
+	// the files to extend and include are only meaningful in the files themselves
+	var content []*yamlv3.Node
+	for i := 0; i+1 < len(document.Content); i += 2 {
+		if key := document.Content[i].Value; key != "extends" && key != "include" {
+			content = append(content, document.Content[i], document.Content[i+1])
+		}
+	}
+	document.Content = content
+	removeReplaceTags(document)
+	merged.document = document
+	return merged
+}
+
+// addNodeFile records the file of a node and of the nodes it contains
+func (merged *mergedImageDefinition) addNodeFile(node *yamlv3.Node, path string) {
+	merged.nodeFiles[node] = path
+	for _, child := range node.Content {
+		merged.addNodeFile(child, path)
+	}
+}
+
+// mergeNodes merges a node of an image definition file into the node of the files
+// merged before it, and returns the merged node
+func (merged *mergedImageDefinition) mergeNodes(base *yamlv3.Node, override *yamlv3.Node) *yamlv3.Node {
+	if override.Tag == replaceTag {
+		return override
+	}
+	switch {
+	case base.Kind == yamlv3.MappingNode && override.Kind == yamlv3.MappingNode:
+		mergedNode := *override
+		mergedNode.Content = append([]*yamlv3.Node{}, base.Content...)
+		for i := 0; i+1 < len(override.Content); i += 2 {
+			key, value := override.Content[i], override.Content[i+1]
+			found := false
+			for j := 0; j+1 < len(mergedNode.Content); j += 2 {
+				if mergedNode.Content[j].Value == key.Value {
+					mergedNode.Content[j+1] = merged.mergeNodes(mergedNode.Content[j+1], value)
+					found = true
+					break
+				}
+			}
+			if !found {
+				mergedNode.Content = append(mergedNode.Content, key, value)
+			}
+		}
+		merged.nodeFiles[&mergedNode] = merged.nodeFiles[override]
+		return &mergedNode
+	case base.Kind == yamlv3.SequenceNode && override.Kind == yamlv3.SequenceNode:
+		mergedNode := *override
+		mergedNode.Content = append(append([]*yamlv3.Node{}, base.Content...), override.Content...)
+		merged.nodeFiles[&mergedNode] = merged.nodeFiles[override]
+		return &mergedNode
+	}
+	return override
+}
+
+// removeReplaceTags removes the !replace tags once the files are merged, so the
+// merged document is decoded as if the nodes were not tagged
+func removeReplaceTags(node *yamlv3.Node) {
+	if node.Tag == replaceTag {
+		node.Tag = ""
+	}
+	for _, child := range node.Content {
+		removeReplaceTags(child)
+	}
+}
+
+// decode decodes the merged image definition into the ImageDefinition struct
+func (merged *mergedImageDefinition) decode(imageDefinition *imagedefinition.ImageDefinition) error {
+	imageDefinitionBytes := merged.files[len(merged.files)-1].bytes
+	if len(merged.files) > 1 {
+		var err error
+		imageDefinitionBytes, err = yamlv3.Marshal(merged.document)
+		if err != nil {
+			return fmt.Errorf("Error merging the image definition files: %s", err.Error())
+		}
+	}
+	return yaml.NewDecoder(bytes.NewReader(imageDefinitionBytes)).Decode(imageDefinition)
+}
+
+// locate returns the file, line and column of the value of a key path in the merged
+// image definition. If the path does not exist, the closest existing parent is located
+func (merged *mergedImageDefinition) locate(keyPath []string) (string, int, int) {
+	node := nodeAtKeyPath(merged.document, keyPath)
+	return merged.nodeFiles[node], node.Line, node.Column
+}
+
+// validationErrors locates the problems found in the merged image definition in
+// the files that introduced the values
+func (merged *mergedImageDefinition) validationErrors(keyErrors []keyError) []ValidationError {
+	var validationErrors []ValidationError
+	for _, err := range keyErrors {
+		file, line, column := merged.locate(err.keyPath)
+		validationErrors = append(validationErrors, ValidationError{
+			File:    file,
+			Line:    line,
+			Column:  column,
+			Path:    formatKeyPath(err.keyPath),
+			Message: err.message,
+		})
+	}
+	return validationErrors
+}
+
+// imageDefinitionFilesError joins the problems found in the files of an image
+// definition into a single error
+func imageDefinitionFilesError(prefix string, validationErrors []ValidationError) error {
+	var problems []string
+	for _, validationError := range validationErrors {
+		problems = append(problems, validationError.String())
+	}
+	return fmt.Errorf("%s:\n  %s", prefix, strings.Join(problems, "\n  "))
+}
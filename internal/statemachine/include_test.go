@@ -0,0 +1,200 @@
+// This test file tests the image definitions that extend and include other files
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestParseImageDefinitionIncludes ensures that an image definition is merged with
+// the files it extends and includes
+func TestParseImageDefinitionIncludes(t *testing.T) {
+	t.Run("test_parse_image_definition_includes", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"includes", "child.yaml")
+		err := stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+
+		imageDef := stateMachine.ImageDef
+		// scalars are overridden, the keys that are not overridden are kept
+		if imageDef.ImageName != "ubuntu-server-amd64-child" || imageDef.Series != "jammy" ||
+			imageDef.Gadget == nil || imageDef.Gadget.GadgetType != "git" {
+			t.Errorf("Expected the keys of base.yaml to be overridden by child.yaml but got %+v", imageDef)
+		}
+		if imageDef.Extends != "" || imageDef.Include != nil {
+			t.Errorf("Expected the extended and included files to be left out of the image definition")
+		}
+
+		var extraSnaps, extraPackages []string
+		for _, snap := range imageDef.Customization.ExtraSnaps {
+			extraSnaps = append(extraSnaps, snap.SnapName)
+		}
+		for _, extraPackage := range imageDef.Customization.ExtraPackages {
+			extraPackages = append(extraPackages, extraPackage.PackageName)
+		}
+		// lists are appended, unless they are marked with !replace
+		if !reflect.DeepEqual(extraSnaps, []string{"core22"}) {
+			t.Errorf("Expected the extra snaps to be replaced but got %q", extraSnaps)
+		}
+		expectedPackages := []string{"hello-ubuntu-image-public", "hello-ubuntu-image-private"}
+		if !reflect.DeepEqual(extraPackages, expectedPackages) {
+			t.Errorf("Expected the extra packages to be %q but got %q", expectedPackages, extraPackages)
+		}
+		if len(imageDef.Customization.Fstab) != 1 || imageDef.Customization.Fstab[0].Label != "writable" {
+			t.Errorf("Expected the fstab of fstab.yaml to be included but got %+v", imageDef.Customization.Fstab)
+		}
+	})
+	t.Run("test_parse_image_definition_includes_diamond", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"includes", "diamond.yaml")
+		err := stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+
+		// fstab.yaml is included by both included files, but only merged once
+		imageDef := stateMachine.ImageDef
+		if len(imageDef.Customization.Fstab) != 1 {
+			t.Errorf("Expected the fstab of fstab.yaml to be merged once but got %+v",
+				imageDef.Customization.Fstab)
+		}
+		var extraPackages []string
+		for _, extraPackage := range imageDef.Customization.ExtraPackages {
+			extraPackages = append(extraPackages, extraPackage.PackageName)
+		}
+		expectedPackages := []string{"hello-ubuntu-image-public", "hello-left", "hello-right"}
+		if !reflect.DeepEqual(extraPackages, expectedPackages) {
+			t.Errorf("Expected the extra packages to be %q but got %q", expectedPackages, extraPackages)
+		}
+	})
+	t.Run("test_parse_image_definition_includes_errors", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		includesDir := filepath.Join("testdata", "image_definitions", "includes")
+
+		// the problems are located in the file that introduced the value
+		stateMachine.Args.ImageDefinition = filepath.Join(includesDir, "bad_child.yaml")
+		err := stateMachine.parseImageDefinition()
+		asserter.AssertErrContains(err, filepath.Join(includesDir, "bad_class.yaml")+":1:8: class: Class must be one of the following")
+
+		stateMachine.Args.ImageDefinition = filepath.Join(includesDir, "missing_include.yaml")
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrContains(err, filepath.Join(includesDir, "missing_include.yaml")+":4:5: include[1]: Error opening image definition file")
+
+		stateMachine.Args.ImageDefinition = filepath.Join(includesDir, "cycle.yaml")
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrContains(err, "include[0]: "+filepath.Join(includesDir, "cycle.yaml")+" extends or includes itself")
+	})
+}
+
+// TestValidateImageDefinitionIncludes ensures that the validate command reports the
+// problems of an image definition in the files it extends and includes
+func TestValidateImageDefinitionIncludes(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	defer os.RemoveAll(tmpDir)
+	includesDir := filepath.Join("testdata", "image_definitions", "includes")
+	wrongTypes := filepath.Join(tmpDir, "wrong_types.yaml")
+	err = os.WriteFile(wrongTypes, []byte("extends: base.yaml\ninclude:\n  - fragment.yaml\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(tmpDir, "base.yaml"), []byte("name: test\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(tmpDir, "fragment.yaml"), []byte("revision: abc\nextra-snap: hello\n"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	testCases := []struct {
+		name            string
+		imageDefinition string
+		expected        []string
+	}{
+		{"valid", filepath.Join(includesDir, "child.yaml"), nil},
+		{"bad_value", filepath.Join(includesDir, "bad_child.yaml"), []string{
+			filepath.Join(includesDir, "bad_class.yaml") + ":1:8: class: Class must be one of the following",
+		}},
+		{"wrong_types", wrongTypes, []string{
+			filepath.Join(tmpDir, "fragment.yaml") + ":1:11: revision: cannot unmarshal !!str `abc` into int",
+		}},
+		{"cycle", filepath.Join(includesDir, "cycle.yaml"), []string{
+			filepath.Join(includesDir, "cycle.yaml") + ":3:5: include[0]: ",
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_validate_image_definition_includes_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			validationErrors, err := ValidateImageDefinition(tc.imageDefinition, false, nil)
+			asserter.AssertErrNil(err, true)
+			if len(validationErrors) != len(tc.expected) {
+				t.Fatalf("Expected %d errors but got %q", len(tc.expected), validationErrors)
+			}
+			for i, validationError := range validationErrors {
+				if !strings.HasPrefix(validationError.String(), tc.expected[i]) {
+					t.Errorf("Expected error %d to start with \"%s\" but got \"%s\"", i, tc.expected[i], validationError)
+				}
+			}
+		})
+	}
+
+	t.Run("test_validate_image_definition_includes_unknown_keys", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		err := os.WriteFile(filepath.Join(tmpDir, "fragment.yaml"), []byte("revision: 2\nextra-snap: hello\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		validationErrors, err := ValidateImageDefinition(wrongTypes, false, nil)
+		asserter.AssertErrNil(err, true)
+		if len(validationErrors) == 0 || validationErrors[0].File != filepath.Join(tmpDir, "fragment.yaml") ||
+			validationErrors[0].Line != 2 || validationErrors[0].Path != "extra-snap" {
+			t.Errorf("Expected the unknown key to be located in fragment.yaml but got %q", validationErrors)
+		}
+	})
+}
+
+// TestImageDefinitionChecksumIncludes ensures that the checksum of an image definition
+// changes when a file it includes is modified, so a build can't be resumed with it
+func TestImageDefinitionChecksumIncludes(t *testing.T) {
+	t.Run("test_image_definition_checksum_includes", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		fragment := filepath.Join(tmpDir, "fragment.yaml")
+		err = os.WriteFile(filepath.Join(tmpDir, "image.yaml"), []byte("name: test\ninclude:\n  - fragment.yaml\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(fragment, []byte("revision: 1\n"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.Args.ImageDefinition = filepath.Join(tmpDir, "image.yaml")
+		checksum, err := stateMachine.imageDefinitionChecksum()
+		asserter.AssertErrNil(err, true)
+
+		err = os.WriteFile(fragment, []byte("revision: 2\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		modifiedChecksum, err := stateMachine.imageDefinitionChecksum()
+		asserter.AssertErrNil(err, true)
+		if checksum == modifiedChecksum {
+			t.Errorf("Expected the checksum to change when an included file is modified")
+		}
+	})
+}
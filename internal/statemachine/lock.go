@@ -0,0 +1,193 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lockFileName is the name of the file in the workdir that is locked while
+// a build or `ubuntu-image cleanup` uses the workdir
+const lockFileName = "ubuntu-image.lock"
+
+var osHostname = os.Hostname
+
+// heldWorkDirLocks records the workdirs locked by this process, by their absolute
+// path. flock(2) doesn't tell the owner of a lock apart from another build of the
+// same process, like concurrent calls of pkg/ubuntuimage.Build
+var heldWorkDirLocks = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// lockOwner records who holds the lock of a workdir
+type lockOwner struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// workDirLock is an advisory lock on a workdir, taken with flock(2) on the lock
+// file. The kernel releases it when the process exits, even if it crashed or
+// was killed, so a lock file that can be locked again is stale
+type workDirLock struct {
+	workDir string
+	path    string
+	file    *os.File
+}
+
+// lockWorkDir locks the given workdir, refusing to do so if another process or
+// another build of this process holds the lock. A stale lock left behind by a
+// process that is gone is broken, and a warning explaining it is returned. A
+// state machine that holds the lock keeps it when it resumes, see lock
+func lockWorkDir(workDir string) (*workDirLock, string, error) {
+	absWorkDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error resolving the workdir: %s", err.Error())
+	}
+	heldWorkDirLocks.Lock()
+	defer heldWorkDirLocks.Unlock()
+	if heldWorkDirLocks.paths[absWorkDir] {
+		return nil, "", fmt.Errorf("the workdir %s is in use by another build of this process", workDir)
+	}
+	lock, warning, err := flockWorkDir(workDir)
+	if err != nil {
+		return nil, "", err
+	}
+	lock.workDir = absWorkDir
+	heldWorkDirLocks.paths[absWorkDir] = true
+	return lock, warning, nil
+}
+
+// flockWorkDir takes the flock(2) lock of the lock file of the given workdir
+func flockWorkDir(workDir string) (*workDirLock, string, error) {
+	lockPath := filepath.Join(workDir, lockFileName)
+	hostname, _ := osHostname()
+	for {
+		lockFile, err := osOpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error opening lock file: %s", err.Error())
+		}
+		previousOwner, _ := readLockOwner(lockFile)
+
+		err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			lockFile.Close()
+			return nil, "", lockedError(workDir, previousOwner)
+		}
+		if err != nil {
+			lockFile.Close()
+			return nil, "", fmt.Errorf("Error locking workdir %s: %s", workDir, err.Error())
+		}
+
+		// the owner that released the lock may have removed the lock file after
+		// we opened it, in which case we hold the lock of a file that another
+		// process can't see. Try again with the current lock file
+		if !sameFile(lockFile, lockPath) {
+			lockFile.Close()
+			continue
+		}
+
+		var warning string
+		if previousOwner != nil {
+			warning = fmt.Sprintf("breaking the stale lock of workdir %s held by PID %d on host %s "+
+				"since %s", workDir, previousOwner.PID, previousOwner.Host,
+				previousOwner.Started.Format(time.RFC3339))
+		}
+		owner := lockOwner{PID: os.Getpid(), Host: hostname, Started: time.Now()}
+		ownerBytes, _ := json.Marshal(owner)
+		if err := lockFile.Truncate(0); err != nil {
+			lockFile.Close()
+			return nil, "", fmt.Errorf("Error writing lock file: %s", err.Error())
+		}
+		if _, err := lockFile.WriteAt(ownerBytes, 0); err != nil {
+			lockFile.Close()
+			return nil, "", fmt.Errorf("Error writing lock file: %s", err.Error())
+		}
+		return &workDirLock{path: lockPath, file: lockFile}, warning, nil
+	}
+}
+
+// readLockOwner reads the owner recorded in a lock file. It returns
+// nil if the lock file is empty, as it is when it was just created
+func readLockOwner(lockFile *os.File) (*lockOwner, error) {
+	ownerBytes, err := ioReadAll(lockFile)
+	if err != nil || len(ownerBytes) == 0 {
+		return nil, err
+	}
+	var owner lockOwner
+	if err := json.Unmarshal(ownerBytes, &owner); err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
+
+// sameFile returns whether the open file is the one found at path
+func sameFile(file *os.File, path string) bool {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fileInfo, pathInfo)
+}
+
+// lockedError explains who is using the workdir
+func lockedError(workDir string, owner *lockOwner) error {
+	if owner == nil {
+		return fmt.Errorf("the workdir %s is in use by another ubuntu-image process", workDir)
+	}
+	return fmt.Errorf("the workdir %s is in use by another ubuntu-image process (PID %d on host %s, "+
+		"started %s). Wait for it to finish or use another workdir", workDir, owner.PID, owner.Host,
+		owner.Started.Format(time.RFC3339))
+}
+
+// release removes the lock file and then unlocks it. A process that opened the
+// lock file before it was removed notices it is gone and creates a new one
+func (lock *workDirLock) release() error {
+	if lock == nil {
+		return nil
+	}
+	defer func() {
+		lock.file.Close()
+		heldWorkDirLocks.Lock()
+		delete(heldWorkDirLocks.paths, lock.workDir)
+		heldWorkDirLocks.Unlock()
+	}()
+	if err := os.Remove(lock.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing lock file: %s", err.Error())
+	}
+	return nil
+}
+
+// lock locks the workdir of the state machine for the rest of the build. A state
+// machine that already holds the lock, because it is resumed, keeps it
+func (stateMachine *StateMachine) lock() error {
+	if stateMachine.workDirLock != nil {
+		return nil
+	}
+	lock, warning, err := lockWorkDir(stateMachine.stateMachineFlags.WorkDir)
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		stateMachine.warningf("%s\n", warning)
+	}
+	stateMachine.workDirLock = lock
+	return nil
+}
+
+// unlock releases the lock on the workdir, if it is held
+func (stateMachine *StateMachine) unlock() error {
+	err := stateMachine.workDirLock.release()
+	stateMachine.workDirLock = nil
+	return err
+}
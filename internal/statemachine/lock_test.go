@@ -0,0 +1,150 @@
+// This test file tests the lock that prevents builds from sharing a workdir
+package statemachine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// otherOwner pretends the lock is held by a process on another host
+var otherOwner = lockOwner{PID: 4242, Host: "otherhost", Started: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+// pretendOtherOwner rewrites the owner recorded in a lock that is held by this process
+func pretendOtherOwner(t *testing.T, lock *workDirLock) {
+	asserter := helper.Asserter{T: t}
+	ownerBytes, err := json.Marshal(otherOwner)
+	asserter.AssertErrNil(err, true)
+	err = lock.file.Truncate(0)
+	asserter.AssertErrNil(err, true)
+	_, err = lock.file.WriteAt(ownerBytes, 0)
+	asserter.AssertErrNil(err, true)
+}
+
+// TestLockWorkDir ensures that a workdir locked by a build can't be locked by another
+// build of the same process, and that it can be locked again once the lock is released
+func TestLockWorkDir(t *testing.T) {
+	t.Run("test_lock_workdir", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		lock, warning, err := lockWorkDir(workDir)
+		asserter.AssertErrNil(err, true)
+		if warning != "" {
+			t.Errorf("Expected no warning but got \"%s\"", warning)
+		}
+
+		// another build of the same process can't lock it, whatever
+		// the path it is given with
+		_, _, err = lockWorkDir(filepath.Join(workDir, "..", filepath.Base(workDir)))
+		asserter.AssertErrContains(err, "is in use by another build of this process")
+		if _, err := os.Stat(filepath.Join(workDir, lockFileName)); err != nil {
+			t.Errorf("Expected the lock file to be kept by the owner of the lock")
+		}
+
+		err = lock.release()
+		asserter.AssertErrNil(err, true)
+		if _, err := os.Stat(filepath.Join(workDir, lockFileName)); !os.IsNotExist(err) {
+			t.Errorf("Expected the lock file to be removed")
+		}
+		lock, _, err = lockWorkDir(workDir)
+		asserter.AssertErrNil(err, true)
+		err = lock.release()
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestLockWorkDirOtherProcess ensures that a workdir locked by another process
+// can't be locked, and that the owner of the lock is reported
+func TestLockWorkDirOtherProcess(t *testing.T) {
+	t.Run("test_lock_workdir_other_process", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		// the flock of another process isn't recorded in heldWorkDirLocks
+		otherLock, _, err := flockWorkDir(workDir)
+		asserter.AssertErrNil(err, true)
+		pretendOtherOwner(t, otherLock)
+		_, _, err = lockWorkDir(workDir)
+		asserter.AssertErrContains(err, "is in use by another ubuntu-image process (PID 4242 on host "+
+			"otherhost, started 2023-01-02T03:04:05Z)")
+
+		err = otherLock.release()
+		asserter.AssertErrNil(err, true)
+		lock, _, err := lockWorkDir(workDir)
+		asserter.AssertErrNil(err, true)
+		err = lock.release()
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestStaleWorkDirLock ensures that the lock left behind by a process that is gone is broken
+func TestStaleWorkDirLock(t *testing.T) {
+	t.Run("test_stale_workdir_lock", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		ownerBytes, err := json.Marshal(otherOwner)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(workDir, lockFileName), ownerBytes, 0644)
+		asserter.AssertErrNil(err, true)
+
+		lock, warning, err := lockWorkDir(workDir)
+		asserter.AssertErrNil(err, true)
+		defer lock.release()
+		if !strings.Contains(warning, "breaking the stale lock of workdir "+workDir+" held by PID 4242 on host otherhost") {
+			t.Errorf("Unexpected warning \"%s\"", warning)
+		}
+
+		lockBytes, err := os.ReadFile(filepath.Join(workDir, lockFileName))
+		asserter.AssertErrNil(err, true)
+		var owner lockOwner
+		err = json.Unmarshal(lockBytes, &owner)
+		asserter.AssertErrNil(err, true)
+		if owner.PID != os.Getpid() {
+			t.Errorf("Expected the lock to be owned by PID %d but it is owned by PID %d", os.Getpid(), owner.PID)
+		}
+	})
+}
+
+// TestLockedWorkDir ensures that a build or cleanup refuses to use a workdir
+// that is used by another build
+func TestLockedWorkDir(t *testing.T) {
+	t.Run("test_locked_workdir", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		// the flock of another process isn't recorded in heldWorkDirLocks
+		otherLock, _, err := flockWorkDir(workDir)
+		asserter.AssertErrNil(err, true)
+		pretendOtherOwner(t, otherLock)
+
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		err = stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrContains(err, "is in use by another ubuntu-image process (PID 4242")
+
+		err = Cleanup(workDir)
+		asserter.AssertErrContains(err, "is in use by another ubuntu-image process (PID 4242")
+
+		err = otherLock.release()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.unlock()
+		asserter.AssertErrNil(err, true)
+	})
+}
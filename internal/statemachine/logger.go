@@ -0,0 +1,151 @@
+package statemachine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// buildLogFileName is the name of the file in the workdir the build log is written to
+const buildLogFileName = "build.log"
+
+// Logger receives the messages printed while an image is built, such as the
+// states being run, warnings and debug output. *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LogLevel is the severity of a message of the build
+type LogLevel = helper.LogLevel
+
+// The levels of the messages of the build, from the least to the most severe
+const (
+	LogDebug   = helper.LogDebug
+	LogInfo    = helper.LogInfo
+	LogWarning = helper.LogWarning
+	LogError   = helper.LogError
+)
+
+// LeveledLogger is a Logger that also receives the level of every message and
+// the state that logged it. If the logger set with SetLogger implements it, Logf
+// receives every message whatever the verbosity of the build, and Printf only
+// the output that is not a log message, like the plan and the profile summary
+type LeveledLogger interface {
+	Logger
+	Logf(level LogLevel, state string, format string, v ...interface{})
+}
+
+// consoleLogger prints the messages to the console. It is used unless
+// another logger is set with SetLogger
+type consoleLogger struct {
+	output io.Writer
+}
+
+func (logger consoleLogger) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(logger.output, format, v...)
+}
+
+// consoleOutput returns where the messages of the build and the live output of
+// the commands it runs are printed. With --progress-format=json, stdout only
+// receives the events, so everything else goes to stderr
+func (stateMachine *StateMachine) consoleOutput() io.Writer {
+	if stateMachine.commonFlags.ProgressFormat == "json" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// SetLogger sets the logger that receives the messages of the build
+func (stateMachine *StateMachine) SetLogger(logger Logger) {
+	stateMachine.log = logger
+}
+
+// SetEventHandler sets a function that is called with every event of the
+// build, regardless of --progress-format
+func (stateMachine *StateMachine) SetEventHandler(handler func(Event)) {
+	stateMachine.eventHandler = handler
+}
+
+// logger returns the logger set with SetLogger, or one printing to the console. The
+// messages of states that run concurrently are held back, see runConcurrently
+func (stateMachine *StateMachine) logger() Logger {
+	if stateMachine.deferred != nil {
+		return stateMachine.deferred
+	}
+	if stateMachine.log == nil {
+		return consoleLogger{output: stateMachine.consoleOutput()}
+	}
+	return stateMachine.log
+}
+
+// buildLogger returns the build log, which receives every message of the
+// build and the output of the commands it runs, whatever the verbosity
+func (stateMachine *StateMachine) buildLogger() *helper.BuildLog {
+	if stateMachine.buildLog == nil {
+		stateMachine.buildLog = helper.NewBuildLog()
+	}
+	return stateMachine.buildLog
+}
+
+// openBuildLog starts writing the build log to the workdir, including the
+// messages logged before the workdir was created
+func (stateMachine *StateMachine) openBuildLog() error {
+	return stateMachine.buildLogger().Open(filepath.Join(stateMachine.stateMachineFlags.WorkDir,
+		buildLogFileName))
+}
+
+// logf writes a message to the build log and sends it to the logger, see printLog
+func (stateMachine *StateMachine) logf(level LogLevel, format string, v ...interface{}) {
+	stateMachine.buildLogger().Log(level, stateMachine.CurrentStep, format, v...)
+	stateMachine.printLog(level, stateMachine.CurrentStep, fmt.Sprintf(format, v...))
+}
+
+// printLog sends a message to the logger. A LeveledLogger receives all of them,
+// otherwise the verbosity of the build decides: debug messages are printed with
+// --debug and the other messages unless --quiet is given. When the progress is
+// reported as JSON, they are printed to stderr, see consoleOutput
+func (stateMachine *StateMachine) printLog(level LogLevel, state string, message string) {
+	message = stateMachine.redact(message)
+	if leveledLogger, ok := stateMachine.logger().(LeveledLogger); ok {
+		leveledLogger.Logf(level, state, "%s", message)
+		return
+	}
+	var printed bool
+	switch level {
+	case LogDebug:
+		printed = stateMachine.commonFlags.Debug
+	default:
+		printed = !stateMachine.commonFlags.Quiet
+	}
+	if !printed {
+		return
+	}
+	if level == LogWarning {
+		message = "WARNING: " + message
+	}
+	stateMachine.logger().Printf("%s", message)
+}
+
+// debugf logs a debug message, see logf
+func (stateMachine *StateMachine) debugf(format string, v ...interface{}) {
+	stateMachine.logf(LogDebug, format, v...)
+}
+
+// infof logs an informational message, see logf
+func (stateMachine *StateMachine) infof(format string, v ...interface{}) {
+	stateMachine.logf(LogInfo, format, v...)
+}
+
+// warningf logs a warning, which is printed with a "WARNING: " prefix, see logf
+func (stateMachine *StateMachine) warningf(format string, v ...interface{}) {
+	stateMachine.logf(LogWarning, format, v...)
+}
+
+// commandLog returns a writer logging the output of a command in the build log.
+// It must be flushed once the command finished
+func (stateMachine *StateMachine) commandLog() *helper.LogWriter {
+	return stateMachine.buildLogger().Writer(LogDebug, stateMachine.CurrentStep)
+}
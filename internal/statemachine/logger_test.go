@@ -0,0 +1,175 @@
+// This test file tests the leveled logging and the build log
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// testLeveledLogger records the log messages with their level and state
+type testLeveledLogger struct {
+	testLogger
+	logs []string
+}
+
+func (logger *testLeveledLogger) Logf(level LogLevel, state string, format string, v ...interface{}) {
+	logger.logs = append(logger.logs, fmt.Sprintf("%s %s %s", level, state, fmt.Sprintf(format, v...)))
+}
+
+// TestLogLevels ensures that the verbosity flags decide which messages are printed
+func TestLogLevels(t *testing.T) {
+	testCases := []struct {
+		name           string
+		quiet          bool
+		debug          bool
+		progressFormat string
+		expected       []string
+	}{
+		{"default", false, false, "text", []string{"info\n", "WARNING: warning\n"}},
+		{"debug", false, true, "text", []string{"debug\n", "info\n", "WARNING: warning\n"}},
+		{"quiet", true, false, "text", nil},
+		{"json", false, false, "json", []string{"info\n", "WARNING: warning\n"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_log_levels_"+tc.name, func(t *testing.T) {
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Quiet = tc.quiet
+			stateMachine.commonFlags.Debug = tc.debug
+			stateMachine.commonFlags.ProgressFormat = tc.progressFormat
+			logger := &testLogger{}
+			stateMachine.SetLogger(logger)
+
+			stateMachine.debugf("debug\n")
+			stateMachine.infof("info\n")
+			stateMachine.warningf("warning\n")
+			if !reflect.DeepEqual(logger.messages, tc.expected) {
+				t.Errorf("Expected messages %q but got %q", tc.expected, logger.messages)
+			}
+		})
+	}
+}
+
+// TestLeveledLogger ensures that a LeveledLogger receives every log message with
+// its level and state, including the ones of states that ran concurrently
+func TestLeveledLogger(t *testing.T) {
+	t.Run("test_leveled_logger", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Quiet = true
+		stateMachine.commonFlags.Jobs = 2
+		logger := &testLeveledLogger{}
+		stateMachine.SetLogger(logger)
+
+		debugState := func(name string) stateFunc {
+			return stateFunc{name, func(stateMachine *StateMachine) error {
+				stateMachine.debugf("debug %s\n", name)
+				return nil
+			}}
+		}
+		stateMachine.states = []stateFunc{
+			debugState("populate_rootfs_contents"),
+			debugState("generate_manifest"),
+			debugState("generate_filelist"),
+		}
+		err := stateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		expected := []string{
+			"INFO populate_rootfs_contents [0] populate_rootfs_contents\n",
+			"DEBUG populate_rootfs_contents debug populate_rootfs_contents\n",
+			"INFO generate_manifest [1] generate_manifest\n",
+			"DEBUG generate_manifest debug generate_manifest\n",
+			"INFO generate_filelist [2] generate_filelist\n",
+			"DEBUG generate_filelist debug generate_filelist\n",
+		}
+		if !reflect.DeepEqual(logger.logs, expected) {
+			t.Errorf("Expected log messages %q but got %q", expected, logger.logs)
+		}
+		if len(logger.messages) != 0 {
+			t.Errorf("Expected no messages besides the log messages but got %q", logger.messages)
+		}
+	})
+}
+
+// TestBuildLog ensures that the build log in the workdir receives every message and
+// the output of the commands, whatever the verbosity of the build
+func TestBuildLog(t *testing.T) {
+	t.Run("test_build_log", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.commonFlags.Quiet = true
+		logger := &testLogger{}
+		stateMachine.SetLogger(logger)
+
+		// messages logged before the workdir exists are kept until the log is opened
+		stateMachine.debugf("before the workdir\n")
+		stateMachine.CurrentStep = "make_temporary_directories"
+		err = stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer stateMachine.unlock()
+
+		stateMachine.CurrentStep = "germinate"
+		stateMachine.warningf("first line\nsecond line\n")
+		_, err = stateMachine.runCmd(exec.Command("sh", "-c", "echo output; printf 'error' >&2"))
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.buildLogger().Close()
+		asserter.AssertErrNil(err, true)
+
+		if len(logger.messages) != 0 {
+			t.Errorf("Expected nothing to be printed with --quiet but got %q", logger.messages)
+		}
+
+		buildLogBytes, err := os.ReadFile(filepath.Join(workDir, buildLogFileName))
+		asserter.AssertErrNil(err, true)
+		lines := strings.Split(strings.TrimSuffix(string(buildLogBytes), "\n"), "\n")
+		expected := []string{
+			"DEBUG before the workdir",
+			"WARNING [germinate] first line",
+			"WARNING [germinate] second line",
+			"DEBUG [germinate] Running sh -c echo output; printf 'error' >&2",
+			"DEBUG [germinate] output",
+			"DEBUG [germinate] error",
+		}
+		if len(lines) != len(expected) {
+			t.Fatalf("Expected the build log to have %d lines but got:\n%s", len(expected), string(buildLogBytes))
+		}
+		timestamp := regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}(Z|[+-]\d{2}:\d{2}) `)
+		for i, line := range lines {
+			if !timestamp.MatchString(line) {
+				t.Errorf("Expected line \"%s\" to start with a timestamp", line)
+			}
+			if message := timestamp.ReplaceAllString(line, ""); message != expected[i] {
+				t.Errorf("Expected line %d of the build log to be \"%s\" but got \"%s\"", i, expected[i], message)
+			}
+		}
+	})
+}
+
+// TestFailedOpenBuildLog tests failing to open the build log
+func TestFailedOpenBuildLog(t *testing.T) {
+	t.Run("test_failed_open_build_log", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.WorkDir = filepath.Join("/tmp", "ubuntu-image-does-not-exist")
+		err := stateMachine.openBuildLog()
+		asserter.AssertErrContains(err, "Error opening build log")
+	})
+}
@@ -0,0 +1,170 @@
+package statemachine
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// metadataFileName is the name of the state file written to the workdir
+const metadataFileName = "ubuntu-image.json"
+
+// legacyMetadataFileName is the name of the gob encoded state
+// file written by older versions of ubuntu-image
+const legacyMetadataFileName = "ubuntu-image.gob"
+
+// metadataVersion is the version of the state file schema. It must be
+// increased whenever the information needed to resume a build changes
+const metadataVersion = 1
+
+// stateMachineMetadata is the information persisted in the workdir
+// that allows a partial state machine run to be resumed
+type stateMachineMetadata struct {
+	Version      int                      `json:"version"`
+	ImageType    string                   `json:"image_type,omitempty"`
+	CurrentStep  string                   `json:"current_step"`
+	StepsTaken   int                      `json:"steps_taken"`
+	YamlFilePath string                   `json:"yaml_file_path,omitempty"`
+	IsSeeded     bool                     `json:"is_seeded"`
+	SectorSize   quantity.Size            `json:"sector_size,omitempty"`
+	RootfsSize   quantity.Size            `json:"rootfs_size,omitempty"`
+	GadgetInfo   *gadget.Info             `json:"gadget_info,omitempty"`
+	ImageSizes   map[string]quantity.Size `json:"image_sizes,omitempty"`
+	VolumeOrder  []string                 `json:"volume_order,omitempty"`
+	VolumeNames  map[string]string        `json:"volume_names,omitempty"`
+	OutputDir    string                   `json:"output_dir,omitempty"`
+
+	// the names of all the states of the build, including the ones that have
+	// not run yet. This is used to make sure a resumed build runs the same states
+	StateNames []string `json:"states"`
+
+	// only set for classic builds
+	Classic *classicMetadata `json:"classic,omitempty"`
+}
+
+// classicMetadata holds the information specific to partial classic builds
+type classicMetadata struct {
+	ImageDefinitionPath   string                          `json:"image_definition_path"`
+	ImageDefinitionSHA256 string                          `json:"image_definition_sha256,omitempty"`
+	SetOverridesSHA256    string                          `json:"set_overrides_sha256,omitempty"`
+	ImageDef              imagedefinition.ImageDefinition `json:"image_definition"`
+	Packages              []string                        `json:"packages,omitempty"`
+	Snaps                 []string                        `json:"snaps,omitempty"`
+}
+
+// loadMetadata reads the state file of a partial build from the workdir. If only
+// a gob encoded state file written by an older version of ubuntu-image is found,
+// it is migrated to the current schema
+func loadMetadata(workDir string) (*stateMachineMetadata, error) {
+	var metadata stateMachineMetadata
+	metadataBytes, err := osReadFile(filepath.Join(workDir, metadataFileName))
+	if err == nil {
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to parse metadata file: %s", err.Error())
+		}
+		if metadata.Version == 0 {
+			return nil, fmt.Errorf("failed to parse metadata file: no schema version found")
+		}
+		if metadata.Version > metadataVersion {
+			return nil, fmt.Errorf("metadata file version %d is newer than the version %d "+
+				"supported by this version of ubuntu-image", metadata.Version, metadataVersion)
+		}
+	} else if os.IsNotExist(err) {
+		if err := loadLegacyMetadata(workDir, &metadata); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("error reading metadata file: %s", err.Error())
+	}
+
+	// the volume names are not part of the JSON representation of gadget.Info
+	if metadata.GadgetInfo != nil {
+		for name, volume := range metadata.GadgetInfo.Volumes {
+			volume.Name = name
+			for i := range volume.Structure {
+				volume.Structure[i].VolumeName = name
+			}
+		}
+	}
+	return &metadata, nil
+}
+
+// loadLegacyMetadata decodes a gob encoded state file. Older versions of
+// ubuntu-image encoded the whole StateMachine struct, whose exported fields
+// are decoded into the matching fields of the metadata
+func loadLegacyMetadata(workDir string, metadata *stateMachineMetadata) error {
+	gobfile, err := osOpen(filepath.Join(workDir, legacyMetadataFileName))
+	if err != nil {
+		return fmt.Errorf("error reading metadata file: %s", err.Error())
+	}
+	defer gobfile.Close()
+	if err := gob.NewDecoder(gobfile).Decode(metadata); err != nil {
+		return fmt.Errorf("failed to parse metadata file: %s", err.Error())
+	}
+	metadata.Version = metadataVersion
+	return nil
+}
+
+// ShowState prints the progress of the partial build in the given workdir
+func ShowState(workDir string) error {
+	metadata, err := loadMetadata(workDir)
+	if err != nil {
+		return err
+	}
+
+	if metadata.ImageType != "" {
+		fmt.Printf("Image type: %s\n", metadata.ImageType)
+	}
+	if metadata.Classic != nil {
+		fmt.Printf("Image definition: %s\n", metadata.Classic.ImageDefinitionPath)
+	}
+	if metadata.OutputDir != "" {
+		fmt.Printf("Output directory: %s\n", metadata.OutputDir)
+	}
+
+	fmt.Println("Completed steps:")
+	for i := 0; i < metadata.StepsTaken && i < len(metadata.StateNames); i++ {
+		fmt.Printf("  [%d] %s\n", i, metadata.StateNames[i])
+	}
+	fmt.Println("Remaining steps:")
+	if metadata.StateNames == nil {
+		fmt.Println("  unknown, the state file was written by an older version of ubuntu-image")
+	}
+	for i := metadata.StepsTaken; i < len(metadata.StateNames); i++ {
+		fmt.Printf("  [%d] %s\n", i, metadata.StateNames[i])
+	}
+
+	if metadata.RootfsSize != 0 {
+		fmt.Printf("Rootfs size: %s\n", metadata.RootfsSize.IECString())
+	}
+	if len(metadata.ImageSizes) > 0 {
+		var volumeNames []string
+		for volumeName := range metadata.ImageSizes {
+			volumeNames = append(volumeNames, volumeName)
+		}
+		sort.Strings(volumeNames)
+		fmt.Println("Image sizes:")
+		for _, volumeName := range volumeNames {
+			fmt.Printf("  %s: %s\n", volumeName, metadata.ImageSizes[volumeName].IECString())
+		}
+	}
+	if len(metadata.VolumeNames) > 0 {
+		var volumeNames []string
+		for volumeName := range metadata.VolumeNames {
+			volumeNames = append(volumeNames, volumeName)
+		}
+		sort.Strings(volumeNames)
+		fmt.Println("Volume names:")
+		for _, volumeName := range volumeNames {
+			fmt.Printf("  %s: %s\n", volumeName, metadata.VolumeNames[volumeName])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// This test file tests reading, writing and migrating the state file of partial builds
+package statemachine
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// TestMetadataRoundTrip runs a partial state machine and ensures the versioned
+// JSON state file contains everything needed to resume it
+func TestMetadataRoundTrip(t *testing.T) {
+	t.Run("test_metadata_round_trip", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var partialStateMachine testStateMachine
+		partialStateMachine.commonFlags, partialStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		partialStateMachine.stateMachineFlags.WorkDir = workDir
+		partialStateMachine.stateMachineFlags.Until = "calculate_rootfs_size"
+		partialStateMachine.RootfsSize = 8 * quantity.SizeMiB
+		partialStateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+
+		err = partialStateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+		err = partialStateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+		err = partialStateMachine.Teardown(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		// make sure the state file is versioned JSON
+		metadataBytes, err := os.ReadFile(filepath.Join(workDir, metadataFileName))
+		asserter.AssertErrNil(err, true)
+		var metadata map[string]interface{}
+		err = json.Unmarshal(metadataBytes, &metadata)
+		asserter.AssertErrNil(err, true)
+		if metadata["version"] != float64(metadataVersion) {
+			t.Errorf("Expected version %d in state file, but got %v", metadataVersion, metadata["version"])
+		}
+
+		var resumeStateMachine testStateMachine
+		resumeStateMachine.commonFlags, resumeStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		resumeStateMachine.stateMachineFlags.WorkDir = workDir
+		resumeStateMachine.stateMachineFlags.Resume = true
+
+		err = resumeStateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+		if resumeStateMachine.StepsTaken != partialStateMachine.StepsTaken {
+			t.Errorf("Expected %d steps taken, but got %d",
+				partialStateMachine.StepsTaken, resumeStateMachine.StepsTaken)
+		}
+		if resumeStateMachine.RootfsSize != partialStateMachine.RootfsSize {
+			t.Errorf("Expected rootfs size %d, but got %d",
+				partialStateMachine.RootfsSize, resumeStateMachine.RootfsSize)
+		}
+		if resumeStateMachine.VolumeNames["pc"] != "pc.img" {
+			t.Errorf("Expected volume names %v, but got %v",
+				partialStateMachine.VolumeNames, resumeStateMachine.VolumeNames)
+		}
+	})
+}
+
+// TestLegacyMetadataMigration ensures that a gob encoded state file written by an
+// older version of ubuntu-image can be resumed and is replaced by the JSON state file
+func TestLegacyMetadataMigration(t *testing.T) {
+	t.Run("test_legacy_metadata_migration", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		// older versions encoded the whole StateMachine struct
+		var legacyStateMachine StateMachine
+		legacyStateMachine.CurrentStep = "populate_rootfs_contents"
+		legacyStateMachine.StepsTaken = 5
+		legacyStateMachine.RootfsSize = quantity.SizeGiB
+		legacyStateMachine.VolumeOrder = []string{"pc"}
+		gobfile, err := os.Create(filepath.Join(workDir, legacyMetadataFileName))
+		asserter.AssertErrNil(err, true)
+		err = gob.NewEncoder(gobfile).Encode(&legacyStateMachine)
+		asserter.AssertErrNil(err, true)
+		gobfile.Close()
+
+		var stateMachine testStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.stateMachineFlags.Resume = true
+
+		err = stateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+		if stateMachine.StepsTaken != legacyStateMachine.StepsTaken {
+			t.Errorf("Expected %d steps taken, but got %d",
+				legacyStateMachine.StepsTaken, stateMachine.StepsTaken)
+		}
+		if stateMachine.RootfsSize != legacyStateMachine.RootfsSize {
+			t.Errorf("Expected rootfs size %d, but got %d",
+				legacyStateMachine.RootfsSize, stateMachine.RootfsSize)
+		}
+
+		err = stateMachine.Teardown(context.Background())
+		asserter.AssertErrNil(err, true)
+		if _, err := os.Stat(filepath.Join(workDir, metadataFileName)); err != nil {
+			t.Errorf("Expected the state file to be written, but got %s", err.Error())
+		}
+		if _, err := os.Stat(filepath.Join(workDir, legacyMetadataFileName)); !os.IsNotExist(err) {
+			t.Errorf("Expected the legacy state file to be removed")
+		}
+	})
+}
+
+// TestFailedLoadMetadata tests failures when reading invalid state files
+func TestFailedLoadMetadata(t *testing.T) {
+	testCases := []struct {
+		name          string
+		contents      string
+		expectedError string
+	}{
+		{"invalid_json", "{", "failed to parse metadata file"},
+		{"no_version", `{"steps_taken": 1}`, "no schema version found"},
+		{"newer_version", `{"version": 1000}`, "metadata file version 1000 is newer"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_load_metadata_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(workDir)
+
+			err = os.WriteFile(filepath.Join(workDir, metadataFileName), []byte(tc.contents), 0644)
+			asserter.AssertErrNil(err, true)
+
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.stateMachineFlags.Resume = true
+			stateMachine.stateMachineFlags.WorkDir = workDir
+
+			err = stateMachine.readMetadata()
+			asserter.AssertErrContains(err, tc.expectedError)
+		})
+	}
+}
+
+// TestShowState ensures the completed and remaining steps of a partial build are printed
+func TestShowState(t *testing.T) {
+	t.Run("test_show_state", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var partialStateMachine testStateMachine
+		partialStateMachine.commonFlags, partialStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		partialStateMachine.stateMachineFlags.WorkDir = workDir
+		partialStateMachine.stateMachineFlags.Thru = "prepare_image"
+		partialStateMachine.ImageSizes = map[string]quantity.Size{"pc": 4 * quantity.SizeGiB}
+		partialStateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+
+		err = partialStateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+		err = partialStateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+		err = partialStateMachine.Teardown(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+		err = ShowState(workDir)
+		restoreStdout()
+		asserter.AssertErrNil(err, true)
+		readStdout, err := io.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+
+		expectedOutput := []string{
+			"Completed steps:\n  [0] make_temporary_directories\n  [1] prepare_gadget_tree\n  [2] prepare_image\n",
+			"Remaining steps:\n  [3] load_gadget_yaml\n",
+			"  [13] finish\n",
+			"Image sizes:\n  pc: 4 GiB\n",
+			"Volume names:\n  pc: pc.img\n",
+		}
+		for _, expected := range expectedOutput {
+			if !strings.Contains(string(readStdout), expected) {
+				t.Errorf("Expected \"%s\" in output \"%s\"", expected, string(readStdout))
+			}
+		}
+
+		// a workdir without a state file can't be shown
+		err = ShowState(filepath.Join(workDir, "nonexistent"))
+		asserter.AssertErrContains(err, "error reading metadata file")
+	})
+}
@@ -0,0 +1,371 @@
+package statemachine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// mountRegistryFileName is the name of the file in the workdir that lists
+// the mounts and loop devices that are still set up
+const mountRegistryFileName = "mounts.json"
+
+// procMountsPath is the list of the mounts of the host, used by
+// `ubuntu-image cleanup` to find mounts that were not recorded
+var procMountsPath = "/proc/self/mounts"
+
+// mountEntry is a mount or loop device set up during the build
+type mountEntry struct {
+	// the mountpoint or loop device
+	Target string `json:"target"`
+	// the command that unmounts or detaches it
+	Teardown []string `json:"teardown"`
+}
+
+// mountRegistry tracks everything that is mounted or attached during the build,
+// so it can be torn down in reverse order when the build fails or is interrupted.
+// The registry is written to the workdir so an earlier run that crashed can be
+// recovered with `ubuntu-image cleanup`
+type mountRegistry struct {
+	mutex   sync.Mutex
+	path    string
+	Entries []mountEntry `json:"entries"`
+}
+
+// registry returns the mount registry of the state machine, creating it on first use
+func (stateMachine *StateMachine) registry() *mountRegistry {
+	if stateMachine.mounts == nil {
+		stateMachine.mounts = &mountRegistry{}
+	}
+	if stateMachine.mounts.path == "" && stateMachine.stateMachineFlags.WorkDir != "" {
+		stateMachine.mounts.path = filepath.Join(stateMachine.stateMachineFlags.WorkDir,
+			mountRegistryFileName)
+	}
+	return stateMachine.mounts
+}
+
+// add records a mount or loop device that was set up
+func (registry *mountRegistry) add(entry mountEntry) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.Entries = append(registry.Entries, entry)
+	return registry.save()
+}
+
+// remove forgets about a mount or loop device that was torn down
+func (registry *mountRegistry) remove(target string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for i := len(registry.Entries) - 1; i >= 0; i-- {
+		if registry.Entries[i].Target == target {
+			registry.Entries = append(registry.Entries[:i], registry.Entries[i+1:]...)
+			break
+		}
+	}
+	return registry.save()
+}
+
+// save writes the registry to the workdir, or removes
+// the file once nothing is mounted anymore
+func (registry *mountRegistry) save() error {
+	if registry.path == "" {
+		return nil
+	}
+	if len(registry.Entries) == 0 {
+		if err := osRemoveAll(registry.path); err != nil {
+			return fmt.Errorf("Error removing mount registry: %s", err.Error())
+		}
+		return nil
+	}
+	registryBytes, err := json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding mount registry: %s", err.Error())
+	}
+	if err := osWriteFile(registry.path, registryBytes, 0644); err != nil {
+		return fmt.Errorf("Error writing mount registry: %s", err.Error())
+	}
+	return nil
+}
+
+// mount runs the given mount command and records that target has to be unmounted.
+// The teardown command is recorded as it is run on the host, since execCommand
+// is applied to it again when it is torn down
+func (stateMachine *StateMachine) mount(mountCmd *exec.Cmd, target string) error {
+	cmdOutput, err := stateMachine.runCmd(mountCmd)
+	if err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			mountCmd.String(), err.Error(), cmdOutput.String())
+	}
+	return stateMachine.registry().add(mountEntry{Target: target, Teardown: []string{"umount", target}})
+}
+
+// chrootMountPoints are mounted in a chroot to run commands in it. /run is
+// an empty temporary directory rather than the one of the host
+var chrootMountPoints = []struct {
+	dest     string
+	fromHost bool
+}{
+	{dest: "/dev", fromHost: true},
+	{dest: "/proc", fromHost: true},
+	{dest: "/sys", fromHost: true},
+	{dest: "/run", fromHost: false},
+}
+
+// mountChroot mounts /dev, /proc, /sys and /run in the given chroot and returns
+// the mountpoints, to be torn down with unmountAll. The temporary directory of
+// /run is created before anything is mounted. If a mount fails, the ones that
+// were already set up are returned along with the error
+func (stateMachine *StateMachine) mountChroot(chroot string) ([]string, error) {
+	var mountCmds []*exec.Cmd
+	for _, mount := range chrootMountPoints {
+		var mountCmd *exec.Cmd
+		if mount.fromHost {
+			mountCmd, _ = mountFromHost(chroot, mount.dest)
+		} else {
+			var err error
+			mountCmd, _, err = mountTempFS(chroot, stateMachine.tempDirs.scratch, mount.dest)
+			if err != nil {
+				return nil, fmt.Errorf("Error mounting temporary directory for mountpoint \"%s\": \"%s\"",
+					mount.dest,
+					err.Error(),
+				)
+			}
+		}
+		mountCmds = append(mountCmds, mountCmd)
+	}
+
+	var mountTargets []string
+	for i, mount := range chrootMountPoints {
+		target := filepath.Join(chroot, mount.dest)
+		if err := stateMachine.mount(mountCmds[i], target); err != nil {
+			return mountTargets, err
+		}
+		mountTargets = append(mountTargets, target)
+	}
+	return mountTargets, nil
+}
+
+// attachLoop attaches a disk image to a loop device and records how to detach it
+func (stateMachine *StateMachine) attachLoop(imgPath string) (string, error) {
+	losetupCmd := generateLosetupCmd(stateMachine.commonFlags.SectorSize, imgPath)
+	var losetupOutput bytes.Buffer
+	losetupCmd.Stdout = &losetupOutput
+	err := stateMachine.timeCommand(losetupCmd.Args, func() error {
+		return helperRunCmdContext(stateMachine.buildContext(), losetupCmd)
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error running losetup command \"%s\". Error is %s",
+			losetupCmd.String(),
+			err.Error(),
+		)
+	}
+	loopUsed := strings.TrimSpace(losetupOutput.String())
+	err = stateMachine.registry().add(mountEntry{
+		Target:   loopUsed,
+		Teardown: []string{"losetup", "--detach", loopUsed},
+	})
+	return loopUsed, err
+}
+
+// unmount tears down a single mount or loop device that was set up with
+// mount or attachLoop
+func (stateMachine *StateMachine) unmount(target string) error {
+	registry := stateMachine.registry()
+	registry.mutex.Lock()
+	var teardown []string
+	for _, entry := range registry.Entries {
+		if entry.Target == target {
+			teardown = entry.Teardown
+		}
+	}
+	registry.mutex.Unlock()
+	if teardown == nil {
+		return fmt.Errorf("Error unmounting %s: it was not mounted by ubuntu-image", target)
+	}
+
+	// mounts must be torn down even if the build was cancelled
+	teardownCmd := execCommand(teardown[0], teardown[1:]...)
+	cmdOutput, err := stateMachine.runCmdContext(context.Background(), teardownCmd)
+	if err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			teardownCmd.String(), err.Error(), cmdOutput.String())
+	}
+	return registry.remove(target)
+}
+
+// unmountAll tears down the given mounts and loop devices in reverse order
+func (stateMachine *StateMachine) unmountAll(targets []string) error {
+	for i := len(targets) - 1; i >= 0; i-- {
+		if err := stateMachine.unmount(targets[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownMounts tears down everything that is still mounted or attached, in
+// the reverse order it was set up. Entries that fail to be torn down are kept
+// in the registry so `ubuntu-image cleanup` can be used to try again
+func (stateMachine *StateMachine) teardownMounts() error {
+	if stateMachine.mounts == nil {
+		return nil
+	}
+	registry := stateMachine.registry()
+	registry.mutex.Lock()
+	entries := make([]mountEntry, len(registry.Entries))
+	copy(entries, registry.Entries)
+	registry.mutex.Unlock()
+
+	var failed []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := stateMachine.unmount(entries[i].Target); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %s\n", err.Error())
+			failed = append(failed, entries[i].Target)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Error tearing down %s. Run \"ubuntu-image cleanup --workdir %s\" to try again",
+			strings.Join(failed, ", "), stateMachine.stateMachineFlags.WorkDir)
+	}
+	return nil
+}
+
+// Cleanup tears down the mounts and loop devices left behind in the given workdir by an
+// earlier run of ubuntu-image that crashed or was killed. Mounts that were not recorded
+// in the registry, but are found below the workdir, are unmounted as well
+func Cleanup(workDir string) error {
+	absWorkDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return fmt.Errorf("Error resolving the workdir: %s", err.Error())
+	}
+	// don't tear down the mounts of a build that is still running
+	lock, warning, err := lockWorkDir(absWorkDir)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	if warning != "" {
+		fmt.Printf("WARNING: %s\n", warning)
+	}
+
+	registry := &mountRegistry{path: filepath.Join(absWorkDir, mountRegistryFileName)}
+	registryBytes, err := osReadFile(registry.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading mount registry: %s", err.Error())
+	}
+	if err == nil {
+		if err := json.Unmarshal(registryBytes, registry); err != nil {
+			return fmt.Errorf("Error parsing mount registry: %s", err.Error())
+		}
+	}
+
+	// unrecorded mounts may be left if the build was killed right after mounting
+	// something. Unmount the deepest ones first so nested mounts are handled
+	hostMounts, err := mountsBelow(absWorkDir)
+	if err != nil {
+		return err
+	}
+	// recorded mounts that are already gone don't need to be unmounted again
+	var entries []mountEntry
+	for _, entry := range registry.Entries {
+		mounted := entry.Teardown[0] != "umount"
+		for _, hostMount := range hostMounts {
+			if entry.Target == hostMount {
+				mounted = true
+			}
+		}
+		if mounted {
+			entries = append(entries, entry)
+		}
+	}
+	registry.Entries = entries
+	for _, hostMount := range hostMounts {
+		recorded := false
+		for _, entry := range registry.Entries {
+			if entry.Target == hostMount {
+				recorded = true
+			}
+		}
+		if !recorded {
+			registry.Entries = append(registry.Entries,
+				mountEntry{Target: hostMount, Teardown: []string{"umount", hostMount}})
+		}
+	}
+
+	var failed []string
+	for i := len(registry.Entries) - 1; i >= 0; i-- {
+		entry := registry.Entries[i]
+		fmt.Printf("Tearing down %s\n", entry.Target)
+		teardownCmd := execCommand(entry.Teardown[0], entry.Teardown[1:]...)
+		if output, err := teardownCmd.CombinedOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				teardownCmd.String(), err.Error(), string(output))
+			failed = append(failed, entry.Target)
+			continue
+		}
+		registry.Entries = append(registry.Entries[:i], registry.Entries[i+1:]...)
+	}
+	if err := registry.save(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Error tearing down %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// mountsBelow returns the mountpoints of the host that are below the given
+// directory, sorted so that the deepest ones come last
+func mountsBelow(dir string) ([]string, error) {
+	procMounts, err := osOpen(procMountsPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the mounts of the host: %s", err.Error())
+	}
+	defer procMounts.Close()
+
+	var mountPoints []string
+	scanner := bufio.NewScanner(procMounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		// spaces and other special characters are octal escaped
+		mountPoint := unescapeMountPoint(fields[1])
+		if strings.HasPrefix(mountPoint, dir+string(filepath.Separator)) {
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading the mounts of the host: %s", err.Error())
+	}
+	sort.SliceStable(mountPoints, func(i, j int) bool {
+		return strings.Count(mountPoints[i], "/") < strings.Count(mountPoints[j], "/")
+	})
+	return mountPoints, nil
+}
+
+// unescapeMountPoint decodes the octal escapes used in /proc/self/mounts
+func unescapeMountPoint(mountPoint string) string {
+	var unescaped strings.Builder
+	for i := 0; i < len(mountPoint); i++ {
+		if mountPoint[i] == '\\' && i+4 <= len(mountPoint) {
+			if value, err := strconv.ParseUint(mountPoint[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(mountPoint[i])
+	}
+	return unescaped.String()
+}
@@ -0,0 +1,187 @@
+// This test file tests tracking and tearing down mounts and loop devices
+package statemachine
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestMountRegistry ensures mounts are recorded in the workdir and torn down in reverse order
+func TestMountRegistry(t *testing.T) {
+	t.Run("test_mount_registry", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		stateMachine.stateMachineFlags.WorkDir = workDir
+
+		testCaseName = "TestMountRegistry"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+
+		var targets []string
+		for _, mountPoint := range []string{"/dev", "/proc"} {
+			mountCmd, _ := mountFromHost(workDir, mountPoint)
+			target := filepath.Join(workDir, mountPoint)
+			err = stateMachine.mount(mountCmd, target)
+			asserter.AssertErrNil(err, true)
+			targets = append(targets, target)
+		}
+
+		registryBytes, err := os.ReadFile(filepath.Join(workDir, mountRegistryFileName))
+		asserter.AssertErrNil(err, true)
+		var registry mountRegistry
+		err = json.Unmarshal(registryBytes, &registry)
+		asserter.AssertErrNil(err, true)
+		if len(registry.Entries) != 2 || registry.Entries[1].Target != targets[1] ||
+			registry.Entries[1].Teardown[0] != "umount" {
+			t.Errorf("Unexpected mount registry %s", string(registryBytes))
+		}
+
+		err = stateMachine.unmountAll(targets)
+		asserter.AssertErrNil(err, true)
+		if _, err := os.Stat(filepath.Join(workDir, mountRegistryFileName)); !os.IsNotExist(err) {
+			t.Errorf("Expected the mount registry to be removed once nothing is mounted")
+		}
+
+		err = stateMachine.unmount(targets[0])
+		asserter.AssertErrContains(err, "it was not mounted by ubuntu-image")
+	})
+}
+
+// TestFailedTeardownMounts ensures the workdir is not removed if something is still mounted in it
+func TestFailedTeardownMounts(t *testing.T) {
+	t.Run("test_failed_teardown_mounts", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.cleanWorkDir = true
+
+		testCaseName = "TestFailedTeardownMounts"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+
+		loopUsed, err := stateMachine.attachLoop(filepath.Join(workDir, "pc.img"))
+		asserter.AssertErrNil(err, true)
+		mountCmd, _ := mountFromHost(workDir, "/dev")
+		err = stateMachine.mount(mountCmd, filepath.Join(workDir, "dev"))
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.cleanup()
+		asserter.AssertErrContains(err, "ubuntu-image cleanup --workdir "+workDir)
+		if _, err := os.Stat(workDir); err != nil {
+			t.Errorf("Expected the workdir to be kept, but got %s", err.Error())
+		}
+		// the loop device could be detached, the mount is left for ubuntu-image cleanup
+		if len(stateMachine.mounts.Entries) != 1 || stateMachine.mounts.Entries[0].Target == loopUsed {
+			t.Errorf("Unexpected mounts left: %v", stateMachine.mounts.Entries)
+		}
+
+		testCaseName = "TestMountRegistry"
+		err = stateMachine.cleanup()
+		asserter.AssertErrNil(err, true)
+		if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+			t.Errorf("Expected the workdir to be removed")
+		}
+	})
+}
+
+// TestCleanupWorkDir tears down the recorded and unrecorded mounts left in a workdir
+func TestCleanupWorkDir(t *testing.T) {
+	t.Run("test_cleanup_workdir", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		registry := mountRegistry{Entries: []mountEntry{
+			{Target: "/dev/loop99", Teardown: []string{"losetup", "--detach", "/dev/loop99"}},
+			{Target: filepath.Join(workDir, "chroot", "dev"),
+				Teardown: []string{"umount", filepath.Join(workDir, "chroot", "dev")}},
+			// already unmounted, so it is skipped
+			{Target: filepath.Join(workDir, "chroot", "sys"),
+				Teardown: []string{"umount", filepath.Join(workDir, "chroot", "sys")}},
+		}}
+		registryBytes, err := json.Marshal(&registry)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(workDir, mountRegistryFileName), registryBytes, 0644)
+		asserter.AssertErrNil(err, true)
+
+		procMounts := strings.Join([]string{
+			"proc /proc proc rw 0 0",
+			"udev " + filepath.Join(workDir, "chroot", "dev") + " devtmpfs rw 0 0",
+			"tmpfs " + filepath.Join(workDir, "scratch", "run\\040dir") + " tmpfs rw 0 0",
+			"proc " + filepath.Join(workDir, "chroot", "proc") + " proc rw 0 0",
+		}, "\n")
+		procMountsFile := filepath.Join(workDir, "mounts")
+		err = os.WriteFile(procMountsFile, []byte(procMounts), 0644)
+		asserter.AssertErrNil(err, true)
+		procMountsPath = procMountsFile
+		testCaseName = "TestMountRegistry"
+		execCommand = fakeExecCommand
+		defer func() {
+			procMountsPath = "/proc/self/mounts"
+			execCommand = exec.Command
+		}()
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+		err = Cleanup(workDir)
+		restoreStdout()
+		asserter.AssertErrNil(err, true)
+		readStdout, err := io.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+
+		expectedOutput := "Tearing down " + filepath.Join(workDir, "chroot", "proc") + "\n" +
+			"Tearing down " + filepath.Join(workDir, "scratch", "run dir") + "\n" +
+			"Tearing down " + filepath.Join(workDir, "chroot", "dev") + "\n" +
+			"Tearing down /dev/loop99\n"
+		if string(readStdout) != expectedOutput {
+			t.Errorf("Expected output \"%s\", but got \"%s\"", expectedOutput, string(readStdout))
+		}
+		if _, err := os.Stat(filepath.Join(workDir, mountRegistryFileName)); !os.IsNotExist(err) {
+			t.Errorf("Expected the mount registry to be removed")
+		}
+	})
+}
+
+// TestFailedCleanupWorkDir tests failures when tearing down mounts left in a workdir
+func TestFailedCleanupWorkDir(t *testing.T) {
+	t.Run("test_failed_cleanup_workdir", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		err = os.WriteFile(filepath.Join(workDir, mountRegistryFileName), []byte("{"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = Cleanup(workDir)
+		asserter.AssertErrContains(err, "Error parsing mount registry")
+
+		err = os.Remove(filepath.Join(workDir, mountRegistryFileName))
+		asserter.AssertErrNil(err, true)
+		procMountsPath = filepath.Join(workDir, "nonexistent")
+		defer func() {
+			procMountsPath = "/proc/self/mounts"
+		}()
+		err = Cleanup(workDir)
+		asserter.AssertErrContains(err, "Error reading the mounts of the host")
+	})
+}
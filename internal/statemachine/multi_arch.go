@@ -0,0 +1,244 @@
+package statemachine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/google/uuid"
+)
+
+// sharedDirName is the directory of the workdir of a build for several architectures
+// in which the gadget git repository is cloned once for all the architectures. The
+// other downloads are done by the build of each architecture
+const sharedDirName = "shared"
+
+// architectureBuild is the build of the image for one of the architectures listed
+// in the image definition
+type architectureBuild struct {
+	architecture string
+	stateMachine *ClassicStateMachine
+	err          error
+	duration     time.Duration
+}
+
+// imageDefinitionArchitectures returns the architectures listed in the image
+// definition, with the overrides given with --set
+func imageDefinitionArchitectures(imageDefinitionPath string, overrides []string) ([]string, error) {
+	imageDefinition, err := readImageDefinition(imageDefinitionPath, overrides)
+	if err != nil {
+		return nil, err
+	}
+	return imageDefinition.Architecture, nil
+}
+
+// readImageDefinition reads an image definition with the files it extends and
+// includes, the overrides given with --set and the variables substituted, without
+// validating it. parse_image_definition is the state that validates it
+func readImageDefinition(imageDefinitionPath string, overrides []string) (*imagedefinition.ImageDefinition, error) {
+	files, err := readImageDefinitionFiles(imageDefinitionPath)
+	if err != nil {
+		return nil, err
+	}
+	var imageDefinition imagedefinition.ImageDefinition
+	if err := mergeImageDefinitionFiles(files).decode(&imageDefinition); err != nil {
+		return nil, err
+	}
+	if err := setOverrides(&imageDefinition, overrides); err != nil {
+		return nil, err
+	}
+	substituteVariables(&imageDefinition)
+	return &imageDefinition, nil
+}
+
+// setupArchitectureBuilds prepares a state machine for every architecture listed in
+// the image definition. Each of them builds the image in a sub-directory of the
+// workdir named after the architecture, and writes the artifacts, named after the
+// architecture, to the same output directory
+func (classicStateMachine *ClassicStateMachine) setupArchitectureBuilds(ctx context.Context, architectures []string) error {
+	workDir := classicStateMachine.stateMachineFlags.WorkDir
+	outputDir := classicStateMachine.commonFlags.OutputDir
+	// nothing is written to disk if only the plan is printed
+	if !classicStateMachine.Opts.Plan && !classicStateMachine.Opts.DryRun {
+		if workDir == "" {
+			workDir = filepath.Join("/tmp", "ubuntu-image-"+uuid.NewString())
+			if err := osMkdir(workDir, 0755); err != nil {
+				return fmt.Errorf("Failed to create temporary directory: %s", err.Error())
+			}
+			classicStateMachine.stateMachineFlags.WorkDir = workDir
+			classicStateMachine.cleanWorkDir = true
+		}
+		// the artifacts of all the architectures are written to the same directory
+		if outputDir == "" {
+			if classicStateMachine.cleanWorkDir {
+				outputDir, _ = os.Getwd()
+			} else {
+				outputDir = workDir
+			}
+		}
+	}
+
+	for _, architecture := range architectures {
+		stateMachine := &ClassicStateMachine{
+			Opts:                 classicStateMachine.Opts,
+			Args:                 classicStateMachine.Args,
+			artifactArchitecture: architecture,
+		}
+		stateMachine.Opts.Set = append(append([]string{}, classicStateMachine.Opts.Set...),
+			"architecture="+architecture)
+		commonFlags := *classicStateMachine.commonFlags
+		commonFlags.OutputDir = outputDir
+		stateMachineFlags := *classicStateMachine.stateMachineFlags
+		if workDir != "" {
+			stateMachineFlags.WorkDir = filepath.Join(workDir, architecture)
+			stateMachine.sharedDir = filepath.Join(workDir, sharedDirName)
+		}
+		stateMachine.SetCommonOpts(&commonFlags, &stateMachineFlags)
+		stateMachine.log = classicStateMachine.log
+		stateMachine.eventHandler = classicStateMachine.eventHandler
+
+		if err := stateMachine.Setup(ctx); err != nil {
+			return fmt.Errorf("Error setting up the build for %s: %s", architecture, err.Error())
+		}
+		classicStateMachine.architectureBuilds = append(classicStateMachine.architectureBuilds,
+			&architectureBuild{architecture: architecture, stateMachine: stateMachine})
+	}
+	return nil
+}
+
+// runArchitectureBuilds builds the image for every architecture in turn, then prints
+// a summary of the builds. A failed build doesn't stop the builds of the other
+// architectures
+func (classicStateMachine *ClassicStateMachine) runArchitectureBuilds(ctx context.Context) error {
+	var failed []string
+	for _, build := range classicStateMachine.architectureBuilds {
+		classicStateMachine.logger().Printf("Building %s for %s\n",
+			classicStateMachine.Args.ImageDefinition, build.architecture)
+		start := time.Now()
+		build.err = build.stateMachine.Run(ctx)
+		if build.err == nil {
+			build.err = build.stateMachine.Teardown(ctx)
+		}
+		build.duration = time.Since(start)
+		if build.err != nil {
+			failed = append(failed, build.architecture)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if !classicStateMachine.Opts.Plan && !classicStateMachine.Opts.DryRun {
+		classicStateMachine.printArchitectureSummary()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("the image could not be built for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// printArchitectureSummary prints the result of the build of every architecture
+// and the artifacts it created
+func (classicStateMachine *ClassicStateMachine) printArchitectureSummary() {
+	var summary strings.Builder
+	w := tabwriter.NewWriter(&summary, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\nArchitectures:")
+	fmt.Fprintln(w, "ARCHITECTURE\tRESULT\tDURATION\tARTIFACTS")
+	for _, build := range classicStateMachine.architectureBuilds {
+		result := "built"
+		if build.err != nil {
+			result = "failed: " + build.err.Error()
+			// only the first line of the error fits in the table
+			result, _, _ = strings.Cut(result, "\n")
+		} else if build.duration == 0 {
+			result = "not built"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.2fs\t%s\n", build.architecture, result, build.duration.Seconds(),
+			strings.Join(artifactNames(build.stateMachine.ImageDef.Artifacts), ", "))
+	}
+	w.Flush()
+	classicStateMachine.logger().Printf("%s", summary.String())
+}
+
+// artifactNames returns the names of the files the artifacts of the image definition
+// are written to
+func artifactNames(artifacts *imagedefinition.Artifact) []string {
+	var names []string
+	forEachArtifactName(artifacts, func(name reflect.Value) {
+		names = append(names, name.String())
+	})
+	return names
+}
+
+// nameArtifactsForArchitecture adds the architecture to the names of the artifacts,
+// so the artifacts of the builds for several architectures don't overwrite each other.
+// The names that already contain the architecture, usually through ${ARCH}, are kept
+func nameArtifactsForArchitecture(artifacts *imagedefinition.Artifact, architecture string) {
+	forEachArtifactName(artifacts, func(name reflect.Value) {
+		name.SetString(architectureFileName(name.String(), architecture))
+	})
+}
+
+// forEachArtifactName calls a function with the name of every artifact of the image
+// definition. The artifacts are pointers to structs, or to slices of structs, with
+// the name of the file in their "name" key
+func forEachArtifactName(artifacts *imagedefinition.Artifact, function func(reflect.Value)) {
+	if artifacts == nil {
+		return
+	}
+	value := reflect.ValueOf(artifacts).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() {
+			continue
+		}
+		field = field.Elem()
+		items := []reflect.Value{field}
+		if field.Kind() == reflect.Slice {
+			items = nil
+			for j := 0; j < field.Len(); j++ {
+				items = append(items, field.Index(j))
+			}
+		}
+		for _, item := range items {
+			if structField, found := structFieldByYAMLKey(item.Type(), "name"); found {
+				if name := item.FieldByIndex(structField.Index); name.String() != "" {
+					function(name)
+				}
+			}
+		}
+	}
+}
+
+// architectureFileName adds the architecture to the name of a file, before its
+// extension, unless the name already contains it as a component following a "-"
+// or a ".", like pc-arm64.img. A name in which the architecture is only part of
+// a word, like amd64 in ubuntu-amd64v3.img, is still renamed
+func architectureFileName(name string, architecture string) string {
+	architectureComponent := regexp.MustCompile(`[-.]` + regexp.QuoteMeta(architecture) + `([-.]|$)`)
+	if architectureComponent.MatchString(name) {
+		return name
+	}
+	extension := filepath.Ext(name)
+	if base := strings.TrimSuffix(name, extension); filepath.Ext(base) == ".tar" {
+		extension = ".tar" + extension
+	}
+	return strings.TrimSuffix(name, extension) + "-" + architecture + extension
+}
+
+// sharedGadgetSource returns the directory of the workdir in which the gadget git
+// repository is cloned once for all the architectures, named after the repository
+// and branch since they can depend on the architecture
+func (classicStateMachine *ClassicStateMachine) sharedGadgetSource() string {
+	gadget := classicStateMachine.ImageDef.Gadget
+	checksum := sha256.Sum256([]byte(gadget.GadgetURL + "#" + gadget.GadgetBranch))
+	return filepath.Join(classicStateMachine.sharedDir, "gadget-"+hex.EncodeToString(checksum[:])[:12])
+}
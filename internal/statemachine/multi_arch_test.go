@@ -0,0 +1,241 @@
+// This test file tests the builds of an image definition for several architectures
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestImageDefinitionArchitectures ensures that the architectures of an image
+// definition are read with the overrides
+func TestImageDefinitionArchitectures(t *testing.T) {
+	testCases := []struct {
+		name            string
+		imageDefinition string
+		overrides       []string
+		expected        []string
+		expectedErr     string
+	}{
+		{"single", "test_amd64.yaml", nil, []string{"amd64"}, ""},
+		{"list", "test_multi_arch.yaml", nil, []string{"amd64", "arm64"}, ""},
+		{"override", "test_multi_arch.yaml", []string{"architecture=riscv64"}, []string{"riscv64"}, ""},
+		{"override_list", "test_amd64.yaml", []string{"architecture=amd64,armhf"}, []string{"amd64", "armhf"}, ""},
+		{"invalid", "test_invalid_yaml.yaml", nil, nil, "Error decoding"},
+		{"missing", "does_not_exist.yaml", nil, nil, "Error opening image definition file"},
+		{"bad_override", "test_amd64.yaml", []string{"does-not-exist=1"}, nil, "does-not-exist"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_image_definition_architectures_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			architectures, err := imageDefinitionArchitectures(
+				filepath.Join("testdata", "image_definitions", tc.imageDefinition), tc.overrides)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+			} else {
+				asserter.AssertErrNil(err, true)
+			}
+			if !reflect.DeepEqual(architectures, tc.expected) {
+				t.Errorf("Expected architectures %q but got %q", tc.expected, architectures)
+			}
+		})
+	}
+}
+
+// TestArchitectureFileName ensures that the architecture is added to the names of
+// the artifacts that don't contain it already
+func TestArchitectureFileName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{"pc.img", "pc-arm64.img"},
+		{"rootfs.tar.gz", "rootfs-arm64.tar.gz"},
+		{"rootfs.tar", "rootfs-arm64.tar"},
+		{"manifest", "manifest-arm64"},
+		{"ubuntu-arm64.qcow2", "ubuntu-arm64.qcow2"},
+		{"ubuntu.arm64.img", "ubuntu.arm64.img"},
+		{"ubuntu-arm64-raspi.img", "ubuntu-arm64-raspi.img"},
+		{"ubuntu-arm64v8.img", "ubuntu-arm64v8-arm64.img"},
+		{"farm64.tar.gz", "farm64-arm64.tar.gz"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_architecture_file_name_"+tc.name, func(t *testing.T) {
+			if name := architectureFileName(tc.name, "arm64"); name != tc.expected {
+				t.Errorf("Expected %s to be named %s but got %s", tc.name, tc.expected, name)
+			}
+		})
+	}
+}
+
+// TestParseImageDefinitionArchitecture ensures that the build for one of the
+// architectures of an image definition names the artifacts after it
+func TestParseImageDefinitionArchitecture(t *testing.T) {
+	t.Run("test_parse_image_definition_architecture", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"test_multi_arch.yaml")
+		stateMachine.Opts.Set = []string{"architecture=arm64"}
+		stateMachine.artifactArchitecture = "arm64"
+		err := stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+
+		if !reflect.DeepEqual(stateMachine.ImageDef.Architecture, imagedefinition.Architectures{"arm64"}) {
+			t.Errorf("Expected the architecture to be arm64 but got %q", stateMachine.ImageDef.Architecture)
+		}
+		expected := []string{"pc-arm64.img", "ubuntu-arm64.qcow2", "filesystem-manifest-arm64.txt", "rootfs-arm64.tar.gz"}
+		if names := artifactNames(stateMachine.ImageDef.Artifacts); !reflect.DeepEqual(names, expected) {
+			t.Errorf("Expected the artifacts to be named %q but got %q", expected, names)
+		}
+	})
+}
+
+// TestSetupArchitectureBuilds ensures that an image definition listing several
+// architectures is built for each of them in a sub-directory of the workdir
+func TestSetupArchitectureBuilds(t *testing.T) {
+	t.Run("test_setup_architecture_builds", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"test_multi_arch.yaml")
+		stateMachine.Opts.Set = []string{"revision=2"}
+		err = stateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		if len(stateMachine.architectureBuilds) != 2 {
+			t.Fatalf("Expected a build for amd64 and arm64 but got %d builds", len(stateMachine.architectureBuilds))
+		}
+		for i, architecture := range []string{"amd64", "arm64"} {
+			build := stateMachine.architectureBuilds[i]
+			if build.architecture != architecture ||
+				build.stateMachine.stateMachineFlags.WorkDir != filepath.Join(workDir, architecture) ||
+				build.stateMachine.commonFlags.OutputDir != workDir ||
+				build.stateMachine.sharedDir != filepath.Join(workDir, sharedDirName) {
+				t.Errorf("Unexpected build for %s: workdir %s, output directory %s and shared directory %s",
+					build.architecture, build.stateMachine.stateMachineFlags.WorkDir,
+					build.stateMachine.commonFlags.OutputDir, build.stateMachine.sharedDir)
+			}
+			expectedSet := []string{"revision=2", "architecture=" + architecture}
+			if !reflect.DeepEqual(build.stateMachine.Opts.Set, expectedSet) {
+				t.Errorf("Expected the build to set %q but got %q", expectedSet, build.stateMachine.Opts.Set)
+			}
+		}
+		// the flags of the builds are not shared
+		if stateMachine.stateMachineFlags.WorkDir != workDir {
+			t.Errorf("Expected the workdir to be left as it is but got %s", stateMachine.stateMachineFlags.WorkDir)
+		}
+	})
+	t.Run("test_setup_architecture_builds_plan", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"test_multi_arch.yaml")
+		stateMachine.Opts.Plan = true
+		logger := &testLogger{}
+		stateMachine.SetLogger(logger)
+		err := stateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+		if stateMachine.stateMachineFlags.WorkDir != "" || stateMachine.cleanWorkDir {
+			t.Errorf("Expected no workdir to be created to print the plan")
+		}
+
+		err = stateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+		output := strings.Join(logger.messages, "")
+		for _, architecture := range []string{"amd64", "arm64"} {
+			if !strings.Contains(output, "for "+architecture) {
+				t.Errorf("Expected the plan for %s to be printed but got:\n%s", architecture, output)
+			}
+		}
+		err = stateMachine.Teardown(context.Background())
+		asserter.AssertErrNil(err, true)
+	})
+	t.Run("test_setup_architecture_builds_bad_image_definition", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		// the image definition can't be built for a single architecture either
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"test_multi_arch.yaml")
+		stateMachine.Opts.Set = []string{"does-not-exist=1"}
+		stateMachine.Opts.Plan = true
+		err := stateMachine.Setup(context.Background())
+		asserter.AssertErrContains(err, "Error reading image definition file")
+		if len(stateMachine.architectureBuilds) != 0 {
+			t.Errorf("Expected no build to be set up but got %d builds", len(stateMachine.architectureBuilds))
+		}
+	})
+}
+
+// TestArchitectureSummary ensures that the result of the builds for every
+// architecture are summarized
+func TestArchitectureSummary(t *testing.T) {
+	t.Run("test_architecture_summary", func(t *testing.T) {
+		var stateMachine ClassicStateMachine
+		logger := &testLogger{}
+		stateMachine.SetLogger(logger)
+		built := &ClassicStateMachine{}
+		built.ImageDef.Artifacts = &imagedefinition.Artifact{
+			Img: &[]imagedefinition.Img{{ImgName: "pc-amd64.img"}},
+		}
+		stateMachine.architectureBuilds = []*architectureBuild{
+			{architecture: "amd64", stateMachine: built, duration: 1},
+			{architecture: "arm64", stateMachine: &ClassicStateMachine{}, duration: 1,
+				err: fmt.Errorf("Error running debootstrap\nfull output")},
+			{architecture: "armhf", stateMachine: &ClassicStateMachine{}},
+		}
+		stateMachine.printArchitectureSummary()
+		output := strings.Join(logger.messages, "")
+		expectedLines := map[string][]string{
+			"amd64": {"built", "pc-amd64.img"},
+			"arm64": {"failed: Error running debootstrap"},
+			"armhf": {"not built"},
+		}
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			for _, expected := range expectedLines[fields[0]] {
+				if !strings.Contains(line, expected) {
+					t.Errorf("Expected the summary of %s to contain \"%s\" but got \"%s\"", fields[0], expected, line)
+				}
+			}
+			delete(expectedLines, fields[0])
+		}
+		if len(expectedLines) > 0 {
+			t.Errorf("Expected every architecture to be summarized but got:\n%s", output)
+		}
+		if strings.Contains(output, "full output") {
+			t.Errorf("Expected only the first line of the errors in the summary but got:\n%s", output)
+		}
+	})
+}
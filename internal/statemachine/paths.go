@@ -0,0 +1,141 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// fileURIPrefix is the prefix of the URLs of the image definition that point to
+// files or directories on the host
+const fileURIPrefix = "file://"
+
+// localPath is a path of the image definition that points to a file or a directory
+// on the host, as opposed to a URL or a path in the rootfs of the image
+type localPath struct {
+	keyPath []string
+	value   *string
+	isURI   bool
+	isDir   bool
+	anyType bool
+}
+
+// localPaths returns the paths of the image definition that are on the host. The URLs
+// are local if they begin with file://, and the gadget URL is a directory
+func localPaths(imageDefinition *imagedefinition.ImageDefinition) []localPath {
+	var paths []localPath
+	addURI := func(keyPath []string, value *string, isDir bool) {
+		if strings.HasPrefix(*value, fileURIPrefix) {
+			paths = append(paths, localPath{keyPath: keyPath, value: value, isURI: true, isDir: isDir})
+		}
+	}
+	if imageDefinition.Gadget != nil {
+		addURI([]string{"gadget", "url"}, &imageDefinition.Gadget.GadgetURL, true)
+	}
+	addURI([]string{"model-assertion"}, &imageDefinition.ModelAssertion, false)
+	if imageDefinition.Rootfs != nil && imageDefinition.Rootfs.Tarball != nil {
+		addURI([]string{"rootfs", "tarball", "url"}, &imageDefinition.Rootfs.Tarball.TarballURL, false)
+		addURI([]string{"rootfs", "tarball", "gpg"}, &imageDefinition.Rootfs.Tarball.GPG, false)
+	}
+	if imageDefinition.Customization != nil {
+		for i, ppa := range imageDefinition.Customization.ExtraPPAs {
+			paths = append(paths, localPath{
+				keyPath: []string{"customization", "extra-ppas", strconv.Itoa(i), "auth-file"},
+				value:   &ppa.AuthFile,
+			})
+		}
+		for i, repository := range imageDefinition.Customization.ExtraRepositories {
+			paths = append(paths, localPath{
+				keyPath: []string{"customization", "extra-repositories", strconv.Itoa(i), "signed-by"},
+				value:   &repository.SignedBy,
+			})
+		}
+	}
+	if imageDefinition.Customization != nil && imageDefinition.Customization.Manual != nil {
+		for i, copyFile := range imageDefinition.Customization.Manual.CopyFile {
+			paths = append(paths, localPath{
+				keyPath: []string{"customization", "manual", "copy-file", strconv.Itoa(i), "source"},
+				value:   &copyFile.Source,
+				anyType: true,
+			})
+		}
+	}
+	return paths
+}
+
+// resolveLocalPaths makes the paths of the image definition that are on the host
+// absolute, and checks that they exist, so a missing file fails the build before
+// anything is done. A relative path is relative to the directory of the image
+// definition file it is written in, given by fileOf, so the image is built the
+// same way from any directory. The paths in the rootfs of the image are absolute
+// and checked by validateImageDefinition
+func resolveLocalPaths(imageDefinition *imagedefinition.ImageDefinition, fileOf func(keyPath []string) string) []keyError {
+	var keyErrors []keyError
+	for _, path := range localPaths(imageDefinition) {
+		localPath := *path.value
+		if path.isURI {
+			localPath = strings.TrimPrefix(localPath, fileURIPrefix)
+		}
+		if localPath == "" {
+			continue
+		}
+		if !filepath.IsAbs(localPath) {
+			localPath = filepath.Join(filepath.Dir(fileOf(path.keyPath)), localPath)
+			absPath, err := filepath.Abs(localPath)
+			if err == nil {
+				localPath = absPath
+			}
+		}
+		if path.isURI {
+			*path.value = fileURIPrefix + localPath
+		} else {
+			*path.value = localPath
+		}
+
+		info, err := os.Stat(localPath)
+		switch {
+		case os.IsNotExist(err):
+			keyErrors = append(keyErrors, keyError{path.keyPath, fmt.Sprintf("%s does not exist", localPath)})
+		case err != nil:
+			keyErrors = append(keyErrors, keyError{path.keyPath, err.Error()})
+		case path.anyType:
+		case path.isDir && !info.IsDir():
+			keyErrors = append(keyErrors, keyError{path.keyPath, fmt.Sprintf("%s is not a directory", localPath)})
+		case !path.isDir && info.IsDir():
+			keyErrors = append(keyErrors, keyError{path.keyPath, fmt.Sprintf("%s is a directory", localPath)})
+		}
+	}
+	return keyErrors
+}
+
+// ResolveImageDefinitionPaths makes the relative paths of an image definition that
+// are on the host absolute, relative to baseDir. It is used for image definitions
+// that are not read from a file. The paths that don't exist are reported when the
+// image definition is parsed by the state machine
+func ResolveImageDefinitionPaths(imageDefinition *imagedefinition.ImageDefinition, baseDir string) {
+	// the paths are resolved relative to the directory of the file returned by fileOf
+	resolveLocalPaths(imageDefinition, func(keyPath []string) string {
+		return filepath.Join(baseDir, "image-definition.yaml")
+	})
+}
+
+// fileOf returns the image definition file in which the value of a key path is
+// written. The values set with --set are considered written in the image
+// definition given on the command line
+func (merged *mergedImageDefinition) fileOf(keyPath []string, overrides []string) string {
+	imageDefinitionPath := merged.files[len(merged.files)-1].path
+	for _, override := range overrides {
+		overridden, _, _ := strings.Cut(override, "=")
+		if formatKeyPath(parseKeyPath(overridden)) == formatKeyPath(keyPath) {
+			return imageDefinitionPath
+		}
+	}
+	if file, _, _ := merged.locate(keyPath); file != "" {
+		return file
+	}
+	return imageDefinitionPath
+}
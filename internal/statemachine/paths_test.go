@@ -0,0 +1,195 @@
+// This test file tests the resolution of the paths of image definitions on the host
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// testLocalPathsDefinition is an image definition with relative paths on the host
+const testLocalPathsDefinition = `name: test
+display-name: Test
+revision: 1
+architecture: amd64
+series: jammy
+class: preinstalled
+gadget:
+  url: file://gadget
+  type: directory
+model-assertion: file://model.assertion
+rootfs:
+  tarball:
+    url: file://rootfs.tar
+customization:
+  manual:
+    copy-file:
+      - source: files/hosts
+        destination: /etc/hosts
+    execute:
+      - path: /usr/bin/true
+artifacts:
+  rootfs-tarball:
+    name: rootfs.tar
+`
+
+// writeLocalPathsDefinition writes testLocalPathsDefinition to a directory, with the
+// files it points to, and returns the path of the image definition
+func writeLocalPathsDefinition(t *testing.T, dir string) string {
+	asserter := helper.Asserter{T: t}
+	for _, subdir := range []string{"gadget", "files"} {
+		err := os.MkdirAll(filepath.Join(dir, subdir), 0755)
+		asserter.AssertErrNil(err, true)
+	}
+	for _, file := range []string{"model.assertion", "rootfs.tar", filepath.Join("files", "hosts")} {
+		err := os.WriteFile(filepath.Join(dir, file), []byte("test"), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	imageDefinitionPath := filepath.Join(dir, "image.yaml")
+	err := os.WriteFile(imageDefinitionPath, []byte(testLocalPathsDefinition), 0644)
+	asserter.AssertErrNil(err, true)
+	return imageDefinitionPath
+}
+
+// TestResolveLocalPaths ensures that the paths of the image definition on the host
+// are relative to the directory of the image definition, and that they must exist
+func TestResolveLocalPaths(t *testing.T) {
+	t.Run("test_resolve_local_paths", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		imageDefinitionPath := writeLocalPathsDefinition(t, tmpDir)
+
+		// the current directory doesn't matter
+		err = os.Chdir("/")
+		asserter.AssertErrNil(err, true)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ImageDefinition, err = filepath.Rel("/", imageDefinitionPath)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+
+		imageDef := stateMachine.ImageDef
+		testCases := []struct {
+			path     string
+			expected string
+		}{
+			{imageDef.Gadget.GadgetURL, "file://" + filepath.Join(tmpDir, "gadget")},
+			{imageDef.ModelAssertion, "file://" + filepath.Join(tmpDir, "model.assertion")},
+			{imageDef.Rootfs.Tarball.TarballURL, "file://" + filepath.Join(tmpDir, "rootfs.tar")},
+			{imageDef.Customization.Manual.CopyFile[0].Source, filepath.Join(tmpDir, "files", "hosts")},
+			// the paths in the rootfs are left as they are
+			{imageDef.Customization.Manual.Execute[0].ExecutePath, "/usr/bin/true"},
+		}
+		for _, tc := range testCases {
+			if tc.path != tc.expected {
+				t.Errorf("Expected path %s but got %s", tc.expected, tc.path)
+			}
+		}
+	})
+	t.Run("test_resolve_local_paths_override", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		imageDefinitionPath := writeLocalPathsDefinition(t, tmpDir)
+
+		// the paths of the included files are relative to their directory,
+		// the values set on the command line to the image definition
+		fragmentDir := filepath.Join(tmpDir, "fragments")
+		err = os.MkdirAll(filepath.Join(fragmentDir, "gadget"), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(fragmentDir, "gadget.yaml"),
+			[]byte("gadget:\n  url: file://gadget\n  type: directory\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(tmpDir, "other.assertion"), []byte("test"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(imageDefinitionPath,
+			[]byte(testLocalPathsDefinition+"include:\n  - fragments/gadget.yaml\n"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ImageDefinition = imageDefinitionPath
+		stateMachine.Opts.Set = []string{"model-assertion=file://other.assertion"}
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+
+		if expected := "file://" + filepath.Join(tmpDir, "gadget"); stateMachine.ImageDef.Gadget.GadgetURL != expected {
+			t.Errorf("Expected the gadget of the image definition %s but got %s",
+				expected, stateMachine.ImageDef.Gadget.GadgetURL)
+		}
+		if expected := "file://" + filepath.Join(tmpDir, "other.assertion"); stateMachine.ImageDef.ModelAssertion != expected {
+			t.Errorf("Expected the model assertion set on the command line %s but got %s",
+				expected, stateMachine.ImageDef.ModelAssertion)
+		}
+
+		// the keys only set in an included file are relative to it
+		err = os.WriteFile(imageDefinitionPath, []byte(strings.Replace(testLocalPathsDefinition,
+			"gadget:\n  url: file://gadget\n  type: directory\n", "", 1)+"include:\n  - fragments/gadget.yaml\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+		if expected := "file://" + filepath.Join(fragmentDir, "gadget"); stateMachine.ImageDef.Gadget.GadgetURL != expected {
+			t.Errorf("Expected the gadget of the included file %s but got %s",
+				expected, stateMachine.ImageDef.Gadget.GadgetURL)
+		}
+	})
+	t.Run("test_resolve_local_paths_errors", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		imageDefinitionPath := writeLocalPathsDefinition(t, tmpDir)
+		err = os.Remove(filepath.Join(tmpDir, "files", "hosts"))
+		asserter.AssertErrNil(err, true)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ImageDefinition = imageDefinitionPath
+		stateMachine.Opts.Set = []string{"gadget.url=file://rootfs.tar", "rootfs.tarball.url=file://gadget"}
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrContains(err, "gadget.url: "+filepath.Join(tmpDir, "rootfs.tar")+" is not a directory")
+		asserter.AssertErrContains(err, "rootfs.tarball.url: "+filepath.Join(tmpDir, "gadget")+" is a directory")
+		asserter.AssertErrContains(err, "customization.manual.copy-file[0].source: "+
+			filepath.Join(tmpDir, "files", "hosts")+" does not exist")
+	})
+	t.Run("test_resolve_local_paths_validate", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		imageDefinitionPath := writeLocalPathsDefinition(t, tmpDir)
+		err = os.Remove(filepath.Join(tmpDir, "model.assertion"))
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(imageDefinitionPath, []byte(strings.Replace(testLocalPathsDefinition,
+			"path: /usr/bin/true", "path: usr/bin/true", 1)), 0644)
+		asserter.AssertErrNil(err, true)
+
+		validationErrors, err := ValidateImageDefinition(imageDefinitionPath, false, nil)
+		asserter.AssertErrNil(err, true)
+		expected := []string{
+			imageDefinitionPath + ":20:15: customization.manual.execute[0].path: Key customization:manual:execute:path needs to be an absolute path",
+			imageDefinitionPath + ":10:18: model-assertion: " + filepath.Join(tmpDir, "model.assertion") + " does not exist",
+		}
+		if len(validationErrors) != len(expected) {
+			t.Fatalf("Expected %d errors but got %q", len(expected), validationErrors)
+		}
+		for i, validationError := range validationErrors {
+			if !strings.HasPrefix(validationError.String(), expected[i]) {
+				t.Errorf("Expected error %d to start with \"%s\" but got \"%s\"", i, expected[i], validationError)
+			}
+		}
+	})
+}
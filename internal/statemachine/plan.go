@@ -0,0 +1,207 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// startingStateReason is printed for the states that run for every classic image
+const startingStateReason = "always run"
+
+// printPlan parses the image definition and calculates the states, then prints
+// the states that would run and the reason they are needed. With --dry-run, the
+// external commands each state would run are printed as well. Nothing is
+// written to disk and no commands are run
+func (classicStateMachine *ClassicStateMachine) printPlan() error {
+	stateMachine := &classicStateMachine.StateMachine
+	if err := stateMachine.parseImageDefinition(); err != nil {
+		return err
+	}
+	if err := stateMachine.calculateStates(); err != nil {
+		return err
+	}
+
+	// determine the directories that would be used, without creating them
+	workDir := stateMachine.stateMachineFlags.WorkDir
+	if workDir == "" {
+		workDir = "<workdir>"
+	}
+	stateMachine.tempDirs.rootfs = filepath.Join(workDir, "root")
+	stateMachine.tempDirs.unpack = filepath.Join(workDir, "unpack")
+	stateMachine.tempDirs.volumes = filepath.Join(workDir, "volumes")
+	stateMachine.tempDirs.chroot = filepath.Join(workDir, "chroot")
+	stateMachine.tempDirs.scratch = filepath.Join(workDir, "scratch")
+	if stateMachine.commonFlags.OutputDir == "" {
+		if stateMachine.stateMachineFlags.WorkDir != "" {
+			stateMachine.commonFlags.OutputDir = stateMachine.stateMachineFlags.WorkDir
+		} else {
+			stateMachine.commonFlags.OutputDir, _ = os.Getwd()
+		}
+	}
+
+	stateMachine.logger().Printf("The following states would run to build %s:\n", classicStateMachine.Args.ImageDefinition)
+	for i, state := range stateMachine.states {
+		reason, found := classicStateMachine.stateReasons[state.name]
+		if !found {
+			reason = startingStateReason
+		}
+		stateMachine.logger().Printf("[%d] %s (%s)\n", i, state.name, reason)
+		if classicStateMachine.Opts.DryRun {
+			for _, command := range classicStateMachine.plannedCommands(state.name) {
+				stateMachine.logger().Printf("    %s\n", strings.Join(command, " "))
+			}
+		}
+	}
+	return nil
+}
+
+// plannedCommands returns the external commands the given state would run. Values
+// that are only known while the image is being built, like the loop device a disk
+// image is attached to, are shown as placeholders in angle brackets
+func (classicStateMachine *ClassicStateMachine) plannedCommands(stateName string) [][]string {
+	stateMachine := &classicStateMachine.StateMachine
+	imageDef := classicStateMachine.ImageDef
+	chroot := stateMachine.tempDirs.chroot
+
+	var commands [][]string
+	switch stateName {
+	case "germinate":
+		commands = append(commands, generateGerminateCmd(imageDef).Args)
+	case "create_chroot":
+		commands = append(commands,
+			generateDebootstrapCmd(imageDef, chroot, classicStateMachine.Packages).Args)
+	case "install_packages", "install_extra_packages":
+		var packages []string
+		if stateName == "install_packages" {
+			packages = append(packages, "<packages from the seed>")
+		}
+		if imageDef.Customization != nil {
+			for _, packageInfo := range imageDef.Customization.ExtraPackages {
+				packages = append(packages, packageInfo.PackageName)
+			}
+		}
+		if imageDef.Kernel != "" {
+			packages = append(packages, imageDef.Kernel)
+		}
+		commands = append(commands, classicStateMachine.plannedChrootCommands(
+			generateAptCmds(chroot, packages))...)
+	case "disable_extra_ppas":
+		commands = append(commands, classicStateMachine.plannedChrootCommands(
+			[]*exec.Cmd{generateAptUpdateCmd(chroot)})...)
+	case "preseed_image", "preseed_extra_snaps":
+		var umounts [][]string
+		for _, mountPoint := range []string{"/dev", "/proc", "/sys/kernel/security", "/sys/fs/cgroup"} {
+			mountCmd, umountCmd := mountFromHost(chroot, mountPoint)
+			commands = append(commands, mountCmd.Args)
+			umounts = append(umounts, umountCmd.Args)
+		}
+		commands = append(commands, []string{"/usr/lib/snapd/snap-preseed", chroot})
+		commands = append(commands, umounts...)
+	case "make_disk":
+		for _, imgName := range classicStateMachine.plannedImages() {
+			commands = append(commands, []string{"dd",
+				"if=" + filepath.Join(stateMachine.tempDirs.volumes, "<volume>", "part<N>.img"),
+				"of=" + filepath.Join(stateMachine.commonFlags.OutputDir, imgName),
+				"bs=" + stateMachine.commonFlags.SectorSize,
+				"seek=<structure offset>",
+				"count=<structure size>",
+				"conv=notrunc",
+				"conv=sparse",
+			})
+		}
+	case "update_bootloader":
+		mountDir := filepath.Join(stateMachine.tempDirs.scratch, "loopback")
+		imgPath := filepath.Join(stateMachine.commonFlags.OutputDir, "<image containing the rootfs>")
+		commands = append(commands,
+			generateLosetupCmd(stateMachine.commonFlags.SectorSize, imgPath).Args,
+			[]string{"mount", "<loop device>p<rootfs partition>", mountDir},
+		)
+		var umounts [][]string
+		for _, mountPoint := range []string{"/dev", "/proc", "/sys"} {
+			mountCmd, umountCmd := mountFromHost(mountDir, mountPoint)
+			commands = append(commands, mountCmd.Args)
+			umounts = append(umounts, umountCmd.Args)
+		}
+		commands = append(commands, []string{"chroot", mountDir, "update-grub"})
+		commands = append(commands, umounts...)
+		commands = append(commands,
+			[]string{"umount", mountDir},
+			[]string{"losetup", "--detach", "<loop device>"},
+		)
+	case "make_qcow2_image":
+		for _, qcow2 := range *imageDef.Artifacts.Qcow2 {
+			backingFile := filepath.Join(stateMachine.commonFlags.OutputDir,
+				qcow2BackingImage(imageDef.Artifacts, qcow2))
+			resultingFile := filepath.Join(stateMachine.commonFlags.OutputDir, qcow2.Qcow2Name)
+			commands = append(commands, generateQemuImgCmd(backingFile, resultingFile).Args)
+		}
+	}
+	return commands
+}
+
+// plannedChrootCommands returns the commands run in the chroot by the states
+// using apt, between the mounts of mountChroot and the matching umounts
+func (classicStateMachine *ClassicStateMachine) plannedChrootCommands(chrootCmds []*exec.Cmd) [][]string {
+	stateMachine := &classicStateMachine.StateMachine
+	chroot := stateMachine.tempDirs.chroot
+
+	var commands, umounts [][]string
+	for _, mountPoint := range []string{"/dev", "/proc", "/sys"} {
+		mountCmd, umountCmd := mountFromHost(chroot, mountPoint)
+		commands = append(commands, mountCmd.Args)
+		umounts = append(umounts, umountCmd.Args)
+	}
+	commands = append(commands, []string{"mount", "--bind",
+		filepath.Join(stateMachine.tempDirs.scratch, "<temporary directory>"),
+		filepath.Join(chroot, "run")})
+	umounts = append(umounts, []string{"umount", filepath.Join(chroot, "run")})
+	for _, chrootCmd := range chrootCmds {
+		commands = append(commands, chrootCmd.Args)
+	}
+	return append(commands, umounts...)
+}
+
+// plannedImages returns the names of the raw disk images that would be created.
+// qcow2 images are converted from a raw image, which is created if no img
+// artifact is defined for the same volume
+func (classicStateMachine *ClassicStateMachine) plannedImages() []string {
+	artifacts := classicStateMachine.ImageDef.Artifacts
+	var imgNames []string
+	if artifacts.Img != nil {
+		for _, img := range *artifacts.Img {
+			imgNames = append(imgNames, img.ImgName)
+		}
+	}
+	if artifacts.Qcow2 != nil {
+		for _, qcow2 := range *artifacts.Qcow2 {
+			backingImage := qcow2BackingImage(artifacts, qcow2)
+			found := false
+			for _, imgName := range imgNames {
+				if imgName == backingImage {
+					found = true
+				}
+			}
+			if !found {
+				imgNames = append(imgNames, backingImage)
+			}
+		}
+	}
+	return imgNames
+}
+
+// qcow2BackingImage returns the name of the raw disk image a qcow2 image is converted from
+func qcow2BackingImage(artifacts *imagedefinition.Artifact, qcow2 imagedefinition.Qcow2) string {
+	if artifacts.Img != nil {
+		for _, img := range *artifacts.Img {
+			if img.ImgVolume == qcow2.Qcow2Volume {
+				return img.ImgName
+			}
+		}
+	}
+	return fmt.Sprintf("%s.img", qcow2.Qcow2Name)
+}
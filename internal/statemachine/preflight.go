@@ -0,0 +1,264 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// define some functions that can be mocked by test cases
+var execLookPath = exec.LookPath
+var osGeteuid = os.Geteuid
+var syscallStatfs = syscall.Statfs
+
+// stateRequirement describes what a state needs from the host. The space
+// requirements are rough estimates of what a typical image needs. The workdir
+// space is the free space the state needs to run, and the output dir space is
+// the size of the artifacts the state writes
+type stateRequirement struct {
+	tools          []string
+	root           bool
+	workDirSpace   quantity.Size
+	outputDirSpace quantity.Size
+}
+
+// mountTools are needed by the states that bind mount host directories in the chroot
+var mountTools = []string{"mount", "umount", "chroot"}
+
+// classicStateRequirements lists the host requirements of the states of classic images
+var classicStateRequirements = map[string]stateRequirement{
+	"build_gadget_tree":            {tools: []string{"make"}},
+	"germinate":                    {tools: []string{"germinate"}},
+	"create_chroot":                {tools: []string{"debootstrap"}, root: true, workDirSpace: quantity.SizeGiB},
+	"add_extra_ppas":               {tools: []string{"gpg"}},
+	"install_packages":             {tools: mountTools, root: true, workDirSpace: 2 * quantity.SizeGiB},
+	"install_extra_packages":       {tools: mountTools, root: true, workDirSpace: quantity.SizeGiB},
+	"prepare_image":                {root: true, workDirSpace: quantity.SizeGiB},
+	"install_extra_snaps":          {root: true, workDirSpace: quantity.SizeGiB},
+	"preseed_image":                {tools: append([]string{"/usr/lib/snapd/snap-preseed"}, mountTools...), root: true},
+	"preseed_extra_snaps":          {tools: append([]string{"/usr/lib/snapd/snap-preseed"}, mountTools...), root: true},
+	"extract_rootfs_tar":           {tools: []string{"tar"}, root: true, workDirSpace: 2 * quantity.SizeGiB},
+	"perform_manual_customization": {tools: []string{"chroot"}, root: true},
+	"disable_extra_ppas":           {tools: mountTools, root: true},
+	"populate_rootfs_contents":     {workDirSpace: 2 * quantity.SizeGiB},
+	"calculate_rootfs_size":        {tools: []string{"du"}},
+	"populate_prepare_partitions":  {workDirSpace: 2 * quantity.SizeGiB},
+	"make_disk":                    {tools: []string{"dd"}, outputDirSpace: 2 * quantity.SizeGiB},
+	"update_bootloader":            {tools: append([]string{"losetup"}, mountTools...), root: true},
+	"make_qcow2_image":             {tools: []string{"qemu-img"}, outputDirSpace: quantity.SizeGiB},
+	"generate_manifest":            {tools: []string{"chroot"}, root: true},
+	"generate_filelist":            {tools: []string{"chroot"}, root: true},
+	"generate_rootfs_tarball":      {tools: []string{"tar"}, outputDirSpace: quantity.SizeGiB},
+}
+
+// snapStateRequirements lists the host requirements of the states of snap images
+var snapStateRequirements = map[string]stateRequirement{
+	"prepare_image":               {workDirSpace: quantity.SizeGiB},
+	"populate_rootfs_contents":    {workDirSpace: quantity.SizeGiB},
+	"calculate_rootfs_size":       {tools: []string{"du"}},
+	"populate_prepare_partitions": {workDirSpace: quantity.SizeGiB},
+	"make_disk":                   {tools: []string{"dd"}, outputDirSpace: quantity.SizeGiB},
+}
+
+// stateRequirements returns the host requirements of the states of the image type
+func (stateMachine *StateMachine) stateRequirements() map[string]stateRequirement {
+	switch stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		return classicStateRequirements
+	case *SnapStateMachine:
+		return snapStateRequirements
+	}
+	return nil
+}
+
+// preflight checks that the host can run the remaining states of the build, so it
+// fails before any work is done rather than deep into the build. It runs once,
+// as soon as the states are known, which for classic images is after calculate_states
+func (stateMachine *StateMachine) preflight() error {
+	if stateMachine.preflightDone {
+		return nil
+	}
+	states := stateMachine.remainingStates()
+	for _, state := range states {
+		if state.name == "calculate_states" {
+			return nil
+		}
+	}
+	stateMachine.preflightDone = true
+	if stateMachine.commonFlags.SkipPreflight {
+		return nil
+	}
+	return stateMachine.preflightChecks(states)
+}
+
+// remainingStates returns the states that will run, taking --until and --thru into account
+func (stateMachine *StateMachine) remainingStates() []stateFunc {
+	var states []stateFunc
+	for _, state := range stateMachine.states[stateMachine.StepsTaken:] {
+		if state.name == stateMachine.stateMachineFlags.Until {
+			break
+		}
+		states = append(states, state)
+		if stateMachine.isLastState(state.name) {
+			break
+		}
+	}
+	return states
+}
+
+// preflightChecks checks the host tools, privileges and free space needed by the
+// given states, and reports every problem found in a single error
+func (stateMachine *StateMachine) preflightChecks(states []stateFunc) error {
+	requirements := stateMachine.stateRequirements()
+	if requirements == nil {
+		return nil
+	}
+	var problems []string
+
+	// map each missing tool to the states that need it
+	missingTools := make(map[string][]string)
+	var rootStates []string
+	var workDirSpace, outputDirSpace quantity.Size
+	for _, state := range states {
+		requirement := requirements[state.name]
+		tools := append([]string{}, requirement.tools...)
+		if state.name == "populate_prepare_partitions" {
+			tools = append(tools, stateMachine.filesystemTools()...)
+		}
+		for _, tool := range tools {
+			if _, err := execLookPath(tool); err != nil {
+				missingTools[tool] = append(missingTools[tool], state.name)
+			}
+		}
+		if requirement.root {
+			rootStates = append(rootStates, state.name)
+		}
+		// the workdir needs room for the most demanding state, while the
+		// artifacts accumulate in the output dir
+		if requirement.workDirSpace > workDirSpace {
+			workDirSpace = requirement.workDirSpace
+		}
+		outputDirSpace += requirement.outputDirSpace
+	}
+
+	var toolNames []string
+	for tool := range missingTools {
+		toolNames = append(toolNames, tool)
+	}
+	sort.Strings(toolNames)
+	for _, tool := range toolNames {
+		problems = append(problems, fmt.Sprintf("\"%s\" was not found, it is needed by %s",
+			tool, strings.Join(missingTools[tool], ", ")))
+	}
+	if len(rootStates) > 0 && osGeteuid() != 0 {
+		problems = append(problems, fmt.Sprintf("ubuntu-image must be run as root, "+
+			"it is needed by %s", strings.Join(rootStates, ", ")))
+	}
+	problems = append(problems, stateMachine.checkFreeSpace(workDirSpace, outputDirSpace)...)
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("preflight checks failed:\n  - %s\nFix these problems and try again, "+
+		"or use --skip-preflight to skip these checks", strings.Join(problems, "\n  - "))
+}
+
+// filesystemTools returns the tools needed to create the filesystems of the
+// partitions. The gadget is usually not loaded yet when the checks run, in which
+// case the tools for the ext4 rootfs and a vfat boot partition are needed
+func (stateMachine *StateMachine) filesystemTools() []string {
+	filesystems := []string{"ext4", "vfat"}
+	if stateMachine.GadgetInfo != nil {
+		filesystems = nil
+		for _, volumeName := range stateMachine.VolumeOrder {
+			for _, structure := range stateMachine.GadgetInfo.Volumes[volumeName].Structure {
+				if structure.Filesystem != "" && structure.Filesystem != "none" {
+					filesystems = append(filesystems, structure.Filesystem)
+				}
+			}
+		}
+	}
+	var tools []string
+	seen := make(map[string]bool)
+	for _, filesystem := range filesystems {
+		if seen[filesystem] {
+			continue
+		}
+		seen[filesystem] = true
+		tools = append(tools, "mkfs."+filesystem)
+		// mkfs.vfat can't populate the filesystem, mcopy is used for that
+		if filesystem == "vfat" {
+			tools = append(tools, "mcopy")
+		}
+	}
+	return tools
+}
+
+// checkFreeSpace checks that the workdir and output dir have the estimated free
+// space. If they are on the same filesystem, it must have room for both
+func (stateMachine *StateMachine) checkFreeSpace(workDirSpace, outputDirSpace quantity.Size) []string {
+	// determine the directories that will be used, they may not exist yet
+	workDir := stateMachine.stateMachineFlags.WorkDir
+	if workDir == "" {
+		workDir = "/tmp"
+	}
+	outputDir := stateMachine.commonFlags.OutputDir
+	if outputDir == "" {
+		if stateMachine.stateMachineFlags.WorkDir != "" {
+			outputDir = stateMachine.stateMachineFlags.WorkDir
+		} else {
+			outputDir, _ = os.Getwd()
+		}
+	}
+
+	var problems []string
+	workDirFree, workDirFsid, err := freeSpace(workDir)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	outputDirFree, outputDirFsid, err := freeSpace(outputDir)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if workDirFsid == outputDirFsid {
+		workDirSpace += outputDirSpace
+		outputDirSpace = 0
+	}
+	if workDirFree < workDirSpace {
+		problems = append(problems, fmt.Sprintf("the workdir %s needs an estimated %s of free "+
+			"space but only %s is available", workDir, workDirSpace.IECString(), workDirFree.IECString()))
+	}
+	if outputDirFree < outputDirSpace {
+		problems = append(problems, fmt.Sprintf("the output directory %s needs an estimated %s of free "+
+			"space but only %s is available", outputDir, outputDirSpace.IECString(), outputDirFree.IECString()))
+	}
+	return problems
+}
+
+// freeSpace returns the space available to unprivileged users on the filesystem a
+// directory is or will be created on, and the ID of that filesystem
+func freeSpace(dir string) (quantity.Size, syscall.Fsid, error) {
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, syscall.Fsid{}, fmt.Errorf("Error getting absolute path of %s: %s", dir, err.Error())
+	}
+	for {
+		var stat syscall.Statfs_t
+		err := syscallStatfs(path, &stat)
+		if err == nil {
+			return quantity.Size(stat.Bavail) * quantity.Size(stat.Bsize), stat.Fsid, nil
+		}
+		// the directory is created by the build, check its closest existing parent
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, syscall.Fsid{}, fmt.Errorf("Error checking free space of %s: %s", dir, err.Error())
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,222 @@
+// This test file tests the checks of the host run before the build
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// mockLookPath pretends the given tools are not installed
+func mockLookPath(missing ...string) func(string) (string, error) {
+	return func(tool string) (string, error) {
+		for _, missingTool := range missing {
+			if tool == missingTool {
+				return "", fmt.Errorf("executable file not found in $PATH")
+			}
+		}
+		return "/usr/bin/" + tool, nil
+	}
+}
+
+// mockStatfs pretends every filesystem has the given free space
+func mockStatfs(free uint64) func(string, *syscall.Statfs_t) error {
+	return func(path string, stat *syscall.Statfs_t) error {
+		stat.Bavail = free
+		stat.Bsize = 1
+		return nil
+	}
+}
+
+// TestPreflight ensures that all the problems found on the host are reported at once
+func TestPreflight(t *testing.T) {
+	t.Run("test_preflight", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.stateMachineFlags.WorkDir = "/tmp/ubuntu-image-preflight/workdir"
+		stateMachine.states = []stateFunc{
+			noopState("parse_image_definition"),
+			noopState("calculate_states"),
+			noopState("germinate"),
+			noopState("create_chroot"),
+			noopState("install_packages"),
+			noopState("make_qcow2_image"),
+			noopState("finish"),
+		}
+		stateMachine.StepsTaken = 1
+
+		execLookPath = mockLookPath("germinate", "qemu-img")
+		osGeteuid = func() int { return 1000 }
+		syscallStatfs = mockStatfs(1024)
+		defer func() {
+			execLookPath = exec.LookPath
+			osGeteuid = os.Geteuid
+			syscallStatfs = syscall.Statfs
+		}()
+
+		// the states are not known before calculate_states ran
+		err := stateMachine.preflight()
+		asserter.AssertErrNil(err, true)
+		if stateMachine.preflightDone {
+			t.Errorf("Expected the preflight checks to wait for calculate_states")
+		}
+
+		stateMachine.StepsTaken = 2
+		err = stateMachine.preflight()
+		asserter.AssertErrContains(err, "preflight checks failed:\n"+
+			"  - \"germinate\" was not found, it is needed by germinate\n"+
+			"  - \"qemu-img\" was not found, it is needed by make_qcow2_image\n"+
+			"  - ubuntu-image must be run as root, it is needed by create_chroot, install_packages\n"+
+			"  - the workdir /tmp/ubuntu-image-preflight/workdir needs an estimated 3 GiB of free space "+
+			"but only 1 KiB is available\n"+
+			"Fix these problems and try again, or use --skip-preflight to skip these checks")
+
+		// the checks only run once
+		err = stateMachine.preflight()
+		asserter.AssertErrNil(err, true)
+
+		// --until and --thru leave out the states that won't run
+		stateMachine.preflightDone = false
+		stateMachine.stateMachineFlags.Until = "create_chroot"
+		err = stateMachine.preflight()
+		asserter.AssertErrContains(err, "\"germinate\" was not found")
+		if err != nil && strings.Contains(err.Error(), "create_chroot") {
+			t.Errorf("Expected the states after --until to be left out, but got \"%s\"", err.Error())
+		}
+
+		stateMachine.preflightDone = false
+		stateMachine.stateMachineFlags.Until = ""
+		stateMachine.commonFlags.SkipPreflight = true
+		err = stateMachine.preflight()
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestPreflightSeedBuild ensures that the host of a typical build from a seed
+// passes the checks with a realistic amount of free space
+func TestPreflightSeedBuild(t *testing.T) {
+	t.Run("test_preflight_seed_build", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.stateMachineFlags.WorkDir = "/tmp/ubuntu-image-preflight/workdir"
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_amd64.yaml")
+		err := stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.calculateStates()
+		asserter.AssertErrNil(err, true)
+
+		execLookPath = mockLookPath()
+		osGeteuid = func() int { return 0 }
+		syscallStatfs = mockStatfs(uint64(8 * quantity.SizeGiB))
+		defer func() {
+			execLookPath = exec.LookPath
+			osGeteuid = os.Geteuid
+			syscallStatfs = syscall.Statfs
+		}()
+
+		err = stateMachine.preflightChecks(stateMachine.states)
+		asserter.AssertErrNil(err, true)
+
+		syscallStatfs = mockStatfs(uint64(4 * quantity.SizeGiB))
+		err = stateMachine.preflightChecks(stateMachine.states)
+		asserter.AssertErrContains(err, "needs an estimated 6 GiB of free space but only 4 GiB is available")
+	})
+}
+
+// TestPreflightRun ensures that the build fails before running a state if the host
+// can't build the image
+func TestPreflightRun(t *testing.T) {
+	t.Run("test_preflight_run", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.SetLogger(&testLogger{})
+		stateMachine.states = []stateFunc{
+			noopState("calculate_rootfs_size"),
+			noopState("make_disk"),
+		}
+
+		execLookPath = mockLookPath("du")
+		defer func() {
+			execLookPath = exec.LookPath
+		}()
+		err := stateMachine.Run(context.Background())
+		asserter.AssertErrContains(err, "\"du\" was not found, it is needed by calculate_rootfs_size")
+		if stateMachine.StepsTaken != 0 {
+			t.Errorf("Expected no state to run but %d did", stateMachine.StepsTaken)
+		}
+	})
+}
+
+// TestFilesystemTools ensures the mkfs tools are determined from the gadget once it is loaded
+func TestFilesystemTools(t *testing.T) {
+	t.Run("test_filesystem_tools", func(t *testing.T) {
+		var stateMachine StateMachine
+		expected := []string{"mkfs.ext4", "mkfs.vfat", "mcopy"}
+		if tools := stateMachine.filesystemTools(); !reflect.DeepEqual(tools, expected) {
+			t.Errorf("Expected tools %v but got %v", expected, tools)
+		}
+
+		stateMachine.VolumeOrder = []string{"pc"}
+		stateMachine.GadgetInfo = &gadget.Info{
+			Volumes: map[string]*gadget.Volume{
+				"pc": {
+					Structure: []gadget.VolumeStructure{
+						{Filesystem: "none"},
+						{Filesystem: "ext4"},
+						{Filesystem: ""},
+						{Filesystem: "ext4"},
+					},
+				},
+			},
+		}
+		expected = []string{"mkfs.ext4"}
+		if tools := stateMachine.filesystemTools(); !reflect.DeepEqual(tools, expected) {
+			t.Errorf("Expected tools %v but got %v", expected, tools)
+		}
+	})
+}
+
+// TestFreeSpace ensures the free space of a directory that does not exist yet
+// is the one of its closest existing parent
+func TestFreeSpace(t *testing.T) {
+	t.Run("test_free_space", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+
+		free, fsid, err := freeSpace(tmpDir)
+		asserter.AssertErrNil(err, true)
+		missingFree, missingFsid, err := freeSpace(filepath.Join(tmpDir, "does", "not", "exist"))
+		asserter.AssertErrNil(err, true)
+		if fsid != missingFsid || free == 0 || missingFree == 0 {
+			t.Errorf("Expected the free space of %s to be found", tmpDir)
+		}
+
+		syscallStatfs = func(string, *syscall.Statfs_t) error { return syscall.EACCES }
+		defer func() {
+			syscallStatfs = syscall.Statfs
+		}()
+		_, _, err = freeSpace(tmpDir)
+		asserter.AssertErrContains(err, "Error checking free space")
+	})
+}
@@ -0,0 +1,169 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// profileFileName is the name of the build profile written to the output directory
+const profileFileName = "build-profile.json"
+
+// maxProfiledCommands is the number of slowest commands shown in the summary table
+const maxProfiledCommands = 10
+
+// stateTiming records how long a single state took to run
+type stateTiming struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration"` // in seconds
+	Failed   bool    `json:"failed,omitempty"`
+}
+
+// commandTiming records how long a single external command took to run
+type commandTiming struct {
+	State    string   `json:"state"`
+	Command  []string `json:"command"`
+	Duration float64  `json:"duration"` // in seconds
+	Failed   bool     `json:"failed,omitempty"`
+}
+
+// buildProfile holds the wall time spent in every state and external command
+// of a state machine run
+type buildProfile struct {
+	Start    time.Time       `json:"start"`
+	Duration float64         `json:"duration"` // in seconds
+	States   []stateTiming   `json:"states"`
+	Commands []commandTiming `json:"commands"`
+}
+
+// timeCommand runs an external command through the given function, notifying
+// listeners that it was spawned and recording how long it took in the profile.
+// The secrets of the build are redacted from the command
+func (stateMachine *StateMachine) timeCommand(args []string, run func() error) error {
+	args = stateMachine.redactArgs(args)
+	stateMachine.emitEvent(Event{Type: EventCommandSpawned, Command: args})
+	stateMachine.buildLogger().Log(helper.LogDebug, stateMachine.CurrentStep, "Running %s", strings.Join(args, " "))
+	start := time.Now()
+	err := run()
+	stateMachine.profile.Commands = append(stateMachine.profile.Commands, commandTiming{
+		State:    stateMachine.CurrentStep,
+		Command:  args,
+		Duration: time.Since(start).Seconds(),
+		Failed:   err != nil,
+	})
+	return err
+}
+
+// recordState adds the timing of a finished or failed state to the profile
+func (stateMachine *StateMachine) recordState(name string, start time.Time, err error) float64 {
+	duration := time.Since(start).Seconds()
+	stateMachine.profile.States = append(stateMachine.profile.States, stateTiming{
+		Name:     name,
+		Duration: duration,
+		Failed:   err != nil,
+	})
+	return duration
+}
+
+// writeProfile writes the build profile as JSON to the output directory. The
+// profile is only written once the output directory has been created. When the
+// build is resumed, the profile of the earlier runs is kept and this run is
+// added to it, so the profile covers the whole build
+func (stateMachine *StateMachine) writeProfile() error {
+	if stateMachine.commonFlags.OutputDir == "" {
+		return nil
+	}
+	if _, err := os.Stat(stateMachine.commonFlags.OutputDir); err != nil {
+		return nil
+	}
+	profilePath := filepath.Join(stateMachine.commonFlags.OutputDir, profileFileName)
+	stateMachine.profile.Duration = time.Since(stateMachine.profile.Start).Seconds()
+	profile := stateMachine.profile
+	if stateMachine.loadsMetadata() {
+		earlierProfile, err := stateMachine.readEarlierProfile(profilePath)
+		if err != nil {
+			return err
+		}
+		if earlierProfile != nil {
+			profile.Start = earlierProfile.Start
+			profile.Duration += earlierProfile.Duration
+			profile.States = append(append([]stateTiming{}, earlierProfile.States...), profile.States...)
+			profile.Commands = append(append([]commandTiming{}, earlierProfile.Commands...), profile.Commands...)
+		}
+	}
+	profileBytes, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding build profile: %s", err.Error())
+	}
+	if err := osWriteFile(profilePath, profileBytes, 0644); err != nil {
+		return fmt.Errorf("Error writing build profile: %s", err.Error())
+	}
+	return nil
+}
+
+// readEarlierProfile reads the profile written by the earlier runs of a resumed
+// build. It is read before this run writes the profile for the first time, and
+// nothing is returned if the earlier runs did not write one
+func (stateMachine *StateMachine) readEarlierProfile(profilePath string) (*buildProfile, error) {
+	if stateMachine.earlierProfileRead {
+		return stateMachine.earlierProfile, nil
+	}
+	profileBytes, err := osReadFile(profilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			stateMachine.earlierProfileRead = true
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error reading build profile: %s", err.Error())
+	}
+	var earlierProfile buildProfile
+	if err := json.Unmarshal(profileBytes, &earlierProfile); err != nil {
+		return nil, fmt.Errorf("Error decoding build profile: %s", err.Error())
+	}
+	stateMachine.earlierProfile = &earlierProfile
+	stateMachine.earlierProfileRead = true
+	return stateMachine.earlierProfile, nil
+}
+
+// printProfile prints a human readable summary of the time spent in every
+// state and in the slowest external commands
+func (stateMachine *StateMachine) printProfile() {
+	var summary strings.Builder
+	w := tabwriter.NewWriter(&summary, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\nBuild profile:")
+	fmt.Fprintln(w, "STATE\tDURATION")
+	for _, state := range stateMachine.profile.States {
+		name := state.Name
+		if state.Failed {
+			name += " (failed)"
+		}
+		fmt.Fprintf(w, "%s\t%.2fs\n", name, state.Duration)
+	}
+
+	if len(stateMachine.profile.Commands) > 0 {
+		commands := make([]commandTiming, len(stateMachine.profile.Commands))
+		copy(commands, stateMachine.profile.Commands)
+		sort.SliceStable(commands, func(i, j int) bool {
+			return commands[i].Duration > commands[j].Duration
+		})
+		if len(commands) > maxProfiledCommands {
+			commands = commands[:maxProfiledCommands]
+		}
+		fmt.Fprintln(w, "\nSlowest commands:")
+		fmt.Fprintln(w, "STATE\tDURATION\tCOMMAND")
+		for _, command := range commands {
+			fmt.Fprintf(w, "%s\t%.2fs\t%s\n", command.State, command.Duration,
+				strings.Join(command.Command, " "))
+		}
+	}
+	fmt.Fprintf(w, "\nTotal:\t%.2fs\n", time.Since(stateMachine.profile.Start).Seconds())
+	w.Flush()
+	stateMachine.logger().Printf("%s", summary.String())
+}
@@ -0,0 +1,307 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// define some functions that can be mocked by test cases
+var timeNow = time.Now
+
+// resolvedImageDefinitionFileName is the file of the output directory in which
+// the image definition is written once variables and overrides are applied
+const resolvedImageDefinitionFileName = "resolved-image-definition.yaml"
+
+// imageDefinitionVariable matches the ${NAME} references to variables in the values
+// of the image definition, and $${ which is an escaped ${
+var imageDefinitionVariable = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// keyError is a problem with the value of a key of the image definition
+type keyError struct {
+	keyPath []string
+	message string
+}
+
+func (err keyError) Error() string {
+	return fmt.Sprintf("%s: %s", formatKeyPath(err.keyPath), err.message)
+}
+
+// keyErrorsToError joins the problems found in the image definition into a single error
+func keyErrorsToError(prefix string, keyErrors []keyError) error {
+	if len(keyErrors) == 0 {
+		return nil
+	}
+	var problems []string
+	for _, err := range keyErrors {
+		problems = append(problems, err.Error())
+	}
+	return fmt.Errorf("%s:\n  %s", prefix, strings.Join(problems, "\n  "))
+}
+
+// buildDate returns the date of the build as YYYYMMDD. It is the date of
+// SOURCE_DATE_EPOCH if it is set, for reproducible builds
+func buildDate() string {
+	date := timeNow()
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		date = time.Unix(epoch, 0)
+	}
+	return date.UTC().Format("20060102")
+}
+
+// substituteVariables replaces the ${NAME} references in the values of the image
+// definition with the value of the variable. The built-in variables are SERIES,
+// ARCH, NAME and REVISION, set from the image definition, and BUILD_DATE. Other
+// names are looked up in the environment, so series and architecture can only
+// use the environment and BUILD_DATE. The cloud-init configuration is left as it
+// is, since it commonly contains shell variables
+func substituteVariables(imageDefinition *imagedefinition.ImageDefinition) []keyError {
+	variables := map[string]string{"BUILD_DATE": buildDate()}
+	lookup := func(name string) (string, bool) {
+		if value, found := variables[name]; found {
+			return value, true
+		}
+		return os.LookupEnv(name)
+	}
+
+	// the values of the built-in variables are expanded themselves, the
+	// problems with them are reported when their keys are substituted
+	for _, builtin := range []struct {
+		name  string
+		value string
+	}{
+		{"SERIES", imageDefinition.Series},
+		{"ARCH", imageDefinition.Architecture.String()},
+		{"NAME", imageDefinition.ImageName},
+	} {
+		variables[builtin.name], _ = expandVariables(builtin.value, lookup)
+	}
+	variables["REVISION"] = strconv.Itoa(imageDefinition.Revision)
+
+	return substituteVariablesIn(reflect.ValueOf(imageDefinition), nil, lookup)
+}
+
+// substituteVariablesIn does the work of substituteVariables for a value of the
+// image definition at the given key path
+func substituteVariablesIn(value reflect.Value, keyPath []string, lookup func(string) (string, bool)) []keyError {
+	var keyErrors []keyError
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() && value.Type() != reflect.TypeOf(&imagedefinition.CloudInit{}) {
+			keyErrors = substituteVariablesIn(value.Elem(), keyPath, lookup)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			key := strings.Split(value.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			keyErrors = append(keyErrors, substituteVariablesIn(value.Field(i),
+				append(append([]string{}, keyPath...), key), lookup)...)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			keyErrors = append(keyErrors, substituteVariablesIn(value.Index(i),
+				append(append([]string{}, keyPath...), strconv.Itoa(i)), lookup)...)
+		}
+	case reflect.String:
+		expanded, err := expandVariables(value.String(), lookup)
+		if err != nil {
+			keyErrors = append(keyErrors, keyError{keyPath, err.Error()})
+		}
+		value.SetString(expanded)
+	}
+	return keyErrors
+}
+
+// expandVariables replaces the references to variables in a string. The references
+// to undefined variables are reported and left as they are
+func expandVariables(value string, lookup func(string) (string, bool)) (string, error) {
+	var undefined []string
+	expanded := imageDefinitionVariable.ReplaceAllStringFunc(value, func(reference string) string {
+		if reference == "$${" {
+			return "${"
+		}
+		name := reference[2 : len(reference)-1]
+		variable, found := lookup(name)
+		if !found {
+			undefined = append(undefined, reference)
+			return reference
+		}
+		return variable
+	})
+	if len(undefined) > 0 {
+		return expanded, fmt.Errorf("undefined variable %s, use $${ for a literal ${",
+			strings.Join(undefined, ", "))
+	}
+	return expanded, nil
+}
+
+// setOverrides sets the keys of the image definition given with --set, as
+// key.path=value. The key path is written as in the YAML file, with the index
+// of list items in brackets, for example customization.extra-snaps[0].channel.
+// An item can be added at the end of a list by using its length as the index
+func setOverrides(imageDefinition *imagedefinition.ImageDefinition, overrides []string) error {
+	for _, override := range overrides {
+		keyPath, value, found := strings.Cut(override, "=")
+		if !found {
+			return fmt.Errorf("Error setting \"%s\": the override must be given as key.path=value", override)
+		}
+		if err := setOverride(reflect.ValueOf(imageDefinition).Elem(), parseKeyPath(keyPath), nil, value); err != nil {
+			return fmt.Errorf("Error setting \"%s\": %s", override, err.Error())
+		}
+	}
+	return nil
+}
+
+// parseKeyPath splits a key path formatted by formatKeyPath into its keys
+func parseKeyPath(keyPath string) []string {
+	var keys []string
+	for _, key := range strings.Split(keyPath, ".") {
+		for {
+			start := strings.Index(key, "[")
+			if start == -1 || !strings.HasSuffix(key, "]") {
+				keys = append(keys, key)
+				break
+			}
+			end := strings.Index(key[start:], "]") + start
+			if start > 0 {
+				keys = append(keys, key[:start])
+			}
+			keys = append(keys, key[start+1:end])
+			key = key[end+1:]
+			if key == "" {
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// setOverride sets the value at the end of the key path, starting from the given
+// value of the image definition. The structs and lists on the way are created
+// if they don't exist
+func setOverride(value reflect.Value, keyPath []string, parentPath []string, override string) error {
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			value.Set(reflect.New(value.Type().Elem()))
+		}
+		value = value.Elem()
+	}
+	if len(keyPath) == 0 {
+		return setOverrideValue(value, parentPath, override)
+	}
+	key := keyPath[0]
+	keyPathSoFar := append(append([]string{}, parentPath...), key)
+	switch value.Kind() {
+	case reflect.Struct:
+		structField, found := structFieldByYAMLKey(value.Type(), key)
+		if !found {
+			message := fmt.Sprintf("unknown key \"%s\"", formatKeyPath(keyPathSoFar))
+			if suggestion := closestKey(key, yamlKeys(value.Type())); suggestion != "" {
+				message = fmt.Sprintf("%s, did you mean \"%s\"?", message, suggestion)
+			}
+			return fmt.Errorf("%s", message)
+		}
+		return setOverride(value.FieldByIndex(structField.Index), keyPath[1:], keyPathSoFar, override)
+	case reflect.Slice:
+		index, err := strconv.Atoi(key)
+		if err != nil || index < 0 || index > value.Len() {
+			return fmt.Errorf("%s is not an index of the %d items of %s", key, value.Len(),
+				formatKeyPath(parentPath))
+		}
+		if index == value.Len() {
+			value.Set(reflect.Append(value, reflect.Zero(value.Type().Elem())))
+		}
+		return setOverride(value.Index(index), keyPath[1:], keyPathSoFar, override)
+	}
+	return fmt.Errorf("%s has no key \"%s\"", formatKeyPath(parentPath), key)
+}
+
+// setOverrideValue parses the value given with --set according to the type of the key
+func setOverrideValue(value reflect.Value, keyPath []string, override string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(override)
+	case reflect.Int:
+		integer, err := strconv.Atoi(override)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer", formatKeyPath(keyPath))
+		}
+		value.SetInt(int64(integer))
+	case reflect.Bool:
+		boolean, err := strconv.ParseBool(override)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", formatKeyPath(keyPath))
+		}
+		value.SetBool(boolean)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("%s is a list, set the keys of its items instead", formatKeyPath(keyPath))
+		}
+		value.Set(reflect.ValueOf(strings.Split(override, ",")))
+	default:
+		return fmt.Errorf("%s has keys, set them instead", formatKeyPath(keyPath))
+	}
+	return nil
+}
+
+// writeResolvedImageDefinition writes the image definition the image is built from,
+// with the variables substituted, the overrides and the default values, to the
+// output directory, so it can be known how an image was built. The credentials
+// written in the image definition are redacted
+func (classicStateMachine *ClassicStateMachine) writeResolvedImageDefinition() error {
+	var document yamlv3.Node
+	if err := document.Encode(redactedImageDefinition(classicStateMachine.ImageDef)); err != nil {
+		return fmt.Errorf("Error encoding the resolved image definition: %s", err.Error())
+	}
+	pruneEmptyNodes(&document)
+	resolvedBytes, err := yamlv3.Marshal(&document)
+	if err != nil {
+		return fmt.Errorf("Error encoding the resolved image definition: %s", err.Error())
+	}
+	resolvedFileName := resolvedImageDefinitionFileName
+	if classicStateMachine.artifactArchitecture != "" {
+		resolvedFileName = architectureFileName(resolvedFileName, classicStateMachine.artifactArchitecture)
+	}
+	resolvedPath := filepath.Join(classicStateMachine.commonFlags.OutputDir, resolvedFileName)
+	if err := osWriteFile(resolvedPath, resolvedBytes, 0644); err != nil {
+		return fmt.Errorf("Error writing the resolved image definition: %s", err.Error())
+	}
+	return nil
+}
+
+// pruneEmptyNodes removes the keys of a YAML document that have a null, zero or
+// empty value. The image definition treats them the same way as missing keys
+func pruneEmptyNodes(node *yamlv3.Node) bool {
+	switch node.Kind {
+	case yamlv3.DocumentNode:
+		for _, child := range node.Content {
+			pruneEmptyNodes(child)
+		}
+		return false
+	case yamlv3.MappingNode:
+		var content []*yamlv3.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if !pruneEmptyNodes(node.Content[i+1]) {
+				content = append(content, node.Content[i], node.Content[i+1])
+			}
+		}
+		node.Content = content
+		return len(content) == 0
+	case yamlv3.SequenceNode:
+		for _, child := range node.Content {
+			pruneEmptyNodes(child)
+		}
+		return len(node.Content) == 0
+	case yamlv3.ScalarNode:
+		return node.Tag == "!!null" || (node.Tag == "!!str" && node.Value == "") ||
+			(node.Tag == "!!int" && node.Value == "0")
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+// This test file tests the variable substitution and the command line overrides
+// of image definitions
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"gopkg.in/yaml.v2"
+)
+
+// TestSubstituteVariables ensures that the references to the built-in variables and
+// the environment are replaced in the values of the image definition
+func TestSubstituteVariables(t *testing.T) {
+	t.Run("test_substitute_variables", func(t *testing.T) {
+		t.Setenv("UBUNTU_SERIES", "noble")
+		t.Setenv("MIRROR_HOST", "ports.ubuntu.com")
+		t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+		imageDefinition := imagedefinition.ImageDefinition{
+			ImageName:    "ubuntu-${SERIES}-${ARCH}",
+			Architecture: imagedefinition.Architectures{"arm64"},
+			Series:       "${UBUNTU_SERIES}",
+			Revision:     3,
+			Kernel:       "linux-image-generic",
+			Rootfs: &imagedefinition.Rootfs{
+				Mirror:       "http://${MIRROR_HOST}/ubuntu/",
+				ArchiveTasks: []string{"server-${SERIES}"},
+			},
+			Customization: &imagedefinition.Customization{
+				CloudInit: &imagedefinition.CloudInit{
+					UserData: "runcmd:\n  - echo ${HOME}\n",
+				},
+				ExtraPackages: []*imagedefinition.Package{
+					{PackageName: "$${LITERAL}"},
+				},
+			},
+			Artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{ImgName: "${NAME}-${BUILD_DATE}-r${REVISION}.img"},
+				},
+			},
+		}
+		keyErrors := substituteVariables(&imageDefinition)
+		if len(keyErrors) != 0 {
+			t.Fatalf("Unexpected errors %q", keyErrors)
+		}
+
+		expected := map[string]string{
+			"name":                   "ubuntu-noble-arm64",
+			"series":                 "noble",
+			"mirror":                 "http://ports.ubuntu.com/ubuntu/",
+			"archive-tasks":          "server-noble",
+			"user-data":              "runcmd:\n  - echo ${HOME}\n",
+			"extra-packages[0].name": "${LITERAL}",
+			"img[0].name":            "ubuntu-noble-arm64-20231114-r3.img",
+		}
+		got := map[string]string{
+			"name":                   imageDefinition.ImageName,
+			"series":                 imageDefinition.Series,
+			"mirror":                 imageDefinition.Rootfs.Mirror,
+			"archive-tasks":          imageDefinition.Rootfs.ArchiveTasks[0],
+			"user-data":              imageDefinition.Customization.CloudInit.UserData,
+			"extra-packages[0].name": imageDefinition.Customization.ExtraPackages[0].PackageName,
+			"img[0].name":            (*imageDefinition.Artifacts.Img)[0].ImgName,
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected values %q but got %q", expected, got)
+		}
+	})
+	t.Run("test_substitute_undefined_variables", func(t *testing.T) {
+		imageDefinition := imagedefinition.ImageDefinition{
+			ImageName: "ubuntu",
+			Series:    "${UBUNTU_IMAGE_UNDEFINED}",
+			Customization: &imagedefinition.Customization{
+				ExtraSnaps: []*imagedefinition.Snap{
+					{SnapName: "hello", Channel: "${UBUNTU_IMAGE_UNDEFINED}/edge"},
+				},
+			},
+		}
+		keyErrors := substituteVariables(&imageDefinition)
+		expected := []string{
+			"series: undefined variable ${UBUNTU_IMAGE_UNDEFINED}, use $${ for a literal ${",
+			"customization.extra-snaps[0].channel: undefined variable ${UBUNTU_IMAGE_UNDEFINED}, use $${ for a literal ${",
+		}
+		var got []string
+		for _, keyError := range keyErrors {
+			got = append(got, keyError.Error())
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected errors %q but got %q", expected, got)
+		}
+	})
+}
+
+// TestBuildDate ensures that the build date is the current date, unless
+// SOURCE_DATE_EPOCH is set
+func TestBuildDate(t *testing.T) {
+	t.Run("test_build_date", func(t *testing.T) {
+		timeNow = func() time.Time { return time.Date(2024, 4, 25, 12, 0, 0, 0, time.UTC) }
+		defer func() {
+			timeNow = time.Now
+		}()
+		t.Setenv("SOURCE_DATE_EPOCH", "")
+		if date := buildDate(); date != "20240425" {
+			t.Errorf("Expected the build date to be 20240425 but got %s", date)
+		}
+		t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+		if date := buildDate(); date != "20231114" {
+			t.Errorf("Expected the build date to be 20231114 but got %s", date)
+		}
+	})
+}
+
+// TestSetOverrides ensures that the keys given with --set are set in the image
+// definition, with the type of the key
+func TestSetOverrides(t *testing.T) {
+	t.Run("test_set_overrides", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		imageDefinition := imagedefinition.ImageDefinition{
+			Customization: &imagedefinition.Customization{
+				ExtraSnaps: []*imagedefinition.Snap{{SnapName: "hello"}},
+			},
+		}
+		err := setOverrides(&imageDefinition, []string{
+			"rootfs.mirror=http://ports.ubuntu.com/ubuntu/",
+			"revision=4",
+			"rootfs.seed.vcs=false",
+			"rootfs.components=main,universe",
+			"customization.extra-snaps[0].channel=edge",
+			"customization.extra-snaps[1].name=core22",
+			"artifacts.img[0].name=pc.img",
+			"kernel=",
+		})
+		asserter.AssertErrNil(err, true)
+
+		if imageDefinition.Rootfs.Mirror != "http://ports.ubuntu.com/ubuntu/" ||
+			imageDefinition.Revision != 4 || imageDefinition.Rootfs.Seed.Vcs ||
+			!reflect.DeepEqual(imageDefinition.Rootfs.Components, []string{"main", "universe"}) {
+			t.Errorf("Unexpected rootfs %+v and revision %d", imageDefinition.Rootfs, imageDefinition.Revision)
+		}
+		extraSnaps := imageDefinition.Customization.ExtraSnaps
+		if len(extraSnaps) != 2 || extraSnaps[0].Channel != "edge" || extraSnaps[1].SnapName != "core22" {
+			t.Errorf("Unexpected extra snaps %+v", extraSnaps)
+		}
+		if (*imageDefinition.Artifacts.Img)[0].ImgName != "pc.img" {
+			t.Errorf("Unexpected img artifacts %+v", *imageDefinition.Artifacts.Img)
+		}
+	})
+	testCases := []struct {
+		name          string
+		override      string
+		expectedError string
+	}{
+		{"no_value", "rootfs.mirror", "the override must be given as key.path=value"},
+		{"unknown_key", "rootfs.miror=http://ports.ubuntu.com/ubuntu/", "unknown key \"rootfs.miror\", did you mean \"mirror\"?"},
+		{"not_an_integer", "revision=four", "revision must be an integer"},
+		{"not_a_bool", "rootfs.seed.vcs=maybe", "rootfs.seed.vcs must be true or false"},
+		{"index_out_of_range", "customization.extra-snaps[2].name=core22", "2 is not an index of the 0 items of customization.extra-snaps"},
+		{"not_a_list", "rootfs[0]=main", "unknown key \"rootfs[0]\""},
+		{"not_a_struct", "kernel.name=linux-generic", "kernel has no key \"name\""},
+		{"struct", "rootfs=main", "rootfs has keys, set them instead"},
+		{"list_of_structs", "customization.extra-snaps=hello", "customization.extra-snaps is a list, set the keys of its items instead"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_set_overrides_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var imageDefinition imagedefinition.ImageDefinition
+			err := setOverrides(&imageDefinition, []string{tc.override})
+			asserter.AssertErrContains(err, tc.expectedError)
+		})
+	}
+}
+
+// TestResolvedImageDefinition ensures that the image definition is built with the
+// overrides and the variables, and that it is written to the output directory
+func TestResolvedImageDefinition(t *testing.T) {
+	t.Run("test_resolved_image_definition", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+		t.Setenv("UBUNTU_IMAGE_TEST_SERIES", "noble")
+		outputDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outputDir)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.commonFlags.OutputDir = outputDir
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+			"test_amd64.yaml")
+		stateMachine.Opts.Set = []string{
+			"series=${UBUNTU_IMAGE_TEST_SERIES}",
+			"rootfs.seed.branch=${SERIES}",
+			"customization.extra-snaps[0].channel=edge",
+		}
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+		if stateMachine.ImageDef.Series != "noble" || stateMachine.ImageDef.Rootfs.Seed.SeedBranch != "noble" ||
+			stateMachine.ImageDef.Customization.ExtraSnaps[0].Channel != "edge" {
+			t.Errorf("Expected the overrides to be set but got series %s, seed branch %s and channel %s",
+				stateMachine.ImageDef.Series, stateMachine.ImageDef.Rootfs.Seed.SeedBranch,
+				stateMachine.ImageDef.Customization.ExtraSnaps[0].Channel)
+		}
+
+		err = stateMachine.determineOutputDirectory()
+		asserter.AssertErrNil(err, true)
+		resolvedBytes, err := os.ReadFile(filepath.Join(outputDir, resolvedImageDefinitionFileName))
+		asserter.AssertErrNil(err, true)
+		if strings.Contains(string(resolvedBytes), "null") || strings.Contains(string(resolvedBytes), "\"\"") {
+			t.Errorf("Expected the empty keys to be left out but got:\n%s", string(resolvedBytes))
+		}
+		var resolved imagedefinition.ImageDefinition
+		err = yaml.Unmarshal(resolvedBytes, &resolved)
+		asserter.AssertErrNil(err, true)
+		expected := redactedImageDefinition(stateMachine.ImageDef)
+		if !reflect.DeepEqual(resolved, expected) {
+			t.Errorf("Expected the resolved image definition to be\n%+v\nbut got\n%+v", expected, resolved)
+		}
+
+		// the credentials of the private PPAs must not be written
+		authPPAs := 0
+		for _, ppa := range stateMachine.ImageDef.Customization.ExtraPPAs {
+			if ppa.Auth == "" {
+				continue
+			}
+			authPPAs++
+			if strings.Contains(string(resolvedBytes), ppa.Auth) {
+				t.Errorf("Expected the credentials of ppa %s to be redacted but got:\n%s",
+					ppa.PPAName, string(resolvedBytes))
+			}
+		}
+		if authPPAs == 0 {
+			t.Errorf("Expected the image definition to have a PPA with auth")
+		}
+
+		// the overrides must be valid
+		stateMachine.Opts.Set = []string{"series"}
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrContains(err, "the override must be given as key.path=value")
+
+		stateMachine.Opts.Set = []string{"kernel=${UBUNTU_IMAGE_UNDEFINED}"}
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrContains(err, "kernel: undefined variable ${UBUNTU_IMAGE_UNDEFINED}")
+	})
+}
@@ -0,0 +1,205 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/iancoleman/orderedmap"
+	"github.com/invopop/jsonschema"
+)
+
+// ImageDefinitionSchema returns the JSON schema of the image definition file, for
+// editors and other tools. It is the schema that image definitions are validated
+// against, with the keys as they are written in YAML, the descriptions and defaults
+// of the keys, and the rules that are checked in Go code when parsing the file
+func ImageDefinitionSchema() ([]byte, error) {
+	var jsonReflector jsonschema.Reflector
+	schema := jsonReflector.Reflect(&imagedefinition.ImageDefinition{})
+	schemaDefinitionsToYAML(schema.Definitions, reflect.TypeOf(imagedefinition.ImageDefinition{}),
+		true, make(map[string]bool))
+	addSchemaConditionals(schema.Definitions)
+	schemaBytes, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Error generating the image definition schema: %s", err.Error())
+	}
+	return schemaBytes, nil
+}
+
+// schemaDefinitionsToYAML rewrites the definition of a struct of the image definition
+// and the ones of its nested structs to describe the YAML file: the properties are
+// named after the YAML keys, they are documented and the keys that have a default
+// value are not required. Each definition is only rewritten once.
+// The string, integer and boolean fields of the structs that helper.CheckEmptyFields
+// doesn't reach are not required, since they are only checked to be present in the
+// decoded struct, where they always are
+func schemaDefinitionsToYAML(definitions jsonschema.Definitions, structType reflect.Type, checkedEmpty bool, rewritten map[string]bool) {
+	definition, found := definitions[structType.Name()]
+	if !found || rewritten[structType.Name()] {
+		return
+	}
+	rewritten[structType.Name()] = true
+	definition.Description = imagedefinition.Descriptions[structType.Name()]
+
+	yamlNames := make(map[string]string)
+	notRequired := make(map[string]bool)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		yamlName := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		yamlNames[jsonName] = yamlName
+		_, hasDefault := field.Tag.Lookup("default")
+		isNullable := field.Type.Kind() == reflect.Ptr || field.Type.Kind() == reflect.Slice
+		notRequired[jsonName] = hasDefault || (!checkedEmpty && !isNullable)
+
+		// properties are moved to the end of the map when renamed, so renaming
+		// all of them in order keeps the order of the fields
+		value, found := definition.Properties.Get(jsonName)
+		if !found {
+			continue
+		}
+		property := value.(*jsonschema.Schema)
+		definition.Properties.Delete(jsonName)
+		definition.Properties.Set(yamlName, property)
+
+		if description, found := imagedefinition.Descriptions[structType.Name()+"."+field.Name]; found {
+			property.Description = description
+		}
+		if defaultValue, found := field.Tag.Lookup("default"); found {
+			property.Default = schemaDefault(field.Type, defaultValue)
+		}
+
+		// helper.CheckEmptyFields goes through pointers to structs and slices of them
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Slice {
+			fieldType = fieldType.Elem()
+		}
+		fieldCheckedEmpty := checkedEmpty && fieldType.Kind() == reflect.Ptr &&
+			fieldType.Elem().Kind() == reflect.Struct
+		for fieldType.Kind() == reflect.Ptr || fieldType.Kind() == reflect.Slice {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct {
+			schemaDefinitionsToYAML(definitions, fieldType, fieldCheckedEmpty, rewritten)
+		}
+	}
+
+	var required []string
+	for _, jsonName := range definition.Required {
+		if notRequired[jsonName] {
+			continue
+		}
+		required = append(required, schemaRename(jsonName, yamlNames))
+	}
+	definition.Required = required
+	for _, oneOf := range definition.OneOf {
+		for i, jsonName := range oneOf.Required {
+			oneOf.Required[i] = schemaRename(jsonName, yamlNames)
+		}
+	}
+}
+
+// schemaRename returns the YAML key of a property of the JSON schema
+func schemaRename(jsonName string, yamlNames map[string]string) string {
+	if yamlName, found := yamlNames[jsonName]; found {
+		return yamlName
+	}
+	return jsonName
+}
+
+// schemaDefault converts the value of a default tag, as it is set by helper.SetDefaults,
+// to a value of the JSON schema
+func schemaDefault(fieldType reflect.Type, defaultValue string) interface{} {
+	if fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	switch fieldType.Kind() {
+	case reflect.Bool:
+		return defaultValue == "true"
+	case reflect.Int:
+		if value, err := strconv.Atoi(defaultValue); err == nil {
+			return value
+		}
+	case reflect.Slice:
+		return strings.Split(defaultValue, ",")
+	}
+	return defaultValue
+}
+
+// schemaProperties returns the properties of a schema made of a single property
+func schemaProperties(name string, property *jsonschema.Schema) *orderedmap.OrderedMap {
+	properties := orderedmap.New()
+	properties.Set(name, property)
+	return properties
+}
+
+// schemaProperty returns a property of a definition of the schema
+func schemaProperty(definitions jsonschema.Definitions, definition string, property string) *jsonschema.Schema {
+	value, _ := definitions[definition].Properties.Get(property)
+	return value.(*jsonschema.Schema)
+}
+
+// addSchemaConditionals adds the rules that validateImageDefinition checks in Go
+// code, because they can't be expressed by struct tags, to the definitions of the
+// schema describing the YAML file
+func addSchemaConditionals(definitions jsonschema.Definitions) {
+	// gadgets that are not prebuilt must have a URL
+	definitions["Gadget"].AllOf = append(definitions["Gadget"].AllOf, &jsonschema.Schema{
+		If: &jsonschema.Schema{
+			Properties: schemaProperties("type", &jsonschema.Schema{Enum: []interface{}{"git", "directory"}}),
+		},
+		Then: &jsonschema.Schema{Required: []string{"url"}},
+	})
+
+	// images can't be created without a gadget
+	var diskArtifacts []*jsonschema.Schema
+	artifactType := reflect.TypeOf(imagedefinition.Artifact{})
+	for i := 0; i < artifactType.NumField(); i++ {
+		field := artifactType.Field(i)
+		if field.Tag.Get("is_disk") == "true" {
+			diskArtifacts = append(diskArtifacts, &jsonschema.Schema{
+				Required: []string{strings.Split(field.Tag.Get("yaml"), ",")[0]},
+			})
+		}
+	}
+	definitions["ImageDefinition"].AllOf = append(definitions["ImageDefinition"].AllOf, &jsonschema.Schema{
+		If: &jsonschema.Schema{Not: &jsonschema.Schema{Required: []string{"gadget"}}},
+		Then: &jsonschema.Schema{
+			Properties: schemaProperties("artifacts", &jsonschema.Schema{
+				Not: &jsonschema.Schema{AnyOf: diskArtifacts},
+			}),
+		},
+	})
+
+	// private PPAs must have a fingerprint, and their credentials are given
+	// with only one of the keys
+	privatePPA := []*jsonschema.Schema{
+		{Required: []string{"auth"}},
+		{Required: []string{"auth-file"}},
+		{Required: []string{"auth-env"}},
+	}
+	definitions["PPA"].AllOf = append(definitions["PPA"].AllOf, &jsonschema.Schema{
+		If:   &jsonschema.Schema{AnyOf: privatePPA},
+		Then: &jsonschema.Schema{Required: []string{"fingerprint"}},
+	}, &jsonschema.Schema{
+		Not: &jsonschema.Schema{AnyOf: []*jsonschema.Schema{
+			{Required: []string{"auth", "auth-file"}},
+			{Required: []string{"auth", "auth-env"}},
+			{Required: []string{"auth-file", "auth-env"}},
+		}},
+	})
+
+	// the files copied, executed and touched in the rootfs must have an
+	// absolute path, that can't escape it
+	for _, path := range []*jsonschema.Schema{
+		schemaProperty(definitions, "CopyFile", "destination"),
+		schemaProperty(definitions, "Execute", "path"),
+		schemaProperty(definitions, "TouchFile", "path"),
+	} {
+		path.Pattern = "^/"
+		path.Not = &jsonschema.Schema{Pattern: "/\\.\\./"}
+	}
+}
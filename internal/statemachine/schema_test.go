@@ -0,0 +1,106 @@
+// This test file tests the JSON schema of image definitions exported for editors
+package statemachine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/xeipuuv/gojsonschema"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// TestImageDefinitionSchema ensures that the exported schema accepts and rejects the
+// YAML files the same way the image definition parsing does
+func TestImageDefinitionSchema(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	schemaBytes, err := ImageDefinitionSchema()
+	asserter.AssertErrNil(err, true)
+
+	// editors mostly support draft 7, the schema must not rely on later drafts
+	schemaLoader := gojsonschema.NewSchemaLoader()
+	schemaLoader.Draft = gojsonschema.Draft7
+	schemaLoader.AutoDetect = false
+	schema, err := schemaLoader.Compile(gojsonschema.NewBytesLoader(schemaBytes))
+	asserter.AssertErrNil(err, true)
+
+	testCases := []struct {
+		name            string
+		imageDefinition string
+		expectedError   string
+	}{
+		{"valid", "test_amd64.yaml", ""},
+		{"valid_with_defaults", "test_raspi.yaml", ""},
+		{"valid_without_gadget", "test_extract_rootfs_tar.yaml", ""},
+		{"valid_prebuilt_gadget", "test_prebuilt_gadget.yaml", ""},
+		{"valid_multi_arch", "test_multi_arch.yaml", ""},
+		{"enum", "test_bad_class.yaml", "class must be one of the following"},
+		{"pattern", "test_bad_ppa_name.yaml", "Does not match pattern"},
+		{"oneof", "test_both_seed_and_tasks.yaml", "Must validate one and only one schema"},
+		{"missing_key", "test_missing_name.yaml", "name is required"},
+		{"unknown_key", "test_unknown_keys.yaml", "Additional property artefacts is not allowed"},
+		{"git_gadget_without_url", "test_git_gadget_without_url.yaml", "url is required"},
+		{"private_ppa_without_fingerprint", "test_private_ppa_without_fingerprint.yaml", "fingerprint is required"},
+		{"conflicting_ppa_auth", "test_conflicting_ppa_auth.yaml", "extra-ppas.0: Must not validate the schema"},
+		{"img_without_gadget", "test_image_without_gadget.yaml", "artifacts: Must not validate the schema"},
+		{"relative_copy_file", "test_invalid_paths_in_manual_copy.yaml", "copy-file.1.destination: Does not match pattern"},
+		{"escaping_touch_file", "test_invalid_paths_in_manual_touch_file.yaml", "touch-file.1.path: Must not validate the schema"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_image_definition_schema_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imageDefinitionBytes, err := os.ReadFile(filepath.Join("testdata", "image_definitions", tc.imageDefinition))
+			asserter.AssertErrNil(err, true)
+			var imageDefinition interface{}
+			err = yamlv3.Unmarshal(imageDefinitionBytes, &imageDefinition)
+			asserter.AssertErrNil(err, true)
+
+			result, err := schema.Validate(gojsonschema.NewGoLoader(imageDefinition))
+			asserter.AssertErrNil(err, true)
+			var problems []string
+			for _, resultError := range result.Errors() {
+				problems = append(problems, resultError.String())
+			}
+			if tc.expectedError == "" {
+				if !result.Valid() {
+					t.Errorf("Expected %s to be valid but got %q", tc.imageDefinition, problems)
+				}
+			} else if !strings.Contains(strings.Join(problems, "\n"), tc.expectedError) {
+				t.Errorf("Expected an error containing \"%s\" but got %q", tc.expectedError, problems)
+			}
+		})
+	}
+
+	t.Run("test_image_definition_schema_documentation", func(t *testing.T) {
+		var document struct {
+			Defs map[string]struct {
+				Properties map[string]struct {
+					Description string      `json:"description"`
+					Default     interface{} `json:"default"`
+					Enum        []string    `json:"enum"`
+				} `json:"properties"`
+			} `json:"$defs"`
+		}
+		err := json.Unmarshal(schemaBytes, &document)
+		asserter.AssertErrNil(err, true)
+		for definition, defSchema := range document.Defs {
+			for key, property := range defSchema.Properties {
+				if property.Description == "" {
+					t.Errorf("Key %s of %s has no description", key, definition)
+				}
+			}
+		}
+		if mirror := document.Defs["Rootfs"].Properties["mirror"].Default; mirror != "http://archive.ubuntu.com/ubuntu/" {
+			t.Errorf("Expected the default mirror to be documented but got %v", mirror)
+		}
+		if vcs := document.Defs["Seed"].Properties["vcs"].Default; vcs != true {
+			t.Errorf("Expected vcs to default to true but got %v", vcs)
+		}
+		if pockets := document.Defs["Rootfs"].Properties["pocket"].Enum; len(pockets) == 0 {
+			t.Errorf("Expected the pockets to be listed")
+		}
+	})
+}
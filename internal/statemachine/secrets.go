@@ -0,0 +1,185 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// ppaCredentialsPattern matches the credentials of a private PPA, in the
+// format "user:password"
+var ppaCredentialsPattern = regexp.MustCompile(`^[a-zA-Z0-9_.+-]+:[a-zA-Z0-9]+$`)
+
+// isPrivatePPA returns whether credentials are given for a PPA, in the image
+// definition, in a file or in an environment variable
+func isPrivatePPA(ppa *imagedefinition.PPA) bool {
+	return ppa.Auth != "" || ppa.AuthFile != "" || ppa.AuthEnv != ""
+}
+
+// ppaCredentials returns the login and password of a private PPA, read from the
+// auth key of the image definition, the file given with auth-file or the
+// environment variable given with auth-env. The errors never contain them
+func ppaCredentials(ppa *imagedefinition.PPA) (login string, password string, err error) {
+	credentials := ppa.Auth
+	switch {
+	case ppa.AuthFile != "":
+		credentialsBytes, err := osReadFile(ppa.AuthFile)
+		if err != nil {
+			return "", "", fmt.Errorf("Error reading the credentials of ppa \"%s\": %s",
+				ppa.PPAName, err.Error())
+		}
+		credentials = string(credentialsBytes)
+	case ppa.AuthEnv != "":
+		var found bool
+		credentials, found = os.LookupEnv(ppa.AuthEnv)
+		if !found {
+			return "", "", fmt.Errorf("the environment variable %s holding the credentials of ppa \"%s\" is not set",
+				ppa.AuthEnv, ppa.PPAName)
+		}
+	}
+	credentials = strings.TrimSpace(credentials)
+	if !ppaCredentialsPattern.MatchString(credentials) {
+		return "", "", fmt.Errorf("the credentials of ppa \"%s\" must be in the format \"user:password\"",
+			ppa.PPAName)
+	}
+	login, password, _ = strings.Cut(credentials, ":")
+	return login, password, nil
+}
+
+// ppaCredentialsKey returns the key of the image definition the credentials of
+// a private PPA are given with
+func ppaCredentialsKey(ppa *imagedefinition.PPA) string {
+	switch {
+	case ppa.AuthFile != "":
+		return "auth-file"
+	case ppa.AuthEnv != "":
+		return "auth-env"
+	}
+	return "auth"
+}
+
+// checkPPACredentials reads the credentials of the private PPAs, so a missing
+// file or environment variable fails the build before anything is done, and
+// makes sure they are redacted from everything the build prints and logs. The
+// credentials written in the image definition itself are only kept for
+// compatibility, so they are warned about
+func (stateMachine *StateMachine) checkPPACredentials(imageDefinition *imagedefinition.ImageDefinition) []keyError {
+	if imageDefinition.Customization == nil {
+		return nil
+	}
+	var keyErrors []keyError
+	for i, ppa := range imageDefinition.Customization.ExtraPPAs {
+		if !isPrivatePPA(ppa) {
+			continue
+		}
+		keyPath := []string{"customization", "extra-ppas", strconv.Itoa(i), ppaCredentialsKey(ppa)}
+		_, password, err := ppaCredentials(ppa)
+		if err != nil {
+			keyErrors = append(keyErrors, keyError{keyPath, err.Error()})
+			continue
+		}
+		stateMachine.buildLogger().AddSecret(password)
+		if ppa.Auth != "" {
+			stateMachine.warningf("%s writes the credentials of ppa \"%s\" in the image definition, "+
+				"use auth-file or auth-env instead\n", formatKeyPath(keyPath), ppa.PPAName)
+		}
+	}
+	return keyErrors
+}
+
+// redact replaces the secrets of the build in a message, such as the credentials
+// of private PPAs, so they are not printed or written to the build log
+func (stateMachine *StateMachine) redact(message string) string {
+	return stateMachine.buildLogger().Redact(message)
+}
+
+// redactArgs returns the arguments of a command with the secrets of the build
+// redacted, to report the command to the listeners and in the profile
+func (stateMachine *StateMachine) redactArgs(args []string) []string {
+	redactedArgs := make([]string, len(args))
+	for i, arg := range args {
+		redactedArgs[i] = stateMachine.redact(arg)
+	}
+	return redactedArgs
+}
+
+// redactedError is an error whose message had the secrets of the build redacted.
+// It wraps the original error, so it can still be inspected with errors.As
+type redactedError struct {
+	message string
+	cause   error
+}
+
+func (err *redactedError) Error() string {
+	return err.message
+}
+
+func (err *redactedError) Unwrap() error {
+	return err.cause
+}
+
+// redactError redacts the secrets of the build from the message of an error, which
+// often contains the command that failed and its output
+func (stateMachine *StateMachine) redactError(err error) error {
+	message := stateMachine.redact(err.Error())
+	if message == err.Error() {
+		return err
+	}
+	return &redactedError{message: message, cause: err}
+}
+
+// redactedImageDefinition returns a copy of an image definition in which the
+// credentials written in it are redacted, to write it to the files that are
+// kept after the build
+func redactedImageDefinition(imageDefinition imagedefinition.ImageDefinition) imagedefinition.ImageDefinition {
+	if imageDefinition.Customization == nil || len(imageDefinition.Customization.ExtraPPAs) == 0 {
+		return imageDefinition
+	}
+	customization := *imageDefinition.Customization
+	customization.ExtraPPAs = make([]*imagedefinition.PPA, len(imageDefinition.Customization.ExtraPPAs))
+	for i, ppa := range imageDefinition.Customization.ExtraPPAs {
+		redactedPPA := *ppa
+		if redactedPPA.Auth != "" {
+			redactedPPA.Auth = helper.RedactedSecret
+		}
+		customization.ExtraPPAs[i] = &redactedPPA
+	}
+	imageDefinition.Customization = &customization
+	return imageDefinition
+}
+
+// restoreRedactedCredentials reads the credentials written in the image definition
+// again when a build is resumed, since they are redacted in the metadata. The image
+// definition was checked to be unchanged since the build was started
+func (classicStateMachine *ClassicStateMachine) restoreRedactedCredentials() error {
+	if classicStateMachine.ImageDef.Customization == nil {
+		return nil
+	}
+	var imageDefinition *imagedefinition.ImageDefinition
+	for i, ppa := range classicStateMachine.ImageDef.Customization.ExtraPPAs {
+		if ppa.Auth != helper.RedactedSecret {
+			continue
+		}
+		if imageDefinition == nil {
+			var err error
+			imageDefinition, err = readImageDefinition(classicStateMachine.Args.ImageDefinition,
+				classicStateMachine.Opts.Set)
+			if err != nil {
+				return fmt.Errorf("Error reading the credentials of the image definition: %s", err.Error())
+			}
+		}
+		if imageDefinition.Customization == nil || i >= len(imageDefinition.Customization.ExtraPPAs) {
+			return fmt.Errorf("Error reading the credentials of ppa \"%s\" from the image definition",
+				ppa.PPAName)
+		}
+		ppa.Auth = imageDefinition.Customization.ExtraPPAs[i].Auth
+		_, password, _ := strings.Cut(ppa.Auth, ":")
+		classicStateMachine.buildLogger().AddSecret(password)
+	}
+	return nil
+}
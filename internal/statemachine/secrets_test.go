@@ -0,0 +1,306 @@
+// This test file tests that the credentials of private PPAs are kept out of the
+// output of the build, the files it writes and the image
+package statemachine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// TestPPACredentials ensures that the credentials of private PPAs are read from
+// the image definition, a file or an environment variable
+func TestPPACredentials(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	credentialsFile := filepath.Join(tmpDir, "credentials")
+	if err := os.WriteFile(credentialsFile, []byte("testuser:testpass\n"), 0600); err != nil {
+		t.Fatalf("Error writing credentials file: %s", err.Error())
+	}
+	t.Setenv("TEST_PPA_CREDENTIALS", "testuser:testpass")
+	t.Setenv("TEST_PPA_BAD_CREDENTIALS", "testpass")
+
+	testCases := []struct {
+		name          string
+		ppa           imagedefinition.PPA
+		expectedError string
+	}{
+		{"auth", imagedefinition.PPA{Auth: "testuser:testpass"}, ""},
+		{"auth_file", imagedefinition.PPA{AuthFile: credentialsFile}, ""},
+		{"auth_env", imagedefinition.PPA{AuthEnv: "TEST_PPA_CREDENTIALS"}, ""},
+		{"missing_file", imagedefinition.PPA{AuthFile: filepath.Join(tmpDir, "missing")},
+			"Error reading the credentials of ppa"},
+		{"missing_env", imagedefinition.PPA{AuthEnv: "TEST_PPA_MISSING_CREDENTIALS"},
+			"the environment variable TEST_PPA_MISSING_CREDENTIALS holding the credentials of ppa"},
+		{"bad_format", imagedefinition.PPA{AuthEnv: "TEST_PPA_BAD_CREDENTIALS"},
+			"must be in the format \"user:password\""},
+	}
+	for _, tc := range testCases {
+		t.Run("test_ppa_credentials_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tc.ppa.PPAName = "private/ppa"
+			login, password, err := ppaCredentials(&tc.ppa)
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				if strings.Contains(err.Error(), "testpass") {
+					t.Errorf("Expected the error not to contain the credentials but got \"%s\"", err.Error())
+				}
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			if login != "testuser" || password != "testpass" {
+				t.Errorf("Expected the credentials testuser:testpass but got %s:%s", login, password)
+			}
+		})
+	}
+}
+
+// TestCheckPPACredentials ensures that the credentials of the private PPAs are
+// checked when the image definition is parsed, and redacted from then on
+func TestCheckPPACredentials(t *testing.T) {
+	t.Run("test_check_ppa_credentials", func(t *testing.T) {
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		logger := &testLogger{}
+		stateMachine.SetLogger(logger)
+		imageDefinition := imagedefinition.ImageDefinition{
+			Customization: &imagedefinition.Customization{
+				ExtraPPAs: []*imagedefinition.PPA{
+					{PPAName: "public/ppa"},
+					{PPAName: "private/ppa", Auth: "testuser:testpass"},
+					{PPAName: "private/other", AuthEnv: "TEST_PPA_MISSING_CREDENTIALS"},
+				},
+			},
+		}
+		keyErrors := stateMachine.checkPPACredentials(&imageDefinition)
+		if len(keyErrors) != 1 || formatKeyPath(keyErrors[0].keyPath) != "customization.extra-ppas[2].auth-env" {
+			t.Errorf("Expected an error about the missing environment variable but got %v", keyErrors)
+		}
+		output := strings.Join(logger.messages, "")
+		if !strings.Contains(output, "WARNING: customization.extra-ppas[1].auth writes the credentials") {
+			t.Errorf("Expected a warning about the credentials in the image definition but got \"%s\"", output)
+		}
+		if redacted := stateMachine.redact("testuser:testpass"); redacted != "testuser:"+helper.RedactedSecret {
+			t.Errorf("Expected the password to be redacted but got \"%s\"", redacted)
+		}
+	})
+}
+
+// TestRedactSecrets ensures that the secrets of the build are redacted from the
+// messages, the build log, the events, the profile and the errors
+func TestRedactSecrets(t *testing.T) {
+	t.Run("test_redact_secrets", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var stateMachine testStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		logger := &testLogger{}
+		var events []Event
+		stateMachine.SetLogger(logger)
+		stateMachine.SetEventHandler(func(event Event) {
+			events = append(events, event)
+		})
+		err = stateMachine.openBuildLog()
+		asserter.AssertErrNil(err, true)
+		stateMachine.buildLogger().AddSecret("testpass")
+
+		stateMachine.states = []stateFunc{
+			{"test_secret", func(stateMachine *StateMachine) error {
+				stateMachine.infof("Using testuser:testpass\n")
+				cmd := exec.Command("sh", "-c", "echo testpass; exit 1")
+				cmdOutput, err := stateMachine.runCmd(cmd)
+				return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Full output below:\n%s",
+					cmd.String(), err.Error(), cmdOutput.String())
+			}},
+		}
+		err = stateMachine.Run(context.Background())
+		asserter.AssertErrContains(err, "echo "+helper.RedactedSecret)
+		err = stateMachine.buildLogger().Close()
+		asserter.AssertErrNil(err, true)
+
+		buildLogBytes, err := os.ReadFile(filepath.Join(workDir, buildLogFileName))
+		asserter.AssertErrNil(err, true)
+		if !strings.Contains(string(buildLogBytes), "Using testuser:"+helper.RedactedSecret) {
+			t.Errorf("Expected the message to be logged with the secret redacted but got:\n%s", buildLogBytes)
+		}
+		eventBytes, err := json.Marshal(events)
+		asserter.AssertErrNil(err, true)
+		profileBytes, err := json.Marshal(stateMachine.profile)
+		asserter.AssertErrNil(err, true)
+		outputs := map[string]string{
+			"messages":  strings.Join(logger.messages, ""),
+			"build log": string(buildLogBytes),
+			"events":    string(eventBytes),
+			"profile":   string(profileBytes),
+		}
+		for name, output := range outputs {
+			if strings.Contains(output, "testpass") {
+				t.Errorf("Expected the secret to be redacted from the %s but got:\n%s", name, output)
+			}
+		}
+	})
+}
+
+// TestRedactedImageDefinition ensures that the credentials written in the image
+// definition are redacted from the files written by the build, and restored when
+// the build is resumed
+func TestRedactedImageDefinition(t *testing.T) {
+	t.Run("test_redacted_image_definition", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+		outputDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outputDir)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.OutputDir = outputDir
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_amd64.yaml")
+		err = stateMachine.parseImageDefinition()
+		asserter.AssertErrNil(err, true)
+		privatePPA := stateMachine.ImageDef.Customization.ExtraPPAs[1]
+		auth := privatePPA.Auth
+
+		redacted := redactedImageDefinition(stateMachine.ImageDef)
+		if redacted.Customization.ExtraPPAs[1].Auth != helper.RedactedSecret {
+			t.Errorf("Expected the credentials to be redacted but got \"%s\"", redacted.Customization.ExtraPPAs[1].Auth)
+		}
+		if redacted.Customization.ExtraPPAs[0].Auth != "" {
+			t.Errorf("Expected the public PPA to be left as it is")
+		}
+		if privatePPA.Auth != auth {
+			t.Errorf("Expected the image definition to be left as it is")
+		}
+
+		err = stateMachine.writeResolvedImageDefinition()
+		asserter.AssertErrNil(err, true)
+		resolvedBytes, err := os.ReadFile(filepath.Join(outputDir, resolvedImageDefinitionFileName))
+		asserter.AssertErrNil(err, true)
+		if strings.Contains(string(resolvedBytes), auth) {
+			t.Errorf("Expected the credentials to be redacted from the resolved image definition but got:\n%s",
+				resolvedBytes)
+		}
+
+		// a resumed build reads them from the image definition again
+		stateMachine.ImageDef = redacted
+		err = stateMachine.restoreRedactedCredentials()
+		asserter.AssertErrNil(err, true)
+		if stateMachine.ImageDef.Customization.ExtraPPAs[1].Auth != auth {
+			t.Errorf("Expected the credentials to be restored but got \"%s\"",
+				stateMachine.ImageDef.Customization.ExtraPPAs[1].Auth)
+		}
+	})
+}
+
+// TestPPACredentialsFiles ensures that the credentials of private PPAs are written
+// to /etc/apt/auth.conf.d instead of the sources, and removed before the rootfs
+// is populated
+func TestPPACredentialsFiles(t *testing.T) {
+	t.Run("test_ppa_credentials_files", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		chroot, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(chroot)
+		t.Setenv("TEST_PPA_CREDENTIALS", "testuser:testpass")
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.tempDirs.chroot = chroot
+		privatePPA := &imagedefinition.PPA{
+			PPAName: "private/ppa",
+			AuthEnv: "TEST_PPA_CREDENTIALS",
+		}
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Series: "jammy",
+			Customization: &imagedefinition.Customization{
+				ExtraPPAs: []*imagedefinition.PPA{{PPAName: "public/ppa"}, privatePPA},
+			},
+		}
+
+		err = stateMachine.writePPACredentials(privatePPA, "jammy")
+		asserter.AssertErrNil(err, true)
+		authFile := filepath.Join(chroot, "etc", "apt", "auth.conf.d", "private-ubuntu-ppa-jammy.conf")
+		authFileInfo, err := os.Stat(authFile)
+		asserter.AssertErrNil(err, true)
+		if authFileInfo.Mode().Perm() != 0600 {
+			t.Errorf("Expected the credentials to only be readable by root but got mode %s", authFileInfo.Mode())
+		}
+		authFileBytes, err := os.ReadFile(authFile)
+		asserter.AssertErrNil(err, true)
+		if !strings.Contains(string(authFileBytes), "login testuser password testpass") {
+			t.Errorf("Expected the credentials to be written for apt but got \"%s\"", authFileBytes)
+		}
+
+		err = stateMachine.removePPACredentials()
+		asserter.AssertErrNil(err, true)
+		if _, err := os.Stat(authFile); !os.IsNotExist(err) {
+			t.Errorf("Expected the credentials to be removed from the chroot")
+		}
+		// removing them again does nothing, for resumed builds
+		err = stateMachine.removePPACredentials()
+		asserter.AssertErrNil(err, true)
+	})
+	t.Run("test_failed_ppa_credentials_files", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		chroot, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(chroot)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.tempDirs.chroot = chroot
+		privatePPA := &imagedefinition.PPA{
+			PPAName: "private/ppa",
+			Auth:    "testuser:testpass",
+		}
+
+		osMkdirAll = mockMkdirAll
+		defer func() {
+			osMkdirAll = os.MkdirAll
+		}()
+		err = stateMachine.writePPACredentials(privatePPA, "jammy")
+		asserter.AssertErrContains(err, "Failed to create apt auth.conf.d")
+		osMkdirAll = os.MkdirAll
+
+		osWriteFile = mockWriteFile
+		defer func() {
+			osWriteFile = os.WriteFile
+		}()
+		err = stateMachine.writePPACredentials(privatePPA, "jammy")
+		asserter.AssertErrContains(err, "Error writing the credentials of ppa")
+		osWriteFile = os.WriteFile
+
+		stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			Series: "jammy",
+			Customization: &imagedefinition.Customization{
+				ExtraPPAs: []*imagedefinition.PPA{privatePPA},
+			},
+		}
+		osRemove = mockRemove
+		defer func() {
+			osRemove = os.Remove
+		}()
+		err = stateMachine.removePPACredentials()
+		asserter.AssertErrContains(err, "Error removing the credentials of ppa")
+		osRemove = os.Remove
+	})
+}
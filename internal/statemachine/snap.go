@@ -1,6 +1,8 @@
 package statemachine
 
 import (
+	"context"
+
 	"github.com/canonical/ubuntu-image/internal/commands"
 )
 
@@ -30,7 +32,7 @@ type SnapStateMachine struct {
 
 // Setup assigns variables and calls other functions that must be executed before Run(). It is
 // exported so it can be used as a polymorphism in main
-func (snapStateMachine *SnapStateMachine) Setup() error {
+func (snapStateMachine *SnapStateMachine) Setup(ctx context.Context) error {
 	// set the parent pointer of the embedded struct
 	snapStateMachine.parent = snapStateMachine
 
@@ -47,6 +49,11 @@ func (snapStateMachine *SnapStateMachine) Setup() error {
 		return err
 	}
 
+	// validate the states given with --state-timeout
+	if err := snapStateMachine.validateStateTimeouts(); err != nil {
+		return err
+	}
+
 	// if --resume was passed, figure out where to start
 	if err := snapStateMachine.readMetadata(); err != nil {
 		return err
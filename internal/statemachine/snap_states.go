@@ -31,7 +31,7 @@ func (stateMachine *StateMachine) prepareImage() error {
 	}
 	imageOpts.Revisions = make(map[string]snap.Revision)
 	for snapName, snapRev := range snapStateMachine.Opts.Revisions {
-		fmt.Printf("WARNING: revision %d for snap %s may not be the latest available version!\n", snapRev, snapName)
+		stateMachine.warningf("revision %d for snap %s may not be the latest available version!\n", snapRev, snapName)
 		imageOpts.Revisions[snapName] = snap.Revision{N: snapRev}
 	}
 
@@ -68,6 +68,7 @@ func (stateMachine *StateMachine) prepareImage() error {
 	if err := imagePrepare(&imageOpts); err != nil {
 		return fmt.Errorf("Error preparing image: %s", err.Error())
 	}
+	stateMachine.artifactWritten(ArtifactSeedManifest, imageOpts.SeedManifestPath)
 
 	// set the gadget yaml location
 	snapStateMachine.YamlFilePath = filepath.Join(stateMachine.tempDirs.unpack, "gadget", "meta", "gadget.yaml")
@@ -133,5 +134,9 @@ func (stateMachine *StateMachine) generateSnapManifest() error {
 	// snaps.manifest
 	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, "snaps.manifest")
 	snapsDir := filepath.Join(stateMachine.tempDirs.rootfs, "system-data", "var", "lib", "snapd", "snaps")
-	return WriteSnapManifest(snapsDir, outputPath)
+	if err := WriteSnapManifest(snapsDir, outputPath); err != nil {
+		return err
+	}
+	stateMachine.artifactWritten(ArtifactSnapsManifest, outputPath)
+	return nil
 }
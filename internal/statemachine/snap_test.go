@@ -45,7 +45,7 @@ func TestFailedSnapSetup(t *testing.T) {
 			stateMachine.stateMachineFlags.Until = tc.until
 			stateMachine.stateMachineFlags.Thru = tc.thru
 
-			err := stateMachine.Setup()
+			err := stateMachine.Setup(context.Background())
 			asserter.AssertErrContains(err, tc.errMsg)
 		})
 	}
@@ -65,7 +65,7 @@ func TestFailedReadMetadataSnap(t *testing.T) {
 		stateMachine.stateMachineFlags.Resume = true
 		stateMachine.stateMachineFlags.WorkDir = testDir
 
-		err := stateMachine.Setup()
+		err := stateMachine.Setup(context.Background())
 		asserter.AssertErrContains(err, "error reading metadata file")
 	})
 }
@@ -87,10 +87,10 @@ func TestSuccessfulSnapCore20(t *testing.T) {
 		defer os.RemoveAll(workDir)
 		stateMachine.stateMachineFlags.WorkDir = workDir
 
-		err = stateMachine.Setup()
+		err = stateMachine.Setup(context.Background())
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Run()
+		err = stateMachine.Run(context.Background())
 		asserter.AssertErrNil(err, true)
 
 		// make sure the "factory" boot flag was set
@@ -103,7 +103,7 @@ func TestSuccessfulSnapCore20(t *testing.T) {
 			t.Errorf("grubenv file does not have factory boot flag set")
 		}
 
-		err = stateMachine.Teardown()
+		err = stateMachine.Teardown(context.Background())
 		asserter.AssertErrNil(err, true)
 	})
 }
@@ -128,10 +128,10 @@ func TestSuccessfulSnapCore18(t *testing.T) {
 		defer os.RemoveAll(workDir)
 		stateMachine.stateMachineFlags.WorkDir = workDir
 
-		err = stateMachine.Setup()
+		err = stateMachine.Setup(context.Background())
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Run()
+		err = stateMachine.Run(context.Background())
 		asserter.AssertErrNil(err, true)
 
 		// make sure cloud-init user-data was placed correctly
@@ -171,7 +171,7 @@ func TestSuccessfulSnapCore18(t *testing.T) {
 			t.Error("First three bytes of resulting image file are not correct")
 		}
 
-		err = stateMachine.Teardown()
+		err = stateMachine.Teardown(context.Background())
 		asserter.AssertErrNil(err, true)
 	})
 }
@@ -189,14 +189,20 @@ func TestFailedPrepareImage(t *testing.T) {
 		stateMachine.parent = &stateMachine
 		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
 		stateMachine.Opts.DisableConsoleConf = true
+		// the host tools are not needed to reach prepare_image
+		stateMachine.commonFlags.SkipPreflight = true
+		outputDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outputDir)
+		stateMachine.commonFlags.OutputDir = outputDir
 
-		err := stateMachine.Setup()
+		err = stateMachine.Setup(context.Background())
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Run()
+		err = stateMachine.Run(context.Background())
 		asserter.AssertErrContains(err, "Error preparing image")
 
-		err = stateMachine.Teardown()
+		err = stateMachine.Teardown(context.Background())
 		asserter.AssertErrNil(err, true)
 	})
 }
@@ -228,10 +234,10 @@ func TestPopulateSnapRootfsContents(t *testing.T) {
 			stateMachine.stateMachineFlags.WorkDir = workDir
 			stateMachine.stateMachineFlags.Thru = "populate_rootfs_contents"
 
-			err = stateMachine.Setup()
+			err = stateMachine.Setup(context.Background())
 			asserter.AssertErrNil(err, true)
 
-			err = stateMachine.Run()
+			err = stateMachine.Run(context.Background())
 			asserter.AssertErrNil(err, true)
 
 			// check the files before Teardown
@@ -244,7 +250,7 @@ func TestPopulateSnapRootfsContents(t *testing.T) {
 				}
 			}
 
-			err = stateMachine.Teardown()
+			err = stateMachine.Teardown(context.Background())
 			asserter.AssertErrNil(err, true)
 		})
 	}
@@ -450,10 +456,10 @@ func TestSnapFlagSyntax(t *testing.T) {
 			stateMachine.stateMachineFlags.WorkDir = workDir
 			stateMachine.commonFlags.OutputDir = workDir
 
-			err = stateMachine.Setup()
+			err = stateMachine.Setup(context.Background())
 			asserter.AssertErrNil(err, true)
 
-			err = stateMachine.Run()
+			err = stateMachine.Run(context.Background())
 
 			if tc.valid {
 				// check Run() ended without errors
@@ -539,10 +545,10 @@ func TestSnapRevisions(t *testing.T) {
 		stateMachine.stateMachineFlags.WorkDir = workDir
 		stateMachine.commonFlags.OutputDir = workDir
 
-		err = stateMachine.Setup()
+		err = stateMachine.Setup(context.Background())
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Run()
+		err = stateMachine.Run(context.Background())
 		asserter.AssertErrNil(err, true)
 
 		for snapName, expectedRevision := range stateMachine.Opts.Revisions {
@@ -589,10 +595,10 @@ func TestValidationFlag(t *testing.T) {
 		stateMachine.stateMachineFlags.Thru = "prepare_image"
 		stateMachine.commonFlags.Validation = "enforce"
 
-		err = stateMachine.Setup()
+		err = stateMachine.Setup(context.Background())
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Run()
+		err = stateMachine.Run(context.Background())
 		asserter.AssertErrNil(err, true)
 
 		// make sure the correct revision of the snap exists
@@ -601,7 +607,7 @@ func TestValidationFlag(t *testing.T) {
 			"system-seed", "snaps", "test-snapd-gated_"+gatedRevision+".snap"))
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Teardown()
+		err = stateMachine.Teardown(context.Background())
 		asserter.AssertErrNil(err, true)
 	})
 }
@@ -627,13 +633,13 @@ func TestGadgetEdgeCases(t *testing.T) {
 		customSnap := filepath.Join("testdata", "pc_20-gadget-edge-cases.snap")
 		stateMachine.Opts.Snaps = []string{customSnap}
 
-		err = stateMachine.Setup()
+		err = stateMachine.Setup(context.Background())
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Run()
+		err = stateMachine.Run(context.Background())
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Teardown()
+		err = stateMachine.Teardown(context.Background())
 		asserter.AssertErrNil(err, true)
 	})
 }
@@ -666,10 +672,10 @@ func TestPreseedFlag(t *testing.T) {
 		stateMachine.Opts.AppArmorKernelFeaturesDir = "/some/path"
 		stateMachine.Opts.PreseedSignKey = "akey"
 
-		err = stateMachine.Setup()
+		err = stateMachine.Setup(context.Background())
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.Run()
+		err = stateMachine.Run(context.Background())
 		asserter.AssertErrNil(err, true)
 
 		if calledOpts == nil {
@@ -690,7 +696,7 @@ func TestPreseedFlag(t *testing.T) {
 			t.Errorf("Expected apparmor kernel features dir to be %q, but it's %q", expectedAAPath, calledOpts.AppArmorKernelFeaturesDir)
 		}
 
-		err = stateMachine.Teardown()
+		err = stateMachine.Teardown(context.Background())
 		asserter.AssertErrNil(err, true)
 	})
 }
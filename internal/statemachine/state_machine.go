@@ -3,18 +3,21 @@
 package statemachine
 
 import (
+	"context"
 	"crypto/rand"
-	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
@@ -40,6 +43,8 @@ var helperCheckEmptyFields = helper.CheckEmptyFields
 var helperCheckTags = helper.CheckTags
 var helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
 var helperRestoreResolvConf = helper.RestoreResolvConf
+var helperRunScript = helper.RunScript
+var helperRunCmdContext = helper.RunCmdContext
 var ioReadAll = io.ReadAll
 var osReadDir = os.ReadDir
 var osReadFile = os.ReadFile
@@ -49,6 +54,7 @@ var osMkdirAll = os.MkdirAll
 var osMkdirTemp = os.MkdirTemp
 var osOpen = os.Open
 var osOpenFile = os.OpenFile
+var osRemove = os.Remove
 var osRemoveAll = os.RemoveAll
 var osRename = os.Rename
 var osCreate = os.Create
@@ -71,11 +77,12 @@ var filepathRel = filepath.Rel
 
 var mockableBlockSize string = "1" //used for mocking dd calls
 
-// SmInterface allows different image types to implement their own setup/run/teardown functions
+// SmInterface allows different image types to implement their own setup/run/teardown functions.
+// The context given to Run cancels the build when it is done
 type SmInterface interface {
-	Setup() error
-	Run() error
-	Teardown() error
+	Setup(ctx context.Context) error
+	Run(ctx context.Context) error
+	Teardown(ctx context.Context) error
 }
 
 // stateFunc allows us easy access to the function names, which will help with --resume and debug statements
@@ -122,6 +129,36 @@ type StateMachine struct {
 
 	// names of images for each volume
 	VolumeNames map[string]string
+
+	// wall time spent in each state and external command
+	profile buildProfile
+
+	// the profile of the earlier runs of a resumed build, see writeProfile
+	earlierProfile     *buildProfile
+	earlierProfileRead bool
+
+	// the mounts and loop devices that are currently set up
+	mounts *mountRegistry
+
+	// the context of the running state, see buildContext
+	ctx context.Context
+
+	// where the messages and events of the build are sent, see SetLogger
+	// and SetEventHandler
+	log          Logger
+	eventHandler func(Event)
+
+	// the output held back while the state runs concurrently with others
+	deferred *deferredOutput
+
+	// the lock on the workdir, held for the duration of the build
+	workDirLock *workDirLock
+
+	// whether the host was checked for the tools and space the build needs
+	preflightDone bool
+
+	// the full log of the build written to the workdir, see buildLogger
+	buildLog *helper.BuildLog
 }
 
 // SetCommonOpts stores the common options for all image types in the struct
@@ -237,11 +274,9 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 		// look for the rootfs and check if the image is seeded
 		for ii, structure := range volume.Structure {
 			if structure.Role == "" && structure.Label == gadget.SystemBoot {
-				if !stateMachine.commonFlags.Quiet {
-					fmt.Printf("WARNING: volumes:%s:structure:%d:filesystem_label "+
-						"used for defining partition roles; use role instead\n",
-						volumeName, ii)
-				}
+				stateMachine.warningf("volumes:%s:structure:%d:filesystem_label "+
+					"used for defining partition roles; use role instead\n",
+					volumeName, ii)
 			} else if structure.Role == gadget.SystemData {
 				rootfsSeen = true
 			} else if structure.Role == gadget.SystemSeed {
@@ -331,55 +366,136 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 
 // readMetadata reads info about a partial state machine from disk
 func (stateMachine *StateMachine) readMetadata() error {
-	// handle the resume case
-	if stateMachine.stateMachineFlags.Resume {
-		// open the ubuntu-image.gob file and determine the state
-		var partialStateMachine = new(StateMachine)
-		gobfilePath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "ubuntu-image.gob")
-		gobfile, err := os.Open(gobfilePath)
-		if err != nil {
-			return fmt.Errorf("error reading metadata file: %s", err.Error())
-		}
-		defer gobfile.Close()
-		dec := gob.NewDecoder(gobfile)
-		err = dec.Decode(&partialStateMachine)
-		if err != nil {
-			return fmt.Errorf("failed to parse metadata file: %s", err.Error())
-		}
-		stateMachine.CurrentStep = partialStateMachine.CurrentStep
-		stateMachine.StepsTaken = partialStateMachine.StepsTaken
-		stateMachine.GadgetInfo = partialStateMachine.GadgetInfo
-		stateMachine.YamlFilePath = partialStateMachine.YamlFilePath
-		stateMachine.ImageSizes = partialStateMachine.ImageSizes
-		stateMachine.RootfsSize = partialStateMachine.RootfsSize
-		stateMachine.IsSeeded = partialStateMachine.IsSeeded
-		stateMachine.VolumeOrder = partialStateMachine.VolumeOrder
-		stateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
-		stateMachine.tempDirs.unpack = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "unpack")
-		stateMachine.tempDirs.volumes = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "volumes")
-
-		// delete all of the stateFuncs that have already run
-		stateMachine.states = stateMachine.states[stateMachine.StepsTaken:]
+	// handle the resume case, --only and --from also resume the partial build
+	if !stateMachine.loadsMetadata() {
+		return nil
+	}
+	// read the state file and determine the state
+	metadata, err := loadMetadata(stateMachine.stateMachineFlags.WorkDir)
+	if err != nil {
+		return err
+	}
+	// make sure no other build uses the same workdir
+	if err := stateMachine.lock(); err != nil {
+		return err
+	}
+	if err := stateMachine.openBuildLog(); err != nil {
+		stateMachine.unlock()
+		return err
+	}
+	if err := stateMachine.restoreMetadata(metadata); err != nil {
+		stateMachine.unlock()
+		return err
 	}
 	return nil
 }
 
+// restoreMetadata restores the state of a partial build and
+// determines the state to resume it from
+func (stateMachine *StateMachine) restoreMetadata(metadata *stateMachineMetadata) error {
+	stateMachine.CurrentStep = metadata.CurrentStep
+	stateMachine.StepsTaken = metadata.StepsTaken
+	stateMachine.GadgetInfo = metadata.GadgetInfo
+	stateMachine.YamlFilePath = metadata.YamlFilePath
+	stateMachine.ImageSizes = metadata.ImageSizes
+	stateMachine.RootfsSize = metadata.RootfsSize
+	stateMachine.SectorSize = metadata.SectorSize
+	stateMachine.IsSeeded = metadata.IsSeeded
+	stateMachine.VolumeOrder = metadata.VolumeOrder
+	stateMachine.VolumeNames = metadata.VolumeNames
+	if stateMachine.commonFlags.OutputDir == "" {
+		stateMachine.commonFlags.OutputDir = metadata.OutputDir
+	}
+	stateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
+	stateMachine.tempDirs.unpack = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "unpack")
+	stateMachine.tempDirs.volumes = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "volumes")
+	stateMachine.tempDirs.chroot = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "chroot")
+	stateMachine.tempDirs.scratch = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "scratch")
+
+	// classic builds calculate most of their states dynamically, so they
+	// have to be recalculated before we know where to resume from
+	if classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine); ok {
+		if err := classicStateMachine.restoreClassicMetadata(metadata); err != nil {
+			return err
+		}
+	}
+
+	if metadata.StateNames != nil && !reflect.DeepEqual(metadata.StateNames, stateMachine.stateNames()) {
+		return fmt.Errorf("the states of the partial build (%s) do not match the "+
+			"states to resume (%s)", strings.Join(metadata.StateNames, ", "),
+			strings.Join(stateMachine.stateNames(), ", "))
+	}
+	if stateMachine.StepsTaken > len(stateMachine.states) {
+		return fmt.Errorf("metadata file records %d steps taken but there are only %d states",
+			stateMachine.StepsTaken, len(stateMachine.states))
+	}
+	return stateMachine.rewind()
+}
+
 // writeMetadata writes the state machine info to disk. This will be used when resuming a
 // partial state machine run
 func (stateMachine *StateMachine) writeMetadata() error {
-	gobfilePath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "ubuntu-image.gob")
-	gobfile, err := os.OpenFile(gobfilePath, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil && !os.IsExist(err) {
-		return fmt.Errorf("error opening metadata file for writing: %s", gobfilePath)
+	metadata := stateMachineMetadata{
+		Version:      metadataVersion,
+		CurrentStep:  stateMachine.CurrentStep,
+		StepsTaken:   stateMachine.StepsTaken,
+		YamlFilePath: stateMachine.YamlFilePath,
+		IsSeeded:     stateMachine.IsSeeded,
+		SectorSize:   stateMachine.SectorSize,
+		RootfsSize:   stateMachine.RootfsSize,
+		GadgetInfo:   stateMachine.GadgetInfo,
+		ImageSizes:   stateMachine.ImageSizes,
+		VolumeOrder:  stateMachine.VolumeOrder,
+		VolumeNames:  stateMachine.VolumeNames,
+		OutputDir:    stateMachine.commonFlags.OutputDir,
+		StateNames:   stateMachine.stateNames(),
+	}
+	switch classicStateMachine := stateMachine.parent.(type) {
+	case *SnapStateMachine:
+		metadata.ImageType = "snap"
+	case *ClassicStateMachine:
+		metadata.ImageType = "classic"
+		// store the absolute path so the build can be resumed from another directory
+		imageDefinitionPath, err := filepath.Abs(classicStateMachine.Args.ImageDefinition)
+		if err != nil {
+			return fmt.Errorf("Error getting absolute path of the image definition: %s", err.Error())
+		}
+		metadata.Classic = &classicMetadata{
+			ImageDefinitionPath:   imageDefinitionPath,
+			ImageDefinitionSHA256: classicStateMachine.imageDefinitionSHA256,
+			SetOverridesSHA256:    classicStateMachine.setOverridesSHA256,
+			ImageDef:              redactedImageDefinition(classicStateMachine.ImageDef),
+			Packages:              classicStateMachine.Packages,
+			Snaps:                 classicStateMachine.Snaps,
+		}
 	}
-	defer gobfile.Close()
-	enc := gob.NewEncoder(gobfile)
 
-	// no need to check errors, as it will panic if there is one
-	enc.Encode(stateMachine)
+	metadataBytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding metadata: %s", err.Error())
+	}
+	metadataPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, metadataFileName)
+	if err := osWriteFile(metadataPath, metadataBytes, 0644); err != nil {
+		return fmt.Errorf("error writing metadata file: %s", err.Error())
+	}
+
+	// the state file of an older version was migrated, so it can be removed
+	legacyMetadataPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, legacyMetadataFileName)
+	if err := os.Remove(legacyMetadataPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing legacy metadata file: %s", err.Error())
+	}
 	return nil
 }
 
+// stateNames returns the names of all the states of the state machine
+func (stateMachine *StateMachine) stateNames() []string {
+	var names []string
+	for _, state := range stateMachine.states {
+		names = append(names, state.name)
+	}
+	return names
+}
+
 // handleContentSizes ensures that the sizes of the partitions are large enough and stores
 // safe values in the stateMachine struct for use during make_image
 func (stateMachine *StateMachine) handleContentSizes(farthestOffset quantity.Offset, volumeName string) {
@@ -391,7 +507,7 @@ func (stateMachine *StateMachine) handleContentSizes(farthestOffset quantity.Off
 		stateMachine.ImageSizes[volumeName] = calculated
 	} else {
 		if volumeSize < calculated {
-			fmt.Printf("WARNING: ignoring image size smaller than "+
+			stateMachine.warningf("ignoring image size smaller than "+
 				"minimum required size: vol:%s %d < %d\n",
 				volumeName, uint64(volumeSize), uint64(calculated))
 			stateMachine.ImageSizes[volumeName] = calculated
@@ -401,38 +517,97 @@ func (stateMachine *StateMachine) handleContentSizes(farthestOffset quantity.Off
 	}
 }
 
-// Run iterates through the state functions, stopping when appropriate based on --until and --thru
-func (stateMachine *StateMachine) Run() error {
-	// iterate through the states
-	for i := 0; i < len(stateMachine.states); i++ {
-		stateFunc := stateMachine.states[i]
-		if stateFunc.name == stateMachine.stateMachineFlags.Until {
+// Run iterates through the state functions, stopping when appropriate based on --until and --thru.
+// The build is cancelled when ctx is done or the duration given with --timeout has passed
+func (stateMachine *StateMachine) Run(ctx context.Context) error {
+	stateMachine.profile.Start = time.Now()
+	// create the build log before states may run concurrently and share it
+	stateMachine.buildLogger()
+	if stateMachine.commonFlags.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, stateMachine.commonFlags.Timeout)
+		defer cancelTimeout()
+	}
+	// iterate through the states, skipping the ones that already ran if the
+	// state machine was resumed. Independent states are run concurrently
+	for stateMachine.StepsTaken < len(stateMachine.states) {
+		batch := stateMachine.nextStates()
+		if len(batch) == 0 {
 			break
 		}
-		if !stateMachine.commonFlags.Quiet {
-			fmt.Printf("[%d] %s\n", stateMachine.StepsTaken, stateFunc.name)
+		// check the host as soon as the states that will run are known
+		err := stateMachine.preflight()
+		if err == nil {
+			if len(batch) == 1 {
+				err = stateMachine.runStep(ctx, batch[0])
+			} else {
+				err = stateMachine.runConcurrently(ctx, batch)
+			}
 		}
-		if err := stateFunc.function(stateMachine); err != nil {
+		if err != nil {
+			// the profile is most useful to understand failed builds, so
+			// write it out even though the error takes precedence
+			stateMachine.writeProfile()
+			// let the user investigate the failure before the workdir is cleaned up,
+			// unless the build was interrupted or timed out
+			var cancelled *cancelledError
+			if !errors.As(err, &cancelled) {
+				stateMachine.debugShellOnFailure()
+			}
 			// clean up work dir on error
-			stateMachine.cleanup()
+			if cleanupErr := stateMachine.cleanup(); cleanupErr != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: %s\n", cleanupErr.Error())
+			}
 			return err
 		}
-		stateMachine.StepsTaken++
-		if stateFunc.name == stateMachine.stateMachineFlags.Thru {
+		if stateMachine.isLastState(batch[len(batch)-1].name) {
 			break
 		}
 	}
+	if err := stateMachine.writeProfile(); err != nil {
+		return err
+	}
+	if (stateMachine.commonFlags.Verbose || stateMachine.commonFlags.Debug) &&
+		!stateMachine.commonFlags.Quiet && stateMachine.commonFlags.ProgressFormat != "json" {
+		stateMachine.printProfile()
+	}
+	return nil
+}
+
+// runStep runs a single state, reporting its progress
+func (stateMachine *StateMachine) runStep(ctx context.Context, stateFunc stateFunc) error {
+	stateMachine.CurrentStep = stateFunc.name
+	stateMachine.infof("[%d] %s\n", stateMachine.StepsTaken, stateFunc.name)
+	stateMachine.emitEvent(Event{Type: EventStateStarted})
+	start := time.Now()
+	if err := stateMachine.runStateContext(ctx, stateFunc); err != nil {
+		err = stateMachine.redactError(err)
+		stateMachine.buildLogger().Log(helper.LogError, stateFunc.name, "%s", err.Error())
+		stateMachine.emitEvent(Event{
+			Type:     EventStateFailed,
+			Duration: stateMachine.recordState(stateFunc.name, start, err),
+			Error:    err.Error(),
+		})
+		return err
+	}
+	stateMachine.emitEvent(Event{
+		Type:     EventStateFinished,
+		Duration: stateMachine.recordState(stateFunc.name, start, nil),
+	})
+	stateMachine.StepsTaken++
 	return nil
 }
 
 // Teardown handles anything else that needs to happen after the states have finished running
-func (stateMachine *StateMachine) Teardown() error {
+func (stateMachine *StateMachine) Teardown(ctx context.Context) error {
+	stateMachine.buildLogger().Close()
 	if !stateMachine.cleanWorkDir {
 		if err := stateMachine.writeMetadata(); err != nil {
+			stateMachine.unlock()
 			return err
 		}
-	} else {
-		stateMachine.cleanup()
+		return stateMachine.unlock()
 	}
+	stateMachine.cleanup()
 	return nil
 }
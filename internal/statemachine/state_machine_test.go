@@ -1,6 +1,8 @@
 package statemachine
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +12,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
@@ -50,7 +53,7 @@ var allTestStates = []stateFunc{
 }
 
 // define some mocked versions of go package functions
-func mockCopyBlob([]string) error {
+func mockCopyBlob(context.Context, []string) error {
 	return fmt.Errorf("Test Error")
 }
 func mockSetDefaults(interface{}) error {
@@ -68,7 +71,7 @@ func mockBackupAndCopyResolvConf(string) error {
 func mockRestoreResolvConf(string) error {
 	return fmt.Errorf("Test Error")
 }
-func mockCopyBlobSuccess([]string) error {
+func mockCopyBlobSuccess(context.Context, []string) error {
 	return nil
 }
 func mockLayoutVolume(*gadget.Volume, *gadget.LayoutOptions) (*gadget.LaidOutVolume, error) {
@@ -117,6 +120,9 @@ func mockOpenFileAppend(name string, flag int, perm os.FileMode) (*os.File, erro
 func mockOpenFileBadPerms(name string, flag int, perm os.FileMode) (*os.File, error) {
 	return os.OpenFile(name, os.O_RDONLY|os.O_CREATE, perm)
 }
+func mockRemove(string) error {
+	return fmt.Errorf("Test error")
+}
 func mockRemoveAll(string) error {
 	return fmt.Errorf("Test error")
 }
@@ -233,6 +239,8 @@ func TestExecHelperProcess(t *testing.T) {
 		fallthrough
 	case "TestFailedInstallPackages":
 		fallthrough
+	case "TestFailedDisableExtraPPAs":
+		fallthrough
 	case "TestFailedBuildGadgetTree":
 		// throwing an error here simulates the "command" having an error
 		os.Exit(1)
@@ -242,6 +250,16 @@ func TestExecHelperProcess(t *testing.T) {
 			os.Exit(1)
 		}
 		break
+	case "TestCancelBuild":
+		if args[0] == "sleep" {
+			time.Sleep(30 * time.Second)
+		}
+		break
+	case "TestFailedTeardownMounts":
+		if args[0] == "umount" {
+			os.Exit(1)
+		}
+		break
 	case "TestFailedRunLiveBuild":
 		// Do nothing so we don't have to wait for actual lb commands
 		break
@@ -254,7 +272,7 @@ type testStateMachine struct {
 }
 
 // testStateMachine needs its own setup
-func (TestStateMachine *testStateMachine) Setup() error {
+func (TestStateMachine *testStateMachine) Setup(ctx context.Context) error {
 	// set the states that will be used for this image type
 	TestStateMachine.states = allTestStates
 
@@ -299,13 +317,13 @@ func TestUntilThru(t *testing.T) {
 					partialStateMachine.stateMachineFlags.Thru = state.name
 				}
 
-				err := partialStateMachine.Setup()
+				err := partialStateMachine.Setup(context.Background())
 				asserter.AssertErrNil(err, false)
 
-				err = partialStateMachine.Run()
+				err = partialStateMachine.Run(context.Background())
 				asserter.AssertErrNil(err, false)
 
-				err = partialStateMachine.Teardown()
+				err = partialStateMachine.Teardown(context.Background())
 				asserter.AssertErrNil(err, false)
 
 				// now resume
@@ -314,13 +332,13 @@ func TestUntilThru(t *testing.T) {
 				resumeStateMachine.stateMachineFlags.Resume = true
 				resumeStateMachine.stateMachineFlags.WorkDir = partialStateMachine.stateMachineFlags.WorkDir
 
-				err = resumeStateMachine.Setup()
+				err = resumeStateMachine.Setup(context.Background())
 				asserter.AssertErrNil(err, false)
 
-				err = resumeStateMachine.Run()
+				err = resumeStateMachine.Run(context.Background())
 				asserter.AssertErrNil(err, false)
 
-				err = resumeStateMachine.Teardown()
+				err = resumeStateMachine.Teardown(context.Background())
 				asserter.AssertErrNil(err, false)
 
 				os.RemoveAll(tempDir)
@@ -329,6 +347,92 @@ func TestUntilThru(t *testing.T) {
 	}
 }
 
+// TestOnlyFrom ensures that --only and --from run the given state of a partial
+// build again, and that --only stops after it
+func TestOnlyFrom(t *testing.T) {
+	testCases := []struct {
+		name               string
+		only               string
+		from               string
+		expectedStepsTaken int
+	}{
+		{"only_state_that_ran", "prepare_image", "", 3},
+		{"only_next_state", "load_gadget_yaml", "", 4},
+		{"from_state_that_ran", "", "prepare_gadget_tree", len(allTestStates)},
+	}
+	for _, tc := range testCases {
+		t.Run("test_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(workDir)
+
+			// run a partial build through prepare_image
+			var partialStateMachine testStateMachine
+			partialStateMachine.commonFlags, partialStateMachine.stateMachineFlags = helper.InitCommonOpts()
+			partialStateMachine.commonFlags.Quiet = true
+			partialStateMachine.stateMachineFlags.WorkDir = workDir
+			partialStateMachine.stateMachineFlags.Thru = "prepare_image"
+			err = partialStateMachine.Setup(context.Background())
+			asserter.AssertErrNil(err, true)
+			err = partialStateMachine.Run(context.Background())
+			asserter.AssertErrNil(err, true)
+			err = partialStateMachine.Teardown(context.Background())
+			asserter.AssertErrNil(err, true)
+
+			var stateMachine testStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Quiet = true
+			stateMachine.stateMachineFlags.WorkDir = workDir
+			stateMachine.stateMachineFlags.Only = tc.only
+			stateMachine.stateMachineFlags.From = tc.from
+			err = stateMachine.Setup(context.Background())
+			asserter.AssertErrNil(err, true)
+			stateName := tc.only + tc.from
+			if stateMachine.states[stateMachine.StepsTaken].name != stateName {
+				t.Errorf("Expected the build to start at %s but it starts at %s",
+					stateName, stateMachine.states[stateMachine.StepsTaken].name)
+			}
+
+			err = stateMachine.Run(context.Background())
+			asserter.AssertErrNil(err, true)
+			if stateMachine.StepsTaken != tc.expectedStepsTaken {
+				t.Errorf("Expected %d steps to be taken but got %d",
+					tc.expectedStepsTaken, stateMachine.StepsTaken)
+			}
+		})
+	}
+}
+
+// TestFailedOnlyFrom ensures that --only can't skip states that have not run yet
+func TestFailedOnlyFrom(t *testing.T) {
+	t.Run("test_failed_only_from", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var partialStateMachine testStateMachine
+		partialStateMachine.commonFlags, partialStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		partialStateMachine.commonFlags.Quiet = true
+		partialStateMachine.stateMachineFlags.WorkDir = workDir
+		partialStateMachine.stateMachineFlags.Until = "prepare_image"
+		err = partialStateMachine.Setup(context.Background())
+		asserter.AssertErrNil(err, true)
+		err = partialStateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+		err = partialStateMachine.Teardown(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		var stateMachine testStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.stateMachineFlags.Only = "make_disk"
+		err = stateMachine.Setup(context.Background())
+		asserter.AssertErrContains(err, "state make_disk cannot run yet, the next state of the partial build is prepare_image")
+	})
+}
+
 // TestDebug ensures that the name of the states is printed when the --debug flag is used
 func TestDebug(t *testing.T) {
 	t.Run("test_debug", func(t *testing.T) {
@@ -343,14 +447,14 @@ func TestDebug(t *testing.T) {
 		stateMachine.stateMachineFlags.WorkDir = workDir
 		stateMachine.commonFlags.Debug = true
 
-		stateMachine.Setup()
+		stateMachine.Setup(context.Background())
 
 		// just use the one state
 		stateMachine.states = testStates
 		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
 		asserter.AssertErrNil(err, true)
 
-		stateMachine.Run()
+		stateMachine.Run(context.Background())
 
 		// restore stdout and check that the debug info was printed
 		restoreStdout()
@@ -365,6 +469,280 @@ func TestDebug(t *testing.T) {
 	})
 }
 
+// TestProgressFormatJSON ensures that one JSON event per line is printed for
+// every state, command and artifact when --progress-format=json is used
+func TestProgressFormatJSON(t *testing.T) {
+	t.Run("test_progress_format_json", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine testStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.ProgressFormat = "json"
+		stateMachine.states = []stateFunc{
+			{"test_command", func(stateMachine *StateMachine) error {
+				_, err := stateMachine.runCmd(exec.Command("true"))
+				return err
+			}},
+			{"test_artifact", func(stateMachine *StateMachine) error {
+				stateMachine.artifactWritten(ArtifactImg, "test.img")
+				return nil
+			}},
+			{"test_fail", func(stateMachine *StateMachine) error { return fmt.Errorf("Test Error") }},
+		}
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.Run(context.Background())
+		asserter.AssertErrContains(err, "Test Error")
+
+		restoreStdout()
+		readStdout, err := io.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+
+		expectedEvents := []Event{
+			{Type: EventStateStarted, State: "test_command", Step: 0},
+			{Type: EventCommandSpawned, State: "test_command", Step: 0, Command: []string{"true"}},
+			{Type: EventStateFinished, State: "test_command", Step: 0},
+			{Type: EventStateStarted, State: "test_artifact", Step: 1},
+			{Type: EventArtifactWritten, State: "test_artifact", Step: 1, Artifact: "test.img",
+				ArtifactType: ArtifactImg},
+			{Type: EventStateFinished, State: "test_artifact", Step: 1},
+			{Type: EventStateStarted, State: "test_fail", Step: 2},
+			{Type: EventStateFailed, State: "test_fail", Step: 2, Error: "Test Error"},
+		}
+		lines := strings.Split(strings.TrimSpace(string(readStdout)), "\n")
+		if len(lines) != len(expectedEvents) {
+			t.Fatalf("Expected %d events but got %d:\n%s", len(expectedEvents), len(lines), readStdout)
+		}
+		for i, line := range lines {
+			var event Event
+			err := json.Unmarshal([]byte(line), &event)
+			asserter.AssertErrNil(err, true)
+			// time and duration are not predictable
+			event.Time = time.Time{}
+			event.Duration = 0
+			if !reflect.DeepEqual(event, expectedEvents[i]) {
+				t.Errorf("Expected event %+v but got %+v", expectedEvents[i], event)
+			}
+		}
+	})
+}
+
+// TestProgressFormatJSONOnlyEvents ensures that the messages and the live output
+// of the commands go to stderr with --progress-format=json, so that every line
+// printed to stdout is an event
+func TestProgressFormatJSONOnlyEvents(t *testing.T) {
+	t.Run("test_progress_format_json_only_events", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine testStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.ProgressFormat = "json"
+		stateMachine.commonFlags.Debug = true
+		stateMachine.states = []stateFunc{
+			{"test_warning", func(stateMachine *StateMachine) error {
+				stateMachine.warningf("test warning\n")
+				return nil
+			}},
+			{"test_command", func(stateMachine *StateMachine) error {
+				_, err := stateMachine.runCmd(exec.Command("echo", "test output"))
+				return err
+			}},
+		}
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+		stderr, restoreStderr, err := helper.CaptureStd(&os.Stderr)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		restoreStdout()
+		restoreStderr()
+		readStdout, err := io.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+		readStderr, err := io.ReadAll(stderr)
+		asserter.AssertErrNil(err, true)
+
+		for _, line := range strings.Split(strings.TrimSpace(string(readStdout)), "\n") {
+			var event Event
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				t.Errorf("Expected only JSON events on stdout but got line \"%s\"", line)
+			}
+		}
+		for _, expected := range []string{"[0] test_warning", "WARNING: test warning", "test output"} {
+			if !strings.Contains(string(readStderr), expected) {
+				t.Errorf("Expected \"%s\" in stderr but got \"%s\"", expected, string(readStderr))
+			}
+		}
+	})
+}
+
+// testLogger records the messages of the build
+type testLogger struct {
+	messages []string
+}
+
+func (logger *testLogger) Printf(format string, v ...interface{}) {
+	logger.messages = append(logger.messages, fmt.Sprintf(format, v...))
+}
+
+// TestEventHandlerAndLogger ensures that the events and messages of the build are
+// sent to the event handler and logger instead of stdout when they are set
+func TestEventHandlerAndLogger(t *testing.T) {
+	t.Run("test_event_handler_and_logger", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine testStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.states = []stateFunc{
+			{"test_artifact", func(stateMachine *StateMachine) error {
+				stateMachine.artifactWritten(ArtifactQcow2, "test.qcow2")
+				return nil
+			}},
+		}
+		logger := &testLogger{}
+		var events []Event
+		stateMachine.SetLogger(logger)
+		stateMachine.SetEventHandler(func(event Event) {
+			events = append(events, event)
+		})
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		restoreStdout()
+		readStdout, err := io.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+		if len(readStdout) != 0 {
+			t.Errorf("Expected nothing to be printed to stdout but got \"%s\"", readStdout)
+		}
+
+		expectedMessages := []string{"[0] test_artifact\n"}
+		if !reflect.DeepEqual(logger.messages, expectedMessages) {
+			t.Errorf("Expected messages %v but got %v", expectedMessages, logger.messages)
+		}
+
+		expectedTypes := []string{EventStateStarted, EventArtifactWritten, EventStateFinished}
+		if len(events) != len(expectedTypes) {
+			t.Fatalf("Expected %d events but got %d: %+v", len(expectedTypes), len(events), events)
+		}
+		for i, event := range events {
+			if event.Type != expectedTypes[i] {
+				t.Errorf("Expected event of type %s but got %s", expectedTypes[i], event.Type)
+			}
+		}
+		if events[1].Artifact != "test.qcow2" || events[1].ArtifactType != ArtifactQcow2 {
+			t.Errorf("Unexpected artifact event %+v", events[1])
+		}
+	})
+}
+
+// TestBuildProfile ensures that the time spent in states and commands is
+// written to the output directory and summarized in verbose runs
+func TestBuildProfile(t *testing.T) {
+	t.Run("test_build_profile", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		outputDir, err := os.MkdirTemp("/tmp", "ubuntu-image-profile-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outputDir)
+
+		var stateMachine testStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.OutputDir = outputDir
+		stateMachine.commonFlags.Verbose = true
+		stateMachine.states = []stateFunc{
+			{"test_command", func(stateMachine *StateMachine) error {
+				_, err := stateMachine.runCmd(exec.Command("true"))
+				return err
+			}},
+			{"test_succeed", func(*StateMachine) error { return nil }},
+		}
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+
+		restoreStdout()
+		readStdout, err := io.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+
+		if !strings.Contains(string(readStdout), "Build profile") {
+			t.Errorf("Expected a build profile summary in output \"%s\"", string(readStdout))
+		}
+
+		profileBytes, err := os.ReadFile(filepath.Join(outputDir, profileFileName))
+		asserter.AssertErrNil(err, true)
+		var profile buildProfile
+		err = json.Unmarshal(profileBytes, &profile)
+		asserter.AssertErrNil(err, true)
+
+		if len(profile.States) != 2 || profile.States[0].Name != "test_command" ||
+			profile.States[1].Name != "test_succeed" {
+			t.Errorf("Unexpected states in build profile: %+v", profile.States)
+		}
+		if len(profile.Commands) != 1 || profile.Commands[0].State != "test_command" ||
+			!reflect.DeepEqual(profile.Commands[0].Command, []string{"true"}) {
+			t.Errorf("Unexpected commands in build profile: %+v", profile.Commands)
+		}
+	})
+	t.Run("test_build_profile_resumed", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		outputDir, err := os.MkdirTemp("/tmp", "ubuntu-image-profile-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outputDir)
+
+		var stateMachine testStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.OutputDir = outputDir
+		stateMachine.stateMachineFlags.Thru = "test_command"
+		stateMachine.states = []stateFunc{
+			{"test_command", func(stateMachine *StateMachine) error {
+				_, err := stateMachine.runCmd(exec.Command("true"))
+				return err
+			}},
+			{"test_succeed", func(*StateMachine) error { return nil }},
+		}
+		err = stateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+		start := stateMachine.profile.Start
+
+		// resume the build in another state machine, as a new run would
+		var resumedStateMachine testStateMachine
+		resumedStateMachine.commonFlags, resumedStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		resumedStateMachine.commonFlags.OutputDir = outputDir
+		resumedStateMachine.stateMachineFlags.Resume = true
+		resumedStateMachine.states = stateMachine.states
+		resumedStateMachine.StepsTaken = 1
+		err = resumedStateMachine.Run(context.Background())
+		asserter.AssertErrNil(err, true)
+		// writing the profile again does not add the earlier runs twice
+		err = resumedStateMachine.writeProfile()
+		asserter.AssertErrNil(err, true)
+
+		profileBytes, err := os.ReadFile(filepath.Join(outputDir, profileFileName))
+		asserter.AssertErrNil(err, true)
+		var profile buildProfile
+		err = json.Unmarshal(profileBytes, &profile)
+		asserter.AssertErrNil(err, true)
+
+		if len(profile.States) != 2 || profile.States[0].Name != "test_command" ||
+			profile.States[1].Name != "test_succeed" {
+			t.Errorf("Expected the states of both runs in the build profile but got %+v", profile.States)
+		}
+		if len(profile.Commands) != 1 || profile.Commands[0].State != "test_command" {
+			t.Errorf("Expected the commands of the first run in the build profile but got %+v", profile.Commands)
+		}
+		if !profile.Start.Equal(start) {
+			t.Errorf("Expected the build profile to start at %s but got %s", start, profile.Start)
+		}
+	})
+}
+
 // TestFunction replaces some of the stateFuncs to test various error scenarios
 func TestFunctionErrors(t *testing.T) {
 	testCases := []struct {
@@ -388,7 +766,7 @@ func TestFunctionErrors(t *testing.T) {
 			var stateMachine testStateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.stateMachineFlags.WorkDir = workDir
-			stateMachine.Setup()
+			stateMachine.Setup(context.Background())
 
 			// override the function, but save the old one
 			oldStateFunc := stateMachine.states[tc.overrideState]
@@ -396,8 +774,8 @@ func TestFunctionErrors(t *testing.T) {
 			defer func() {
 				stateMachine.states[tc.overrideState] = oldStateFunc
 			}()
-			if err := stateMachine.Run(); err == nil {
-				if err := stateMachine.Teardown(); err == nil {
+			if err := stateMachine.Run(context.Background()); err == nil {
+				if err := stateMachine.Teardown(context.Background()); err == nil {
 					t.Errorf("Expected an error but there was none")
 				}
 			}
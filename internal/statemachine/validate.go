@@ -0,0 +1,623 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/invopop/jsonschema"
+	"github.com/xeipuuv/gojsonschema"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem found in an image definition, located in the YAML
+// file by its line, column and key path, such as customization.extra-ppas[0].name.
+// The line and column are 0 when they are unknown
+type ValidationError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (validationError ValidationError) String() string {
+	location := validationError.File
+	if validationError.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, validationError.Line)
+		if validationError.Column > 0 {
+			location = fmt.Sprintf("%s:%d", location, validationError.Column)
+		}
+	}
+	if validationError.Path == "" {
+		return fmt.Sprintf("%s: %s", location, validationError.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, validationError.Path, validationError.Message)
+}
+
+// yamlErrorLine matches the lines of the errors returned by the YAML libraries
+var yamlErrorLine = regexp.MustCompile(`line (\d+): (.*)`)
+
+// schemaContext returns the context of an error about the given field of the image
+// definition, named as in the JSON schema
+func schemaContext(fields ...string) *gojsonschema.JsonContext {
+	context := gojsonschema.NewJsonContext("(root)", nil)
+	for _, field := range fields {
+		context = gojsonschema.NewJsonContext(field, context)
+	}
+	return context
+}
+
+// validateImageDefinition validates a decoded image definition against a schema
+// generated from the ImageDefinition struct and runs the custom checks that the
+// schema can't express. Every problem found is added to the returned result
+func validateImageDefinition(imageDefinition *imagedefinition.ImageDefinition) (*gojsonschema.Result, error) {
+	// The official standard for YAML schemas states that they are an extension of
+	// JSON schema draft 4. We therefore validate the decoded YAML against a JSON
+	// schema. The workflow is as follows:
+	// 1. Use the jsonschema library to generate a schema from the struct definition
+	// 2. Load the created schema and parsed yaml into types defined by gojsonschema
+	// 3. Use the gojsonschema library to validate the parsed YAML against the schema
+
+	var jsonReflector jsonschema.Reflector
+
+	// 1. parse the ImageDefinition struct into a schema using the jsonschema tags
+	schema := jsonReflector.Reflect(&imagedefinition.ImageDefinition{})
+
+	// 2. load the schema and parsed YAML data into types understood by gojsonschema
+	schemaLoader := gojsonschema.NewGoLoader(schema)
+	imageDefinitionLoader := gojsonschema.NewGoLoader(*imageDefinition)
+
+	// 3. validate the parsed data against the schema
+	result, err := gojsonschemaValidate(schemaLoader, imageDefinitionLoader)
+	if err != nil {
+		return nil, fmt.Errorf("Schema validation returned an error: %s", err.Error())
+	}
+
+	// do custom validation for gadgetURL being required if gadget is not pre-built
+	if imageDefinition.Gadget != nil {
+		if imageDefinition.Gadget.GadgetType != "prebuilt" && imageDefinition.Gadget.GadgetURL == "" {
+			errDetail := gojsonschema.ErrorDetails{
+				"key":   "gadget:type",
+				"value": imageDefinition.Gadget.GadgetType,
+			}
+			result.AddError(
+				imagedefinition.NewMissingURLError(
+					schemaContext("Gadget", "GadgetURL"),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+	}
+
+	// don't allow any images to be created without a gadget. A missing
+	// artifacts key is reported by the schema validation
+	if imageDefinition.Gadget == nil && imageDefinition.Artifacts != nil {
+		diskUsed, err := helperCheckTags(imageDefinition.Artifacts, "is_disk")
+		if err != nil {
+			return nil, fmt.Errorf("Error checking struct tags for Artifacts: \"%s\"", err.Error())
+		}
+		if diskUsed != "" {
+			errDetail := gojsonschema.ErrorDetails{
+				"key1": diskUsed,
+				"key2": "gadget:",
+			}
+			result.AddError(
+				imagedefinition.NewDependentKeyError(
+					schemaContext("Artifacts", diskUsed),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+	}
+
+	if imageDefinition.Customization != nil {
+		// do custom validation for private PPAs requiring fingerprint
+		// and their credentials being given only once
+		for i, ppa := range imageDefinition.Customization.ExtraPPAs {
+			var credentialKeys []string
+			for key, value := range map[string]string{"auth": ppa.Auth, "auth-file": ppa.AuthFile, "auth-env": ppa.AuthEnv} {
+				if value != "" {
+					credentialKeys = append(credentialKeys, key)
+				}
+			}
+			if len(credentialKeys) > 1 {
+				sort.Strings(credentialKeys)
+				errDetail := gojsonschema.ErrorDetails{
+					"ppaName": ppa.PPAName,
+					"keys":    strings.Join(credentialKeys, ", "),
+				}
+				result.AddError(
+					imagedefinition.NewConflictingPPAAuthError(
+						schemaContext("Customization", "ExtraPPAs", strconv.Itoa(i)),
+						52,
+						errDetail,
+					),
+					errDetail,
+				)
+			}
+			if isPrivatePPA(ppa) && ppa.Fingerprint == "" {
+				errDetail := gojsonschema.ErrorDetails{
+					"ppaName": ppa.PPAName,
+				}
+				result.AddError(
+					imagedefinition.NewInvalidPPAError(
+						schemaContext("Customization", "ExtraPPAs", strconv.Itoa(i), "Fingerprint"),
+						52,
+						errDetail,
+					),
+					errDetail,
+				)
+			}
+		}
+		// do custom validation for manual customization paths
+		if imageDefinition.Customization.Manual != nil {
+			if imageDefinition.Customization.Manual.CopyFile != nil {
+				for i, copy := range imageDefinition.Customization.Manual.CopyFile {
+					// XXX: filepath.IsAbs() does returns true for paths like /../../something
+					// and those are NOT absolute paths.
+					if !filepath.IsAbs(copy.Dest) || strings.Contains(copy.Dest, "/../") {
+						errDetail := gojsonschema.ErrorDetails{
+							"key":   "customization:manual:copy-file:destination",
+							"value": copy.Dest,
+						}
+						result.AddError(
+							imagedefinition.NewPathNotAbsoluteError(
+								schemaContext("Customization", "Manual", "CopyFile", strconv.Itoa(i), "Dest"),
+								52,
+								errDetail,
+							),
+							errDetail,
+						)
+					}
+				}
+			}
+			for i, execute := range imageDefinition.Customization.Manual.Execute {
+				// XXX: filepath.IsAbs() does returns true for paths like /../../something
+				// and those are NOT absolute paths.
+				if !filepath.IsAbs(execute.ExecutePath) || strings.Contains(execute.ExecutePath, "/../") {
+					errDetail := gojsonschema.ErrorDetails{
+						"key":   "customization:manual:execute:path",
+						"value": execute.ExecutePath,
+					}
+					result.AddError(
+						imagedefinition.NewPathNotAbsoluteError(
+							schemaContext("Customization", "Manual", "Execute", strconv.Itoa(i), "ExecutePath"),
+							52,
+							errDetail,
+						),
+						errDetail,
+					)
+				}
+			}
+			if imageDefinition.Customization.Manual.TouchFile != nil {
+				for i, touch := range imageDefinition.Customization.Manual.TouchFile {
+					// XXX: filepath.IsAbs() does returns true for paths like /../../something
+					// and those are NOT absolute paths.
+					if !filepath.IsAbs(touch.TouchPath) || strings.Contains(touch.TouchPath, "/../") {
+						errDetail := gojsonschema.ErrorDetails{
+							"key":   "customization:manual:touch-file:path",
+							"value": touch.TouchPath,
+						}
+						result.AddError(
+							imagedefinition.NewPathNotAbsoluteError(
+								schemaContext("Customization", "Manual", "TouchFile", strconv.Itoa(i), "TouchPath"),
+								52,
+								errDetail,
+							),
+							errDetail,
+						)
+					}
+				}
+			}
+		}
+	}
+
+	// TODO: I've created a PR upstream in xeipuuv/gojsonschema
+	// https://github.com/xeipuuv/gojsonschema/pull/352
+	// if it gets merged this can be removed
+	err = helperCheckEmptyFields(imageDefinition, result, schema)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ValidateImageDefinition runs the checks done when a classic build parses the
+// image definition at the given path, without building anything. Every problem
+// found is returned, located in the YAML file that introduced it, which can be a
+// file the image definition extends or includes. Unknown keys are only reported
+// if allowUnknownKeys is false. The overrides are keys set as with --set. The
+// error is only set if the checks could not be run or the overrides are invalid
+func ValidateImageDefinition(imageDefinitionPath string, allowUnknownKeys bool, overrides []string) ([]ValidationError, error) {
+	files, err := readImageDefinitionFiles(imageDefinitionPath)
+	if err != nil {
+		var fileError *imageDefinitionFileError
+		if errors.As(err, &fileError) {
+			return fileError.validationErrors, nil
+		}
+		return nil, err
+	}
+	merged := mergeImageDefinitionFiles(files)
+
+	var imageDefinition imagedefinition.ImageDefinition
+	if err := merged.decode(&imageDefinition); err != nil {
+		return []ValidationError{{File: imageDefinitionPath, Message: err.Error()}}, nil
+	}
+	if err := setOverrides(&imageDefinition, overrides); err != nil {
+		return nil, err
+	}
+	substitutionErrors := substituteVariables(&imageDefinition)
+	if err := helperSetDefaults(&imageDefinition); err != nil {
+		return nil, err
+	}
+	result, err := validateImageDefinition(&imageDefinition)
+	if err != nil {
+		return nil, err
+	}
+
+	var validationErrors []ValidationError
+	if !allowUnknownKeys {
+		for _, file := range files {
+			validationErrors = append(validationErrors, unknownKeys(file.path, file.document)...)
+		}
+	}
+	validationErrors = append(validationErrors, merged.validationErrors(substitutionErrors)...)
+	// the schema errors are in no particular order, sort them as they appear in the files
+	schemaErrors := merged.validationErrors(resultKeyErrors(result))
+	sort.SliceStable(schemaErrors, func(i, j int) bool {
+		if schemaErrors[i].File != schemaErrors[j].File {
+			return schemaErrors[i].File < schemaErrors[j].File
+		}
+		if schemaErrors[i].Line != schemaErrors[j].Line {
+			return schemaErrors[i].Line < schemaErrors[j].Line
+		}
+		return schemaErrors[i].Column < schemaErrors[j].Column
+	})
+	validationErrors = append(validationErrors, schemaErrors...)
+	pathErrors := resolveLocalPaths(&imageDefinition, func(keyPath []string) string {
+		return merged.fileOf(keyPath, overrides)
+	})
+	validationErrors = append(validationErrors, merged.validationErrors(pathErrors)...)
+	return validationErrors, nil
+}
+
+// resultKeyErrors translates the errors of the schema validation to the key paths
+// of the YAML file
+func resultKeyErrors(result *gojsonschema.Result) []keyError {
+	var keyErrors []keyError
+	for _, resultError := range result.Errors() {
+		keyPath := schemaPathToKeyPath(resultError.Field())
+		// the errors about missing keys are about a property of the field,
+		// they are located at the field since the property doesn't exist
+		if property, found := resultError.Details()["property"]; found {
+			propertyPath := schemaPathToKeyPath(resultError.Field() + "." + fmt.Sprint(property))
+			if len(propertyPath) > len(keyPath) {
+				keyPath = propertyPath
+			} else {
+				keyPath = append(keyPath, fmt.Sprint(property))
+			}
+		}
+		keyErrors = append(keyErrors, keyError{keyPath, resultError.Description()})
+	}
+	return keyErrors
+}
+
+// yamlErrors turns an error decoding the YAML file into validation errors,
+// one for every line the error is about
+func yamlErrors(imageDefinitionPath string, document *yamlv3.Node, err error) []ValidationError {
+	var validationErrors []ValidationError
+	for _, match := range yamlErrorLine.FindAllStringSubmatch(err.Error(), -1) {
+		line, _ := strconv.Atoi(match[1])
+		validationError := ValidationError{
+			File:    imageDefinitionPath,
+			Line:    line,
+			Message: match[2],
+		}
+		if document != nil {
+			keyPath, column := keyPathAtLine(document, line)
+			validationError.Path = formatKeyPath(keyPath)
+			validationError.Column = column
+		}
+		validationErrors = append(validationErrors, validationError)
+	}
+	if len(validationErrors) == 0 {
+		validationErrors = append(validationErrors, ValidationError{
+			File:    imageDefinitionPath,
+			Message: err.Error(),
+		})
+	}
+	return validationErrors
+}
+
+// schemaPathToKeyPath translates the path of a field in the JSON schema, such as
+// Customization.ExtraPPAs.0.PPAName, to the keys of the YAML file. The fields
+// can also be named by their YAML keys. The translation stops at the first field
+// that is not part of the ImageDefinition struct
+func schemaPathToKeyPath(schemaPath string) []string {
+	var keyPath []string
+	fieldType := reflect.TypeOf(imagedefinition.ImageDefinition{})
+	for _, field := range strings.Split(schemaPath, ".") {
+		if field == "(root)" {
+			continue
+		}
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		switch fieldType.Kind() {
+		case reflect.Slice, reflect.Array:
+			if _, err := strconv.Atoi(field); err != nil {
+				return keyPath
+			}
+			keyPath = append(keyPath, field)
+			fieldType = fieldType.Elem()
+			continue
+		case reflect.Struct:
+			structField, found := structFieldByName(fieldType, field)
+			if !found {
+				return keyPath
+			}
+			keyPath = append(keyPath, strings.Split(structField.Tag.Get("yaml"), ",")[0])
+			fieldType = structField.Type
+			continue
+		}
+		return keyPath
+	}
+	return keyPath
+}
+
+// structFieldByName finds a field of a struct by its name in the JSON schema or its YAML key
+func structFieldByName(structType reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		jsonName := strings.Split(structField.Tag.Get("json"), ",")[0]
+		yamlName := strings.Split(structField.Tag.Get("yaml"), ",")[0]
+		if name == jsonName || name == yamlName {
+			return structField, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// formatKeyPath joins YAML keys, writing the indexes of sequences in brackets
+func formatKeyPath(keyPath []string) string {
+	var formatted strings.Builder
+	for _, key := range keyPath {
+		if _, err := strconv.Atoi(key); err == nil {
+			fmt.Fprintf(&formatted, "[%s]", key)
+			continue
+		}
+		if formatted.Len() > 0 {
+			formatted.WriteString(".")
+		}
+		formatted.WriteString(key)
+	}
+	return formatted.String()
+}
+
+// locateKeyPath returns the line and column of the value of a key path in the YAML
+// document. If the path does not exist, the closest existing parent is located
+func locateKeyPath(document *yamlv3.Node, keyPath []string) (int, int) {
+	node := nodeAtKeyPath(document, keyPath)
+	return node.Line, node.Column
+}
+
+// nodeAtKeyPath returns the node of the value of a key path in the YAML document,
+// or the one of its closest existing parent
+func nodeAtKeyPath(document *yamlv3.Node, keyPath []string) *yamlv3.Node {
+	node := document
+	if node.Kind == yamlv3.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, key := range keyPath {
+		child := childNode(node, key)
+		if child == nil {
+			break
+		}
+		node = child
+	}
+	return node
+}
+
+// childNode returns the value of a key of a mapping node, or an item of a sequence node
+func childNode(node *yamlv3.Node, key string) *yamlv3.Node {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1]
+			}
+		}
+	case yamlv3.SequenceNode:
+		if index, err := strconv.Atoi(key); err == nil && index >= 0 && index < len(node.Content) {
+			return node.Content[index]
+		}
+	}
+	return nil
+}
+
+// keyPathAtLine returns the key path and the column of the first value found on
+// the given line of the YAML document
+func keyPathAtLine(node *yamlv3.Node, line int) ([]string, int) {
+	if node.Kind == yamlv3.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Line == line && value.Line == line {
+				return []string{key.Value}, value.Column
+			}
+			if key.Line == line {
+				return []string{key.Value}, key.Column
+			}
+			if keyPath, column := keyPathAtLine(value, line); keyPath != nil {
+				return append([]string{key.Value}, keyPath...), column
+			}
+		}
+	case yamlv3.SequenceNode:
+		for i, item := range node.Content {
+			if item.Line == line && item.Kind == yamlv3.ScalarNode {
+				return []string{strconv.Itoa(i)}, item.Column
+			}
+			if keyPath, column := keyPathAtLine(item, line); keyPath != nil {
+				return append([]string{strconv.Itoa(i)}, keyPath...), column
+			}
+		}
+	case yamlv3.ScalarNode:
+		if node.Line == line {
+			return []string{}, node.Column
+		}
+	}
+	return nil, 0
+}
+
+// checkUnknownKeys fails if the image definition has keys that are not part of
+// its format. With --allow-unknown-keys, they are only warned about
+func (classicStateMachine *ClassicStateMachine) checkUnknownKeys(files []imageDefinitionFile) error {
+	var validationErrors []ValidationError
+	for _, file := range files {
+		validationErrors = append(validationErrors, unknownKeys(file.path, file.document)...)
+	}
+	if len(validationErrors) == 0 {
+		return nil
+	}
+	var problems []string
+	for _, validationError := range validationErrors {
+		problems = append(problems, validationError.String())
+	}
+	if classicStateMachine.Opts.AllowUnknownKeys {
+		classicStateMachine.warningf("ignoring unknown keys in the image definition:\n  %s\n",
+			strings.Join(problems, "\n  "))
+		return nil
+	}
+	return fmt.Errorf("Schema validation failed: unknown keys in the image definition:\n  %s\n"+
+		"Fix them, or use --allow-unknown-keys to ignore them", strings.Join(problems, "\n  "))
+}
+
+// unknownKeys walks the YAML document along the ImageDefinition struct and returns
+// an error for every key that is not a field of the struct, suggesting the known
+// key it is closest to. The YAML decoder silently ignores them, so a typo in a key
+// would leave out what it configures
+func unknownKeys(imageDefinitionPath string, document *yamlv3.Node) []ValidationError {
+	node := document
+	if node.Kind == yamlv3.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	return unknownKeysOf(imageDefinitionPath, node, reflect.TypeOf(imagedefinition.ImageDefinition{}), nil)
+}
+
+// unknownKeysOf does the work of unknownKeys for a node of the given type
+func unknownKeysOf(imageDefinitionPath string, node *yamlv3.Node, nodeType reflect.Type, keyPath []string) []ValidationError {
+	for nodeType.Kind() == reflect.Ptr {
+		nodeType = nodeType.Elem()
+	}
+	var validationErrors []ValidationError
+	switch {
+	case node.Kind == yamlv3.MappingNode && nodeType.Kind() == reflect.Struct:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			valueKeyPath := append(append([]string{}, keyPath...), key.Value)
+			structField, found := structFieldByYAMLKey(nodeType, key.Value)
+			if !found {
+				message := fmt.Sprintf("unknown key \"%s\"", key.Value)
+				if suggestion := closestKey(key.Value, yamlKeys(nodeType)); suggestion != "" {
+					message = fmt.Sprintf("%s, did you mean \"%s\"?", message, suggestion)
+				}
+				validationErrors = append(validationErrors, ValidationError{
+					File:    imageDefinitionPath,
+					Line:    key.Line,
+					Column:  key.Column,
+					Path:    formatKeyPath(valueKeyPath),
+					Message: message,
+				})
+				continue
+			}
+			validationErrors = append(validationErrors,
+				unknownKeysOf(imageDefinitionPath, value, structField.Type, valueKeyPath)...)
+		}
+	case node.Kind == yamlv3.SequenceNode && (nodeType.Kind() == reflect.Slice || nodeType.Kind() == reflect.Array):
+		for i, item := range node.Content {
+			itemKeyPath := append(append([]string{}, keyPath...), strconv.Itoa(i))
+			validationErrors = append(validationErrors,
+				unknownKeysOf(imageDefinitionPath, item, nodeType.Elem(), itemKeyPath)...)
+		}
+	}
+	return validationErrors
+}
+
+// structFieldByYAMLKey finds the field of a struct that is decoded from the given YAML key
+func structFieldByYAMLKey(structType reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < structType.NumField(); i++ {
+		if strings.Split(structType.Field(i).Tag.Get("yaml"), ",")[0] == key {
+			return structType.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// yamlKeys returns the YAML keys of the fields of a struct
+func yamlKeys(structType reflect.Type) []string {
+	var keys []string
+	for i := 0; i < structType.NumField(); i++ {
+		if key := strings.Split(structType.Field(i).Tag.Get("yaml"), ",")[0]; key != "" && key != "-" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// closestKey returns the known key that is the closest to an unknown one, if it
+// is close enough to be a typo of it
+func closestKey(unknownKey string, knownKeys []string) string {
+	closest := ""
+	closestDistance := len(unknownKey)/3 + 1
+	if closestDistance < 2 {
+		closestDistance = 2
+	}
+	for _, knownKey := range knownKeys {
+		if distance := editDistance(strings.ToLower(unknownKey), knownKey); distance < closestDistance {
+			closest = knownKey
+			closestDistance = distance
+		}
+	}
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,219 @@
+// This test file tests the validation of image definitions without building them
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestValidateImageDefinition ensures that every problem found in an image definition
+// is located at its line, column and key path in the YAML file
+func TestValidateImageDefinition(t *testing.T) {
+	testCases := []struct {
+		name            string
+		imageDefinition string
+		expected        []ValidationError
+	}{
+		{"valid", "test_amd64.yaml", nil},
+		{"valid_multi_arch", "test_multi_arch.yaml", nil},
+		{"enum", "test_bad_class.yaml", []ValidationError{
+			{Line: 6, Column: 8, Path: "class", Message: "Class must be one of the following"},
+		}},
+		{"pattern_and_custom_check", "test_bad_ppa_name.yaml", []ValidationError{
+			{Line: 38, Column: 7, Path: "customization.extra-ppas[0].fingerprint",
+				Message: "Fingerprint is required for private PPAs"},
+			{Line: 38, Column: 13, Path: "customization.extra-ppas[0].name", Message: "Does not match pattern"},
+			{Line: 39, Column: 13, Path: "customization.extra-ppas[0].auth", Message: "Does not match pattern"},
+		}},
+		{"conflicting_ppa_auth", "test_conflicting_ppa_auth.yaml", []ValidationError{
+			{Line: 19, Column: 7, Path: "customization.extra-ppas[0]",
+				Message: "Only one of auth, auth-file and auth-env can be given for a private PPA (auth-env, auth-file)"},
+		}},
+		{"missing_url", "test_git_gadget_without_url.yaml", []ValidationError{
+			{Line: 9, Column: 3, Path: "gadget.url", Message: "a URL must be provided"},
+		}},
+		{"dependent_key", "test_image_without_gadget.yaml", []ValidationError{
+			{Line: 51, Column: 5, Path: "artifacts.img", Message: "Key img cannot be used without key gadget:"},
+		}},
+		{"path_not_absolute", "test_invalid_paths_in_manual_touch_file.yaml", []ValidationError{
+			{Line: 42, Column: 15, Path: "customization.manual.touch-file[0].path", Message: "needs to be an absolute path"},
+			{Line: 44, Column: 15, Path: "customization.manual.touch-file[1].path", Message: "needs to be an absolute path"},
+		}},
+		{"missing_key", "test_missing_name.yaml", []ValidationError{
+			{Line: 1, Column: 1, Path: "name", Message: "Key \"name\" is required"},
+		}},
+		{"oneof", "test_both_seed_and_tasks.yaml", []ValidationError{
+			{Line: 13, Column: 3, Path: "rootfs", Message: "Must validate one and only one schema"},
+		}},
+		{"not_a_mapping", "test_invalid_yaml.yaml", []ValidationError{
+			{Line: 1, Column: 1, Path: "", Message: "cannot unmarshal !!str"},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_validate_image_definition_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imageDefinition := filepath.Join("testdata", "image_definitions", tc.imageDefinition)
+			validationErrors, err := ValidateImageDefinition(imageDefinition, false, nil)
+			asserter.AssertErrNil(err, true)
+			if len(validationErrors) != len(tc.expected) {
+				t.Fatalf("Expected %d errors but got %q", len(tc.expected), validationErrors)
+			}
+			for i, validationError := range validationErrors {
+				expected := tc.expected[i]
+				if validationError.File != imageDefinition || validationError.Line != expected.Line ||
+					validationError.Column != expected.Column || validationError.Path != expected.Path ||
+					!strings.Contains(validationError.Message, expected.Message) {
+					t.Errorf("Expected error %d to be %+v but got %+v", i, expected, validationError)
+				}
+			}
+		})
+	}
+}
+
+// TestValidateImageDefinitionYAMLErrors ensures that the YAML syntax and type
+// errors are located in the file
+func TestValidateImageDefinitionYAMLErrors(t *testing.T) {
+	t.Run("test_validate_image_definition_yaml_errors", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+
+		wrongTypes := filepath.Join(tmpDir, "wrong_types.yaml")
+		err = os.WriteFile(wrongTypes, []byte("name: test\nrevision: abc\nrootfs:\n  seed:\n    vcs: notbool\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		validationErrors, err := ValidateImageDefinition(wrongTypes, false, nil)
+		asserter.AssertErrNil(err, true)
+		expected := []string{
+			wrongTypes + ":2:11: revision: cannot unmarshal !!str `abc` into int",
+			wrongTypes + ":5:10: rootfs.seed.vcs: cannot unmarshal !!str `notbool` into bool",
+		}
+		var got []string
+		for _, validationError := range validationErrors {
+			got = append(got, validationError.String())
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected errors %q but got %q", expected, got)
+		}
+
+		// the column of syntax errors is unknown
+		badSyntax := filepath.Join(tmpDir, "bad_syntax.yaml")
+		err = os.WriteFile(badSyntax, []byte("name: test\n  bad: : value\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		validationErrors, err = ValidateImageDefinition(badSyntax, false, nil)
+		asserter.AssertErrNil(err, true)
+		if len(validationErrors) != 1 ||
+			validationErrors[0].String() != badSyntax+":2: mapping values are not allowed in this context" {
+			t.Errorf("Unexpected errors %q", validationErrors)
+		}
+
+		_, err = ValidateImageDefinition(filepath.Join(tmpDir, "does_not_exist.yaml"), false, nil)
+		asserter.AssertErrContains(err, "Error opening image definition file")
+	})
+}
+
+// TestSchemaPathToKeyPath ensures that the fields of the schema are translated to YAML keys
+func TestSchemaPathToKeyPath(t *testing.T) {
+	testCases := []struct {
+		schemaPath string
+		expected   string
+	}{
+		{"(root)", ""},
+		{"Rootfs.Seed.SeedURLs.1", "rootfs.seed.urls[1]"},
+		{"Artifacts.Img.0.ImgName", "artifacts.img[0].name"},
+		{"Artifacts.qcow2", "artifacts.qcow2"},
+		{"Customization.NotAField.Name", "customization"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_schema_path_to_key_path_"+tc.schemaPath, func(t *testing.T) {
+			if keyPath := formatKeyPath(schemaPathToKeyPath(tc.schemaPath)); keyPath != tc.expected {
+				t.Errorf("Expected key path \"%s\" but got \"%s\"", tc.expected, keyPath)
+			}
+		})
+	}
+}
+
+// TestUnknownKeys ensures that the keys that are not part of the image definition
+// format are reported with the known key they are the closest to
+func TestUnknownKeys(t *testing.T) {
+	t.Run("test_unknown_keys", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		imageDefinition := filepath.Join("testdata", "image_definitions", "test_unknown_keys.yaml")
+		validationErrors, err := ValidateImageDefinition(imageDefinition, false, nil)
+		asserter.AssertErrNil(err, true)
+		expected := []string{
+			imageDefinition + ":12:3: customization.extra-package: unknown key \"extra-package\", " +
+				"did you mean \"extra-packages\"?",
+			imageDefinition + ":18:7: customization.extra-snaps[0].chanel: unknown key \"chanel\", " +
+				"did you mean \"channel\"?",
+			imageDefinition + ":19:1: artefacts: unknown key \"artefacts\", did you mean \"artifacts\"?",
+		}
+		var got []string
+		for _, validationError := range validationErrors {
+			got = append(got, validationError.String())
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected errors %q but got %q", expected, got)
+		}
+
+		validationErrors, err = ValidateImageDefinition(imageDefinition, true, nil)
+		asserter.AssertErrNil(err, true)
+		if len(validationErrors) != 0 {
+			t.Errorf("Expected unknown keys to be allowed but got %q", validationErrors)
+		}
+	})
+}
+
+// TestClosestKey ensures that only the keys that are close enough to be a typo are suggested
+func TestClosestKey(t *testing.T) {
+	knownKeys := []string{"name", "series", "architecture", "extra-packages", "extra-snaps"}
+	testCases := []struct {
+		unknownKey string
+		expected   string
+	}{
+		{"serie", "series"},
+		{"Architecture", "architecture"},
+		{"extra-snap", "extra-snaps"},
+		{"base", ""},
+		{"something-else", ""},
+	}
+	for _, tc := range testCases {
+		t.Run("test_closest_key_"+tc.unknownKey, func(t *testing.T) {
+			if closest := closestKey(tc.unknownKey, knownKeys); closest != tc.expected {
+				t.Errorf("Expected \"%s\" to be suggested but got \"%s\"", tc.expected, closest)
+			}
+		})
+	}
+}
+
+// TestValidateImageDefinitionVariables ensures that the undefined variables are
+// located in the file, and that the overrides are validated
+func TestValidateImageDefinitionVariables(t *testing.T) {
+	t.Run("test_validate_image_definition_variables", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		imageDefinition := filepath.Join("testdata", "image_definitions", "test_amd64.yaml")
+		validationErrors, err := ValidateImageDefinition(imageDefinition, false,
+			[]string{"rootfs.mirror=http://${UBUNTU_IMAGE_UNDEFINED}/ubuntu/", "class=other"})
+		asserter.AssertErrNil(err, true)
+		expected := []string{
+			imageDefinition + ":13:3: rootfs.mirror: undefined variable ${UBUNTU_IMAGE_UNDEFINED}, " +
+				"use $${ for a literal ${",
+			imageDefinition + ":6:8: class: Class must be one of the following: \"preinstalled\", \"cloud\", \"installer\"",
+		}
+		var got []string
+		for _, validationError := range validationErrors {
+			got = append(got, validationError.String())
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected errors %q but got %q", expected, got)
+		}
+
+		_, err = ValidateImageDefinition(imageDefinition, false, []string{"rootfs.miror=http://ports.ubuntu.com/"})
+		asserter.AssertErrContains(err, "unknown key \"rootfs.miror\"")
+	})
+}
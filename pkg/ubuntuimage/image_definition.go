@@ -0,0 +1,93 @@
+package ubuntuimage
+
+import (
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// The sections of an ImageDefinition, so programs can build one without parsing
+// an image definition file. See the documentation of image definition files for
+// the meaning of their fields
+
+// Architectures is the architecture of the image, or the architectures of
+// a multi-architecture build
+type Architectures = imagedefinition.Architectures
+
+// Gadget is the gadget section of the image definition
+type Gadget = imagedefinition.Gadget
+
+// Rootfs is the rootfs section of the image definition
+type Rootfs = imagedefinition.Rootfs
+
+// Seed is the seed section of rootfs, used to build a rootfs via seed germination
+type Seed = imagedefinition.Seed
+
+// Tarball is the tarball section of rootfs, used to build a rootfs from a tarball
+type Tarball = imagedefinition.Tarball
+
+// Customization is the customization section of the image definition
+type Customization = imagedefinition.Customization
+
+// Installer provides customization options specific to installer images
+type Installer = imagedefinition.Installer
+
+// CloudInit provides customizations for running cloud-init
+type CloudInit = imagedefinition.CloudInit
+
+// PPA describes a public or private PPA
+type PPA = imagedefinition.PPA
+
+// Repository describes a third-party APT repository
+type Repository = imagedefinition.Repository
+
+// Package is a package to install in the image
+type Package = imagedefinition.Package
+
+// Snap is a snap to install in the image
+type Snap = imagedefinition.Snap
+
+// Manual provides manual customization options
+type Manual = imagedefinition.Manual
+
+// Fstab is an entry of the fstab of the image
+type Fstab = imagedefinition.Fstab
+
+// CopyFile copies a file into the rootfs of the image
+type CopyFile = imagedefinition.CopyFile
+
+// Execute executes a script in the rootfs of the image
+type Execute = imagedefinition.Execute
+
+// TouchFile touches a file in the rootfs of the image
+type TouchFile = imagedefinition.TouchFile
+
+// AddGroup adds a group in the image
+type AddGroup = imagedefinition.AddGroup
+
+// AddUser adds a user in the image
+type AddUser = imagedefinition.AddUser
+
+// Artifacts is the artifacts section of the image definition, listing the files
+// created by the build. It is not to be confused with Artifact, which describes
+// a file that was written
+type Artifacts = imagedefinition.Artifact
+
+// Img is a raw disk image to create
+type Img = imagedefinition.Img
+
+// Iso is an ISO image to create
+type Iso = imagedefinition.Iso
+
+// Qcow2 is a qcow2 image to create
+type Qcow2 = imagedefinition.Qcow2
+
+// Manifest is the manifest of the packages and snaps of the image to create
+type Manifest = imagedefinition.Manifest
+
+// Filelist is the list of the files of the image to create
+type Filelist = imagedefinition.Filelist
+
+// Changelog is the changelog of the packages of the image to create
+type Changelog = imagedefinition.Changelog
+
+// RootfsTar is a tarball of the rootfs to create
+type RootfsTar = imagedefinition.RootfsTar
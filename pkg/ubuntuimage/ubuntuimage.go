@@ -0,0 +1,379 @@
+// Package ubuntuimage builds Ubuntu images from Go programs. It runs the same
+// state machine as the ubuntu-image command, configured with typed options
+// instead of command line flags
+package ubuntuimage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/canonical/ubuntu-image/internal/statemachine"
+	"gopkg.in/yaml.v2"
+)
+
+// CommonOptions are the options common to all image types, see the
+// "Common options" of the ubuntu-image command
+type CommonOptions = commands.CommonOpts
+
+// StateMachineOptions control the working directory of the build and the
+// steps that are run, see the "State machine options" of the ubuntu-image command
+type StateMachineOptions = commands.StateMachineOpts
+
+// SnapOptions are the options specific to snap based images
+type SnapOptions = commands.SnapOpts
+
+// ClassicOptions are the options specific to classic images
+type ClassicOptions = commands.ClassicOpts
+
+// ImageDefinition describes a classic image, as parsed from an image definition file
+type ImageDefinition = imagedefinition.ImageDefinition
+
+// Event describes a single step of progress of the build
+type Event = statemachine.Event
+
+// Logger receives the messages printed while an image is built. *log.Logger satisfies it
+type Logger = statemachine.Logger
+
+// LeveledLogger is a Logger that receives every log message of the build along with
+// its level and the state that logged it, whatever the verbosity options
+type LeveledLogger = statemachine.LeveledLogger
+
+// LogLevel is the severity of a message passed to LeveledLogger.Logf
+type LogLevel = statemachine.LogLevel
+
+// The levels of the messages passed to LeveledLogger.Logf
+const (
+	LogDebug   = statemachine.LogDebug
+	LogInfo    = statemachine.LogInfo
+	LogWarning = statemachine.LogWarning
+	LogError   = statemachine.LogError
+)
+
+// The types of the events passed to Options.OnEvent
+const (
+	EventStateStarted    = statemachine.EventStateStarted
+	EventStateFinished   = statemachine.EventStateFinished
+	EventStateFailed     = statemachine.EventStateFailed
+	EventCommandSpawned  = statemachine.EventCommandSpawned
+	EventArtifactWritten = statemachine.EventArtifactWritten
+)
+
+// The types of the artifacts listed in Result.Artifacts
+const (
+	ArtifactImg           = statemachine.ArtifactImg
+	ArtifactQcow2         = statemachine.ArtifactQcow2
+	ArtifactManifest      = statemachine.ArtifactManifest
+	ArtifactFilelist      = statemachine.ArtifactFilelist
+	ArtifactRootfsTarball = statemachine.ArtifactRootfsTarball
+	ArtifactSeedManifest  = statemachine.ArtifactSeedManifest
+	ArtifactSnapsManifest = statemachine.ArtifactSnapsManifest
+)
+
+// SnapImage describes a snap based image, built from a model assertion
+type SnapImage struct {
+	// ModelAssertion is the path to the model assertion. It must be empty
+	// when a build is resumed
+	ModelAssertion string
+	Options        SnapOptions
+}
+
+// ClassicImage describes a classic image. Exactly one of ImageDefinitionPath and
+// ImageDefinition must be set, unless a build is resumed
+type ClassicImage struct {
+	// ImageDefinitionPath is the path to an image definition file
+	ImageDefinitionPath string
+	// ImageDefinition is used instead of an image definition file
+	ImageDefinition *ImageDefinition
+	// BaseDir is the directory the relative paths of ImageDefinition are relative
+	// to, like the directory of an image definition file is for the paths written
+	// in it. It defaults to the current directory
+	BaseDir string
+	Options ClassicOptions
+}
+
+// Options configure a build. Exactly one of Snap and Classic must be set
+type Options struct {
+	Common       CommonOptions
+	StateMachine StateMachineOptions
+	Snap         *SnapImage
+	Classic      *ClassicImage
+
+	// Logger receives the messages of the build. They are printed
+	// to stdout if it is nil, like the ubuntu-image command does. It may
+	// be a LeveledLogger. The full log of the build is written to
+	// build.log in the working directory either way
+	Logger Logger
+	// OnEvent is called with every event of the build if it is not nil
+	OnEvent func(Event)
+}
+
+// Artifact is a file written to the output directory by the build
+type Artifact struct {
+	// Type is one of the Artifact* constants
+	Type string
+	Path string
+	Size int64
+}
+
+// Result describes the outcome of a successful build
+type Result struct {
+	OutputDir string
+	// WorkDir is empty if a temporary working directory was used, since it is
+	// removed at the end of the build
+	WorkDir string
+	// Artifacts are listed in the order they were written. Artifacts that were
+	// removed before the end of the build are not listed
+	Artifacts []Artifact
+	Duration  time.Duration
+}
+
+// Manifests returns the manifests and file lists of the image
+func (result *Result) Manifests() []Artifact {
+	var manifests []Artifact
+	for _, artifact := range result.Artifacts {
+		switch artifact.Type {
+		case ArtifactManifest, ArtifactFilelist, ArtifactSeedManifest, ArtifactSnapsManifest:
+			manifests = append(manifests, artifact)
+		}
+	}
+	return manifests
+}
+
+// OptionsError is returned when the options passed to Build are incomplete or inconsistent
+type OptionsError struct {
+	Message string
+}
+
+func (err *OptionsError) Error() string {
+	return err.Message
+}
+
+// SetupError is returned when the build could not be set up, for example
+// because the options are invalid or a previous build can't be resumed
+type SetupError struct {
+	Err error
+}
+
+func (err *SetupError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *SetupError) Unwrap() error {
+	return err.Err
+}
+
+// StateError is returned when a state of the build failed. If the build was
+// cancelled or timed out, it wraps context.Canceled or context.DeadlineExceeded
+type StateError struct {
+	// State is the name of the state that failed and Step its index
+	State string
+	Step  int
+	Err   error
+}
+
+func (err *StateError) Error() string {
+	return fmt.Sprintf("Error in state %s: %s", err.State, err.Err.Error())
+}
+
+func (err *StateError) Unwrap() error {
+	return err.Err
+}
+
+// TeardownError is returned when the states ran successfully, but the state of the
+// build could not be saved in the working directory
+type TeardownError struct {
+	Err error
+}
+
+func (err *TeardownError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *TeardownError) Unwrap() error {
+	return err.Err
+}
+
+// Build builds the image described by opts. Cancelling ctx stops the build, kills
+// the running commands and tears down the mounts, as SIGINT does for the
+// ubuntu-image command. The returned error is an *OptionsError, *SetupError,
+// *StateError or *TeardownError
+func Build(ctx context.Context, opts Options) (*Result, error) {
+	start := time.Now()
+	if err := validateOptions(opts); err != nil {
+		return nil, err
+	}
+
+	// copy the options, the state machine changes some of them while it runs
+	commonOpts := opts.Common
+	stateMachineOpts := opts.StateMachine
+	// go-flags sets these defaults for the ubuntu-image command
+	if commonOpts.SectorSize == "" {
+		commonOpts.SectorSize = "512"
+	}
+	if commonOpts.ProgressFormat == "" {
+		commonOpts.ProgressFormat = "text"
+	}
+
+	var stateMachineInterface statemachine.SmInterface
+	var stateMachine *statemachine.StateMachine
+	if opts.Snap != nil {
+		snapStateMachine := new(statemachine.SnapStateMachine)
+		snapStateMachine.Opts = opts.Snap.Options
+		snapStateMachine.Args = commands.SnapArgs{ModelAssertion: opts.Snap.ModelAssertion}
+		stateMachineInterface = snapStateMachine
+		stateMachine = &snapStateMachine.StateMachine
+	} else {
+		classicStateMachine := new(statemachine.ClassicStateMachine)
+		classicStateMachine.Opts = opts.Classic.Options
+		classicStateMachine.Args = commands.ClassicArgs{ImageDefinition: opts.Classic.ImageDefinitionPath}
+		if opts.Classic.ImageDefinition != nil {
+			imageDefinition, err := resolveImageDefinition(opts.Classic.ImageDefinition, opts.Classic.BaseDir)
+			if err != nil {
+				return nil, &SetupError{Err: err}
+			}
+			imageDefinitionPath, err := writeImageDefinition(imageDefinition, stateMachineOpts.WorkDir)
+			if err != nil {
+				return nil, &SetupError{Err: err}
+			}
+			// the temporary working directory is removed at the end of the build, so
+			// the build can't be resumed and the image definition isn't needed anymore
+			if stateMachineOpts.WorkDir == "" {
+				defer os.Remove(imageDefinitionPath)
+			}
+			classicStateMachine.Args.ImageDefinition = imageDefinitionPath
+		}
+		stateMachineInterface = classicStateMachine
+		stateMachine = &classicStateMachine.StateMachine
+	}
+	stateMachine.SetCommonOpts(&commonOpts, &stateMachineOpts)
+	if opts.Logger != nil {
+		stateMachine.SetLogger(opts.Logger)
+	}
+
+	result := &Result{WorkDir: stateMachineOpts.WorkDir}
+	var artifacts []Artifact
+	stateMachine.SetEventHandler(func(event Event) {
+		if event.Type == EventArtifactWritten {
+			artifacts = append(artifacts, Artifact{Type: event.ArtifactType, Path: event.Artifact})
+		}
+		if opts.OnEvent != nil {
+			opts.OnEvent(event)
+		}
+	})
+
+	if err := stateMachineInterface.Setup(ctx); err != nil {
+		return nil, &SetupError{Err: err}
+	}
+	if err := stateMachineInterface.Run(ctx); err != nil {
+		return nil, &StateError{State: stateMachine.CurrentStep, Step: stateMachine.StepsTaken, Err: err}
+	}
+	if err := stateMachineInterface.Teardown(ctx); err != nil {
+		return nil, &TeardownError{Err: err}
+	}
+
+	result.OutputDir = commonOpts.OutputDir
+	for _, artifact := range artifacts {
+		if !filepath.IsAbs(artifact.Path) {
+			artifact.Path = filepath.Join(result.OutputDir, artifact.Path)
+		}
+		artifactInfo, err := os.Stat(artifact.Path)
+		if err != nil {
+			continue
+		}
+		artifact.Size = artifactInfo.Size()
+		result.Artifacts = append(result.Artifacts, artifact)
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// validateOptions makes sure the options describe exactly one image
+func validateOptions(opts Options) error {
+	if opts.Snap == nil && opts.Classic == nil {
+		return &OptionsError{Message: "Either a snap or a classic image must be given"}
+	}
+	if opts.Snap != nil && opts.Classic != nil {
+		return &OptionsError{Message: "A snap and a classic image cannot both be given"}
+	}
+	// --only and --from resume the partial build as well
+	resume := opts.StateMachine.Resume || opts.StateMachine.Only != "" || opts.StateMachine.From != ""
+	if opts.Snap != nil {
+		if opts.Snap.ModelAssertion == "" && !resume {
+			return &OptionsError{Message: "A model assertion must be given for snap images"}
+		}
+		if opts.Snap.ModelAssertion != "" && resume {
+			return &OptionsError{Message: "A model assertion cannot be given when resuming a build"}
+		}
+		return nil
+	}
+	if opts.Classic.ImageDefinitionPath != "" && opts.Classic.ImageDefinition != nil {
+		return &OptionsError{Message: "An image definition path and an image definition cannot both be given"}
+	}
+	if opts.Classic.ImageDefinitionPath == "" && opts.Classic.ImageDefinition == nil && !resume {
+		return &OptionsError{Message: "An image definition must be given for classic images"}
+	}
+	return nil
+}
+
+// resolveImageDefinition returns a copy of an image definition in which the relative
+// paths on the host are made absolute, relative to baseDir or the current directory.
+// They would be relative to the directory the image definition is written to otherwise
+func resolveImageDefinition(imageDefinition *ImageDefinition, baseDir string) (*ImageDefinition, error) {
+	if baseDir == "" {
+		var err error
+		baseDir, err = os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("Error getting the current directory: %s", err.Error())
+		}
+	}
+	imageDefinitionBytes, err := yaml.Marshal(imageDefinition)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding image definition: %s", err.Error())
+	}
+	resolved := new(ImageDefinition)
+	if err := yaml.Unmarshal(imageDefinitionBytes, resolved); err != nil {
+		return nil, fmt.Errorf("Error decoding image definition: %s", err.Error())
+	}
+	statemachine.ResolveImageDefinitionPaths(resolved, baseDir)
+	return resolved, nil
+}
+
+// imageDefinitionFileName is the file of the working directory in which the
+// image definition is written
+const imageDefinitionFileName = "image-definition.yaml"
+
+// writeImageDefinition writes an image definition to a file, since the state
+// machine reads it from disk and records its path to resume the build. The file
+// is written in workDir, so it is kept as long as the build can be resumed, or
+// to a temporary file if no working directory is given
+func writeImageDefinition(imageDefinition *ImageDefinition, workDir string) (string, error) {
+	imageDefinitionBytes, err := yaml.Marshal(imageDefinition)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding image definition: %s", err.Error())
+	}
+	if workDir != "" {
+		if err := os.MkdirAll(workDir, 0755); err != nil {
+			return "", fmt.Errorf("Error creating work directory: %s", err.Error())
+		}
+		imageDefinitionPath := filepath.Join(workDir, imageDefinitionFileName)
+		if err := os.WriteFile(imageDefinitionPath, imageDefinitionBytes, 0600); err != nil {
+			return "", fmt.Errorf("Error writing image definition file: %s", err.Error())
+		}
+		return imageDefinitionPath, nil
+	}
+	imageDefinitionFile, err := os.CreateTemp("", "ubuntu-image-definition-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("Error creating image definition file: %s", err.Error())
+	}
+	defer imageDefinitionFile.Close()
+	if _, err := imageDefinitionFile.Write(imageDefinitionBytes); err != nil {
+		os.Remove(imageDefinitionFile.Name())
+		return "", fmt.Errorf("Error writing image definition file: %s", err.Error())
+	}
+	return imageDefinitionFile.Name(), nil
+}
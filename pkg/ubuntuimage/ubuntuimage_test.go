@@ -0,0 +1,317 @@
+package ubuntuimage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"gopkg.in/yaml.v2"
+)
+
+const testImageDefinition = "../../internal/statemachine/testdata/image_definitions/test_raspi.yaml"
+
+// testLogger records the messages of the build
+type testLogger struct {
+	messages []string
+}
+
+func (logger *testLogger) Printf(format string, v ...interface{}) {
+	logger.messages = append(logger.messages, fmt.Sprintf(format, v...))
+}
+
+// TestFailedValidateOptions tests options that don't describe exactly one image
+func TestFailedValidateOptions(t *testing.T) {
+	testCases := []struct {
+		name          string
+		opts          Options
+		expectedError string
+	}{
+		{"no_image", Options{}, "Either a snap or a classic image must be given"},
+		{"both_images", Options{Snap: &SnapImage{ModelAssertion: "model"},
+			Classic: &ClassicImage{ImageDefinitionPath: "image.yaml"}},
+			"A snap and a classic image cannot both be given"},
+		{"no_model_assertion", Options{Snap: &SnapImage{}},
+			"A model assertion must be given for snap images"},
+		{"model_assertion_with_resume", Options{Snap: &SnapImage{ModelAssertion: "model"},
+			StateMachine: StateMachineOptions{Resume: true}},
+			"A model assertion cannot be given when resuming a build"},
+		{"no_image_definition", Options{Classic: &ClassicImage{}},
+			"An image definition must be given for classic images"},
+		{"both_image_definitions", Options{Classic: &ClassicImage{ImageDefinitionPath: "image.yaml",
+			ImageDefinition: &ImageDefinition{}}},
+			"An image definition path and an image definition cannot both be given"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_validate_options_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			result, err := Build(context.Background(), tc.opts)
+			asserter.AssertErrContains(err, tc.expectedError)
+			var optionsError *OptionsError
+			if !errors.As(err, &optionsError) {
+				t.Errorf("Expected an *OptionsError but got %T", err)
+			}
+			if result != nil {
+				t.Errorf("Expected no result but got %+v", result)
+			}
+		})
+	}
+}
+
+// TestFailedBuildSetup ensures that invalid state machine options are reported as a *SetupError
+func TestFailedBuildSetup(t *testing.T) {
+	t.Run("test_failed_build_setup", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		_, err := Build(context.Background(), Options{
+			Classic:      &ClassicImage{ImageDefinitionPath: testImageDefinition},
+			StateMachine: StateMachineOptions{Until: "make_disk", Thru: "make_disk"},
+			Common:       CommonOptions{Quiet: true},
+		})
+		asserter.AssertErrContains(err, "cannot specify both --until and --thru")
+		var setupError *SetupError
+		if !errors.As(err, &setupError) {
+			t.Errorf("Expected a *SetupError but got %T", err)
+		}
+	})
+}
+
+// TestCancelledBuild ensures that cancelling the context passed to Build stops
+// the build with a *StateError that wraps context.Canceled
+func TestCancelledBuild(t *testing.T) {
+	t.Run("test_cancelled_build", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var events []Event
+		_, err := Build(ctx, Options{
+			Classic: &ClassicImage{ImageDefinitionPath: testImageDefinition},
+			Logger:  &testLogger{},
+			OnEvent: func(event Event) { events = append(events, event) },
+		})
+		asserter.AssertErrContains(err, "the build was cancelled")
+		var stateError *StateError
+		if !errors.As(err, &stateError) {
+			t.Fatalf("Expected a *StateError but got %T", err)
+		}
+		if stateError.State != "parse_image_definition" || stateError.Step != 0 {
+			t.Errorf("Expected the first state to fail, but %s (%d) failed",
+				stateError.State, stateError.Step)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected error \"%s\" to wrap context.Canceled", err.Error())
+		}
+		if len(events) != 2 || events[0].Type != EventStateStarted || events[1].Type != EventStateFailed {
+			t.Errorf("Expected the first state to start and fail, but got the events %+v", events)
+		}
+	})
+}
+
+// TestConcurrentBuildsSameWorkDir ensures that two builds of the same program can't
+// use the same working directory at the same time
+func TestConcurrentBuildsSameWorkDir(t *testing.T) {
+	t.Run("test_concurrent_builds_same_workdir", func(t *testing.T) {
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		if err != nil {
+			t.Fatalf("Error creating workdir: %s", err.Error())
+		}
+		defer os.RemoveAll(workDir)
+
+		// the build that locks the workdir waits for the other one to finish
+		release := make(chan struct{})
+		var releaseOnce sync.Once
+		build := func(errs chan<- error) {
+			_, err := Build(context.Background(), Options{
+				Classic:      &ClassicImage{ImageDefinitionPath: testImageDefinition},
+				StateMachine: StateMachineOptions{WorkDir: workDir, Thru: "make_temporary_directories"},
+				Common:       CommonOptions{SkipPreflight: true},
+				Logger:       &testLogger{},
+				OnEvent: func(event Event) {
+					if event.Type == EventStateFinished && event.State == "make_temporary_directories" {
+						<-release
+					}
+				},
+			})
+			errs <- err
+		}
+		errs := make(chan error, 2)
+		go build(errs)
+		go build(errs)
+
+		var failed []error
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errs:
+				if err != nil {
+					failed = append(failed, err)
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatalf("Expected one of the builds to fail since the workdir is in use")
+			}
+			releaseOnce.Do(func() { close(release) })
+		}
+		if len(failed) != 1 {
+			t.Fatalf("Expected exactly one of the builds to fail but got the errors %q", failed)
+		}
+		if !strings.Contains(failed[0].Error(), "is in use by another build of this process") {
+			t.Errorf("Expected the workdir to be in use but got \"%s\"", failed[0].Error())
+		}
+	})
+}
+
+// TestBuildImageDefinition ensures that an image definition can be given as a struct, and
+// that the messages of the build are sent to the logger instead of stdout
+func TestBuildImageDefinition(t *testing.T) {
+	t.Run("test_build_image_definition", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		imageDefinitionBytes, err := os.ReadFile(testImageDefinition)
+		asserter.AssertErrNil(err, true)
+		var imageDefinition ImageDefinition
+		err = yaml.Unmarshal(imageDefinitionBytes, &imageDefinition)
+		asserter.AssertErrNil(err, true)
+
+		logger := &testLogger{}
+		result, err := Build(context.Background(), Options{
+			Classic: &ClassicImage{
+				ImageDefinition: &imageDefinition,
+				BaseDir:         filepath.Dir(testImageDefinition),
+				Options:         ClassicOptions{Plan: true},
+			},
+			Logger: logger,
+		})
+		asserter.AssertErrNil(err, true)
+		if len(result.Artifacts) != 0 || len(result.Manifests()) != 0 {
+			t.Errorf("Expected no artifacts to be written by --plan, but got %+v", result.Artifacts)
+		}
+
+		output := strings.Join(logger.messages, "")
+		for _, expected := range []string{"The following states would run",
+			"build_gadget_tree (gadget:type is \"git\")", "make_disk (artifacts:img is set)"} {
+			if !strings.Contains(output, expected) {
+				t.Errorf("Expected \"%s\" in the plan, but got:\n%s", expected, output)
+			}
+		}
+	})
+}
+
+// TestResolveImageDefinition ensures that the relative paths of an image definition
+// are resolved against the base directory, without changing the image definition
+// given by the caller
+func TestResolveImageDefinition(t *testing.T) {
+	testCases := []struct {
+		name     string
+		baseDir  string
+		expected string
+	}{
+		{"base_dir", "/tmp/images", "file:///tmp/images/gadget"},
+		{"current_dir", "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run("test_resolve_image_definition_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			expected := tc.expected
+			if tc.baseDir == "" {
+				cwd, err := os.Getwd()
+				asserter.AssertErrNil(err, true)
+				expected = "file://" + filepath.Join(cwd, "gadget")
+			}
+			imageDefinition := &ImageDefinition{
+				Gadget: &Gadget{GadgetType: "directory", GadgetURL: "file://gadget"},
+			}
+			resolved, err := resolveImageDefinition(imageDefinition, tc.baseDir)
+			asserter.AssertErrNil(err, true)
+			if resolved.Gadget.GadgetURL != expected {
+				t.Errorf("Expected the gadget URL %s but got %s", expected, resolved.Gadget.GadgetURL)
+			}
+			if imageDefinition.Gadget.GadgetURL != "file://gadget" {
+				t.Errorf("Expected the image definition of the caller not to change, but got the gadget URL %s",
+					imageDefinition.Gadget.GadgetURL)
+			}
+		})
+	}
+}
+
+// TestWriteImageDefinition ensures that the image definition is written in the working
+// directory when one is given, so a build stopped with --until or --thru can be resumed
+func TestWriteImageDefinition(t *testing.T) {
+	t.Run("test_write_image_definition", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		imageDefinitionPath, err := writeImageDefinition(&ImageDefinition{Series: "jammy"}, workDir)
+		asserter.AssertErrNil(err, true)
+		if imageDefinitionPath != filepath.Join(workDir, imageDefinitionFileName) {
+			t.Errorf("Expected the image definition to be written in %s, but it was written to %s",
+				workDir, imageDefinitionPath)
+		}
+		imageDefinitionBytes, err := os.ReadFile(imageDefinitionPath)
+		asserter.AssertErrNil(err, true)
+		var imageDefinition ImageDefinition
+		err = yaml.Unmarshal(imageDefinitionBytes, &imageDefinition)
+		asserter.AssertErrNil(err, true)
+		if imageDefinition.Series != "jammy" {
+			t.Errorf("Expected series jammy in the written image definition, but got \"%s\"",
+				imageDefinition.Series)
+		}
+	})
+}
+
+// TestImageDefinitionTypes ensures that an image definition can be built with the
+// types of its sections exported by the package
+func TestImageDefinitionTypes(t *testing.T) {
+	t.Run("test_image_definition_types", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		imgs := []Img{{ImgName: "pc.img"}}
+		imageDefinitionPath, err := writeImageDefinition(&ImageDefinition{
+			ImageName:    "pc",
+			Architecture: Architectures{"amd64"},
+			Series:       "jammy",
+			Gadget:       &Gadget{GadgetType: "git", GadgetURL: "https://github.com/snapcore/pc-gadget.git"},
+			Rootfs:       &Rootfs{Seed: &Seed{SeedURLs: []string{"git://git.launchpad.net/ubuntu-seeds"}}},
+			Customization: &Customization{
+				ExtraPPAs:     []*PPA{{PPAName: "canonical-foundations/ubuntu-image"}},
+				ExtraPackages: []*Package{{PackageName: "hello"}},
+			},
+			Artifacts: &Artifacts{Img: &imgs},
+		}, workDir)
+		asserter.AssertErrNil(err, true)
+
+		imageDefinitionBytes, err := os.ReadFile(imageDefinitionPath)
+		asserter.AssertErrNil(err, true)
+		var imageDefinition ImageDefinition
+		err = yaml.Unmarshal(imageDefinitionBytes, &imageDefinition)
+		asserter.AssertErrNil(err, true)
+		if imageDefinition.Customization.ExtraPPAs[0].PPAName != "canonical-foundations/ubuntu-image" ||
+			(*imageDefinition.Artifacts.Img)[0].ImgName != "pc.img" {
+			t.Errorf("Unexpected image definition written:\n%s", string(imageDefinitionBytes))
+		}
+	})
+}
+
+// TestResultManifests ensures that only the manifests and file lists are returned by Manifests
+func TestResultManifests(t *testing.T) {
+	t.Run("test_result_manifests", func(t *testing.T) {
+		result := Result{Artifacts: []Artifact{
+			{Type: ArtifactImg, Path: "pc.img"},
+			{Type: ArtifactManifest, Path: "pc.manifest"},
+			{Type: ArtifactQcow2, Path: "pc.qcow2"},
+			{Type: ArtifactFilelist, Path: "pc.filelist"},
+		}}
+		manifests := result.Manifests()
+		if len(manifests) != 2 || manifests[0].Path != "pc.manifest" || manifests[1].Path != "pc.filelist" {
+			t.Errorf("Unexpected manifests %+v", manifests)
+		}
+	})
+}